@@ -0,0 +1,341 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 20:58:02
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 20:58:02
+ * @Description: 所有工具通用的异步任务接口：提交后立即返回，由任务队列执行，前端轮询状态，完成后获取结果。
+ * 参数校验和处理逻辑沿用各工具同步接口的实现，避免慢的百度接口长时间占用连接
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"src/app/model"
+	"src/app/service"
+	g "src/global"
+	"src/utils/base"
+	myFileUtil "src/utils/file"
+	"src/utils/response"
+	"src/utils/storage"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const toolJobType = "tool" // 通用工具的异步任务类型
+
+// 支持异步执行的工具
+type asyncTool struct {
+	check  func(task *model.ImgTask) string                // 校验参数，错误写入task.ErrMsg，返回执行时需要的参数
+	run    func(task *model.ImgTask, params string) string // 执行，错误写入task.ErrMsg，返回需要告诉前端的结果，比如压缩后的大小
+	output func(params string) string                      // 结果的格式由参数决定时，返回结果的格式，为空表示和输入一样。批量任务和组合任务里用
+}
+
+type toolJobPayload struct {
+	ImgPath     string `json:"img_path"` // 上传的图片在存储里的key
+	Suffix      string `json:"suffix"`
+	ReginSuffix string `json:"regin_suffix"`
+	Params      string `json:"params"`
+}
+
+var asyncTools = make(map[uint8]asyncTool)
+
+/**
+ * @description: 注册支持异步执行的工具和任务队列的处理函数，启动worker之前调用
+ * @return {*}
+ */
+func InitAsyncTools() {
+	// 证件照换底色
+	asyncTools[1] = asyncTool{
+		check: func(task *model.ImgTask) string {
+			return encodeBgColorParams(checkChangeBgColorParams(task))
+		},
+		run: func(task *model.ImgTask, params string) string {
+			color, spec := decodeBgColorParams(task, params)
+			if task.ErrMsg != "" {
+				return ""
+			}
+			service.ChangeBgColor(task, color, spec)
+			return ""
+		},
+		output: bgColorOutputSuffix,
+	}
+	// 图片有损压缩，结果是选择的压缩参数，包括压缩后的大小
+	asyncTools[2] = asyncTool{
+		check: func(task *model.ImgTask) string {
+			return encodeCompressTarget(checkLossyCompressParams(task), task.Suffix)
+		},
+		run: func(task *model.ImgTask, params string) string {
+			target, _ := decodeCompressTarget(params)
+			plan := service.LossyCompression(task, target)
+			if task.ErrMsg != "" {
+				return ""
+			}
+			planByte, _ := json.Marshal(plan)
+			return string(planByte)
+		},
+		output: func(params string) string {
+			_, suffix := decodeCompressTarget(params)
+			return suffix
+		},
+	}
+	// png无损压缩，结果是压缩后的大小
+	asyncTools[3] = asyncTool{
+		check: func(task *model.ImgTask) string {
+			return encodePngLosslessParams(checkPngLosslessCompressParams(task), task.Suffix)
+		},
+		run: func(task *model.ImgTask, params string) string {
+			level, _ := decodePngLosslessParams(params)
+			service.PngLosslessCompress(task, level)
+			return resultFileSize(task, task.ResultPath)
+		},
+		output: func(params string) string {
+			_, suffix := decodePngLosslessParams(params)
+			return suffix
+		},
+	}
+	// 图片格式转换
+	asyncTools[4] = asyncTool{
+		check: func(task *model.ImgTask) string {
+			checkSuffixParams(task)
+			return ""
+		},
+		run: func(task *model.ImgTask, params string) string {
+			service.ImgConvers(task)
+			return task.Suffix
+		},
+		output: func(params string) string {
+			return params // 批量任务和组合任务的参数是目标格式
+		},
+	}
+	// 图像特效与增强，参数是百度接口的名称和错误信息
+	effects := asyncTool{
+		check: func(task *model.ImgTask) string {
+			apiStr, errMsg := checkEEParams(task)
+			paramsByte, _ := json.Marshal([]string{apiStr, errMsg})
+			return string(paramsByte)
+		},
+		run: func(task *model.ImgTask, params string) string {
+			var apiAndErrMsg []string
+			if err := json.Unmarshal([]byte(params), &apiAndErrMsg); err != nil || len(apiAndErrMsg) != 2 {
+				task.ErrMsg = g.UnknownErrorMsg
+				return ""
+			}
+			service.Generic(task, apiAndErrMsg[0], apiAndErrMsg[1])
+			return ""
+		},
+	}
+	for toolId := uint8(21); toolId <= 26; toolId++ {
+		asyncTools[toolId] = effects
+	}
+	service.RegisterJobHandler(toolJobType, service.JobHandler{Run: runToolJob, OnFail: toolJobFail, MaxAttempts: 2})
+	service.RegisterJobHandler(batchJobType, service.JobHandler{Run: runBatchJob, OnFail: batchJobFail, MaxAttempts: 2})
+	initPipelineTools()
+}
+
+// 获取结果文件的大小
+func resultFileSize(task *model.ImgTask, filePath string) string {
+	if task.ErrMsg != "" {
+		return ""
+	}
+	fs, err := os.Stat(filePath)
+	if err != nil {
+		task.Log.Error("获取文件信息出错：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+		return ""
+	}
+	return strconv.FormatInt(fs.Size(), 10)
+}
+
+// 任务对应的任务类型，27号工具、批量任务和组合任务是单独的任务类型
+func taskJobType(task *model.ImgTask) string {
+	if task.ToolId == 27 {
+		return service.DocConvertJobType
+	}
+	if task.BatchCount > 0 {
+		return batchJobType
+	}
+	if task.Pipeline != "" {
+		return pipelineJobType
+	}
+	return toolJobType
+}
+
+/**
+ * @description: 提交异步任务，参数和各工具的同步接口一样，返回任务id后前端轮询TaskStatus
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func SubmitTask(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	tool, ok := asyncTools[task.ToolId]
+	if !ok {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "该工具不支持异步提交")
+		return
+	}
+	params := tool.check(task)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	// 上传的图片保存到存储，job表里只保存路径
+	imgPath := myFileUtil.StoreImg(task, task.ImgByte, "origin_")
+	task.ImgByte = nil
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Status = model.JobQueued
+	if task.Add(); task.ErrMsg != "" {
+		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
+		return
+	}
+	payload, _ := json.Marshal(toolJobPayload{ImgPath: imgPath, Suffix: task.Suffix, ReginSuffix: task.ReginSuffix, Params: params})
+	if _, err := service.SubmitJob(toolJobType, task, string(payload)); err != nil {
+		task.Log.Error("提交异步任务失败", err)
+		storage.Default().Delete(task.Ctx, imgPath)
+		task.Status, task.Result = model.JobFailed, "提交任务失败"
+		task.UpdateStatus()
+		response.Fail(c, g.ExecuteErrorCode, "提交任务失败，请稍后再试")
+		return
+	}
+	response.Success(c, gin.H{"task_id": task.Id, "status": task.Status})
+}
+
+/**
+ * @description: 查询异步任务的状态和进度，完成后返回结果信息，失败时返回失败原因
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func TaskStatus(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	task.FindWithCreateTime(86400) // 只允许查找一天内的数据
+	if task.ErrMsg != "" {
+		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
+		return
+	}
+	response.Success(c, taskStatusData(task))
+}
+
+// 任务的状态、进度，以及完成后的结果或失败原因
+func taskStatusData(task *model.ImgTask) gin.H {
+	progress := task.Progress
+	if task.Status == model.JobQueued || task.Status == model.JobRunning {
+		// 执行中的进度只更新在job表里
+		if job := model.FindJob(taskJobType(task), task.ToolId, task.Id); job != nil {
+			progress = max(progress, job.Progress)
+		}
+	}
+	status := gin.H{"status": task.Status, "progress": progress}
+	switch task.Status {
+	case model.JobSucceeded:
+		if _, ok := asyncTools[task.ToolId]; ok { // 27号工具的结果是下载地址，需要扣减下载次数才能获取
+			status["result"] = task.Result
+		}
+		if task.BatchCount > 0 { // 批量任务按处理成功的数量计费
+			status["count"], status["amount"] = task.ChargeCount(), task.Amount()
+		}
+	case model.JobFailed:
+		status["message"] = task.Result
+	}
+	return status
+}
+
+/**
+ * @description: 获取异步任务的结果预览图，即带水印的结果图，原图仍然通过下载接口获取
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func TaskResult(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	if _, ok := asyncTools[task.ToolId]; !ok {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "该类型的资源请到对应页面中查看")
+		return
+	}
+	task.FindWithCreateTime(86400)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
+		return
+	}
+	if task.Status != model.JobSucceeded {
+		response.Fail(c, g.ExecuteErrorCode, "任务还未完成")
+		return
+	}
+	task.ResultPath = myFileUtil.GetImgSaveFullPath(task, "water_")
+	if _, err := storage.Default().Stat(task.Ctx, task.ResultPath); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "该工具没有预览图")
+		return
+	}
+	ImgResponse(task)
+}
+
+// 执行通用工具的异步任务
+func runToolJob(ctx context.Context, job *model.Job) error {
+	var payload toolJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return service.NoRetry(err)
+	}
+	tool, ok := asyncTools[job.ToolId]
+	if !ok {
+		return service.NoRetry(errors.New("该工具不支持异步执行"))
+	}
+	task := service.NewJobImgTask(ctx, job, "runToolJob")
+	if task.Find(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	imgByte, err := storage.ReadAll(ctx, payload.ImgPath)
+	if err != nil {
+		task.Log.Error("读取上传的图片失败", err)
+		return service.NoRetry(errors.New("读取上传的图片失败"))
+	}
+	task.Status, task.Progress = model.JobRunning, 10
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	task.ImgByte, task.Suffix, task.ReginSuffix = imgByte, payload.Suffix, payload.ReginSuffix
+	result := tool.run(task, payload.Params)
+	task.ImgByte = nil
+	if task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	task.Status, task.Progress, task.Result = model.JobSucceeded, 100, result
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	go base.ToolCallSuccess(task.ToolId) // 记录访问次数
+	storage.Default().Delete(ctx, payload.ImgPath)
+	return nil
+}
+
+// 通用工具的异步任务彻底失败后，记录失败原因，这类工具是先使用后付款，不需要退款
+func toolJobFail(job *model.Job, errMsg string) {
+	var payload toolJobPayload
+	if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.ImgPath != "" {
+		storage.Default().Delete(context.Background(), payload.ImgPath)
+	}
+	task := service.NewJobImgTask(context.Background(), job, "toolJobFail")
+	if task.Find(); task.ErrMsg != "" {
+		return
+	}
+	task.Status, task.Result = model.JobFailed, errMsg
+	task.UpdateStatus()
+}
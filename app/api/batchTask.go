@@ -0,0 +1,233 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 22:58:20
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 22:58:20
+ * @Description: 批量任务：一次上传多张图片或者zip压缩包，按同一个工具的参数逐张处理，结果打包成一个zip，按图片数量一起付款、一次下载
+ * 提交后和异步任务一样，通过TaskStatus或者推送接口查看进度
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"src/app/model"
+	"src/app/service"
+	g "src/global"
+	"src/utils/base"
+	myFileUtil "src/utils/file"
+	"src/utils/response"
+	"src/utils/storage"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const batchJobType = "batch" // 批量任务的任务类型
+
+// 支持批量处理的工具，逐张处理时复用asyncTools里的实现
+type batchTool struct {
+	suffix  []string                         // 支持的图片格式
+	params  func(task *model.ImgTask) string // 读取参数，错误写入task.ErrMsg
+	convert bool                             // 格式转换，和目标格式相同的图片不需要处理
+}
+
+var batchTools = map[uint8]batchTool{
+	2: {suffix: lossyCompressSuffix, params: func(task *model.ImgTask) string {
+		target := lossyCompressTarget(task, task.C.PostForm("needSize"), task.C.PostForm("minSsim"), task.C.PostForm("minPsnr")) // 每张图片的目标大小和画质下限
+		return encodeCompressTarget(target, compressOutputSuffix(task, task.C.PostForm("suffix"), lossyOutputSuffix))
+	}},
+	3: {suffix: []string{"png"}, params: func(task *model.ImgTask) string {
+		level := pngCompressLevel(task, task.C.PostForm("level"))
+		return encodePngLosslessParams(level, compressOutputSuffix(task, task.C.PostForm("suffix"), pngLosslessOutputSuffix))
+	}},
+	4: {suffix: conversSuffix, convert: true, params: func(task *model.ImgTask) string {
+		suffix := task.C.PostForm("suffix")
+		if !CheckSuffix(suffix, conversSuffix) {
+			task.ErrMsg = "所需的转换格式不支持!"
+		}
+		return suffix
+	}},
+}
+
+type batchJobPayload struct {
+	Files  []service.BatchFile `json:"files"`
+	Params string              `json:"params"`
+}
+
+// 批量任务的结果
+type batchResult struct {
+	Count  int      `json:"count"`  // 处理成功的图片数量
+	Failed []string `json:"failed"` // 处理失败的文件名
+}
+
+/**
+ * @description: 提交批量任务，file字段可以传多张图片或者zip压缩包，其他参数和单张处理的接口一样
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func SubmitBatch(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	tool, ok := batchTools[task.ToolId]
+	if !ok {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "该工具不支持批量处理")
+		return
+	}
+	go base.ToolCall(task.ToolId) // 记录访问次数
+	maxFiles, maxSizeMB := 30, 100
+	if g.VP.GetInt("Batch.MaxFiles") > 0 {
+		maxFiles = g.VP.GetInt("Batch.MaxFiles")
+	}
+	if g.VP.GetInt("Batch.MaxSizeMB") > 0 {
+		maxSizeMB = g.VP.GetInt("Batch.MaxSizeMB")
+	}
+	files := service.CheckBatchImages(task, int64(maxSizeMB)<<20, 10485760, maxFiles) // 单张图片和单张处理一样限10M
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	for _, file := range files {
+		if !CheckSuffix(file.Suffix, tool.suffix) {
+			response.Fail(c, g.ValidatorParamsCheckFailCode, fmt.Sprintf("%s 不是支持的格式!", file.Name))
+			return
+		}
+	}
+	params := tool.params(task)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	if service.SaveBatchFiles(task, files); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Suffix, task.BatchCount, task.Status = "zip", len(files), model.JobQueued
+	if task.Add(); task.ErrMsg != "" {
+		service.RemoveBatchFiles(files)
+		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
+		return
+	}
+	payload, _ := json.Marshal(batchJobPayload{Files: files, Params: params})
+	if _, err := service.SubmitJob(batchJobType, task, string(payload)); err != nil {
+		task.Log.Error("提交批量任务失败", err)
+		service.RemoveBatchFiles(files)
+		task.Status, task.Result = model.JobFailed, "提交任务失败"
+		task.UpdateStatus()
+		response.Fail(c, g.ExecuteErrorCode, "提交任务失败，请稍后再试")
+		return
+	}
+	// 这里的价格是按上传数量的预估，完成后按处理成功的数量计费
+	response.Success(c, gin.H{"task_id": task.Id, "status": task.Status, "count": task.BatchCount, "amount": task.Amount()})
+}
+
+// 执行批量任务，单张图片处理失败不影响其他图片，全部失败才算任务失败
+func runBatchJob(ctx context.Context, job *model.Job) error {
+	var payload batchJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return service.NoRetry(err)
+	}
+	tool, ok := batchTools[job.ToolId]
+	if !ok {
+		return service.NoRetry(errors.New("该工具不支持批量处理"))
+	}
+	task := service.NewJobImgTask(ctx, job, "runBatchJob")
+	if task.Find(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	task.Status, task.Progress = model.JobRunning, 0
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+
+	names, resultPaths := make([]string, 0, len(payload.Files)), make([]string, 0, len(payload.Files))
+	result := batchResult{Failed: make([]string, 0)}
+	for i, file := range payload.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, resultPath := runBatchFile(task, tool, i, file, payload.Params)
+		if resultPath == "" {
+			result.Failed = append(result.Failed, file.Name)
+		} else {
+			names, resultPaths = append(names, name), append(resultPaths, resultPath)
+		}
+		if err := job.SetProgress(90 * (i + 1) / len(payload.Files)); err != nil {
+			return err
+		}
+	}
+	if len(resultPaths) == 0 {
+		return service.NoRetry(errors.New("所有图片都处理失败了"))
+	}
+
+	task.Suffix = "zip"
+	service.ZipBatchResult(task, names, resultPaths)
+	for _, resultPath := range resultPaths {
+		os.Remove(resultPath)
+	}
+	if task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	result.Count = len(resultPaths)
+	resultByte, _ := json.Marshal(result)
+	task.Status, task.Progress, task.Result, task.SuccessCount = model.JobSucceeded, 100, string(resultByte), result.Count
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	go base.ToolCallSuccess(task.ToolId) // 记录访问次数
+	service.RemoveBatchFiles(payload.Files)
+	return nil
+}
+
+// 处理批量任务里的一张图片，返回在压缩包里的文件名和结果文件，处理失败时结果文件为空
+func runBatchFile(task *model.ImgTask, tool batchTool, index int, file service.BatchFile, params string) (string, string) {
+	subTask := service.BatchSubTask(task, index)
+	subTask.Suffix = file.Suffix
+	name := file.Name
+	imgByte, err := storage.ReadAll(task.Ctx, file.Path)
+	if err != nil {
+		task.Log.Error("读取批量任务的图片失败", err)
+		return name, ""
+	}
+	if output := asyncTools[task.ToolId].output; output != nil && output(params) != "" { // 结果的格式由参数指定，压缩包里的文件名也要改
+		subTask.ReginSuffix, subTask.Suffix = file.Suffix, output(params)
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + subTask.Suffix
+		if tool.convert && subTask.ReginSuffix == subTask.Suffix { // 格式相同不需要转换，原图直接放进压缩包
+			return name, myFileUtil.SaveImg(subTask, imgByte, "result_")
+		}
+	}
+	subTask.ImgByte = imgByte
+	asyncTools[task.ToolId].run(subTask, params)
+	subTask.ImgByte = nil
+	os.Remove(myFileUtil.GetImgSaveFullPath(subTask, "water_")) // 批量任务没有预览图
+	if subTask.ErrMsg != "" {
+		task.Log.Warn("批量任务的图片处理失败："+file.Name, subTask.ErrMsg)
+		return name, ""
+	}
+	return name, myFileUtil.GetImgSaveFullPath(subTask, "result_")
+}
+
+// 批量任务彻底失败后，删除上传的图片，记录失败原因
+func batchJobFail(job *model.Job, errMsg string) {
+	var payload batchJobPayload
+	if json.Unmarshal([]byte(job.Payload), &payload) == nil {
+		service.RemoveBatchFiles(payload.Files)
+	}
+	task := service.NewJobImgTask(context.Background(), job, "batchJobFail")
+	if task.Find(); task.ErrMsg != "" {
+		return
+	}
+	task.Status, task.Result = model.JobFailed, errMsg
+	task.UpdateStatus()
+}
@@ -0,0 +1,88 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 17:48:13
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 17:48:13
+ * @Description: 验证码接口，用于访问过于频繁或境外ip的人机验证，验证通过后签发短时有效的通过凭证
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"bytes"
+	g "src/global"
+	"src/utils/response"
+
+	"github.com/dchest/captcha"
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * @description: 生成一个验证码，返回验证码id，图片和语音通过id获取
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func NewCaptcha(c *gin.Context) {
+	length := g.VP.GetInt("Captcha.Length")
+	if length <= 0 {
+		length = captcha.DefaultLen
+	}
+	response.Success(c, gin.H{"captcha_id": captcha.NewLen(length)})
+}
+
+/**
+ * @description: 获取验证码图片，带上reload参数时重新生成数字
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func CaptchaImage(c *gin.Context) {
+	captchaId := c.Param("captchaId")
+	if c.Query("reload") != "" {
+		captcha.Reload(captchaId)
+	}
+	width, height := g.VP.GetInt("Captcha.Width"), g.VP.GetInt("Captcha.Height")
+	if width <= 0 || height <= 0 {
+		width, height = captcha.StdWidth, captcha.StdHeight
+	}
+	var buf bytes.Buffer
+	if err := captcha.WriteImage(&buf, captchaId, width, height); err != nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "验证码不存在或已过期")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(200, "image/png", buf.Bytes())
+}
+
+/**
+ * @description: 获取验证码语音，给看不清图片的用户使用
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func CaptchaAudio(c *gin.Context) {
+	var buf bytes.Buffer
+	if err := captcha.WriteAudio(&buf, c.Param("captchaId"), "zh"); err != nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "验证码不存在或已过期")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(200, "audio/wav", buf.Bytes())
+}
+
+/**
+ * @description: 校验验证码，正确则签发通过凭证，之后的请求把凭证放在请求头captcha-token中。验证码无论对错都只能校验一次
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func VerifyCaptcha(c *gin.Context) {
+	captchaId, value := c.PostForm("captcha_id"), c.PostForm("captcha_value")
+	if captchaId == "" || value == "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "请输入验证码")
+		return
+	}
+	if !captcha.VerifyString(captchaId, value) {
+		response.Fail(c, g.ExecuteErrorCode, "验证码错误，请重新获取")
+		return
+	}
+	token, expireAt := g.IssueCaptchaPass(c.ClientIP())
+	response.Success(c, gin.H{"token": token, "expire_at": expireAt})
+}
@@ -14,7 +14,6 @@ import (
 	"net/http"
 	"src/app/model"
 	"src/app/service"
-	"src/app/service/payService"
 	g "src/global"
 	"src/utils/base"
 	"src/utils/response"
@@ -26,11 +25,6 @@ import (
 	"gocv.io/x/gocv"
 )
 
-var (
-	taskChannel = make(chan uint8, 1)   // 防止并发的通道
-	taskListMap = make(map[string]bool) // 记录任务是否在进行中
-)
-
 /**
  * @description: 文档转换
  * @param {*gin.Context} c
@@ -42,32 +36,27 @@ func DocImgConvert(c *gin.Context) {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	if err := queryTaskStatus(task); err != nil { // 这里面有调用taskChannel
+	if err := queryTaskStatus(task); err != nil {
 		response.Fail(c, g.ExecuteErrorCode, err)
 		return
 	}
 
 	order, err := model.GetOrderByTaskId(task)
 	if err != nil {
-		delete(taskListMap, task.Id) // 删除任务
 		response.Fail(c, g.CurdSelectFailCode, err)
 		return
 	}
 	if order.ResultType != 0 {
-		delete(taskListMap, task.Id) // 删除任务
 		response.Fail(c, g.ExecuteErrorCode, "该工具需要先付款再使用")
 		return
 	}
-	task.UpdatedAt = time.Now().UnixMilli() // 这里相当于记录任务开始的时间
 	checkDCImgParams(task)
 	if task.ErrMsg != "" {
-		delete(taskListMap, task.Id) // 删除任务
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	service.DocImgConvertRequest(task, taskListMap)
+	service.DocImgConvertRequest(task) // 同一个任务重复提交时会返回错误
 	if task.ErrMsg != "" {
-		delete(taskListMap, task.Id) // 删除任务
 		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
@@ -191,25 +180,18 @@ func checkDCImgParams(task *model.ImgTask) {
 
 }
 
-// 查询task
+// 查询task，已经提交过或者已经有结果的任务不能再执行
 func queryTaskStatus(task *model.ImgTask) error {
-	taskChannel <- 1 // 阻塞，防止并发
-	_, ok := taskListMap[task.Id]
-	if ok {
-		<-taskChannel // 释放
+	if model.FindJob(service.DocConvertJobType, task.ToolId, task.Id) != nil {
 		return errors.New("该任务正在执行中，请勿重复执行")
 	}
 	// 查找数据库记录，确认该任务是否已经执行完成
 	if task.Find(); task.ErrMsg != "" {
-		<-taskChannel // 释放
 		return errors.New(task.ErrMsg)
 	}
 	if task.Result != "" {
-		<-taskChannel // 释放
 		return errors.New("该任务已经执行完成，请勿重复执行")
 	}
-	taskListMap[task.Id] = true // 标记任务正在执行
-	<-taskChannel               // 释放
 	return nil
 }
 
@@ -232,36 +214,24 @@ func QueryOrderAutoRefund27() {
 		task.DB = g.Mysql
 		task.Log = &thisLog
 
-		// 查询任务状态是否满足退款要求
-		taskChannel <- 1 // 阻塞，防止并发
-		_, ok := taskListMap[task.Id]
-		if ok {
-			<-taskChannel // 释放
+		// 查询任务状态是否满足退款要求，已经提交的任务由任务队列负责退款
+		if model.FindJob(service.DocConvertJobType, task.ToolId, task.Id) != nil {
 			continue
 		}
 		// 查找数据库记录，确认该任务是否已经执行完成
 		if task.Find(); task.ErrMsg != "" {
-			<-taskChannel // 释放
 			thisLog.Error("在自动退单任务中查询任务失败:"+task.Id, errors.New(task.ErrMsg))
 			continue
 		}
 		if task.Result != "" {
-			<-taskChannel // 释放
 			continue
 		}
-		<-taskChannel // 释放
 		// 订单也需要初始化
 		order.DB = g.Mysql
 		order.Log = &thisLog
 		order.Ctx = ctx
-		if order.Platform == 1 {
-			if err := payService.WechatRefund(&order, "超时未使用自动退款"); err != nil {
-				thisLog.Error("自动退款失败:"+order.Id, err)
-			}
-		} else {
-			if err := payService.AliRefund(&order, "超时未使用自动退款"); err != nil {
-				thisLog.Error("自动退款失败:"+order.Id, err)
-			}
+		if err := service.RefundOrder(&order, "超时未使用自动退款"); err != nil {
+			thisLog.Error("自动退款失败:"+order.Id, err)
 		}
 	}
 }
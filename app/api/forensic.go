@@ -0,0 +1,122 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 03:52:06
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 03:52:06
+ * @Description: 取证水印：下载时写入订单号和任务id，本地接口从可疑的图片中读取出来
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"src/app/model"
+	"src/app/service"
+	g "src/global"
+	"src/utils/response"
+	"src/utils/storage"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var forensicSuffix = []string{"jpg", "jpeg", "png", "bmp", "webp"} // 可以写入取证水印的结果格式，avif不能解码，不写入
+
+// 不写入取证水印的工具：压缩工具的结果大小和编码方式就是用户要的东西，写入后要重新编码，会破坏目标大小和无损压缩的结果
+var forensicSkipTools = []uint8{2, 3}
+
+/**
+ * @description: 结果是否需要写入取证水印。批量任务的zip、证件照排版的pdf、avif格式和压缩工具的结果都不写入
+ * @param {*model.ImgTask} task
+ * @return {bool}
+ */
+func needForensic(task *model.ImgTask) bool {
+	return service.ForensicEnabled() && CheckSuffix(task.Suffix, forensicSuffix) && !slices.Contains(forensicSkipTools, task.ToolId)
+}
+
+/**
+ * @description: 写入取证水印，写入失败时返回原图，不影响用户下载
+ * @param {*model.ImgTask} task 已经扣减过下载次数
+ * @param {[]byte} fileByte 不带水印的图片
+ * @param {string} suffix 图片的格式
+ * @return {[]byte}
+ */
+func embedForensic(task *model.ImgTask, fileByte []byte, suffix string) []byte {
+	orderId, err := model.GetPaidOrderId(task)
+	if err != nil {
+		orderId = 0 // 查不到订单也写入任务id
+	}
+	marked, err := service.EmbedForensic(fileByte, suffix, orderId, task.Id)
+	if err != nil {
+		task.Log.Error("写入取证水印失败：", err)
+		return fileByte
+	}
+	return marked
+}
+
+/**
+ * @description: 读取结果图，写入取证水印后返回。写入失败时返回原图，不影响用户下载
+ * @param {*model.ImgTask} task 已经扣减过下载次数
+ * @param {string} key 结果图在存储里的key
+ * @return {*}
+ */
+func forensicFileResponse(task *model.ImgTask, key string) {
+	fileByte, err := storage.ReadAll(task.C, key)
+	if err != nil {
+		task.Log.Error("读取存储的文件失败：", err)
+		response.Fail(task.C, g.ExecuteErrorCode, "文件不存在或已过期")
+		return
+	}
+	fileByte = embedForensic(task, fileByte, task.Suffix)
+	contentType := mime.TypeByExtension("." + task.Suffix)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	task.C.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, task.Id, task.Suffix))
+	task.C.Data(http.StatusOK, contentType, fileByte)
+}
+
+/**
+ * @description: 本地接口，从上传的可疑图片中读取取证水印，返回订单号和对应的任务
+ * @param {*gin.Context} c 图片放在表单的file字段
+ * @return {*}
+ */
+func ForensicExtract(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "请上传图片")
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "读取图片失败")
+		return
+	}
+	defer file.Close()
+	fileByte, err := io.ReadAll(file)
+	if err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "读取图片失败")
+		return
+	}
+	payload, err := service.ExtractForensic(fileByte)
+	if err != nil {
+		response.Fail(c, g.ExecuteErrorCode, err.Error())
+		return
+	}
+	result := gin.H{"payload": payload}
+	base := model.InitBaseModel(c).GetCtx(c, c).GetLog(c).GetDB(c, c)
+	if payload.OrderId > 0 {
+		order := &model.Order{Id: strconv.FormatUint(payload.OrderId, 10), BaseModel: *base}
+		if order.Get() == nil {
+			result["order"] = order
+		}
+	}
+	if taskIds, err := model.FindTaskIdsByPrefix(base, payload.TaskIdPrefix); err == nil {
+		result["task_ids"] = taskIds
+	}
+	response.Success(c, result)
+}
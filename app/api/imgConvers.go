@@ -13,10 +13,10 @@ import (
 	"src/app/service"
 	g "src/global"
 	"src/utils/base"
+	myFileUtil "src/utils/file"
 	"src/utils/response"
 
 	"github.com/gin-gonic/gin"
-	"gocv.io/x/gocv"
 )
 
 // 基于 gocv 实现图片格式转换
@@ -31,25 +31,16 @@ func ImgConvers(c *gin.Context) {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	var err error
-	task.Mat, err = gocv.IMDecode(task.ImgByte, gocv.IMReadUnchanged)
-	if err != nil {
-		task.Log.Error("解析图片失败：", err)
-		response.Fail(c, g.ValidatorParamsCheckFailCode, "解析图片失败")
-		return
-	}
-	defer task.Mat.Close()
-	service.GocvSaveImg(task, "result_", -1)
+	service.ImgConvers(task)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	service.ImgWatermark(task.Mat)
-	task.ResultPath = service.GocvSaveImg(task, "water_", -1)
-	if task.ErrMsg != "" {
-		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
+	task.Status, task.Progress = model.JobSucceeded, 100 // 同步执行的工具，入库时已经完成
 	task.Add()
 	if task.ErrMsg != "" {
 		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
@@ -75,16 +66,16 @@ func checkSuffixParams(task *model.ImgTask) {
 		task.ErrMsg = "上传的文件和转换格式相同,无需转换"
 		return
 	}
-	// 支持的格式jpg jp2 png tif bmp dwg
-	suffixAccept := []string{"jpg", "jpeg", "jp2", "png", "tiff", "bmp", "webp"}
-
-	// 检查 传入的文件类型和需要的文件类型是否满足suffixAccept的要求
-	if !CheckSuffix(task.ReginSuffix, suffixAccept) {
+	// 检查 传入的文件类型和需要的文件类型是否满足conversSuffix的要求
+	if !CheckSuffix(task.ReginSuffix, conversSuffix) {
 		task.ErrMsg = "上传的文件不是支持的格式!"
 		return
 	}
-	if !CheckSuffix(task.Suffix, suffixAccept) {
+	if !CheckSuffix(task.Suffix, conversSuffix) {
 		task.ErrMsg = "所需的转换格式不支持!"
 		return
 	}
 }
+
+// 格式转换支持的格式jpg jp2 png tif bmp webp
+var conversSuffix = []string{"jpg", "jpeg", "jp2", "png", "tiff", "bmp", "webp"}
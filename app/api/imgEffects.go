@@ -13,6 +13,7 @@ import (
 	"src/app/service"
 	g "src/global"
 	"src/utils/base"
+	myFileUtil "src/utils/file"
 	"src/utils/response"
 
 	"github.com/gin-gonic/gin"
@@ -42,6 +43,11 @@ func EffectsEnhancement(c *gin.Context) {
 		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Status, task.Progress = model.JobSucceeded, 100 // 同步执行的工具，入库时已经完成
 	if task.Add(); task.ErrMsg != "" {
 		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
 		return
@@ -52,32 +58,9 @@ func EffectsEnhancement(c *gin.Context) {
 
 func checkEEParams(task *model.ImgTask) (string, string) {
 
-	var apiStr, errMsg string
-
 	maxSize := 3143680 // 限制上传大小，因为要考虑转换为base64后增大，百度接口限制4M，所以二进制数据应<4M*0.75-24
-	// 从21开始，为了保留拓展性，不再延续之前的toolId，以后还有直接添加即可
-	switch task.ToolId {
-	case 21:
-		apiStr = "image_definition_enhance"
-		errMsg = "图像清晰度增强失败："
-	case 22:
-		apiStr = "colourize"
-		errMsg = "黑白图像上色失败："
-	case 23:
-		apiStr = "image_quality_enhance"
-		errMsg = "图像无损放大两倍失败："
-	case 24:
-		apiStr = "doc_repair"
-		errMsg = "文档图片去底纹失败："
-	case 25:
-		apiStr = "remove_moire"
-		errMsg = "图片去摩尔纹失败："
-	case 26:
-		apiStr = "remove_handwriting"
-		errMsg = "图片去手写体失败："
-	default:
-		task.ErrMsg = "不支持的工具id"
-		task.Log.Error("不支持的工具id:" + string(task.ToolId))
+	apiStr, errMsg := effectsApi(task)
+	if task.ErrMsg != "" {
 		return "", ""
 	}
 	go base.ToolCall(task.ToolId) // 记录访问工具次数
@@ -110,3 +93,32 @@ func checkEEParams(task *model.ImgTask) (string, string) {
 	}
 	return apiStr, errMsg
 }
+
+// 特效与增强工具对应的百度接口名称和失败时的提示
+func effectsApi(task *model.ImgTask) (apiStr string, errMsg string) {
+	// 从21开始，为了保留拓展性，不再延续之前的toolId，以后还有直接添加即可
+	switch task.ToolId {
+	case 21:
+		apiStr = "image_definition_enhance"
+		errMsg = "图像清晰度增强失败："
+	case 22:
+		apiStr = "colourize"
+		errMsg = "黑白图像上色失败："
+	case 23:
+		apiStr = "image_quality_enhance"
+		errMsg = "图像无损放大两倍失败："
+	case 24:
+		apiStr = "doc_repair"
+		errMsg = "文档图片去底纹失败："
+	case 25:
+		apiStr = "remove_moire"
+		errMsg = "图片去摩尔纹失败："
+	case 26:
+		apiStr = "remove_handwriting"
+		errMsg = "图片去手写体失败："
+	default:
+		task.ErrMsg = "不支持的工具id"
+		task.Log.Error("不支持的工具id:" + string(task.ToolId))
+	}
+	return
+}
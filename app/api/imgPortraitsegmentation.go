@@ -10,12 +10,16 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"src/app/dto"
 	"src/app/model"
 	"src/app/service"
 	g "src/global"
 	"src/utils/base"
+	myFileUtil "src/utils/file"
 	"src/utils/response"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gocv.io/x/gocv"
@@ -32,17 +36,22 @@ func CardChangeBGColor(c *gin.Context) {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	color := checkChangeBgColorParams(task)
+	color, spec := checkChangeBgColorParams(task)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	service.ChangeBgColor(task, color)
+	service.ChangeBgColor(task, color, spec)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
 
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Status, task.Progress = model.JobSucceeded, 100 // 同步执行的工具，入库时已经完成
 	if task.Add(); task.ErrMsg != "" {
 		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
 		return
@@ -51,37 +60,45 @@ func CardChangeBGColor(c *gin.Context) {
 	ImgResponse(task)
 }
 
-func checkChangeBgColorParams(task *model.ImgTask) *dto.BRGA {
+func checkChangeBgColorParams(task *model.ImgTask) (*dto.BRGA, *service.IdPhotoSpec) {
 	if task.ToolId != 1 {
 		task.ErrMsg = "接口id与路径不匹配！"
-		return nil
+		return nil, nil
 	}
 	go base.ToolCall(task.ToolId)                                 // 记录访问次数
 	task.ImgByte, task.Suffix = service.CheckImage(task, 3143680) // 检查上传的图像的情况，限3070KB
 	if task.ErrMsg != "" {
-		return nil
+		return nil, nil
 	}
 
 	if task.Suffix != "jpg" && task.Suffix != "png" && task.Suffix != "bmp" {
 		task.ErrMsg = "不支持的文件格式！"
-		return nil
+		return nil, nil
 	}
 	var err error
 	// 检查图片给尺寸
 	task.Mat, err = gocv.IMDecode(task.ImgByte, gocv.IMReadUnchanged)
 	if err != nil {
 		task.ErrMsg = "图像解码失败"
-		return nil
+		return nil, nil
 	}
 	defer task.Mat.Close()
 	size := task.Mat.Size()
 	if size[0] < 15 || size[1] < 15 || size[0] > 4096 || size[1] > 4096 {
 		task.ErrMsg = "上传的图片尺寸不符合要求！"
-		return nil
+		return nil, nil
 	}
 
+	color := parseBgColor(task, task.C.PostForm("color"))
+	if task.ErrMsg != "" {
+		return nil, nil
+	}
+	return color, parseIdPhotoSpec(task, task.C.PostForm("spec"))
+}
+
+// 解析背景色参数，为空时返回nil，表示只抠图不换底色
+func parseBgColor(task *model.ImgTask, colorStr string) *dto.BRGA {
 	var color dto.BRGA
-	colorStr := task.C.PostForm("color")
 	if colorStr != "" {
 		if err := json.Unmarshal([]byte(colorStr), &color); err != nil {
 			task.Log.Error("证件照换底色的RGB json解析失败：", err)
@@ -94,3 +111,150 @@ func checkChangeBgColorParams(task *model.ImgTask) *dto.BRGA {
 
 	return &color
 }
+
+// 解析证件照规格参数，为空时返回nil，表示不裁剪，保持原图的尺寸
+func parseIdPhotoSpec(task *model.ImgTask, name string) *service.IdPhotoSpec {
+	if name == "" {
+		return nil
+	}
+	spec := service.GetIdPhotoSpec(name)
+	if spec == nil {
+		task.ErrMsg = "不支持的证件照规格！"
+	}
+	return spec
+}
+
+// 证件照换底色的参数，异步任务和组合任务保存为json
+type bgColorParams struct {
+	Color *dto.BRGA `json:"color"`
+	Spec  string    `json:"spec"`
+}
+
+// 两个参数都为空时返回空字符串
+func encodeBgColorParams(color *dto.BRGA, spec *service.IdPhotoSpec) string {
+	if color == nil && spec == nil {
+		return ""
+	}
+	params := bgColorParams{Color: color}
+	if spec != nil {
+		params.Spec = spec.Name
+	}
+	paramsByte, _ := json.Marshal(params)
+	return string(paramsByte)
+}
+
+// 解析encodeBgColorParams的结果，兼容以前只保存了背景色的参数
+func decodeBgColorParams(task *model.ImgTask, paramsStr string) (*dto.BRGA, *service.IdPhotoSpec) {
+	if paramsStr == "" {
+		return nil, nil
+	}
+	var params bgColorParams
+	if err := json.Unmarshal([]byte(paramsStr), &params); err != nil {
+		task.ErrMsg = "传入的颜色不正确！"
+		return nil, nil
+	}
+	if params.Color == nil && params.Spec == "" {
+		return parseBgColor(task, paramsStr), nil
+	}
+	return params.Color, parseIdPhotoSpec(task, params.Spec)
+}
+
+// 换底色结果的格式，和ChangeBgColor一致：按规格裁剪的是jpg，不换底色的是png保持透明，其他和输入一样，返回空字符串
+func bgColorOutputSuffix(paramsStr string) string {
+	if paramsStr == "" {
+		return "png"
+	}
+	var params bgColorParams
+	if err := json.Unmarshal([]byte(paramsStr), &params); err != nil {
+		return ""
+	}
+	if params.Spec != "" {
+		return "jpg"
+	}
+	return "" // 只换底色，或者以前只保存了背景色的参数
+}
+
+/**
+ * @description: 查询支持的证件照规格，前端展示供用户选择，换底色时通过spec参数传入规格的name
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func IdPhotoSpecs(c *gin.Context) {
+	response.Success(c, service.IdPhotoSpecs)
+}
+
+/**
+ * @description: 查询冲印排版支持的相纸
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func IdPhotoLayoutPapers(c *gin.Context) {
+	response.Success(c, service.LayoutPapers)
+}
+
+/**
+ * @description: 下载证件照的冲印排版，下载链接上带layout（相纸）、items（规格和数量的json数组）、format（jpg或pdf，默认jpg）
+ * @param {*model.ImgTask} task 已经校验过下载签名
+ * @param {string} layout 相纸
+ * @param {bool} isReduceDownTimes 是否扣减下载次数
+ * @return {*}
+ */
+func idPhotoLayoutDown(task *model.ImgTask, layout string, isReduceDownTimes bool) {
+	c := task.C
+	if task.ToolId != 1 {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "只有证件照支持冲印排版")
+		return
+	}
+	paper := service.GetLayoutPaper(layout)
+	if paper == nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "不支持的相纸")
+		return
+	}
+	format := c.DefaultQuery("format", "jpg")
+	if format != "jpg" && format != "pdf" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "不支持的文件格式！")
+		return
+	}
+	var items []service.LayoutItem
+	if err := json.Unmarshal([]byte(c.Query("items")), &items); err != nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "排版的规格不正确")
+		return
+	}
+	if errMsg := service.CheckLayoutItems(items); errMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, errMsg)
+		return
+	}
+	// 先生成排版，生成失败不扣减下载次数
+	if task.FindWithCreateTime(86400); task.ErrMsg != "" {
+		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
+		return
+	}
+	if task.BatchCount > 0 || task.Pipeline != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "批量和组合任务不支持冲印排版")
+		return
+	}
+	if task.DownloadTimes <= 0 {
+		response.Fail(c, g.ExecuteErrorCode, "下载次数已用完")
+		return
+	}
+	fileByte := service.IdPhotoLayout(task, paper, items, format)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	if service.DownImg(task, isReduceDownTimes); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	go base.ToolDownload(task.ToolId)
+	contentType := "image/jpeg"
+	if format == "pdf" {
+		contentType = "application/pdf" // pdf不写入取证水印
+	} else if service.ForensicEnabled() {
+		fileByte = embedForensic(task, fileByte, "jpg") // 写在整张相纸上，剪下单张照片后读不出来
+	}
+	c.Writer.Header().Add("Access-Control-Expose-Headers", "Content-Disposition,down-times") // 暴露该请求头给前端
+	c.Header("down-times", strconv.Itoa(task.DownloadTimes))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s.%s"`, task.Id, paper.Name, format))
+	c.Data(http.StatusOK, contentType, fileByte)
+}
@@ -9,13 +9,14 @@
 package api
 
 import (
-	"fmt"
-	"os"
+	"encoding/json"
 	"src/app/model"
 	"src/app/service"
 	g "src/global"
 	"src/utils/base"
+	myFileUtil "src/utils/file"
 	"src/utils/response"
+	"src/utils/storage"
 	"strconv"
 	"strings"
 
@@ -44,19 +45,24 @@ func PngLosslessCompress(c *gin.Context) {
 		return
 	}
 
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Status, task.Progress = model.JobSucceeded, 100 // 同步执行的工具，入库时已经完成
 	if task.Add(); task.ErrMsg != "" {
 		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
 		return
 	}
 	go base.ToolCallSuccess(task.ToolId) // 记录访问次数
 
-	fs, err := os.Stat(task.ResultPath)
+	fs, err := storage.Default().Stat(task.Ctx, task.ResultPath)
 	if err != nil {
 		task.Log.Error("获取文件信息出错：", err)
 		response.Fail(c, g.UnknownErrorCode, "")
 		return
 	}
-	response.Success(c, fs.Size())
+	response.Success(c, fs.Size)
 }
 
 /**
@@ -70,23 +76,28 @@ func LossyCompression(c *gin.Context) {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	needSize := checkLossyCompressParams(task)
+	target := checkLossyCompressParams(task)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
 		return
 	}
-	service.LossyCompression(task, needSize)
+	plan := service.LossyCompression(task, target)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
 
-	fs, err := os.Stat(strings.Replace(task.ResultPath, "water", "result", 1))
+	fs, err := storage.Default().Stat(task.Ctx, strings.Replace(task.ResultPath, "water", "result", 1))
 	if err != nil {
 		task.Log.Error("获取文件信息出错：", err)
 		response.Fail(c, g.UnknownErrorCode, g.UnknownErrorMsg)
 		return
 	}
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	task.Status, task.Progress = model.JobSucceeded, 100 // 同步执行的工具，入库时已经完成
 	if task.Add(); task.ErrMsg != "" {
 		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
 		return
@@ -95,34 +106,107 @@ func LossyCompression(c *gin.Context) {
 
 	c.Writer.Header().Add("Access-Control-Expose-Headers", "Compress-Size")       // 暴露该请求头给前端
 	c.Writer.Header().Add("Access-Control-Expose-Headers", "Content-Disposition") // 暴露该请求头给前端
-	c.Header("Compress-Size", strconv.FormatInt(fs.Size(), 10))                   // 设置response的header
-	c.FileAttachment(task.ResultPath, fmt.Sprintf(`%s.%s`, task.Id, task.Suffix))
+	c.Writer.Header().Add("Access-Control-Expose-Headers", "Compress-Plan")       // 暴露该请求头给前端
+	c.Header("Compress-Size", strconv.FormatInt(fs.Size, 10))                     // 设置response的header
+	planByte, _ := json.Marshal(plan)
+	c.Header("Compress-Plan", string(planByte)) // 选择的质量、缩放比例和画质
+	storedFileResponse(task, task.ResultPath)
 }
 
 /**
  * @description: 有损压缩的参数校验
  * @param {*model.ImgTask} task
- * @return {*}
+ * @return {service.CompressTarget} 目标大小和可选的画质下限
  */
-func checkLossyCompressParams(task *model.ImgTask) int {
+func checkLossyCompressParams(task *model.ImgTask) service.CompressTarget {
 	if task.ToolId != 2 {
 		task.ErrMsg = "接口id与路径不匹配！"
-		return 0
+		return service.CompressTarget{}
 	}
-	go base.ToolCall(task.ToolId)                                  // 记录访问次数
-	task.ImgByte, task.Suffix = service.CheckImage(task, 10485760) // 检查上传的图像的情况，确定下是什么类型的任务，限10M
+	go base.ToolCall(task.ToolId)                                       // 记录访问次数
+	task.ImgByte, task.ReginSuffix = service.CheckImage(task, 10485760) // 检查上传的图像的情况，确定下是什么类型的任务，限10M
 	if task.ErrMsg != "" {
-		return 0
+		return service.CompressTarget{}
 	}
-	// 支持的格式jpg png
-	suffixAccept := []string{"jpg", "jpeg", "png"}
-	// 检查 传入的文件类型和需要的文件类型是否满足suffixAccept的要求
-	if !CheckSuffix(task.Suffix, suffixAccept) {
+	// 检查 传入的文件类型和需要的文件类型是否满足lossyCompressSuffix的要求
+	if !CheckSuffix(task.ReginSuffix, lossyCompressSuffix) {
 		task.ErrMsg = "上传的文件不是支持的格式!"
-		return 0
+		return service.CompressTarget{}
+	}
+	// 输出格式不传时和上传的格式一样
+	if task.Suffix = compressOutputSuffix(task, task.C.PostForm("suffix"), lossyOutputSuffix); task.ErrMsg != "" {
+		return service.CompressTarget{}
+	}
+	if task.Suffix == "" {
+		task.Suffix = task.ReginSuffix
+	}
+	return lossyCompressTarget(task, task.C.PostForm("needSize"), task.C.PostForm("minSsim"), task.C.PostForm("minPsnr"))
+}
+
+// 有损压缩支持的格式jpg png webp
+var lossyCompressSuffix = []string{"jpg", "jpeg", "png", "webp"}
+
+// 有损压缩可以输出的格式，avif需要配置开启
+var lossyOutputSuffix = []string{"jpg", "jpeg", "png", "webp", "avif"}
+
+// 校验压缩工具的输出格式，不传时返回空，表示和上传的格式一样
+func compressOutputSuffix(task *model.ImgTask, suffix string, allowed []string) string {
+	if suffix == "" {
+		return ""
+	}
+	if !CheckSuffix(suffix, allowed) || (suffix == "avif" && !service.AvifEnabled()) {
+		task.ErrMsg = "所需的输出格式不支持!"
+		return ""
+	}
+	return suffix
+}
+
+// 校验有损压缩的目标大小和画质下限，画质下限不传表示不限制
+func lossyCompressTarget(task *model.ImgTask, needSizeStr, minSsimStr, minPsnrStr string) service.CompressTarget {
+	target := service.CompressTarget{NeedSize: lossyCompressNeedSize(task, needSizeStr)}
+	if task.ErrMsg != "" {
+		return target
+	}
+	var err error
+	if minSsimStr != "" {
+		if target.MinSsim, err = strconv.ParseFloat(minSsimStr, 64); err != nil || target.MinSsim <= 0 || target.MinSsim > 1 {
+			task.ErrMsg = "输入的SSIM下限必须在0到1之间"
+			return target
+		}
+	}
+	if minPsnrStr != "" {
+		if target.MinPsnr, err = strconv.ParseFloat(minPsnrStr, 64); err != nil || target.MinPsnr <= 0 || target.MinPsnr > 100 {
+			task.ErrMsg = "输入的PSNR下限必须在0到100之间"
+			return target
+		}
 	}
+	return target
+}
+
+// 有损压缩保存到任务中的参数
+type lossyCompressParams struct {
+	service.CompressTarget
+	Suffix string `json:"suffix,omitempty"` // 输出格式，为空时和上传的格式一样
+}
+
+// 有损压缩的参数保存到任务中
+func encodeCompressTarget(target service.CompressTarget, suffix string) string {
+	paramsByte, _ := json.Marshal(lossyCompressParams{CompressTarget: target, Suffix: suffix})
+	return string(paramsByte)
+}
+
+// 解析encodeCompressTarget的结果，兼容以前只保存了目标大小的参数
+func decodeCompressTarget(paramsStr string) (service.CompressTarget, string) {
+	var params lossyCompressParams
+	if err := json.Unmarshal([]byte(paramsStr), &params); err != nil || params.NeedSize == 0 {
+		needSize, _ := strconv.Atoi(paramsStr)
+		return service.CompressTarget{NeedSize: needSize}, ""
+	}
+	return params.CompressTarget, params.Suffix
+}
 
-	needSizeStr := task.C.PostForm("needSize")
+// 校验有损压缩的目标大小参数
+func lossyCompressNeedSize(task *model.ImgTask, needSizeStr string) int {
 	needSize, err := strconv.Atoi(needSizeStr)
 	if err != nil {
 		task.ErrMsg = "输入的目标大小不是整数"
@@ -145,19 +229,50 @@ func checkPngLosslessCompressParams(task *model.ImgTask) int {
 		task.ErrMsg = "接口id与路径不匹配！"
 		return 0
 	}
-	go base.ToolCall(task.ToolId)                                  // 记录访问次数
-	task.ImgByte, task.Suffix = service.CheckImage(task, 10485760) // 检查上传的图像的情况，确定下是什么类型的任务，限10M
+	go base.ToolCall(task.ToolId)                                       // 记录访问次数
+	task.ImgByte, task.ReginSuffix = service.CheckImage(task, 10485760) // 检查上传的图像的情况，确定下是什么类型的任务，限10M
 	if task.ErrMsg != "" {
 		return 0
 	}
 
 	// 核查文件类型
-	if task.Suffix != "png" {
+	if task.ReginSuffix != "png" {
 		task.ErrMsg = "上传的文件类型错误！"
 		return 0
 	}
+	if task.Suffix = compressOutputSuffix(task, task.C.PostForm("suffix"), pngLosslessOutputSuffix); task.Suffix == "" {
+		task.Suffix = task.ReginSuffix
+	}
+	return pngCompressLevel(task, task.C.PostForm("level"))
+}
+
+// png无损压缩可以输出的格式，webp是无损的webp
+var pngLosslessOutputSuffix = []string{"png", "webp"}
+
+// png无损压缩保存到任务中的参数
+type pngLosslessParams struct {
+	Level  int    `json:"level"`
+	Suffix string `json:"suffix,omitempty"` // 输出格式，为空时和上传的格式一样
+}
+
+// png无损压缩的参数保存到任务中
+func encodePngLosslessParams(level int, suffix string) string {
+	paramsByte, _ := json.Marshal(pngLosslessParams{Level: level, Suffix: suffix})
+	return string(paramsByte)
+}
+
+// 解析encodePngLosslessParams的结果，兼容以前只保存了压缩等级的参数
+func decodePngLosslessParams(paramsStr string) (int, string) {
+	var params pngLosslessParams
+	if err := json.Unmarshal([]byte(paramsStr), &params); err != nil {
+		level, _ := strconv.Atoi(paramsStr)
+		return level, ""
+	}
+	return params.Level, params.Suffix
+}
 
-	compressLevelStr := task.C.PostForm("level")
+// 校验png无损压缩的压缩等级参数
+func pngCompressLevel(task *model.ImgTask, compressLevelStr string) int {
 	compressLevel, err := strconv.Atoi(compressLevelStr)
 	if err != nil {
 		task.ErrMsg = "输入的压缩等级不是整数"
@@ -63,7 +63,12 @@ func WechatPay(c *gin.Context) {
 		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
 		return
 	}
+	if task.BatchCount > 0 && task.Status != model.JobSucceeded { // 批量任务按处理成功的数量计费，完成前无法确定价格
+		response.Fail(c, g.ExecuteErrorCode, "批量任务还未完成，完成后再付款")
+		return
+	}
 	order := model.InitOrder(c, task.ToolId, 1)
+	order.Amount = task.Amount() // 批量任务和组合任务的价格和工具单价不同
 	codeUrl, err := payService.WechatNativeCreateOrder(c, order)
 	if err != nil {
 		response.Fail(c, g.UnknownErrorCode, err)
@@ -87,7 +92,12 @@ func AliH5Pay(c *gin.Context) {
 		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
 		return
 	}
+	if task.BatchCount > 0 && task.Status != model.JobSucceeded { // 批量任务按处理成功的数量计费，完成前无法确定价格
+		response.Fail(c, g.ExecuteErrorCode, "批量任务还未完成，完成后再付款")
+		return
+	}
 	order := model.InitOrder(c, task.ToolId, 2)
+	order.Amount = task.Amount() // 批量任务和组合任务的价格和工具单价不同
 	codeUrl, err := payService.AliH5CreateOrder(c, order)
 	if err != nil {
 		response.Fail(c, g.UnknownErrorCode, err)
@@ -0,0 +1,291 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 23:36:08
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 23:36:08
+ * @Description: 组合任务：一次上传，按顺序执行多个工具，上一步的结果（不带水印）作为下一步的输入，只在最后一步加水印，一起付款一次下载。
+ * 比如证件照换底色后再压缩到30KB以下，黑白照片上色后再放大两倍
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"src/app/model"
+	"src/app/service"
+	g "src/global"
+	"src/utils/base"
+	myFileUtil "src/utils/file"
+	"src/utils/response"
+	"src/utils/storage"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	pipelineJobType  = "pipeline" // 组合任务的任务类型
+	maxPipelineSteps = 5          // 组合任务最多的步骤数
+)
+
+// 可以组合的工具，执行时复用asyncTools里的实现
+type pipelineTool struct {
+	maxSize int64                                                    // 输入图片的大小限制
+	suffix  []string                                                 // 支持输入的图片格式
+	params  func(task *model.ImgTask, form map[string]string) string // 校验这一步的参数，错误写入task.ErrMsg，返回值同asyncTool.check
+}
+
+var pipelineTools = make(map[uint8]pipelineTool)
+
+// 前端提交的步骤，参数名和各工具单独使用时的表单字段一样
+type pipelineStepForm struct {
+	ToolId uint8             `json:"tool_id"`
+	Params map[string]string `json:"params"`
+}
+
+// 保存在任务队列里的步骤
+type pipelineStep struct {
+	ToolId uint8  `json:"tool_id"`
+	Params string `json:"params"`
+}
+
+type pipelineJobPayload struct {
+	ImgPath string         `json:"img_path"`
+	Suffix  string         `json:"suffix"`
+	Steps   []pipelineStep `json:"steps"`
+}
+
+// 注册可以组合的工具
+func initPipelineTools() {
+	// 证件照换底色，限3070KB
+	pipelineTools[1] = pipelineTool{maxSize: 3143680, suffix: []string{"jpg", "png", "bmp"}, params: func(task *model.ImgTask, form map[string]string) string {
+		color := parseBgColor(task, form["color"])
+		if task.ErrMsg != "" {
+			return ""
+		}
+		return encodeBgColorParams(color, parseIdPhotoSpec(task, form["spec"]))
+	}}
+	// 有损压缩，限10M
+	pipelineTools[2] = pipelineTool{maxSize: 10485760, suffix: lossyCompressSuffix, params: func(task *model.ImgTask, form map[string]string) string {
+		target := lossyCompressTarget(task, form["needSize"], form["minSsim"], form["minPsnr"])
+		return encodeCompressTarget(target, compressOutputSuffix(task, form["suffix"], lossyOutputSuffix))
+	}}
+	// png无损压缩，限10M
+	pipelineTools[3] = pipelineTool{maxSize: 10485760, suffix: []string{"png"}, params: func(task *model.ImgTask, form map[string]string) string {
+		level := pngCompressLevel(task, form["level"])
+		return encodePngLosslessParams(level, compressOutputSuffix(task, form["suffix"], pngLosslessOutputSuffix))
+	}}
+	// 格式转换，限10M，参数是目标格式
+	pipelineTools[4] = pipelineTool{maxSize: 10485760, suffix: conversSuffix, params: func(task *model.ImgTask, form map[string]string) string {
+		if !CheckSuffix(form["suffix"], conversSuffix) {
+			task.ErrMsg = "所需的转换格式不支持!"
+		}
+		return form["suffix"]
+	}}
+	// 图像特效与增强，百度接口限制base64后4M
+	effects := pipelineTool{maxSize: 3143680, suffix: []string{"jpg", "png", "bmp"}, params: func(task *model.ImgTask, form map[string]string) string {
+		apiStr, errMsg := effectsApi(task)
+		paramsByte, _ := json.Marshal([]string{apiStr, errMsg})
+		return string(paramsByte)
+	}}
+	for toolId := uint8(21); toolId <= 26; toolId++ {
+		pipelineTools[toolId] = effects
+	}
+	service.RegisterJobHandler(pipelineJobType, service.JobHandler{Run: runPipelineJob, OnFail: pipelineJobFail, MaxAttempts: 2})
+}
+
+/**
+ * @description: 提交组合任务。file是上传的图片，steps是步骤的json数组，如[{"tool_id":1,"params":{"color":"..."}},{"tool_id":2,"params":{"needSize":"30720"}}]
+ * 任务归属到最后一步的工具，后续付款、下载时使用返回的tool_id
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func SubmitPipeline(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	var stepForms []pipelineStepForm
+	if err := json.Unmarshal([]byte(c.PostForm("steps")), &stepForms); err != nil {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "步骤参数格式不正确")
+		return
+	}
+	if len(stepForms) < 2 || len(stepForms) > maxPipelineSteps {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, fmt.Sprintf("组合任务需要2到%d个步骤", maxPipelineSteps))
+		return
+	}
+	steps := make([]pipelineStep, len(stepForms))
+	toolIds := make([]string, len(stepForms))
+	for i, stepForm := range stepForms {
+		if _, ok := pipelineTools[stepForm.ToolId]; !ok {
+			response.Fail(c, g.ValidatorParamsCheckFailCode, fmt.Sprintf("第%d步的工具不支持组合使用", i+1))
+			return
+		}
+		go base.ToolCall(stepForm.ToolId) // 记录访问次数
+		stepTask := &model.ImgTask{ToolId: stepForm.ToolId, BaseModel: task.BaseModel}
+		steps[i] = pipelineStep{ToolId: stepForm.ToolId, Params: pipelineTools[stepForm.ToolId].params(stepTask, stepForm.Params)}
+		if stepTask.ErrMsg != "" {
+			response.Fail(c, g.ValidatorParamsCheckFailCode, fmt.Sprintf("第%d步：%s", i+1, stepTask.ErrMsg))
+			return
+		}
+		toolIds[i] = strconv.Itoa(int(stepForm.ToolId))
+	}
+	firstTool := pipelineTools[steps[0].ToolId]
+	task.ImgByte, task.Suffix = service.CheckImage(task, firstTool.maxSize)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	if errMsg := checkPipelineSuffix(steps, task.Suffix); errMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, errMsg)
+		return
+	}
+	imgPath := myFileUtil.StoreImg(task, task.ImgByte, "origin_")
+	task.ImgByte = nil
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
+		return
+	}
+	payload, _ := json.Marshal(pipelineJobPayload{ImgPath: imgPath, Suffix: task.Suffix, Steps: steps})
+	task.ToolId, task.Pipeline, task.Status = steps[len(steps)-1].ToolId, strings.Join(toolIds, ","), model.JobQueued
+	if task.Add(); task.ErrMsg != "" {
+		storage.Default().Delete(task.Ctx, imgPath)
+		response.Fail(c, g.CurdCreatFailCode, task.ErrMsg)
+		return
+	}
+	if _, err := service.SubmitJob(pipelineJobType, task, string(payload)); err != nil {
+		task.Log.Error("提交组合任务失败", err)
+		storage.Default().Delete(task.Ctx, imgPath)
+		task.Status, task.Result = model.JobFailed, "提交任务失败"
+		task.UpdateStatus()
+		response.Fail(c, g.ExecuteErrorCode, "提交任务失败，请稍后再试")
+		return
+	}
+	response.Success(c, gin.H{"task_id": task.Id, "tool_id": task.ToolId, "status": task.Status, "amount": task.Amount()})
+}
+
+/**
+ * @description: 按每一步结果的格式检查下一步能否接受，和执行时的检查一样，提交时就拒绝，不用等到执行失败。
+ * 比如压缩输出avif后，没有工具能读取avif，只能放在最后一步
+ * @param {[]pipelineStep} steps 已经校验过参数的步骤
+ * @param {string} suffix 上传图片的格式
+ * @return {string} 错误信息，为空表示通过
+ */
+func checkPipelineSuffix(steps []pipelineStep, suffix string) string {
+	for i, step := range steps {
+		if !CheckSuffix(suffix, pipelineTools[step.ToolId].suffix) {
+			if i == 0 {
+				return "上传的文件不是第一步支持的格式!"
+			}
+			return fmt.Sprintf("第%d步结果的格式%s不能作为第%d步的输入", i, suffix, i+1)
+		}
+		if output := asyncTools[step.ToolId].output; output != nil && output(step.Params) != "" {
+			suffix = output(step.Params)
+		}
+	}
+	return ""
+}
+
+// 按顺序执行组合任务的每一步，中间结果保存在临时文件里，执行完就删除
+func runPipelineJob(ctx context.Context, job *model.Job) error {
+	var payload pipelineJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return service.NoRetry(err)
+	}
+	task := service.NewJobImgTask(ctx, job, "runPipelineJob")
+	if task.Find(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	imgByte, err := storage.ReadAll(ctx, payload.ImgPath)
+	if err != nil {
+		task.Log.Error("读取上传的图片失败", err)
+		return service.NoRetry(errors.New("读取上传的图片失败"))
+	}
+	task.Status, task.Progress = model.JobRunning, 0
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+
+	tempFiles := make([]string, 0, 2*len(payload.Steps))
+	defer func() {
+		for _, tempFile := range tempFiles {
+			os.Remove(tempFile)
+		}
+	}()
+	suffix, result := payload.Suffix, ""
+	for i, step := range payload.Steps {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		tool, ok := pipelineTools[step.ToolId]
+		if !ok {
+			return service.NoRetry(fmt.Errorf("第%d步的工具不支持组合使用", i+1))
+		}
+		if !CheckSuffix(suffix, tool.suffix) {
+			return service.NoRetry(fmt.Errorf("第%d步：上一步结果的格式%s不支持", i+1, suffix))
+		}
+		if int64(len(imgByte)) > tool.maxSize {
+			return service.NoRetry(fmt.Errorf("第%d步：上一步的结果超过了大小限制", i+1))
+		}
+		// 最后一步直接用任务本身，结果和水印图就是任务的结果；中间步骤用单独的文件名
+		stepTask := task
+		if i < len(payload.Steps)-1 {
+			stepTask = &model.ImgTask{Id: fmt.Sprintf("%s_p%d", task.Id, i), ToolId: step.ToolId, BaseModel: task.BaseModel}
+		}
+		stepTask.ImgByte, stepTask.Suffix = imgByte, suffix
+		if output := asyncTools[step.ToolId].output; output != nil && output(step.Params) != "" { // 格式转换、压缩可以指定结果的格式
+			stepTask.ReginSuffix, stepTask.Suffix = suffix, output(step.Params)
+		}
+		result = asyncTools[step.ToolId].run(stepTask, step.Params)
+		stepTask.ImgByte = nil
+		if stepTask.ErrMsg != "" {
+			return fmt.Errorf("第%d步：%s", i+1, stepTask.ErrMsg)
+		}
+		if stepTask != task {
+			// 中间结果不带水印，作为下一步的输入，水印图用不到
+			resultPath := myFileUtil.GetImgSaveFullPath(stepTask, "result_")
+			tempFiles = append(tempFiles, resultPath, myFileUtil.GetImgSaveFullPath(stepTask, "water_"))
+			if imgByte, err = os.ReadFile(resultPath); err != nil {
+				task.Log.Error("读取中间结果失败", err)
+				return fmt.Errorf("第%d步：读取结果失败", i+1)
+			}
+			suffix = stepTask.Suffix
+		}
+		if err = job.SetProgress(90 * (i + 1) / len(payload.Steps)); err != nil {
+			return err
+		}
+	}
+
+	if myFileUtil.StoreResult(task); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	task.Status, task.Progress, task.Result = model.JobSucceeded, 100, result
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	for _, step := range payload.Steps {
+		go base.ToolCallSuccess(step.ToolId) // 记录访问次数
+	}
+	storage.Default().Delete(ctx, payload.ImgPath)
+	return nil
+}
+
+// 组合任务彻底失败后，删除上传的图片，记录失败原因
+func pipelineJobFail(job *model.Job, errMsg string) {
+	var payload pipelineJobPayload
+	if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.ImgPath != "" {
+		storage.Default().Delete(context.Background(), payload.ImgPath)
+	}
+	task := service.NewJobImgTask(context.Background(), job, "pipelineJobFail")
+	if task.Find(); task.ErrMsg != "" {
+		return
+	}
+	task.Status, task.Result = model.JobFailed, errMsg
+	task.UpdateStatus()
+}
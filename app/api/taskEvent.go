@@ -0,0 +1,134 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 21:52:37
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 21:52:37
+ * @Description: 用SSE向前端推送任务的进度、状态、支付结果和下载次数的变化，前端不需要再轮询，只占用一次ip访问次数
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package api
+
+import (
+	"io"
+	"src/app/model"
+	g "src/global"
+	"src/utils/response"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 一个推送连接已经推送给前端的状态，只有变化了才推送
+type taskStream struct {
+	task      *model.ImgTask
+	status    string
+	progress  int
+	downTimes int // -1表示还没推送过
+	available bool
+}
+
+/**
+ * @description: 订阅任务的事件。连接建立后先推送一次当前状态，之后有变化才推送，任务失败或者结果可以下载后推送close事件并断开。
+ * 事件只在本进程内分发，其他实例上的worker和支付回调产生的变化收不到，所以每次心跳都重新查询一次任务
+ * 事件：status 状态变化，同TaskStatus的返回；progress 进度变化；pay 订单状态变化；download 下载次数变化，available表示是否可以下载；close 推送结束，前端应关闭连接，不要重连
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func TaskEvents(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	// 先订阅再查询当前状态，避免两者之间的变化漏掉
+	events, cancel, ok := g.SubscribeTaskEvent(task.Id)
+	if !ok {
+		response.Fail(c, g.AccessForbiddenCode, "该任务的连接数过多，请关闭其他页面后再试")
+		return
+	}
+	defer cancel()
+	if task.FindWithCreateTime(86400); task.ErrMsg != "" {
+		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
+		return
+	}
+
+	heartbeatSecond, maxMinute := 5, 10
+	if g.VP.GetInt("TaskEvent.HeartbeatSecond") > 0 {
+		heartbeatSecond = g.VP.GetInt("TaskEvent.HeartbeatSecond")
+	}
+	if g.VP.GetInt("TaskEvent.MaxMinute") > 0 {
+		maxMinute = g.VP.GetInt("TaskEvent.MaxMinute")
+	}
+	heartbeat := time.NewTicker(time.Duration(heartbeatSecond) * time.Second)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(time.Duration(maxMinute) * time.Minute) // 限制连接时长，超时后前端重新连接
+	defer deadline.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // 禁止nginx缓存响应，否则事件不能及时推送
+	stream := &taskStream{task: task, downTimes: -1}
+	if stream.push(c, task) {
+		c.SSEvent("close", "")
+		return
+	}
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-deadline.C:
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().UnixMilli())
+			if stream.refresh(c) { // 变化可能发生在其他实例上，本进程收不到事件
+				c.SSEvent("close", "")
+				return false
+			}
+			return true
+		case event, ok := <-events:
+			if !ok { // 服务退出
+				return false
+			}
+			if event.Name == g.TaskEventProgress { // 进度变化频繁，直接推送，不查数据库
+				if progress, ok := event.Data["progress"].(int); ok && progress > stream.progress {
+					stream.progress = progress
+					c.SSEvent(g.TaskEventProgress, event.Data)
+				}
+				return true
+			}
+			if event.Name == g.TaskEventPay {
+				c.SSEvent(g.TaskEventPay, event.Data)
+			}
+			if stream.refresh(c) {
+				c.SSEvent("close", "")
+				return false
+			}
+			return true
+		}
+	})
+}
+
+// 重新查询任务，推送有变化的状态，返回推送是否已经结束
+func (s *taskStream) refresh(c *gin.Context) bool {
+	task := &model.ImgTask{Id: s.task.Id, ToolId: s.task.ToolId, BaseModel: s.task.BaseModel}
+	if task.FindWithCreateTime(86400); task.ErrMsg != "" { // 任务已经过期迁移了，不用再推送
+		return true
+	}
+	return s.push(c, task)
+}
+
+// 推送和上次不一样的状态和下载次数，任务失败或者已经可以下载时返回true
+func (s *taskStream) push(c *gin.Context, task *model.ImgTask) bool {
+	status := taskStatusData(task)
+	progress, _ := status["progress"].(int)
+	if task.Status != s.status || progress != s.progress {
+		s.status, s.progress = task.Status, progress
+		c.SSEvent(g.TaskEventStatus, status)
+	}
+	available := task.Status == model.JobSucceeded && task.DownloadTimes > 0
+	if task.DownloadTimes != s.downTimes || available != s.available {
+		s.downTimes, s.available = task.DownloadTimes, available
+		c.SSEvent(g.TaskEventDownload, gin.H{"available": available, "download_times": task.DownloadTimes})
+	}
+	return task.Status == model.JobFailed || available
+}
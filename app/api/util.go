@@ -9,20 +9,25 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"mime"
+	"net/http"
 	"path"
 	"src/app/model"
 	"src/app/service"
 	g "src/global"
 	"src/utils/base"
 	"src/utils/response"
+	"src/utils/storage"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 /**
- * @description: 图片下载
+ * @description: 图片下载，链接需要通过GetDownUrl获取，同一个链接在有效期内可以多次下载，每次都会扣减下载次数
  * @param {*gin.Context} c
  * @return {*}
  */
@@ -39,6 +44,15 @@ func ImageDown(c *gin.Context) {
 		return
 	}
 	id := c.Param("taskId")
+	if !g.CheckTaskId(id) {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "资源id有误")
+		return
+	}
+	// 下载链接必须是GetDownUrl签发的，防止只凭任务id就能下载
+	if errMsg := g.CheckDownloadSign(uint8(toolId), id, c.Query("expires"), c.Query("bind"), c.Query("sign"), c.ClientIP()); errMsg != "" {
+		response.Fail(c, g.AccessForbiddenCode, errMsg)
+		return
+	}
 	task := &model.ImgTask{Id: id, ToolId: uint8(toolId), BaseModel: *model.InitBaseModel(c).GetCtx(c, c).GetLog(c).GetDB(c, c)}
 
 	if task.ToolId == 27 {
@@ -51,23 +65,97 @@ func ImageDown(c *gin.Context) {
 	if c.Request.Header.Get("Sec-Fetch-Dest") == "document" { // 该标记就是判断手机端的第一次发起请求，第一次就不减少下载次数
 		isReduceDownTimes = false
 	}
+	// 证件照的冲印排版，和结果图共用下载链接和下载次数
+	if layout := c.Query("layout"); layout != "" {
+		idPhotoLayoutDown(task, layout, isReduceDownTimes)
+		return
+	}
 	service.DownImg(task, isReduceDownTimes)
 	if task.ErrMsg != "" {
 		response.Fail(c, g.ExecuteErrorCode, task.ErrMsg)
 		return
 	}
 
-	filePath := path.Join(model.ToolsMap[task.ToolId].SaveDir, fmt.Sprintf(`result_%s.%s`, task.Id, task.Suffix))
+	key := path.Join(model.ToolsMap[task.ToolId].SaveDir, fmt.Sprintf(`result_%s.%s`, task.Id, task.Suffix))
+	go base.ToolDownload(task.ToolId)
+	forensic := needForensic(task)
+	// 使用对象存储时可以重定向到预签名链接，文件不经过本服务器。需要写入取证水印时不能重定向
+	if g.VP.GetBool("Storage.PresignDownload") && !forensic {
+		if url, err := storage.Default().PresignGet(key, fmt.Sprintf(`%s.%s`, task.Id, task.Suffix), presignExpire); err == nil {
+			c.Redirect(http.StatusFound, url)
+			return
+		}
+	}
 	c.Writer.Header().Add("Access-Control-Expose-Headers", "Content-Disposition,down-times") // 暴露该请求头给前端
 	c.Header("down-times", strconv.Itoa(task.DownloadTimes))
+	if forensic {
+		forensicFileResponse(task, key)
+		return
+	}
+	storedFileResponse(task, key)
+}
 
-	go base.ToolDownload(task.ToolId)
-	c.FileAttachment(filePath, fmt.Sprintf(`%s.%s`, task.Id, task.Suffix))
+/**
+ * @description: 获取带签名的下载链接，任务存在且还有下载次数才签发，不扣减下载次数
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func GetDownUrl(c *gin.Context) {
+	task := model.InitImgTask(c)
+	if task.ErrMsg != "" {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, task.ErrMsg)
+		return
+	}
+	if task.ToolId == 27 {
+		response.Fail(c, g.ValidatorParamsCheckFailCode, "该类型的资源请到对应页面中进行下载")
+		return
+	}
+	task.FindWithCreateTime(86400) // 和下载接口一样只允许一天内的数据
+	if task.ErrMsg != "" {
+		response.Fail(c, g.CurdSelectFailCode, task.ErrMsg)
+		return
+	}
+	if task.DownloadTimes <= 0 {
+		response.Fail(c, g.ExecuteErrorCode, "下载次数已用完")
+		return
+	}
+	url, expires := g.SignDownloadUrl(task.ToolId, task.Id, c.ClientIP())
+	response.Success(c, gin.H{"url": url, "expires": expires, "down_times": task.DownloadTimes})
 }
 
 func ImgResponse(task *model.ImgTask) {
 	task.C.Writer.Header().Add("Access-Control-Expose-Headers", "Content-Disposition") // 暴露该请求头给前端
-	task.C.FileAttachment(task.ResultPath, fmt.Sprintf(`%s.%s`, task.Id, task.Suffix))
+	storedFileResponse(task, task.ResultPath)
+}
+
+const presignExpire = 5 * time.Minute // 预签名链接的有效期，重定向后马上就会使用，不需要太长
+
+/**
+ * @description: 返回存储里的文件，本机存储直接返回文件，对象存储流式转发，不在本机落盘
+ * @param {*model.ImgTask} task
+ * @param {string} key 文件在存储里的key
+ * @return {*}
+ */
+func storedFileResponse(task *model.ImgTask, key string) {
+	fileName := fmt.Sprintf(`%s.%s`, task.Id, task.Suffix)
+	if local, ok := storage.Default().(*storage.Local); ok {
+		task.C.FileAttachment(local.Path(key), fileName)
+		return
+	}
+	reader, size, err := storage.Default().Get(task.C, key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			task.Log.Error("读取存储的文件失败：", err)
+		}
+		response.Fail(task.C, g.ExecuteErrorCode, "文件不存在或已过期")
+		return
+	}
+	defer reader.Close()
+	contentType := mime.TypeByExtension("." + task.Suffix)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	task.C.DataFromReader(http.StatusOK, size, contentType, reader, map[string]string{"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, fileName)})
 }
 
 // CheckSuffix 函数用于检查给定的后缀是否在可接受的后缀列表中
@@ -120,3 +208,16 @@ func UpdateToolsMsg(c *gin.Context) {
 	}
 	response.Success(c, "更新工具信息成功")
 }
+
+// 修改配置文件的水印后重新加载，不需要重启
+func UpdateWatermark(c *gin.Context) {
+	if err := g.VP.ReadInConfig(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "读取配置文件失败:"+err.Error())
+		return
+	}
+	if err := service.LoadWatermark(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "更新水印失败:"+err.Error())
+		return
+	}
+	response.Success(c, "更新水印成功")
+}
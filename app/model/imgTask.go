@@ -29,6 +29,11 @@ type ImgTask struct {
 	Suffix        string // 如果结果是后缀，怎保存文件的后缀名，否则为空
 	DownloadTimes int
 	Result        string   // 记录一些不同的结果信息
+	Status        string   `gorm:"size:16"` // 任务状态，取值同job表的状态，同步执行的工具完成后才入库，直接是succeeded
+	Progress      int      // 进度，0~100
+	BatchCount    int      // 批量任务的图片数量，0表示不是批量任务
+	SuccessCount  int      // 批量任务处理成功的图片数量，任务完成后按它计费
+	Pipeline      string   `gorm:"size:64"` // 组合任务依次执行的工具id，逗号分隔，为空表示不是组合任务
 	CreatedAt     int64    `gorm:"autoUpdateTime:milli"`
 	UpdatedAt     int64    `gorm:"autoUpdateTime:milli"`
 	ImgByte       []byte   `json:"-" gorm:"-"` // 通常保存用户上传的图像
@@ -87,6 +92,35 @@ func (t *ImgTask) Update() {
 	}
 }
 
+// 只更新任务的状态、进度和结果，不会覆盖并发修改的下载次数
+func (t *ImgTask) UpdateStatus() {
+	if err := t.DB.Model(t).Select("status", "progress", "result", "suffix", "success_count", "updated_at").Updates(t).Error; err != nil {
+		t.Log.Error("更新任务状态失败：", err)
+		t.ErrMsg = g.UnknownErrorMsg
+		return
+	}
+	g.PublishTaskEvent(t.Id, g.TaskEventStatus, map[string]any{"status": t.Status, "progress": t.Progress})
+}
+
+// 任务的价格，单位分，批量任务和组合任务的价格和工具单价不同
+func (t *ImgTask) Amount() int64 {
+	if t.BatchCount > 0 {
+		return BatchAmount(t.ToolId, t.ChargeCount())
+	}
+	if t.Pipeline != "" {
+		return PipelineAmount(t.Pipeline)
+	}
+	return int64(ToolsMap[t.ToolId].DiscountPrice * 100)
+}
+
+// 批量任务计费的图片数量，完成前是上传的数量，完成后是处理成功的数量
+func (t *ImgTask) ChargeCount() int {
+	if t.Status == JobSucceeded {
+		return t.SuccessCount
+	}
+	return t.BatchCount
+}
+
 // 只能查询创建时间在N秒之内的
 func (t *ImgTask) FindWithCreateTime(second int64) {
 	if t.Id == "" {
@@ -119,6 +153,7 @@ func (t *ImgTask) ReduceDownloadTimes() {
 	}
 	thisMysql.Commit()
 	t.DownloadTimes -= 1
+	g.PublishTaskEvent(t.Id, g.TaskEventDownload, nil)
 }
 
 // // 增加下载次数
@@ -127,5 +162,20 @@ func AddImgTaskDownTimes(order *Order, addDownTimes int) error {
 		order.Log.Error(" 增加下载次数失败：", err)
 		return errors.New(" 增加下载次数失败")
 	}
+	g.PublishTaskEvent(order.TaskId, g.TaskEventDownload, nil)
 	return nil
 }
+
+// 按任务id的前缀查找任务id，包括迁移到备份表的任务，最多返回10个。用于从取证水印中找回任务
+func FindTaskIdsByPrefix(base *BaseModel, prefix string) ([]string, error) {
+	var taskIds []string
+	for _, table := range []string{"img_task", "img_task_backup"} {
+		var ids []string
+		if err := base.DB.Table(table).Where("id LIKE ?", prefix+"%").Limit(10).Pluck("id", &ids).Error; err != nil {
+			base.Log.Error("按前缀查询任务失败", err)
+			return nil, errors.New("查询任务失败")
+		}
+		taskIds = append(taskIds, ids...)
+	}
+	return taskIds, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 19:21:06
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 19:21:06
+ * @Description: job 表，持久化的异步任务队列。任务由worker领取并持有租约，租约过期未续期的任务会被其他worker重新领取，程序重启后也能继续执行
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package model
+
+import (
+	"errors"
+	g "src/global"
+	"strconv"
+	"time"
+
+	"github.com/yitter/idgenerator-go/idgen"
+	"gorm.io/gorm"
+)
+
+// 异步任务的状态
+const (
+	JobQueued    = "queued"    // 排队中
+	JobRunning   = "running"   // 执行中
+	JobSucceeded = "succeeded" // 成功
+	JobFailed    = "failed"    // 失败，不会再重试
+)
+
+var ErrJobExist = errors.New("该任务已经提交过，请勿重复提交")
+
+type Job struct {
+	Id          int64  `gorm:"primaryKey;autoIncrement:false"`
+	Type        string `gorm:"size:32;uniqueIndex:idx_job_task"` // 任务类型，对应注册的处理函数
+	ToolId      uint8  `gorm:"uniqueIndex:idx_job_task"`
+	TaskId      string `gorm:"size:32;uniqueIndex:idx_job_task"` // 同一个类型的任务，一个任务id只能提交一次
+	Payload     string `gorm:"type:text"`                        // 任务参数，由处理函数自己定义，一般是json
+	Status      string `gorm:"size:16;index:idx_job_claim"`
+	Progress    int    // 进度，0~100
+	Attempts    int    // 已经执行的次数
+	MaxAttempts int    // 最多执行的次数
+	RunAt       int64  `gorm:"index:idx_job_claim"` // 排队的任务在该时间之后才能被领取，毫秒，用于重试的退避
+	LeaseOwner  string `gorm:"size:64"`             // 持有租约的worker
+	LeaseUntil  int64  // 租约的过期时间，毫秒
+	LastError   string `gorm:"size:255"`
+	CreatedAt   int64  `gorm:"autoCreateTime:milli"`
+	UpdatedAt   int64  `gorm:"autoUpdateTime:milli"`
+}
+
+/**
+ * @description: 提交一个任务到队列
+ * @param {string} jobType 任务类型
+ * @param {uint8} toolId 工具id
+ * @param {string} taskId 任务id
+ * @param {string} payload 任务参数
+ * @param {int} maxAttempts 最多执行的次数，小于1时按1算
+ * @return {*Job}
+ * @return {error} 重复提交时返回ErrJobExist
+ */
+func EnqueueJob(jobType string, toolId uint8, taskId string, payload string, maxAttempts int) (*Job, error) {
+	job := &Job{
+		Id:          idgen.NextId(),
+		Type:        jobType,
+		ToolId:      toolId,
+		TaskId:      taskId,
+		Payload:     payload,
+		Status:      JobQueued,
+		MaxAttempts: max(maxAttempts, 1),
+		RunAt:       time.Now().UnixMilli(),
+	}
+	if err := g.Mysql.Create(job).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) || FindJob(jobType, toolId, taskId) != nil {
+			return nil, ErrJobExist
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+/**
+ * @description: 查询某个任务id对应的任务
+ * @return {*Job} 不存在或查询失败时返回nil
+ */
+func FindJob(jobType string, toolId uint8, taskId string) *Job {
+	var jobs []Job
+	if err := g.Mysql.Where("type = ? AND tool_id = ? AND task_id = ?", jobType, toolId, taskId).Limit(1).Find(&jobs).Error; err != nil || len(jobs) == 0 {
+		return nil
+	}
+	return &jobs[0]
+}
+
+/**
+ * @description: 领取一个可以执行的任务：排队中且到了执行时间的，或者执行中但租约已经过期且还有重试次数的（持有的worker已经退出）。
+ * 先查出候选任务，再带着同样的条件更新，更新成功才算领取到，多个实例同时领取也不会重复
+ * @param {[]string} jobTypes 本worker能处理的任务类型
+ * @param {string} owner worker的标识
+ * @param {time.Duration} lease 租约时长
+ * @return {*Job} 没有可执行的任务时返回nil
+ * @return {error}
+ */
+func ClaimJob(jobTypes []string, owner string, lease time.Duration) (*Job, error) {
+	now := time.Now().UnixMilli()
+	claimable := g.Mysql.Where("(status = ? AND run_at <= ?) OR (status = ? AND lease_until < ? AND attempts < max_attempts)", JobQueued, now, JobRunning, now)
+	var candidates []Job
+	if err := g.Mysql.Model(&Job{}).Where("type IN ?", jobTypes).Where(claimable).Order("run_at").Limit(5).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, job := range candidates {
+		result := g.Mysql.Model(&Job{}).Where("id = ?", job.Id).Where(claimable).Updates(map[string]any{
+			"status":      JobRunning,
+			"lease_owner": owner,
+			"lease_until": now + lease.Milliseconds(),
+			"attempts":    gorm.Expr("attempts + 1"),
+		})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			if err := g.Mysql.First(&job, job.Id).Error; err != nil {
+				return nil, err
+			}
+			return &job, nil
+		}
+	}
+	return nil, nil
+}
+
+// 只更新本worker持有租约的任务，租约已经被别人拿走时返回错误，调用方应该停止执行
+func (j *Job) updateOwned(values map[string]any) error {
+	result := g.Mysql.Model(&Job{}).Where("id = ? AND lease_owner = ? AND status = ?", j.Id, j.LeaseOwner, JobRunning).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("任务" + strconv.FormatInt(j.Id, 10) + "的租约已失效")
+	}
+	return nil
+}
+
+// 续租
+func (j *Job) RenewLease(lease time.Duration) error {
+	leaseUntil := time.Now().Add(lease).UnixMilli()
+	if err := j.updateOwned(map[string]any{"lease_until": leaseUntil}); err != nil {
+		return err
+	}
+	j.LeaseUntil = leaseUntil
+	return nil
+}
+
+// 更新进度
+func (j *Job) SetProgress(progress int) error {
+	if err := j.updateOwned(map[string]any{"progress": progress}); err != nil {
+		return err
+	}
+	j.Progress = progress
+	g.PublishTaskEvent(j.TaskId, g.TaskEventProgress, map[string]any{"progress": progress})
+	return nil
+}
+
+// 更新任务参数，用于保存执行到一半的状态，重新执行时可以接着做
+func (j *Job) SetPayload(payload string) error {
+	if err := j.updateOwned(map[string]any{"payload": payload}); err != nil {
+		return err
+	}
+	j.Payload = payload
+	return nil
+}
+
+// 标记任务成功
+func (j *Job) Succeed() error {
+	return j.updateOwned(map[string]any{"status": JobSucceeded, "progress": 100, "lease_until": 0})
+}
+
+/**
+ * @description: 标记任务执行失败，还有重试次数时重新排队，否则标记为失败
+ * @param {string} errMsg 失败原因
+ * @param {bool} retry 是否允许重试
+ * @param {time.Duration} backoff 重试前等待的时间
+ * @return {bool} 是否已经彻底失败
+ * @return {error}
+ */
+func (j *Job) Fail(errMsg string, retry bool, backoff time.Duration) (bool, error) {
+	if r := []rune(errMsg); len(r) > 255 { // 字段长度按字符算
+		errMsg = string(r[:255])
+	}
+	if retry && j.Attempts < j.MaxAttempts {
+		return false, j.updateOwned(map[string]any{"status": JobQueued, "run_at": time.Now().Add(backoff).UnixMilli(), "lease_until": 0, "last_error": errMsg})
+	}
+	return true, j.updateOwned(map[string]any{"status": JobFailed, "lease_until": 0, "last_error": errMsg})
+}
+
+// 把租约过期且已经用完重试次数的任务标记为失败，返回这些任务，调用方负责善后
+func FailExhaustedJobs(jobTypes []string) ([]Job, error) {
+	var jobs []Job
+	now := time.Now().UnixMilli()
+	if err := g.Mysql.Where("type IN ? AND status = ? AND lease_until < ? AND attempts >= max_attempts", jobTypes, JobRunning, now).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	failed := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		result := g.Mysql.Model(&Job{}).Where("id = ? AND status = ? AND lease_until = ?", job.Id, JobRunning, job.LeaseUntil).
+			Updates(map[string]any{"status": JobFailed, "last_error": "执行超时，已达到最大重试次数"})
+		if result.Error == nil && result.RowsAffected == 1 {
+			failed = append(failed, job)
+		}
+	}
+	return failed, nil
+}
+
+// 删除在该时间之前结束的任务，毫秒
+func DeleteFinishedJobs(before int64) error {
+	return g.Mysql.Where("status IN ? AND updated_at < ?", []string{JobSucceeded, JobFailed}, before).Delete(&Job{}).Error
+}
@@ -0,0 +1,173 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 11:26:03
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 11:26:03
+ * @Description: job表租约和重试的测试，需要mysql，设置环境变量TEST_MYSQL_DSN后才会执行，如 user:pass@tcp(127.0.0.1:3306)/test
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package model
+
+import (
+	"errors"
+	"os"
+	g "src/global"
+	"testing"
+	"time"
+
+	"github.com/yitter/idgenerator-go/idgen"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+const testJobType = "testJob"
+
+// 连接测试库并清空job表，没有配置TEST_MYSQL_DSN时跳过
+func setupJobTable(t *testing.T) {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("未设置TEST_MYSQL_DSN，跳过")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("连接mysql失败: %v", err)
+	}
+	if err = db.Migrator().DropTable(&Job{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&Job{}); err != nil {
+		t.Fatal(err)
+	}
+	old := g.Mysql
+	g.Mysql = db
+	t.Cleanup(func() { g.Mysql = old })
+	idgen.SetIdGenerator(idgen.NewIdGeneratorOptions(1))
+}
+
+// 让任务的租约或退避时间立即到期
+func expireJob(t *testing.T, id int64) {
+	past := time.Now().Add(-time.Second).UnixMilli()
+	if err := g.Mysql.Model(&Job{}).Where("id = ?", id).Updates(map[string]any{"lease_until": past, "run_at": past}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func claim(t *testing.T, owner string) *Job {
+	job, err := ClaimJob([]string{testJobType}, owner, time.Minute)
+	if err != nil {
+		t.Fatalf("领取任务失败: %v", err)
+	}
+	return job
+}
+
+func TestJobEnqueueDuplicate(t *testing.T) {
+	setupJobTable(t)
+	if _, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 3); !errors.Is(err, ErrJobExist) {
+		t.Fatalf("重复提交应该返回ErrJobExist，实际%v", err)
+	}
+}
+
+func TestJobLease(t *testing.T) {
+	setupJobTable(t)
+	job, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := claim(t, "workerA")
+	if a == nil || a.Id != job.Id || a.Attempts != 1 || a.LeaseOwner != "workerA" {
+		t.Fatalf("workerA应该领取到任务，实际%+v", a)
+	}
+	if b := claim(t, "workerB"); b != nil {
+		t.Fatal("租约有效期内其他worker不能领取")
+	}
+	if err = a.RenewLease(time.Minute); err != nil {
+		t.Fatalf("持有租约时续租应该成功: %v", err)
+	}
+
+	// workerA崩溃，租约过期后由workerB接着执行
+	expireJob(t, job.Id)
+	b := claim(t, "workerB")
+	if b == nil || b.Attempts != 2 || b.LeaseOwner != "workerB" {
+		t.Fatalf("租约过期后workerB应该领取到任务，实际%+v", b)
+	}
+	if err = a.RenewLease(time.Minute); err == nil {
+		t.Fatal("租约被拿走后workerA续租应该失败")
+	}
+	if err = a.Succeed(); err == nil {
+		t.Fatal("租约被拿走后workerA不能写入结果")
+	}
+	if err = b.Succeed(); err != nil {
+		t.Fatal(err)
+	}
+	if c := claim(t, "workerC"); c != nil {
+		t.Fatal("成功的任务不能再被领取")
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	setupJobTable(t)
+	job, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := claim(t, "workerA")
+	failed, err := a.Fail("第一次失败", true, time.Minute)
+	if err != nil || failed {
+		t.Fatalf("还有重试次数时应该重新排队，failed=%v err=%v", failed, err)
+	}
+	if b := claim(t, "workerB"); b != nil {
+		t.Fatal("退避时间内不能领取")
+	}
+	expireJob(t, job.Id)
+	b := claim(t, "workerB")
+	if b == nil || b.Attempts != 2 {
+		t.Fatalf("退避时间过后应该能领取，实际%+v", b)
+	}
+	failed, err = b.Fail("第二次失败", true, time.Minute)
+	if err != nil || !failed {
+		t.Fatalf("重试次数用完后应该彻底失败，failed=%v err=%v", failed, err)
+	}
+	expireJob(t, job.Id)
+	if c := claim(t, "workerC"); c != nil {
+		t.Fatal("失败的任务不能再被领取")
+	}
+}
+
+func TestJobNoRetry(t *testing.T) {
+	setupJobTable(t)
+	if _, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 3); err != nil {
+		t.Fatal(err)
+	}
+	a := claim(t, "workerA")
+	failed, err := a.Fail("参数错误", false, time.Minute)
+	if err != nil || !failed {
+		t.Fatalf("不允许重试时应该直接失败，failed=%v err=%v", failed, err)
+	}
+}
+
+func TestFailExhaustedJobs(t *testing.T) {
+	setupJobTable(t)
+	job, err := EnqueueJob(testJobType, 27, "TASK1", "{}", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim(t, "workerA")
+	if jobs, err := FailExhaustedJobs([]string{testJobType}); err != nil || len(jobs) != 0 {
+		t.Fatalf("租约有效的任务不能标记为失败，jobs=%d err=%v", len(jobs), err)
+	}
+	// 执行期间崩溃，租约过期且没有重试次数了
+	expireJob(t, job.Id)
+	if c := claim(t, "workerB"); c != nil {
+		t.Fatal("重试次数用完的任务不能再被领取")
+	}
+	jobs, err := FailExhaustedJobs([]string{testJobType})
+	if err != nil || len(jobs) != 1 || jobs[0].Id != job.Id {
+		t.Fatalf("应该返回超时的任务用于善后，jobs=%+v err=%v", jobs, err)
+	}
+	if jobs, _ = FailExhaustedJobs([]string{testJobType}); len(jobs) != 0 {
+		t.Fatal("同一个任务只能善后一次")
+	}
+}
@@ -25,6 +25,7 @@ type Order struct {
 	TradeType     string `json:"trade_type" db:"trade_type"`         // 建议类型。 微信：JSAPI：公众号支付 NATIVE：扫码支付 App：App支付 MICROPAY：付款码支付 MWEB：H5支付 FACEPAY：刷脸支付
 	Payer         string `json:"-" db:"payer"`                       // 支付人标识
 	RefundChannel string `json:"refund_channel" db:"refund_channel"` // 退款渠道
+	ClientIp      string `json:"-" db:"client_ip"`                   // 下单用户的ip，已按可信任代理解析出真实地址
 }
 
 func InitOrder(c *gin.Context, toolId uint8, platform int, ctx ...context.Context) *Order {
@@ -34,6 +35,7 @@ func InitOrder(c *gin.Context, toolId uint8, platform int, ctx ...context.Contex
 		ToolId:    toolId,
 		TaskId:    taskId,
 		Platform: uint8(platform),
+		ClientIp:  c.ClientIP(),
 		Amount:    int64(ToolsMap[toolId].DiscountPrice * 100),
 		BaseModel: *InitBaseModel(c).GetCtx(c, ctx...).GetLog(c).GetDB(c, ctx...),
 	}
@@ -64,6 +66,8 @@ func (o *Order) Update() error {
 		o.Log.Error("更新订单失败", err)
 		return err
 	}
+	// 支付回调、主动查询和退款都会走这里，推送给等待支付结果的前端
+	g.PublishTaskEvent(o.TaskId, g.TaskEventPay, map[string]any{"order_id": o.Id, "result_type": o.ResultType, "reason": o.Reason})
 	return nil
 }
 
@@ -81,3 +85,16 @@ func GetOrderByTaskId(task *ImgTask) (*Order, error) {
 	order.DB = task.DB
 	return &order, nil
 }
+
+// 任务最近一次支付成功的订单号，没有支付成功的订单时返回0
+func GetPaidOrderId(task *ImgTask) (uint64, error) {
+	var orderIds []string
+	if err := task.DB.Table("order").Where("task_id = ? AND result_type = 0 AND end_at > 0", task.Id).Order("end_at desc").Limit(1).Pluck("id", &orderIds).Error; err != nil {
+		task.Log.Error("查询订单失败", err)
+		return 0, errors.New("查询订单失败")
+	}
+	if len(orderIds) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(orderIds[0], 10, 64)
+}
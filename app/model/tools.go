@@ -9,7 +9,10 @@
 package model
 
 import (
+	"math"
 	g "src/global"
+	"strconv"
+	"strings"
 )
 
 var ToolsMap = make(map[uint8]Tools)
@@ -39,3 +42,32 @@ func LoadToolConfig() error {
 	}
 	return nil
 }
+
+/**
+ * @description: 批量任务的总价，单位分。每张图按折扣价再打Batch.Discount折，总价不低于单张的价格
+ * @param {uint8} toolId
+ * @param {int} count 图片数量
+ * @return {int64}
+ */
+func BatchAmount(toolId uint8, count int) int64 {
+	price := ToolsMap[toolId].DiscountPrice * 100
+	discount := 1.0
+	if g.VP.IsSet("Batch.Discount") {
+		discount = g.VP.GetFloat64("Batch.Discount")
+	}
+	return int64(math.Max(price, math.Ceil(price*float64(count)*discount)))
+}
+
+/**
+ * @description: 组合任务的总价，单位分，等于每一步工具的折扣价之和
+ * @param {string} pipeline 逗号分隔的工具id
+ * @return {int64}
+ */
+func PipelineAmount(pipeline string) int64 {
+	var price float64
+	for _, toolIdStr := range strings.Split(pipeline, ",") {
+		toolId, _ := strconv.Atoi(toolIdStr)
+		price += ToolsMap[uint8(toolId)].DiscountPrice * 100
+	}
+	return int64(math.Round(price))
+}
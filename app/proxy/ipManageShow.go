@@ -34,11 +34,59 @@ func DeleteIP(c *gin.Context){
 	c.JSON(200, global.IP.DeleteIp(c.Query("ip")))
 }
 
+// 封禁ip，time 用负数表示封禁时长，单位分钟，-128表示永封，可以超过127分钟；reason 为封禁原因
 func AddBanTime(c *gin.Context) {
-	time,err:=strconv.Atoi(c.Query("time"))
-	if err!=nil{
-	    c.JSON(200, gin.H{"error": "time must be a number"})
-	    return
+	time, err := strconv.Atoi(c.Query("time"))
+	if err != nil || time >= 0 {
+		c.JSON(200, gin.H{"error": "time must be a negative number"})
+		return
 	}
-    c.JSON(200, global.IP.AddBanTime(c.Query("ip"), int8(time)))
+	minute := -time
+	if time == -128 {
+		minute = 0 // 永封
+	}
+	c.JSON(200, global.IP.Ban(c.Query("ip"), minute, c.Query("reason"), global.BanSourceManual))
+}
+
+// 查询封禁记录，传ip时返回该ip当前的记录，否则返回所有封禁中的记录
+func GetBanRecord(c *gin.Context) {
+	if c.Query("ip") != "" {
+		c.JSON(200, global.IP.GetBanRecord(c.Query("ip")))
+		return
+	}
+	c.JSON(200, global.IP.GetBanList())
+}
+
+// 查询历史封禁记录，可以传ip过滤
+func GetBanHistory(c *gin.Context) {
+	c.JSON(200, global.IP.GetBanHistory(c.Query("ip")))
+}
+
+func GetRange(c *gin.Context) {
+	c.JSON(200, global.IP.GetRangeList())
+}
+
+// 添加ip段，type: ban 封禁，allow 白名单；time: 有效时长，单位分钟，0或不填表示永久
+func AddRange(c *gin.Context) {
+	rangeType := global.RangeTypeBan
+	if c.Query("type") == "allow" {
+		rangeType = global.RangeTypeAllow
+	}
+	expireMinute := 0
+	if c.Query("time") != "" {
+		var err error
+		if expireMinute, err = strconv.Atoi(c.Query("time")); err != nil {
+			c.JSON(200, gin.H{"error": "time must be a number"})
+			return
+		}
+	}
+	if err := global.IP.AddRange(c.Query("cidr"), rangeType, c.Query("reason"), expireMinute); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, 0)
+}
+
+func DeleteRange(c *gin.Context) {
+	c.JSON(200, global.IP.DeleteRange(c.Query("cidr")))
 }
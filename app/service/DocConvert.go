@@ -11,96 +11,165 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"src/app/dto"
 	"src/app/model"
 	"src/app/service/outApi"
 	"src/app/service/payService"
 	g "src/global"
 	"src/utils/base"
+	myFileUtil "src/utils/file"
+	"src/utils/storage"
 	"time"
 )
 
-var DocConvertTask = make(map[string]int, 0) // 记录任务进度
+const DocConvertJobType = "docConvert" // 图片转文档的异步任务类型
 
-// taskListMap:用于记录任务是否结果，防止并发重复处理同一任务
-func DocImgConvertRequest(task *model.ImgTask, taskListMap map[string]bool) {
-	// 之前已有相同的文件被处理过，所以只需要拿之前的结果重新处理即可
-	dc := outApi.DocConvert(task, task.C, "request", "")
+type docConvertPayload struct {
+	ImgPath     string `json:"img_path"`      // 上传的图片在存储里的key
+	BaiduTaskId string `json:"baidu_task_id"` // 已经提交到百度的任务id，重新执行时不再重复提交
+	SubmitAt    int64  `json:"submit_at"`     // 提交到百度的时间，毫秒
+}
+
+func docConvertJobHandler() JobHandler {
+	return JobHandler{Run: runDocConvert, OnFail: docConvertFail, MaxAttempts: 3}
+}
+
+/**
+ * @description: 提交图片转文档任务。图片先保存到存储，job表里只保存路径，由worker异步执行
+ * @param {*model.ImgTask} task
+ * @return {*}
+ */
+func DocImgConvertRequest(task *model.ImgTask) {
+	imgPath := myFileUtil.StoreImg(task, task.ImgByte, "origin_")
 	if task.ErrMsg != "" {
+		return
+	}
+	payload, _ := json.Marshal(docConvertPayload{ImgPath: imgPath})
+	if _, err := SubmitJob(DocConvertJobType, task, string(payload)); err != nil {
+		if errors.Is(err, model.ErrJobExist) {
+			task.ErrMsg = "该任务正在执行中，请勿重复执行"
+			return
+		}
+		task.Log.Error("提交图片转文档任务失败", err)
 		task.ErrMsg = "图片转文档失败，详情请联系系统管理员"
 		return
 	}
-	go base.OutApiCall(task.ToolId) // 记录api访问成功次数
-	task.Result = dc.Result.TaskId
-	DocConvertTask[task.Id] = 0
-	go DocImgConvertGetResult(task, taskListMap)
+	task.Status, task.Progress = model.JobQueued, 0
+	task.UpdateStatus()
+	task.ErrMsg = "" // 状态更新失败不影响任务执行
 }
 
-func DocImgConvertGetResult(task *model.ImgTask, taskListMap map[string]bool) {
-	sleepTime := 3
-	ctx := context.Background()
-	// 后面操作不能沿用原来的context，因为它的链接已关闭
-	task.DB = g.Mysql.WithContext(ctx)
+// 执行图片转文档：提交到百度后保存百度的任务id，再轮询结果，程序重启后从轮询这一步接着执行
+func runDocConvert(ctx context.Context, job *model.Job) error {
+	var payload docConvertPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return NoRetry(err)
+	}
+	task := NewJobImgTask(ctx, job, "runDocConvert")
+	if task.Find(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	task.Status = model.JobRunning
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return errors.New(task.ErrMsg)
+	}
+	if payload.BaiduTaskId == "" {
+		imgByte, err := storage.ReadAll(ctx, payload.ImgPath)
+		if err != nil {
+			task.Log.Error("读取上传的图片失败", err)
+			return NoRetry(errors.New("读取上传的图片失败"))
+		}
+		task.ImgByte = imgByte
+		dc := outApi.DocConvert(task, ctx, "request", "")
+		task.ImgByte = nil
+		if task.ErrMsg != "" {
+			return errors.New(task.ErrMsg)
+		}
+		go base.OutApiCall(task.ToolId) // 记录api访问成功次数
+		payload.BaiduTaskId, payload.SubmitAt = dc.Result.TaskId, time.Now().UnixMilli()
+		payloadByte, _ := json.Marshal(payload)
+		if err := job.SetPayload(string(payloadByte)); err != nil {
+			return err
+		}
+	}
 	for {
 		// 每次等待一定时间
-		time.Sleep(time.Duration(sleepTime) * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
 		// 查询处理结果
-		dc := outApi.DocConvert(task, ctx, "get_request_result", task.Result) // task.Result 此时保存的就是百度的taskID
-		if task.ErrMsg != "" {                                                // 如果返回的结果有错误，则停止任务并退款
-			task.Result = task.ErrMsg
-			task.Update()
-			// 查找订单发起退款
-			order, err := model.GetOrderByTaskId(task)
-			if err != nil {
-				task.Log.Error("获取订单失败", err)
-			}
-			payService.WechatRefund(order, task.ErrMsg)
-			if task.ErrMsg != "" {
-				return
-			}
-			delete(taskListMap, task.Id) // 删除任务
-			return
+		dc := outApi.DocConvert(task, ctx, "get_request_result", payload.BaiduTaskId)
+		if task.ErrMsg != "" {
+			return errors.New(task.ErrMsg)
 		}
-		//查询任务进度
-		DocConvertTask[task.Id] = dc.Result.Percent
 		if dc.Result.Percent == 100 { // 任务成功
-			delete(DocConvertTask, task.Id) // 删除map的内容，以免无限增加
 			result, err := json.Marshal(dc.Result.ResultData)
 			if err != nil {
 				task.Log.Error("json序列化失败", err)
-				task.Result = g.UnknownErrorMsg
-			} else {
-				task.Result = string(result)
+				return NoRetry(errors.New(g.UnknownErrorMsg))
 			}
-			task.Update()
-			if task.ErrMsg != "" {
-				return
+			task.Status, task.Progress, task.Result = model.JobSucceeded, 100, string(result)
+			if task.UpdateStatus(); task.ErrMsg != "" {
+				return errors.New(task.ErrMsg)
 			}
 			go base.ToolCallSuccess(task.ToolId) // 记录访问次数
-			delete(taskListMap, task.Id)         // 删除任务
-			return
+			storage.Default().Delete(ctx, payload.ImgPath)
+			return nil
+		}
+		if err := job.SetProgress(dc.Result.Percent); err != nil {
+			return err
 		}
 		// 判断任务进行有没有超过一分钟，超过一分钟未完成退款
-		if time.Now().UnixMilli()-task.CreatedAt > 60000 {
-			task.Result = "图片转文档超时,任务已终止，系统已自动发起退款，其注意查收"
-			delete(DocConvertTask, task.Id) // 任务超时，删除任务进度记录
-			task.Update()
-			// 查找订单发起退款
-			order, err := model.GetOrderByTaskId(task)
-			if err != nil {
-				task.Log.Error("获取订单失败", err)
-			}
-			err = payService.WechatRefund(order, "图片转文档超时")
-			if err != nil {
-				task.Log.Error("发起退款失败", err)
-			}
+		if time.Now().UnixMilli()-payload.SubmitAt > 60000 {
 			task.Log.Warn("图片转文档超过一分钟", dc.LogId)
-			delete(taskListMap, task.Id) // 删除任务记录，意味着任务已结束
-			return
+			return NoRetry(errors.New("图片转文档超时,任务已终止，系统已自动发起退款，其注意查收"))
 		}
 	}
 }
 
+// 图片转文档彻底失败后，把失败原因记录到任务结果里，并发起退款
+func docConvertFail(job *model.Job, errMsg string) {
+	task := NewJobImgTask(context.Background(), job, "docConvertFail")
+	var payload docConvertPayload
+	if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.ImgPath != "" {
+		storage.Default().Delete(context.Background(), payload.ImgPath)
+	}
+	if task.Find(); task.ErrMsg != "" {
+		return
+	}
+	task.Status, task.Result = model.JobFailed, errMsg
+	if task.UpdateStatus(); task.ErrMsg != "" {
+		return
+	}
+	// 查找订单发起退款
+	order, err := model.GetOrderByTaskId(task)
+	if err != nil {
+		return
+	}
+	if order.ResultType != 0 { // 已经在退款了，比如被定时器自动退款
+		return
+	}
+	if err = RefundOrder(order, errMsg); err != nil {
+		task.Log.Error("发起退款失败", err)
+	}
+}
+
+/**
+ * @description: 按订单的支付平台发起退款
+ * @param {*model.Order} order
+ * @param {string} reason 退款原因
+ * @return {error}
+ */
+func RefundOrder(order *model.Order, reason string) error {
+	if order.Platform == 1 {
+		return payService.WechatRefund(order, reason)
+	}
+	return payService.AliRefund(order, reason)
+}
+
 type DocConvertDto struct {
 	Code     int            `json:"code" ` // -1：任务失败；1：进行中；2：已完成
 	Percent  int            `json:"percent"`
@@ -110,10 +179,9 @@ type DocConvertDto struct {
 
 func DocImgConvertQueryResult(task *model.ImgTask) (dc *DocConvertDto) {
 	dc = &DocConvertDto{DownAddr: dto.ResultData{}}
-	val, ok := DocConvertTask[task.Id]
-	if ok { // 表明任务还在进行中
-		dc.Code = 1
-		dc.Percent = val
+	if job := model.FindJob(DocConvertJobType, task.ToolId, task.Id); job != nil && (job.Status == model.JobQueued || job.Status == model.JobRunning) {
+		dc.Code = 1 // 表明任务还在进行中
+		dc.Percent = job.Progress
 		return
 	}
 	task.FindWithCreateTime(86400)
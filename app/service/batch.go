@@ -0,0 +1,278 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 22:31:45
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 22:31:45
+ * @Description: 批量处理：读取一次上传的多张图片或者zip压缩包，处理完后把结果打包成一个zip
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"src/app/model"
+	myFileUtil "src/utils/file"
+	"src/utils/storage"
+	"strings"
+
+	"github.com/h2non/filetype"
+)
+
+// 批量任务里的一张图片
+type BatchFile struct {
+	Name    string `json:"name"`   // 原文件名，结果在压缩包里用同样的名字
+	Suffix  string `json:"suffix"` // 解析出来的图像格式
+	Path    string `json:"path"`   // 保存的路径
+	ImgByte []byte `json:"-"`
+}
+
+/**
+ * @description: 读取批量上传的图片，file字段可以是多张图片，也可以是zip压缩包，压缩包里不是图片的文件会被忽略
+ * @param {*model.ImgTask} task
+ * @param {int64} maxSize 上传和解压后的总大小限制
+ * @param {int64} maxFileSize 单张图片的大小限制
+ * @param {int} maxFiles 最多的图片数量
+ * @return {[]BatchFile}
+ */
+func CheckBatchImages(task *model.ImgTask, maxSize int64, maxFileSize int64, maxFiles int) []BatchFile {
+	if task.C.Request.ContentLength > maxSize {
+		task.ErrMsg = fmt.Sprintf("文件大小超过限制，最大不得超过 %d KB", maxSize/1024)
+		return nil
+	}
+	task.C.Request.Body = http.MaxBytesReader(task.C.Writer, task.C.Request.Body, maxSize) // 没有Content-Length时也要限制大小
+	if err := task.C.Request.ParseMultipartForm(32 << 20); err != nil {                    // 超过32M的部分存到临时文件
+		task.Log.Error("未正确上传文件：", err)
+		task.ErrMsg = "未正确上传文件"
+		return nil
+	}
+	fileHeaders := task.C.Request.MultipartForm.File["file"]
+	if len(fileHeaders) == 0 {
+		task.ErrMsg = "未上传文件"
+		return nil
+	}
+	files := make([]BatchFile, 0, len(fileHeaders))
+	var totalSize int64
+	for _, fileHeader := range fileHeaders {
+		fileByte, err := readFormFile(fileHeader)
+		if err != nil {
+			task.Log.Error("读取上传的文件失败：", err)
+			task.ErrMsg = "上传的文件错误！"
+			return nil
+		}
+		if kind, _ := filetype.Match(fileByte); kind.Extension == "zip" {
+			unzipStart := len(files)
+			if files = unzipBatchImages(task, fileByte, files, maxSize-totalSize, maxFileSize, maxFiles); task.ErrMsg != "" {
+				return nil
+			}
+			for _, file := range files[unzipStart:] {
+				totalSize += int64(len(file.ImgByte))
+			}
+			continue
+		}
+		if int64(len(fileByte)) > maxFileSize {
+			task.ErrMsg = fmt.Sprintf("%s 超过单张图片的大小限制 %d KB", fileHeader.Filename, maxFileSize/1024)
+			return nil
+		}
+		imgType, err := filetype.Image(fileByte)
+		if err != nil {
+			task.ErrMsg = fmt.Sprintf("%s 不是图片", fileHeader.Filename)
+			return nil
+		}
+		totalSize += int64(len(fileByte))
+		fileByte = NormalizeUpload(task, fileByte, imgType.Extension) // 和单张上传一样转正、去掉隐私信息
+		files = append(files, BatchFile{Name: baseName(fileHeader.Filename), Suffix: imgType.Extension, ImgByte: fileByte})
+	}
+	if len(files) == 0 {
+		task.ErrMsg = "没有找到可以处理的图片"
+		return nil
+	}
+	if len(files) > maxFiles {
+		task.ErrMsg = fmt.Sprintf("一次最多处理 %d 张图片", maxFiles)
+		return nil
+	}
+	return files
+}
+
+// 去掉文件名里的路径，windows下的路径分隔符也要处理
+func baseName(name string) string {
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+// 读取上传的一个文件
+func readFormFile(fileHeader *multipart.FileHeader) ([]byte, error) {
+	fileRead, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fileRead.Close()
+	return io.ReadAll(fileRead)
+}
+
+// 解压zip里的图片，按解压后的实际大小限制，防止压缩炸弹
+func unzipBatchImages(task *model.ImgTask, zipByte []byte, files []BatchFile, remainSize int64, maxFileSize int64, maxFiles int) []BatchFile {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipByte), int64(len(zipByte)))
+	if err != nil {
+		task.Log.Error("解析zip文件失败：", err)
+		task.ErrMsg = "压缩包解析失败，只支持zip格式"
+		return files
+	}
+	for _, zipFile := range zipReader.File {
+		name := baseName(zipFile.Name)
+		// 跳过目录、隐藏文件和mac系统打包时附带的文件
+		if zipFile.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(zipFile.Name, "__MACOSX/") {
+			continue
+		}
+		if len(files) >= maxFiles {
+			task.ErrMsg = fmt.Sprintf("一次最多处理 %d 张图片", maxFiles)
+			return files
+		}
+		fileByte, err := readZipFile(zipFile, maxFileSize)
+		if err != nil {
+			task.ErrMsg = fmt.Sprintf("%s 读取失败或超过单张图片的大小限制 %d KB", name, maxFileSize/1024)
+			return files
+		}
+		if remainSize -= int64(len(fileByte)); remainSize < 0 {
+			task.ErrMsg = "压缩包解压后的大小超过限制"
+			return files
+		}
+		imgType, err := filetype.Image(fileByte)
+		if err != nil { // 压缩包里经常有说明文档之类的文件，忽略
+			continue
+		}
+		files = append(files, BatchFile{Name: name, Suffix: imgType.Extension, ImgByte: NormalizeUpload(task, fileByte, imgType.Extension)})
+	}
+	return files
+}
+
+// 读取zip里的一个文件，超过maxSize返回错误。不能相信压缩包里记录的大小，按实际读到的判断
+func readZipFile(zipFile *zip.File, maxSize int64) ([]byte, error) {
+	fileRead, err := zipFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fileRead.Close()
+	fileByte, err := io.ReadAll(io.LimitReader(fileRead, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(fileByte)) > maxSize {
+		return nil, fmt.Errorf("文件超过%d字节", maxSize)
+	}
+	return fileByte, nil
+}
+
+/**
+ * @description: 批量任务中第index张图片对应的子任务，文件名带上序号，和其他图片区分开
+ * @param {*model.ImgTask} task 批量任务
+ * @param {int} index
+ * @return {*model.ImgTask}
+ */
+func BatchSubTask(task *model.ImgTask, index int) *model.ImgTask {
+	return &model.ImgTask{Id: fmt.Sprintf("%s_%d", task.Id, index), ToolId: task.ToolId, BaseModel: task.BaseModel}
+}
+
+/**
+ * @description: 保存批量上传的图片到存储，key记录到BatchFile.Path
+ * @param {*model.ImgTask} task
+ * @param {[]BatchFile} files
+ * @return {*}
+ */
+func SaveBatchFiles(task *model.ImgTask, files []BatchFile) {
+	for i := range files {
+		subTask := BatchSubTask(task, i)
+		subTask.Suffix = files[i].Suffix
+		files[i].Path = myFileUtil.StoreImg(subTask, files[i].ImgByte, "origin_")
+		files[i].ImgByte = nil
+		if subTask.ErrMsg != "" {
+			task.ErrMsg = subTask.ErrMsg
+			RemoveBatchFiles(files[:i+1])
+			return
+		}
+	}
+}
+
+// 删除批量任务保存的文件
+func RemoveBatchFiles(files []BatchFile) {
+	for _, file := range files {
+		if file.Path != "" {
+			storage.Default().Delete(context.Background(), file.Path)
+		}
+	}
+}
+
+/**
+ * @description: 把批量任务的结果打包成zip，保存为任务的result_文件，压缩包里重名的文件加上序号
+ * @param {*model.ImgTask} task task.Suffix需要是zip
+ * @param {[]string} names 压缩包里的文件名
+ * @param {[]string} filePaths 对应的结果文件
+ * @return {*}
+ */
+func ZipBatchResult(task *model.ImgTask, names []string, filePaths []string) {
+	zipPath := myFileUtil.GetImgSaveFullPath(task, "result_")
+	if task.ErrMsg != "" {
+		return
+	}
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		task.Log.Error("创建压缩包失败：", err)
+		task.ErrMsg = "创建压缩包失败"
+		return
+	}
+	defer zipFile.Close()
+	zipWriter := zip.NewWriter(zipFile)
+	usedNames := make(map[string]bool)
+	for i, filePath := range filePaths {
+		name := zipEntryName(usedNames, names[i])
+		if err = addZipFile(zipWriter, name, filePath); err != nil {
+			task.Log.Error("写入压缩包失败：", err)
+			task.ErrMsg = "创建压缩包失败"
+			zipWriter.Close()
+			return
+		}
+	}
+	if err = zipWriter.Close(); err != nil {
+		task.Log.Error("写入压缩包失败：", err)
+		task.ErrMsg = "创建压缩包失败"
+	}
+}
+
+/**
+ * @description: 压缩包里的文件名去重，重名的加上序号，如a.jpg、a(1).jpg、a(2).jpg。
+ * 不同目录下的同名图片，或者a.jpg和a.png转换成同一个格式后都会重名，解压时会互相覆盖。
+ * 按不区分大小写比较，因为windows解压时A.jpg和a.jpg也会覆盖
+ * @param {map[string]bool} usedNames 已经使用的文件名，key是小写的
+ * @param {string} name 原文件名
+ * @return {string} 不重名的文件名
+ */
+func zipEntryName(usedNames map[string]bool, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; usedNames[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s(%d)%s", base, i, ext)
+	}
+	usedNames[strings.ToLower(name)] = true
+	return name
+}
+
+// 把一个文件写入压缩包，图片本身已经压缩过了，直接存储不再压缩
+func addZipFile(zipWriter *zip.Writer, name string, filePath string) error {
+	fileByte, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(fileByte)
+	return err
+}
@@ -0,0 +1,40 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 11:48:15
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 11:48:15
+ * @Description: 批量结果压缩包文件名去重的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZipEntryName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+		want  []string
+	}{
+		{"没有重名", []string{"a.jpg", "b.jpg"}, []string{"a.jpg", "b.jpg"}},
+		{"同名", []string{"a.jpg", "a.jpg", "a.jpg"}, []string{"a.jpg", "a(1).jpg", "a(2).jpg"}},
+		{"加序号后和原有的文件重名", []string{"a.jpg", "a(1).jpg", "a.jpg"}, []string{"a.jpg", "a(1).jpg", "a(2).jpg"}},
+		{"大小写不同", []string{"A.jpg", "a.jpg", "a.JPG"}, []string{"A.jpg", "a(1).jpg", "a(2).JPG"}},
+		{"没有扩展名", []string{"a", "a"}, []string{"a", "a(1)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usedNames := make(map[string]bool)
+			got := make([]string, 0, len(tt.input))
+			for _, name := range tt.input {
+				got = append(got, zipEntryName(usedNames, name))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("去重后为%v，期望%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 03:20:48
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 03:20:48
+ * @Description: 取证水印。下载结果时在亮度通道的DCT中频系数里写入订单号和任务id的前6位，肉眼看不出来，
+ * 结果被转卖时可以从图片中取出来查到是哪个订单。先把亮度缩放到固定的大小再写入，所以能经受缩放和重新压缩，不能经受裁剪
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"math"
+	g "src/global"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	forensicSize       = 384 // 写入和读取时亮度缩放到的大小，48*48个8*8的块
+	forensicBlock      = 8
+	forensicTaskIdLen  = 6                                      // 写入任务id的前几位，旧版和新版的任务id都是数字和大写字母
+	forensicPayloadLen = 8 + 4 + 2                              // 订单号、任务id前缀、校验码
+	forensicBits       = forensicPayloadLen * 8                 // 112位，每一位重复写入约20个块
+	forensicAlphabet   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ" // 任务id前缀按36进制保存
+)
+
+// 取证水印的内容
+type ForensicPayload struct {
+	OrderId      uint64  `json:"order_id"`       // 订单号，没有订单时为0
+	TaskIdPrefix string  `json:"task_id_prefix"` // 任务id的前6位
+	Confidence   float64 `json:"confidence"`     // 读取时与结果一致的块的比例，越接近1越可信，0.5左右说明没有水印
+}
+
+/**
+ * @description: 是否给下载的结果添加取证水印，配置Forensic.Enable为false时不添加
+ * @return {bool}
+ */
+func ForensicEnabled() bool {
+	return !g.VP.IsSet("Forensic.Enable") || g.VP.GetBool("Forensic.Enable")
+}
+
+// 写入的强度，即两个DCT系数的差，越大越不容易被破坏，但越容易看出来
+func forensicStrength() float32 {
+	if g.VP.GetFloat64("Forensic.Strength") > 0 {
+		return float32(g.VP.GetFloat64("Forensic.Strength"))
+	}
+	return 10
+}
+
+/**
+ * @description: 把订单号和任务id写入图片，按suffix重新编码，DPI和ICC保持不变
+ * @param {[]byte} imgByte 不带水印的结果图
+ * @param {string} suffix 图片的格式
+ * @param {uint64} orderId 订单号
+ * @param {string} taskId 任务id
+ * @return {[]byte} 写入后的图片
+ * @return {error}
+ */
+func EmbedForensic(imgByte []byte, suffix string, orderId uint64, taskId string) ([]byte, error) {
+	bits, err := forensicEncode(orderId, taskId)
+	if err != nil {
+		return nil, err
+	}
+	img, err := gocv.IMDecode(imgByte, gocv.IMReadUnchanged)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if img.Empty() || img.Rows() < forensicBlock || img.Cols() < forensicBlock {
+		return nil, errors.New("图片太小")
+	}
+
+	// 分离出亮度，透明通道原样保留
+	var channels []gocv.Mat
+	defer func() {
+		for _, channel := range channels {
+			channel.Close()
+		}
+	}()
+	var luma gocv.Mat
+	switch img.Channels() {
+	case 1:
+		luma = img
+	case 3, 4:
+		channels = gocv.Split(img)
+		bgr, ycrcb := gocv.NewMat(), gocv.NewMat()
+		defer bgr.Close()
+		defer ycrcb.Close()
+		gocv.Merge(channels[:3], &bgr)
+		gocv.CvtColor(bgr, &ycrcb, gocv.ColorBGRToYCrCb)
+		for i, channel := range gocv.Split(ycrcb) {
+			channels[i].Close()
+			channels[i] = channel
+		}
+		luma = channels[0]
+	default:
+		return nil, errors.New("图片通道数不支持")
+	}
+
+	// 在缩小后的亮度上写入，把差值放大回原图的大小再叠加，这样读取时缩放到同样的大小就能对齐
+	lumaF := gocv.NewMat()
+	defer lumaF.Close()
+	luma.ConvertTo(&lumaF, gocv.MatTypeCV32F)
+	small := gocv.NewMat()
+	defer small.Close()
+	gocv.Resize(lumaF, &small, image.Pt(forensicSize, forensicSize), 0, 0, gocv.InterpolationArea)
+	marked := small.Clone()
+	defer marked.Close()
+	strength := forensicStrength()
+	forensicEachBlock(marked, func(index int, coeffs *gocv.Mat) bool {
+		c1, c2 := coeffs.GetFloatAt(1, 2), coeffs.GetFloatAt(2, 1)
+		if bits[index%forensicBits] {
+			if c1-c2 >= strength {
+				return false
+			}
+		} else if c2-c1 >= strength {
+			return false
+		}
+		mean, half := (c1+c2)/2, strength/2
+		if !bits[index%forensicBits] {
+			half = -half
+		}
+		coeffs.SetFloatAt(1, 2, mean+half)
+		coeffs.SetFloatAt(2, 1, mean-half)
+		return true
+	})
+	delta, deltaFull := gocv.NewMat(), gocv.NewMat()
+	defer delta.Close()
+	defer deltaFull.Close()
+	gocv.Subtract(marked, small, &delta)
+	gocv.Resize(delta, &deltaFull, image.Pt(img.Cols(), img.Rows()), 0, 0, gocv.InterpolationLinear)
+	gocv.Add(lumaF, deltaFull, &lumaF)
+	lumaF.ConvertTo(&luma, gocv.MatTypeCV8U) // 超出[0,255]的部分会被截断
+
+	result := img
+	if img.Channels() != 1 {
+		ycrcb, bgr := gocv.NewMat(), gocv.NewMat()
+		defer ycrcb.Close()
+		defer bgr.Close()
+		gocv.Merge(channels[:3], &ycrcb)
+		gocv.CvtColor(ycrcb, &bgr, gocv.ColorYCrCbToBGR)
+		result = bgr
+		if img.Channels() == 4 {
+			bgra := gocv.NewMat()
+			defer bgra.Close()
+			bgrChannels := gocv.Split(bgr)
+			gocv.Merge(append(bgrChannels, channels[3]), &bgra)
+			for _, channel := range bgrChannels {
+				channel.Close()
+			}
+			result = bgra
+		}
+	}
+
+	var buf *gocv.NativeByteBuffer
+	switch suffix {
+	case "jpg", "jpeg":
+		buf, err = gocv.IMEncodeWithParams(gocv.JPEGFileExt, result, []int{gocv.IMWriteJpegQuality, 95})
+	case "webp":
+		buf, err = gocv.IMEncodeWithParams(".webp", result, []int{gocv.IMWriteWebpQuality, 95})
+	default:
+		buf, err = gocv.IMEncode(gocv.FileExt("."+suffix), result)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return copyImageMeta(imgByte, buf.GetBytes()), nil
+}
+
+/**
+ * @description: 从图片中读取取证水印，每一位按所有块的系数差求和判断，再用校验码确认
+ * @param {[]byte} imgByte 可疑的图片，可以被缩放和重新压缩过，不能被裁剪
+ * @return {*ForensicPayload}
+ * @return {error} 图片无法解码或者校验码不对
+ */
+func ExtractForensic(imgByte []byte) (*ForensicPayload, error) {
+	img, err := gocv.IMDecode(imgByte, gocv.IMReadGrayScale) // 灰度就是YCrCb的亮度
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if img.Empty() {
+		return nil, errors.New("图片解码失败")
+	}
+	lumaF, small := gocv.NewMat(), gocv.NewMat()
+	defer lumaF.Close()
+	defer small.Close()
+	img.ConvertTo(&lumaF, gocv.MatTypeCV32F)
+	gocv.Resize(lumaF, &small, image.Pt(forensicSize, forensicSize), 0, 0, gocv.InterpolationArea)
+
+	votes := make([]float64, forensicBits)
+	diffs := make([]float32, 0, (forensicSize/forensicBlock)*(forensicSize/forensicBlock))
+	forensicEachBlock(small, func(index int, coeffs *gocv.Mat) bool {
+		diff := coeffs.GetFloatAt(1, 2) - coeffs.GetFloatAt(2, 1)
+		votes[index%forensicBits] += float64(diff)
+		diffs = append(diffs, diff)
+		return false
+	})
+	bits := make([]bool, forensicBits)
+	for i, vote := range votes {
+		bits[i] = vote > 0
+	}
+	agree := 0
+	for index, diff := range diffs {
+		if (diff > 0) == bits[index%forensicBits] {
+			agree++
+		}
+	}
+	payload, err := forensicDecode(bits)
+	if err != nil {
+		return nil, err
+	}
+	payload.Confidence = math.Round(float64(agree)/float64(len(diffs))*1000) / 1000
+	return payload, nil
+}
+
+// 依次对每个8*8的块做DCT，fn返回true时把修改后的系数反变换写回
+func forensicEachBlock(mat gocv.Mat, fn func(index int, coeffs *gocv.Mat) bool) {
+	coeffs, block := gocv.NewMat(), gocv.NewMat()
+	defer coeffs.Close()
+	defer block.Close()
+	index := 0
+	for y := 0; y+forensicBlock <= mat.Rows(); y += forensicBlock {
+		for x := 0; x+forensicBlock <= mat.Cols(); x += forensicBlock {
+			region := mat.Region(image.Rect(x, y, x+forensicBlock, y+forensicBlock))
+			gocv.DCT(region, &coeffs, gocv.DftForward)
+			if fn(index, &coeffs) {
+				gocv.IDCT(coeffs, &block, 0)
+				block.CopyTo(&region)
+			}
+			region.Close()
+			index++
+		}
+	}
+}
+
+// 订单号、任务id前缀和校验码转为比特，高位在前
+func forensicEncode(orderId uint64, taskId string) ([]bool, error) {
+	if len(taskId) < forensicTaskIdLen {
+		return nil, errors.New("任务id太短")
+	}
+	var prefix uint32
+	for _, char := range strings.ToUpper(taskId[:forensicTaskIdLen]) {
+		index := strings.IndexRune(forensicAlphabet, char)
+		if index < 0 {
+			return nil, errors.New("任务id包含不支持的字符")
+		}
+		prefix = prefix*uint32(len(forensicAlphabet)) + uint32(index)
+	}
+	payload := make([]byte, forensicPayloadLen)
+	binary.BigEndian.PutUint64(payload[0:8], orderId)
+	binary.BigEndian.PutUint32(payload[8:12], prefix)
+	binary.BigEndian.PutUint16(payload[12:14], uint16(crc32.ChecksumIEEE(payload[:12])))
+	bits := make([]bool, forensicBits)
+	for i := range bits {
+		bits[i] = payload[i/8]>>(7-i%8)&1 == 1
+	}
+	return bits, nil
+}
+
+// forensicEncode的逆过程，校验码不对时返回错误
+func forensicDecode(bits []bool) (*ForensicPayload, error) {
+	payload := make([]byte, forensicPayloadLen)
+	for i, bit := range bits {
+		if bit {
+			payload[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	if binary.BigEndian.Uint16(payload[12:14]) != uint16(crc32.ChecksumIEEE(payload[:12])) {
+		return nil, errors.New("没有找到取证水印，或者图片被裁剪、修改过多")
+	}
+	prefix := binary.BigEndian.Uint32(payload[8:12])
+	taskIdPrefix := make([]byte, forensicTaskIdLen)
+	for i := forensicTaskIdLen - 1; i >= 0; i-- {
+		taskIdPrefix[i] = forensicAlphabet[prefix%uint32(len(forensicAlphabet))]
+		prefix /= uint32(len(forensicAlphabet))
+	}
+	return &ForensicPayload{OrderId: binary.BigEndian.Uint64(payload[0:8]), TaskIdPrefix: string(taskIdPrefix)}, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 18:47:25
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 18:47:25
+ * @Description: 取证水印的测试：写入后经过重新压缩和缩放仍然能读出订单号和任务id前缀。需要opencv
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"image"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// 编码和解码互为逆过程，任务id前缀不区分大小写
+func TestForensicEncode(t *testing.T) {
+	bits, err := forensicEncode(1234567890123, "a1b2c3xy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := forensicDecode(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.OrderId != 1234567890123 || payload.TaskIdPrefix != "A1B2C3" {
+		t.Fatalf("解码的结果不对：%+v", payload)
+	}
+	bits[5] = !bits[5]
+	if _, err = forensicDecode(bits); err == nil {
+		t.Fatal("改了一位后校验码应该不对")
+	}
+	if _, err = forensicEncode(1, "A1B2C"); err == nil {
+		t.Fatal("任务id太短应该报错")
+	}
+	if _, err = forensicEncode(1, "A1B2C_"); err == nil {
+		t.Fatal("任务id包含不支持的字符应该报错")
+	}
+}
+
+// 写入后按质量75重新压缩成jpg、缩小到一半，仍然能读出来
+func TestForensicRoundTrip(t *testing.T) {
+	mat := testCompressMat(t, 600, 800)
+	defer mat.Close()
+	buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, mat, []int{gocv.IMWriteJpegQuality, 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append([]byte(nil), buf.GetBytes()...)
+	buf.Close()
+	if _, err = ExtractForensic(src); err == nil {
+		t.Fatal("没有水印的图片不应该读出结果")
+	}
+
+	const orderId, taskId = uint64(1234567890123), "A1B2C3XY"
+	marked, err := EmbedForensic(src, "jpg", orderId, taskId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := gocv.IMDecode(marked, gocv.IMReadUnchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	half := gocv.NewMat()
+	defer half.Close()
+	gocv.Resize(img, &half, image.Pt(img.Cols()/2, img.Rows()/2), 0, 0, gocv.InterpolationArea)
+	buf, err = gocv.IMEncodeWithParams(gocv.JPEGFileExt, half, []int{gocv.IMWriteJpegQuality, 75})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Close()
+
+	payload, err := ExtractForensic(buf.GetBytes())
+	if err != nil {
+		t.Fatalf("重新压缩和缩放后读取失败：%v", err)
+	}
+	if payload.OrderId != orderId {
+		t.Fatalf("订单号是%d，期望%d", payload.OrderId, orderId)
+	}
+	if payload.TaskIdPrefix != taskId[:forensicTaskIdLen] {
+		t.Fatalf("任务id前缀是%s，期望%s", payload.TaskIdPrefix, taskId[:forensicTaskIdLen])
+	}
+	// 没有水印时一致的比例在0.5左右
+	if payload.Confidence < 0.65 || payload.Confidence > 1 {
+		t.Fatalf("可信度是%v，期望明显高于0.5", payload.Confidence)
+	}
+}
@@ -10,6 +10,7 @@
 package service
 
 import (
+	"encoding/base64"
 	"src/app/dto"
 	"src/app/model"
 	"src/app/service/outApi"
@@ -22,23 +23,29 @@ import (
 /**
  * @description: 证件照换底色
  * @param {*dto.BgColorBody} bg 原图片的信息
+ * @param {*IdPhotoSpec} spec 证件照规格，不为空时按规格裁剪缩放，结果是带DPI的jpg
  * @return {*} 处理好的证件照
  */
-func ChangeBgColor(task *model.ImgTask, color *dto.BRGA) {
+func ChangeBgColor(task *model.ImgTask, color *dto.BRGA, spec *IdPhotoSpec) {
 
-	fg := outApi.PortraitSegmentation(task, "foreground")
-	if task.ErrMsg != "" {
+	if task.Mat = portraitForeground(task); task.ErrMsg != "" {
 		return
 	}
-	go base.OutApiCall(task.ToolId) // 记录api访问次数
-	var err error
-	task.Mat, err = ImgStr2RGB(fg.Foreground)
-	if err != nil {
-		task.Log.Error("证件照换底色失败：", err)
-		task.ErrMsg = g.UnknownErrorMsg
+	defer func() { task.Mat.Close() }() // 裁剪后task.Mat会被替换
+	if spec != nil {
+		if cropIdPhoto(task, spec); task.ErrMsg != "" {
+			return
+		}
+		if color == nil { // 按规格的背景色
+			color = spec.Color
+		}
+		if color == nil {
+			color = idPhotoWhite
+		}
+		task.Suffix = "jpg" // 证件照一般要求jpg
+		cardChangeBackground(task, color, spec.Dpi)
 		return
 	}
-	defer task.Mat.Close()
 	// 如果传入的背景色为空，则不进行换底色操作，直接返回分割结果
 	if color == nil {
 		// 保存原始结果图
@@ -46,14 +53,67 @@ func ChangeBgColor(task *model.ImgTask, color *dto.BRGA) {
 		if GocvSaveImg(task, "result_", -1); task.ErrMsg != "" {
 			return
 		}
-		ImgWatermark(task.Mat) // 给图片添加水印
+		ImgWatermark(task.ToolId, task.Mat) // 给图片添加水印
 		// 保存带水印的结果图
 		if task.ResultPath = GocvSaveImg(task, "water_", 80); task.ErrMsg != "" {
 			return
 		}
 	} else {
-		cardChangeBackground(task, color)
+		cardChangeBackground(task, color, 0)
+	}
+}
+
+/**
+ * @description: 人像分割，得到带透明通道的人像图。按Segmentation.Provider选择：baidu 只用百度接口；local 只用本地分割；
+ * auto（默认）先用百度接口，失败时自动改用本地分割
+ * @param {*model.ImgTask} task
+ * @return {gocv.Mat} 失败时task.ErrMsg不为空
+ */
+func portraitForeground(task *model.ImgTask) gocv.Mat {
+	provider := g.VP.GetString("Segmentation.Provider")
+	if provider != "local" {
+		if imgByte := baiduForeground(task); task.ErrMsg == "" {
+			mat, err := gocv.IMDecode(imgByte, gocv.IMReadUnchanged)
+			if err == nil && mat.Channels() == 4 {
+				return mat
+			}
+			mat.Close()
+			task.Log.Error("解析百度人像分割的结果失败：", err)
+			task.ErrMsg = g.UnknownErrorMsg
+		}
+		if provider == "baidu" {
+			return gocv.NewMat()
+		}
+		task.Log.Warn("百度人像分割失败，改用本地分割", task.ErrMsg)
+		task.ErrMsg = ""
 	}
+	mat, err := LocalPortraitSegmentation(task)
+	if err != nil {
+		task.Log.Error("本地人像分割失败：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+	}
+	return mat
+}
+
+// 百度人像分割的结果，即透明背景的png
+func baiduForeground(task *model.ImgTask) []byte {
+	imgByte := getBaiduCache(task, "foreground") // 换不同的底色都是用同一个人像分割的结果
+	if imgByte != nil {
+		return imgByte
+	}
+	fg := outApi.PortraitSegmentation(task, "foreground")
+	if task.ErrMsg != "" {
+		return nil
+	}
+	go base.OutApiCall(task.ToolId) // 记录api访问次数
+	imgByte, err := base64.StdEncoding.DecodeString(fg.Foreground)
+	if err != nil {
+		task.Log.Error("证件照换底色失败：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+		return nil
+	}
+	setBaiduCache(task, "foreground", imgByte)
+	return imgByte
 }
 
 /**
@@ -62,7 +122,7 @@ func ChangeBgColor(task *model.ImgTask, color *dto.BRGA) {
  * @param {*gocv.Scalar} bgScalar 目的背景色
  * @return {*} 处理后的照片转为base64
  */
-func cardChangeBackground(task *model.ImgTask, color *dto.BRGA) {
+func cardChangeBackground(task *model.ImgTask, color *dto.BRGA, dpi int) {
 	// 转化为float，且把值转化为[0-1]
 	task.Mat.ConvertToWithParams(&task.Mat, gocv.MatTypeCV32FC1, 1.0/255.0, 0)
 	//分通道
@@ -105,11 +165,16 @@ func cardChangeBackground(task *model.ImgTask, color *dto.BRGA) {
 	dMulAB.Close()
 	// 转化为正常的[0-255]图片
 	task.Mat.ConvertToWithParams(&task.Mat, gocv.MatTypeCV8UC1, 255, 0)
-	// 保存原始结果图
-	if GocvSaveImg(task, "result_", -1); task.ErrMsg != "" {
+	// 保存原始结果图，按规格生成的证件照需要写入DPI
+	if dpi > 0 {
+		GocvSaveImgWithDpi(task, "result_", dpi)
+	} else {
+		GocvSaveImg(task, "result_", -1)
+	}
+	if task.ErrMsg != "" {
 		return
 	}
-	ImgWatermark(task.Mat) // 给图片添加水印
+	ImgWatermark(task.ToolId, task.Mat) // 给图片添加水印
 	// 保存带水印的结果图
 	if task.ResultPath = GocvSaveImg(task, "water_", 80); task.ErrMsg != "" {
 		return
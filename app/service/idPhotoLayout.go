@@ -0,0 +1,303 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 02:10:36
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 02:10:36
+ * @Description: 证件照冲印排版，把换底色的结果按规格排到标准相纸上，带裁切线，可以直接拿去冲印机打印
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"src/app/model"
+	g "src/global"
+	myFileUtil "src/utils/file"
+	"src/utils/storage"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	layoutDpi      = 300 // 排版固定按300DPI，冲印机的常用精度
+	layoutMargin   = 12  // 相纸四周留的边，像素，约1mm
+	layoutGap      = 20  // 照片之间的间隔，像素，约1.7mm，方便沿裁切线剪开
+	layoutMaxCount = 64  // 一张相纸最多排的照片数量
+)
+
+// 相纸
+type LayoutPaper struct {
+	Name     string  `json:"name"` // 请求参数layout使用
+	Title    string  `json:"title"`
+	WidthMm  float64 `json:"width_mm"` // 竖放时的宽
+	HeightMm float64 `json:"height_mm"`
+}
+
+// 支持的相纸，排不下时会自动横放再试一次
+var LayoutPapers = []LayoutPaper{
+	{Name: "4R", Title: "6寸(4R)", WidthMm: 101.6, HeightMm: 152.4},
+	{Name: "5R", Title: "7寸(5R)", WidthMm: 127, HeightMm: 177.8},
+	{Name: "A4", Title: "A4", WidthMm: 210, HeightMm: 297},
+}
+
+// 排版的一种规格及数量，同一张相纸可以混排多种规格
+type LayoutItem struct {
+	Spec  string `json:"spec"`
+	Count int    `json:"count"`
+}
+
+/**
+ * @description: 按标识查找相纸
+ * @param {string} name
+ * @return {*LayoutPaper} 不存在时返回nil
+ */
+func GetLayoutPaper(name string) *LayoutPaper {
+	for i := range LayoutPapers {
+		if LayoutPapers[i].Name == name {
+			return &LayoutPapers[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * @description: 校验排版的规格和数量
+ * @param {[]LayoutItem} items
+ * @return {string} 不通过的原因，为空表示通过
+ */
+func CheckLayoutItems(items []LayoutItem) string {
+	if len(items) == 0 {
+		return "请选择排版的规格"
+	}
+	total := 0
+	for _, item := range items {
+		if GetIdPhotoSpec(item.Spec) == nil {
+			return "不支持的证件照规格！"
+		}
+		if item.Count <= 0 {
+			return "排版的数量不正确"
+		}
+		total += item.Count
+	}
+	if total > layoutMaxCount {
+		return fmt.Sprintf("一张相纸最多排%d张", layoutMaxCount)
+	}
+	return ""
+}
+
+// 毫米转为排版精度下的像素
+func mmToLayoutPx(mm float64) int {
+	return int(math.Round(mm / 25.4 * layoutDpi))
+}
+
+/**
+ * @description: 生成冲印排版。读取任务的结果图，按每种规格的尺寸居中裁剪缩放，排到相纸上并画裁切线
+ * @param {*model.ImgTask} task 已经查询过的证件照换底色任务，使用task.Suffix找到结果图
+ * @param {*LayoutPaper} paper 相纸
+ * @param {[]LayoutItem} items 已经通过CheckLayoutItems校验
+ * @param {string} format jpg或pdf
+ * @return {[]byte} 排版好的文件，失败时task.ErrMsg不为空
+ */
+func IdPhotoLayout(task *model.ImgTask, paper *LayoutPaper, items []LayoutItem, format string) []byte {
+	ctx := task.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	key := myFileUtil.GetImgSaveFullPath(task, "result_")
+	if task.ErrMsg != "" {
+		return nil
+	}
+	imgByte, err := storage.ReadAll(ctx, key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			task.Log.Error("读取证件照结果失败：", err)
+		}
+		task.ErrMsg = "文件不存在或已过期"
+		return nil
+	}
+	photo, err := decodeOnWhite(imgByte)
+	if err != nil {
+		task.Log.Error("证件照结果解码失败：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+		return nil
+	}
+	defer photo.Close()
+
+	// 每种规格生成一次照片，按高度从大到小排，同一行的高度相近，省纸
+	var cells []gocv.Mat
+	defer func() {
+		for _, cell := range cells {
+			cell.Close()
+		}
+	}()
+	sizes := make([]image.Point, 0, layoutMaxCount)
+	cellIndex := make([]int, 0, layoutMaxCount)
+	for _, item := range items {
+		spec := GetIdPhotoSpec(item.Spec)
+		size := image.Pt(mmToLayoutPx(spec.WidthMm), mmToLayoutPx(spec.HeightMm))
+		cells = append(cells, fitPhoto(photo, size))
+		for i := 0; i < item.Count; i++ {
+			sizes = append(sizes, size)
+			cellIndex = append(cellIndex, len(cells)-1)
+		}
+	}
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]].Y > sizes[order[j]].Y })
+	sorted := make([]image.Point, len(order))
+	for i, index := range order {
+		sorted[i] = sizes[index]
+	}
+
+	rects, paperSize, ok := layoutOnPaper(sorted, paper)
+	if !ok {
+		task.ErrMsg = "相纸排不下这么多照片，请减少数量或换大一点的相纸"
+		return nil
+	}
+
+	sheet := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), paperSize.Y, paperSize.X, gocv.MatTypeCV8UC3)
+	defer sheet.Close()
+	guideColor := color.RGBA{R: 190, G: 190, B: 190}
+	for i, rect := range rects {
+		region := sheet.Region(rect)
+		cells[cellIndex[order[i]]].CopyTo(&region)
+		region.Close()
+		gocv.Rectangle(&sheet, rect.Inset(-1), guideColor, 1) // 裁切线画在照片外面一个像素，不遮挡照片
+	}
+
+	jpgBuf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, sheet, []int{gocv.IMWriteJpegQuality, 95})
+	if err != nil {
+		task.Log.Error("排版图片编码失败：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+		return nil
+	}
+	defer jpgBuf.Close()
+	jpgByte := SetImageDpi(jpgBuf.GetBytes(), "jpg", layoutDpi)
+	if format == "pdf" {
+		return jpegToPdf(jpgByte, paperSize)
+	}
+	return jpgByte
+}
+
+// 解码结果图，透明的png铺在白底上，灰度图转为3通道
+func decodeOnWhite(imgByte []byte) (gocv.Mat, error) {
+	img, err := gocv.IMDecode(imgByte, gocv.IMReadUnchanged)
+	if err != nil {
+		return img, err
+	}
+	if img.Empty() {
+		return img, errors.New("图片为空")
+	}
+	switch img.Channels() {
+	case 1:
+		gocv.CvtColor(img, &img, gocv.ColorGrayToBGR)
+	case 4:
+		data := img.ToBytes()
+		rows, cols := img.Rows(), img.Cols()
+		img.Close()
+		bgr := make([]byte, rows*cols*3)
+		for i := 0; i < rows*cols; i++ {
+			alpha := int(data[i*4+3])
+			for c := 0; c < 3; c++ {
+				bgr[i*3+c] = byte((int(data[i*4+c])*alpha + 255*(255-alpha)) / 255)
+			}
+		}
+		return matFromBytes(rows, cols, gocv.MatTypeCV8UC3, bgr)
+	}
+	return img, nil
+}
+
+// 按目标的宽高比居中裁剪再缩放到目标大小，结果图已经是该规格时只是缩放
+func fitPhoto(photo gocv.Mat, size image.Point) gocv.Mat {
+	rows, cols := photo.Rows(), photo.Cols()
+	crop := image.Rect(0, 0, cols, rows)
+	if cols*size.Y > rows*size.X { // 原图更宽，裁掉左右
+		width := rows * size.X / size.Y
+		crop = image.Rect((cols-width)/2, 0, (cols-width)/2+width, rows)
+	} else { // 原图更高，裁掉下面，头部在上面
+		crop = image.Rect(0, 0, cols, cols*size.Y/size.X)
+	}
+	region := photo.Region(crop)
+	defer region.Close()
+	cell := gocv.NewMat()
+	gocv.Resize(region, &cell, size, 0, 0, gocv.InterpolationArea)
+	return cell
+}
+
+// 先竖放，排不下再横放。返回每张照片的位置和相纸的像素大小，横放时宽高互换
+func layoutOnPaper(sizes []image.Point, paper *LayoutPaper) ([]image.Rectangle, image.Point, bool) {
+	paperSize := image.Pt(mmToLayoutPx(paper.WidthMm), mmToLayoutPx(paper.HeightMm))
+	if rects, ok := shelfLayout(sizes, paperSize); ok {
+		return rects, paperSize, true
+	}
+	paperSize = image.Pt(paperSize.Y, paperSize.X)
+	rects, ok := shelfLayout(sizes, paperSize)
+	return rects, paperSize, ok
+}
+
+// 按行排列：一行放不下就换行，整体在相纸上居中。排不下时返回false
+func shelfLayout(sizes []image.Point, paperSize image.Point) ([]image.Rectangle, bool) {
+	rects := make([]image.Rectangle, 0, len(sizes))
+	maxWidth := paperSize.X - 2*layoutMargin
+	x, y, rowHeight, usedWidth := 0, 0, 0, 0
+	for _, size := range sizes {
+		if x > 0 && x+size.X > maxWidth { // 换行
+			x, y, rowHeight = 0, y+rowHeight+layoutGap, 0
+		}
+		if x+size.X > maxWidth || y+size.Y > paperSize.Y-2*layoutMargin {
+			return nil, false
+		}
+		rects = append(rects, image.Rect(x, y, x+size.X, y+size.Y))
+		x += size.X + layoutGap
+		rowHeight = max(rowHeight, size.Y)
+		usedWidth = max(usedWidth, x-layoutGap)
+	}
+	offset := image.Pt((paperSize.X-usedWidth)/2, (paperSize.Y-y-rowHeight)/2)
+	for i := range rects {
+		rects[i] = rects[i].Add(offset)
+	}
+	return rects, true
+}
+
+// 把一张jpg包装成单页的pdf，页面大小按DPI换算成实际尺寸，图片不重新编码
+func jpegToPdf(jpgByte []byte, sizePx image.Point) []byte {
+	widthPt := float64(sizePx.X) / layoutDpi * 72
+	heightPt := float64(sizePx.Y) / layoutDpi * 72
+	content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", widthPt, heightPt)
+
+	var pdf bytes.Buffer
+	offsets := make([]int, 0, 5)
+	pdf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	writeObj := func(body string, stream []byte) {
+		offsets = append(offsets, pdf.Len())
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			pdf.WriteString("stream\n")
+			pdf.Write(stream)
+			pdf.WriteString("\nendstream\n")
+		}
+		pdf.WriteString("endobj\n")
+	}
+	writeObj("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	writeObj("<< /Type /Pages /Kids [3 0 R] /Count 1 >>", nil)
+	writeObj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 4 0 R >> >> /Contents 5 0 R >>", widthPt, heightPt), nil)
+	writeObj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>", sizePx.X, sizePx.Y, len(jpgByte)), jpgByte)
+	writeObj(fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content))
+
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return pdf.Bytes()
+}
@@ -0,0 +1,162 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 19:03:52
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 19:03:52
+ * @Description: 证件照冲印排版的测试：相纸上的排列、横放的回退、排不下的情况、参数校验和pdf的结构
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// 按规格生成排版的尺寸，和IdPhotoLayout一样高的排在前面，调用时按这个顺序传
+func testLayoutSizes(t *testing.T, items ...LayoutItem) []image.Point {
+	var sizes []image.Point
+	for _, item := range items {
+		spec := GetIdPhotoSpec(item.Spec)
+		if spec == nil {
+			t.Fatalf("规格%s不存在", item.Spec)
+		}
+		for i := 0; i < item.Count; i++ {
+			sizes = append(sizes, image.Pt(mmToLayoutPx(spec.WidthMm), mmToLayoutPx(spec.HeightMm)))
+		}
+	}
+	return sizes
+}
+
+// 每张照片的大小不变，都在相纸的边距以内，互相之间至少隔开layoutGap
+func checkLayoutRects(t *testing.T, sizes []image.Point, rects []image.Rectangle, paperSize image.Point) {
+	t.Helper()
+	if len(rects) != len(sizes) {
+		t.Fatalf("排了%d张，期望%d张", len(rects), len(sizes))
+	}
+	inner := image.Rect(layoutMargin, layoutMargin, paperSize.X-layoutMargin, paperSize.Y-layoutMargin)
+	for i, rect := range rects {
+		if rect.Size() != sizes[i] {
+			t.Fatalf("第%d张的大小是%v，期望%v", i+1, rect.Size(), sizes[i])
+		}
+		if !rect.In(inner) {
+			t.Fatalf("第%d张%v超出了相纸的边距%v", i+1, rect, inner)
+		}
+		for j := i + 1; j < len(rects); j++ {
+			if rect.Inset(-layoutGap).Overlaps(rects[j]) {
+				t.Fatalf("第%d张%v和第%d张%v的间隔小于%d", i+1, rect, j+1, rects[j], layoutGap)
+			}
+		}
+	}
+}
+
+func TestLayoutOnPaper(t *testing.T) {
+	paper := GetLayoutPaper("4R")
+	portrait, landscape := image.Pt(1200, 1800), image.Pt(1800, 1200)
+	tests := []struct {
+		name      string
+		items     []LayoutItem
+		paperSize image.Point
+		first     image.Point // 第一张的左上角，整体居中
+	}{
+		// 一寸295*413，一行3张，排3行
+		{"8张一寸", []LayoutItem{{Spec: "one_inch", Count: 8}}, portrait, image.Pt(137, 260)},
+		// 二寸413*579，一行2张，排2行
+		{"4张二寸", []LayoutItem{{Spec: "two_inch", Count: 4}}, portrait, image.Pt(177, 311)},
+		// 竖放时第3行只能放3张一寸，第4行超出高度；横放时4张二寸一行，5张一寸一行
+		{"竖放排不下时横放", []LayoutItem{{Spec: "two_inch", Count: 4}, {Spec: "one_inch", Count: 5}}, landscape, image.Pt(44, 94)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := testLayoutSizes(t, tt.items...)
+			rects, paperSize, ok := layoutOnPaper(sizes, paper)
+			if !ok {
+				t.Fatal("应该排得下")
+			}
+			if paperSize != tt.paperSize {
+				t.Fatalf("相纸的大小是%v，期望%v", paperSize, tt.paperSize)
+			}
+			checkLayoutRects(t, sizes, rects, paperSize)
+			if rects[0].Min != tt.first {
+				t.Fatalf("第一张的位置是%v，期望%v", rects[0].Min, tt.first)
+			}
+		})
+	}
+
+	// 8张一寸加4张二寸，竖放和横放都排不下
+	sizes := testLayoutSizes(t, LayoutItem{Spec: "two_inch", Count: 4}, LayoutItem{Spec: "one_inch", Count: 8})
+	if _, _, ok := layoutOnPaper(sizes, paper); ok {
+		t.Fatal("6寸相纸排不下8张一寸加4张二寸")
+	}
+	if _, ok := shelfLayout(testLayoutSizes(t, LayoutItem{Spec: "us_visa", Count: 1}), image.Pt(500, 500)); ok {
+		t.Fatal("比相纸还宽的照片应该排不下")
+	}
+	// 换成A4就排得下
+	rects, paperSize, ok := layoutOnPaper(sizes, GetLayoutPaper("A4"))
+	if !ok {
+		t.Fatal("A4应该排得下")
+	}
+	checkLayoutRects(t, sizes, rects, paperSize)
+}
+
+func TestCheckLayoutItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []LayoutItem
+		want  string
+	}{
+		{"通过", []LayoutItem{{Spec: "one_inch", Count: 8}, {Spec: "two_inch", Count: 2}}, ""},
+		{"没有规格", nil, "请选择排版的规格"},
+		{"规格不存在", []LayoutItem{{Spec: "one_inch", Count: 1}, {Spec: "three_inch", Count: 1}}, "不支持的证件照规格！"},
+		{"数量为0", []LayoutItem{{Spec: "one_inch", Count: 0}}, "排版的数量不正确"},
+		{"数量为负", []LayoutItem{{Spec: "one_inch", Count: -1}}, "排版的数量不正确"},
+		{"总数刚好是上限", []LayoutItem{{Spec: "one_inch", Count: layoutMaxCount - 1}, {Spec: "two_inch", Count: 1}}, ""},
+		{"总数超过上限", []LayoutItem{{Spec: "one_inch", Count: layoutMaxCount}, {Spec: "two_inch", Count: 1}}, fmt.Sprintf("一张相纸最多排%d张", layoutMaxCount)},
+	}
+	for _, tt := range tests {
+		if got := CheckLayoutItems(tt.items); got != tt.want {
+			t.Errorf("%s：返回%q，期望%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// xref里每个对象的偏移都指向对应的"n 0 obj"，startxref指向xref，图片数据原样放在流里
+func TestJpegToPdf(t *testing.T) {
+	jpgByte := testJpeg(testJfif(), testJpegSegment(0xDB, make([]byte, 65)))
+	pdf := jpegToPdf(jpgByte, image.Pt(1200, 1800))
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("pdf的开头或结尾不对")
+	}
+	match := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if match == nil {
+		t.Fatal("没有startxref")
+	}
+	xref, _ := strconv.Atoi(string(match[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n0 6\n0000000000 65535 f \n")) {
+		t.Fatalf("startxref指向的不是xref：%q", pdf[xref:min(len(pdf), xref+30)])
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(pdf[xref:], -1)
+	if len(entries) != 5 {
+		t.Fatalf("xref里有%d个对象，期望5个", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Fatalf("第%d个对象的偏移%d指向%q", i+1, offset, pdf[offset:min(len(pdf), offset+10)])
+		}
+	}
+	if !bytes.Contains(pdf, []byte("/MediaBox [0 0 288.00 432.00]")) {
+		t.Fatal("6寸相纸的页面大小应该是288*432pt")
+	}
+	stream := fmt.Sprintf("/Length %d >>\nstream\n", len(jpgByte))
+	if !bytes.Contains(pdf, append([]byte(stream), append(jpgByte, []byte("\nendstream\n")...)...)) {
+		t.Fatal("图片数据没有原样写入")
+	}
+	if !bytes.Contains(pdf, []byte("trailer\n<< /Size 6 /Root 1 0 R >>")) {
+		t.Fatal("trailer不对")
+	}
+}
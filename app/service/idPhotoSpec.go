@@ -0,0 +1,166 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 01:32:10
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 01:32:10
+ * @Description: 证件照的标准规格，以及按规格根据人脸位置自动裁剪缩放
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"src/app/dto"
+	"src/app/model"
+
+	"gocv.io/x/gocv"
+)
+
+// 证件照的规格
+type IdPhotoSpec struct {
+	Name      string    `json:"name"`  // 规格的标识，请求参数spec使用
+	Title     string    `json:"title"` // 显示的名称
+	WidthPx   int       `json:"width_px"`
+	HeightPx  int       `json:"height_px"`
+	WidthMm   float64   `json:"width_mm"`
+	HeightMm  float64   `json:"height_mm"`
+	Dpi       int       `json:"dpi"`
+	HeadRatio float64   `json:"head_ratio"` // 头顶到下巴的高度占照片高度的比例
+	TopRatio  float64   `json:"top_ratio"`  // 头顶到照片上边的距离占照片高度的比例
+	Color     *dto.BRGA `json:"color"`      // 规定的背景色，请求没有传color时使用，为空表示没有规定，默认白色
+}
+
+var (
+	idPhotoWhite = &dto.BRGA{B: 255, G: 255, R: 255, A: 255}
+	idPhotoBlue  = &dto.BRGA{B: 219, G: 142, R: 67, A: 255}
+)
+
+// 支持的证件照规格，按常用程度排序，前端按这个顺序展示
+var IdPhotoSpecs = []IdPhotoSpec{
+	{Name: "one_inch", Title: "一寸", WidthPx: 295, HeightPx: 413, WidthMm: 25, HeightMm: 35, Dpi: 300, HeadRatio: 0.6, TopRatio: 0.09},
+	{Name: "two_inch", Title: "二寸", WidthPx: 413, HeightPx: 579, WidthMm: 35, HeightMm: 49, Dpi: 300, HeadRatio: 0.58, TopRatio: 0.09},
+	{Name: "small_one_inch", Title: "小一寸", WidthPx: 260, HeightPx: 378, WidthMm: 22, HeightMm: 32, Dpi: 300, HeadRatio: 0.6, TopRatio: 0.09},
+	{Name: "small_two_inch", Title: "小二寸", WidthPx: 413, HeightPx: 531, WidthMm: 35, HeightMm: 45, Dpi: 300, HeadRatio: 0.62, TopRatio: 0.08},
+	{Name: "passport", Title: "护照", WidthPx: 390, HeightPx: 567, WidthMm: 33, HeightMm: 48, Dpi: 300, HeadRatio: 0.64, TopRatio: 0.08, Color: idPhotoWhite},
+	{Name: "id_card", Title: "居民身份证", WidthPx: 358, HeightPx: 441, WidthMm: 26, HeightMm: 32, Dpi: 350, HeadRatio: 0.64, TopRatio: 0.08, Color: idPhotoWhite},
+	{Name: "us_visa", Title: "美国签证", WidthPx: 600, HeightPx: 600, WidthMm: 51, HeightMm: 51, Dpi: 300, HeadRatio: 0.6, TopRatio: 0.12, Color: idPhotoWhite},
+	{Name: "schengen_visa", Title: "申根签证", WidthPx: 413, HeightPx: 531, WidthMm: 35, HeightMm: 45, Dpi: 300, HeadRatio: 0.75, TopRatio: 0.06, Color: idPhotoWhite},
+	{Name: "driver_license", Title: "驾驶证", WidthPx: 260, HeightPx: 378, WidthMm: 22, HeightMm: 32, Dpi: 300, HeadRatio: 0.6, TopRatio: 0.09, Color: idPhotoWhite},
+	{Name: "exam", Title: "考试报名", WidthPx: 295, HeightPx: 413, WidthMm: 25, HeightMm: 35, Dpi: 300, HeadRatio: 0.6, TopRatio: 0.09, Color: idPhotoBlue},
+}
+
+/**
+ * @description: 按标识查找证件照规格
+ * @param {string} name
+ * @return {*IdPhotoSpec} 不存在时返回nil
+ */
+func GetIdPhotoSpec(name string) *IdPhotoSpec {
+	for i := range IdPhotoSpecs {
+		if IdPhotoSpecs[i].Name == name {
+			return &IdPhotoSpecs[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * @description: 按规格裁剪缩放带透明通道的人像图。人脸检测确定人脸的位置和下巴，透明通道确定头顶，
+ * 缩放到头部高度符合规格，再按头顶的边距裁剪，超出原图的部分是透明的，后面换底色时填充背景色
+ * @param {*model.ImgTask} task task.Mat是BGRA的人像图，裁剪后替换
+ * @param {*IdPhotoSpec} spec
+ * @return {*}
+ */
+func cropIdPhoto(task *model.ImgTask, spec *IdPhotoSpec) {
+	headTop, chin, centerX, err := locateHead(task)
+	if err == nil && chin <= headTop {
+		err = errors.New("头部的高度为0")
+	}
+	if err != nil {
+		task.Log.Error("证件照裁剪失败：", err)
+		task.ErrMsg = "没有识别到人像，请上传正面的人像照片"
+		return
+	}
+	width, height := float64(spec.WidthPx), float64(spec.HeightPx)
+	scale := spec.HeadRatio * height / float64(chin-headTop)
+	left := float64(centerX) - width/2/scale
+	top := float64(headTop) - spec.TopRatio*height/scale
+
+	// 仿射变换：先平移到裁剪的左上角，再缩放
+	transform := gocv.NewMatWithSize(2, 3, gocv.MatTypeCV64F)
+	defer transform.Close()
+	transform.SetDoubleAt(0, 0, scale)
+	transform.SetDoubleAt(0, 1, 0)
+	transform.SetDoubleAt(0, 2, -left*scale)
+	transform.SetDoubleAt(1, 0, 0)
+	transform.SetDoubleAt(1, 1, scale)
+	transform.SetDoubleAt(1, 2, -top*scale)
+	cropped := gocv.NewMat()
+	gocv.WarpAffineWithParams(task.Mat, &cropped, transform, image.Pt(spec.WidthPx, spec.HeightPx), gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	task.Mat.Close()
+	task.Mat = cropped
+}
+
+// 定位头部：头顶的行、下巴的行、脸中心的列
+func locateHead(task *model.ImgTask) (headTop int, chin int, centerX int, err error) {
+	if task.Mat.Channels() != 4 {
+		return 0, 0, 0, errors.New("人像图没有透明通道")
+	}
+	rows, cols := task.Mat.Rows(), task.Mat.Cols()
+	channels := gocv.Split(task.Mat)
+	alpha := channels[3].ToBytes()
+	for _, channel := range channels {
+		channel.Close()
+	}
+	opaque := func(x, y int) bool { return alpha[y*cols+x] > 128 }
+
+	bgr := gocv.NewMat()
+	defer bgr.Close()
+	gocv.CvtColor(task.Mat, &bgr, gocv.ColorBGRAToBGR)
+	face, found := detectFace(bgr)
+	if !found {
+		// 没有人脸检测时，按人像的轮廓估计：头顶是最上面的不透明像素，头部的高度按上半身照片的常见比例估计
+		task.Log.Warn("证件照裁剪没有检测到人脸，按人像轮廓估计", nil)
+		headTop = -1
+		for y := 0; y < rows && headTop < 0; y++ {
+			for x := 0; x < cols; x++ {
+				if opaque(x, y) {
+					headTop = y
+					break
+				}
+			}
+		}
+		if headTop < 0 {
+			return 0, 0, 0, errors.New("人像图全部透明")
+		}
+		chin = headTop + (rows-headTop)*9/20
+		// 头部区域不透明像素的平均列作为中心
+		var sum, count int
+		for y := headTop; y < chin; y++ {
+			for x := 0; x < cols; x++ {
+				if opaque(x, y) {
+					sum, count = sum+x, count+1
+				}
+			}
+		}
+		if count == 0 {
+			return 0, 0, 0, errors.New("人像太小")
+		}
+		return headTop, chin, sum / count, nil
+	}
+
+	// 人脸框的下边大约在嘴和下巴之间，往下补一点
+	chin = min(face.Max.Y+face.Dy()/10, rows)
+	centerX = (face.Min.X + face.Max.X) / 2
+	// 在人脸的列范围内从上往下找第一个不透明的像素作为头顶，头发被分割掉时用人脸框估计
+	headTop = max(face.Min.Y-face.Dy()/3, 0)
+	for y := 0; y < face.Min.Y; y++ {
+		for x := face.Min.X; x < face.Max.X; x++ {
+			if opaque(x, y) {
+				return y, chin, centerX, nil
+			}
+		}
+	}
+	return headTop, chin, centerX, nil
+}
@@ -0,0 +1,36 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 20:41:19
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 20:41:19
+ * @Description: 图像格式转换的实现
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"src/app/model"
+
+	"gocv.io/x/gocv"
+)
+
+/**
+ * @description: 基于 gocv 实现图片格式转换，task.Suffix为目标格式，保存结果图和水印图
+ * @param {*model.ImgTask} task
+ * @return {*}
+ */
+func ImgConvers(task *model.ImgTask) {
+	var err error
+	task.Mat, err = gocv.IMDecode(task.ImgByte, gocv.IMReadUnchanged)
+	if err != nil {
+		task.Log.Error("解析图片失败：", err)
+		task.ErrMsg = "解析图片失败"
+		return
+	}
+	defer task.Mat.Close()
+	if GocvSaveImg(task, "result_", -1); task.ErrMsg != "" {
+		return
+	}
+	ImgWatermark(task.ToolId, task.Mat)
+	task.ResultPath = GocvSaveImg(task, "water_", -1)
+}
@@ -0,0 +1,153 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 01:46:22
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 01:46:22
+ * @Description: 给jpg和png写入DPI信息。OpenCV保存的图片不带DPI，证件照和冲印排版需要按实际尺寸打印。
+ * webp的格式里没有DPI，上传图片的DPI不会带到webp结果里
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"src/app/model"
+	g "src/global"
+	myFileUtil "src/utils/file"
+
+	"gocv.io/x/gocv"
+)
+
+/**
+ * @description: 把task.Mat按task.Suffix编码，写入DPI后保存，只支持jpg和png，其他格式不写DPI
+ * @param {*model.ImgTask} task
+ * @param {string} fileNamePrefix
+ * @param {int} dpi
+ * @return {string} 保存的路径
+ */
+func GocvSaveImgWithDpi(task *model.ImgTask, fileNamePrefix string, dpi int) string {
+	var imgBuf *gocv.NativeByteBuffer
+	var err error
+	switch task.Suffix {
+	case "jpg":
+		imgBuf, err = gocv.IMEncodeWithParams(gocv.JPEGFileExt, task.Mat, []int{gocv.IMWriteJpegQuality, 95})
+	case "png":
+		imgBuf, err = gocv.IMEncode(gocv.PNGFileExt, task.Mat)
+	default:
+		return GocvSaveImg(task, fileNamePrefix, -1)
+	}
+	if err != nil {
+		task.Log.Error("图片编码失败：", err)
+		task.ErrMsg = g.UnknownErrorMsg
+		return ""
+	}
+	defer imgBuf.Close()
+	return myFileUtil.SaveImg(task, copyImageMeta(task.ImgByte, SetImageDpi(imgBuf.GetBytes(), task.Suffix, dpi)), fileNamePrefix)
+}
+
+/**
+ * @description: 写入DPI，jpg修改或插入JFIF头，png替换或插入pHYs块。webp没有DPI字段，和不认识的格式一样原样返回
+ * @param {[]byte} fileByte
+ * @param {string} suffix
+ * @param {int} dpi
+ * @return {[]byte}
+ */
+func SetImageDpi(fileByte []byte, suffix string, dpi int) []byte {
+	switch suffix {
+	case "jpg", "jpeg":
+		return setJpegDpi(fileByte, dpi)
+	case "png":
+		return setPngDpi(fileByte, dpi)
+	}
+	return fileByte
+}
+
+/**
+ * @description: 读取jpg的JFIF头或png的pHYs块里的DPI，重新编码前读取，编码后再写回去
+ * @param {[]byte} fileByte
+ * @param {string} suffix
+ * @return {int} 没有DPI信息或单位不是英寸、米时返回0，webp总是返回0
+ */
+func GetImageDpi(fileByte []byte, suffix string) int {
+	switch suffix {
+	case "jpg", "jpeg":
+		if len(fileByte) >= 18 && fileByte[2] == 0xFF && fileByte[3] == 0xE0 && bytes.Equal(fileByte[6:11], []byte("JFIF\x00")) && fileByte[13] == 1 {
+			return int(binary.BigEndian.Uint16(fileByte[14:16]))
+		}
+	case "png":
+		for pos := 8; pos+12 <= len(fileByte); {
+			length := int(binary.BigEndian.Uint32(fileByte[pos : pos+4]))
+			chunkType := string(fileByte[pos+4 : pos+8])
+			if chunkType == "IDAT" || pos+12+length > len(fileByte) { // pHYs只会在IDAT之前
+				break
+			}
+			if chunkType == "pHYs" && length == 9 && fileByte[pos+16] == 1 {
+				return int(float64(binary.BigEndian.Uint32(fileByte[pos+8:pos+12]))*0.0254 + 0.5)
+			}
+			pos += 12 + length
+		}
+	}
+	return 0
+}
+
+// jpg的DPI在JFIF头(APP0)里：单位1表示每英寸，后面是横向和纵向的密度
+func setJpegDpi(fileByte []byte, dpi int) []byte {
+	if jpegEachSegment(fileByte, func(byte, []byte) {}) < 0 { // 找不到SOS，文件不完整
+		return fileByte
+	}
+	if len(fileByte) >= 18 && fileByte[2] == 0xFF && fileByte[3] == 0xE0 && bytes.Equal(fileByte[6:11], []byte("JFIF\x00")) {
+		result := bytes.Clone(fileByte)
+		result[13] = 1
+		binary.BigEndian.PutUint16(result[14:16], uint16(dpi))
+		binary.BigEndian.PutUint16(result[16:18], uint16(dpi))
+		return result
+	}
+	// 没有JFIF头，在SOI后面插入一个
+	app0 := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(app0[12:14], uint16(dpi))
+	binary.BigEndian.PutUint16(app0[14:16], uint16(dpi))
+	result := make([]byte, 0, len(fileByte)+len(app0))
+	result = append(result, fileByte[:2]...)
+	result = append(result, app0...)
+	return append(result, fileByte[2:]...)
+}
+
+// png的DPI在pHYs块里，单位是每米的像素数。pHYs必须在IDAT之前，这里放在IHDR后面
+func setPngDpi(fileByte []byte, dpi int) []byte {
+	const signatureLen = 8
+	if len(fileByte) < signatureLen+25 || string(fileByte[1:4]) != "PNG" {
+		return fileByte
+	}
+	data := make([]byte, 9)
+	ppm := uint32(float64(dpi)/0.0254 + 0.5)
+	binary.BigEndian.PutUint32(data[0:4], ppm)
+	binary.BigEndian.PutUint32(data[4:8], ppm)
+	data[8] = 1 // 单位：米
+	phys := pngChunk("pHYs", data)
+
+	result := make([]byte, 0, len(fileByte)+len(phys))
+	result = append(result, fileByte[:signatureLen]...)
+	complete := pngEachChunk(fileByte, func(chunkType string, chunk []byte) {
+		if chunkType != "pHYs" { // 原来的pHYs去掉
+			result = append(result, chunk...)
+		}
+		if chunkType == "IHDR" {
+			result = append(result, phys...)
+		}
+	})
+	if !complete { // 文件不完整时原样返回
+		return fileByte
+	}
+	return result
+}
+
+// 生成一个png块：长度、类型、数据、类型和数据的crc
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(data)))
+	copy(chunk[4:8], chunkType)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
@@ -0,0 +1,577 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 04:42:17
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 04:42:17
+ * @Description: 图片的元数据。上传时先按EXIF的方向把图片转正，再去掉EXIF、XMP、文本等可能带GPS和设备信息的部分，
+ * 保留DPI，要求时保留ICC色彩配置文件；保存结果时把上传图片的DPI和ICC写回去。支持jpg、png和webp，其他格式原样返回
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"slices"
+	"src/app/model"
+	g "src/global"
+
+	"gocv.io/x/gocv"
+)
+
+var (
+	jpegIccPrefix  = []byte("ICC_PROFILE\x00") // jpg的APP2里ICC的标识
+	jpegExifPrefix = []byte("Exif\x00\x00")    // jpg的APP1里EXIF的标识
+)
+
+const jpegIccChunkSize = 65533 - 14 // jpg一个APP2段能放的ICC数据，段长度最大65535，减去长度、标识、序号和总数
+
+/**
+ * @description: 上传图片的元数据处理，在CheckImage里调用。处理失败时返回原图，不影响使用
+ * @param {*model.ImgTask} task
+ * @param {[]byte} imgByte 上传的图片
+ * @param {string} suffix 识别出来的格式
+ * @return {[]byte} 转正并去掉隐私信息后的图片
+ */
+func NormalizeUpload(task *model.ImgTask, imgByte []byte, suffix string) []byte {
+	format := imageFormat(imgByte)
+	if format == "" {
+		return imgByte
+	}
+	orientation, exifDpi := parseExif(imageExif(imgByte, format))
+	dpi := GetImageDpi(imgByte, format)
+	if dpi == 0 {
+		dpi = exifDpi // 手机拍的照片一般没有JFIF头，DPI在EXIF里
+	}
+	result := stripMetadata(imgByte, format, keepIcc(task))
+	if dpi > 0 {
+		result = SetImageDpi(result, format, dpi)
+	}
+	if orientation > 1 && orientation <= 8 {
+		rotated, err := applyOrientation(result, format, orientation)
+		if err != nil {
+			task.Log.Warn("按EXIF的方向转正图片失败："+suffix, err.Error())
+			return result
+		}
+		result = rotated
+	}
+	return result
+}
+
+// 是否保留ICC，默认去掉，配置Metadata.KeepIcc或者上传时传keepIcc=true才保留
+func keepIcc(task *model.ImgTask) bool {
+	return g.VP.GetBool("Metadata.KeepIcc") || (task.C != nil && task.C.PostForm("keepIcc") == "true")
+}
+
+/**
+ * @description: 把src的DPI和ICC写入重新编码后的dst，dst已经有的不覆盖，比如证件照规格的DPI
+ * @param {[]byte} src 上传的图片，已经经过NormalizeUpload
+ * @param {[]byte} dst 结果图
+ * @return {[]byte}
+ */
+func copyImageMeta(src []byte, dst []byte) []byte {
+	srcFormat, dstFormat := imageFormat(src), imageFormat(dst)
+	if srcFormat == "" || dstFormat == "" {
+		return dst
+	}
+	if dpi := GetImageDpi(src, srcFormat); dpi > 0 && GetImageDpi(dst, dstFormat) == 0 {
+		dst = SetImageDpi(dst, dstFormat, dpi)
+	}
+	if icc := imageIcc(src, srcFormat); icc != nil && imageIcc(dst, dstFormat) == nil {
+		dst = setImageIcc(dst, dstFormat, icc)
+	}
+	return dst
+}
+
+// 按文件头判断格式，只认识jpg、png和webp
+func imageFormat(imgByte []byte) string {
+	switch {
+	case len(imgByte) >= 3 && imgByte[0] == 0xFF && imgByte[1] == 0xD8 && imgByte[2] == 0xFF:
+		return "jpg"
+	case len(imgByte) >= 8 && string(imgByte[:8]) == "\x89PNG\r\n\x1a\n":
+		return "png"
+	case len(imgByte) >= 16 && string(imgByte[:4]) == "RIFF" && string(imgByte[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+/**
+ * @description: 解析EXIF的IFD0，读取方向和DPI
+ * @param {[]byte} tiff EXIF的数据，TIFF格式
+ * @return {int} 方向，1~8，没有时为0
+ * @return {int} DPI，没有时为0
+ */
+func parseExif(tiff []byte) (orientation int, dpi int) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return
+	}
+	var resolution float64
+	unit := 2 // 默认单位是英寸
+	for i := 0; i < int(order.Uint16(tiff[ifd:])); i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		value := tiff[entry+8 : entry+12]
+		switch order.Uint16(tiff[entry:]) {
+		case 0x0112: // Orientation
+			orientation = int(order.Uint16(value))
+		case 0x0128: // ResolutionUnit，2是英寸，3是厘米
+			unit = int(order.Uint16(value))
+		case 0x011A: // XResolution，分数，值里保存的是偏移
+			if offset := int(order.Uint32(value)); offset+8 <= len(tiff) && order.Uint32(tiff[offset+4:]) > 0 {
+				resolution = float64(order.Uint32(tiff[offset:])) / float64(order.Uint32(tiff[offset+4:]))
+			}
+		}
+	}
+	switch unit {
+	case 2:
+		dpi = int(resolution + 0.5)
+	case 3:
+		dpi = int(resolution*2.54 + 0.5)
+	}
+	return
+}
+
+// 按EXIF的方向转正，重新编码后写回DPI和ICC
+func applyOrientation(imgByte []byte, format string, orientation int) ([]byte, error) {
+	img, err := gocv.IMDecode(imgByte, gocv.IMReadUnchanged) // IMReadUnchanged不会处理EXIF的方向
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	rotated := gocv.NewMat() // 转置和旋转后宽高会变，不能原地处理
+	defer rotated.Close()
+	switch orientation {
+	case 2:
+		gocv.Flip(img, &rotated, 1)
+	case 3:
+		gocv.Rotate(img, &rotated, gocv.Rotate180Clockwise)
+	case 4:
+		gocv.Flip(img, &rotated, 0)
+	case 5:
+		gocv.Transpose(img, &rotated)
+	case 6:
+		gocv.Rotate(img, &rotated, gocv.Rotate90Clockwise)
+	case 7:
+		gocv.Transpose(img, &rotated)
+		gocv.Flip(rotated, &rotated, -1)
+	case 8:
+		gocv.Rotate(img, &rotated, gocv.Rotate90CounterClockwise)
+	}
+	var buf *gocv.NativeByteBuffer
+	switch format {
+	case "jpg":
+		buf, err = gocv.IMEncodeWithParams(gocv.JPEGFileExt, rotated, []int{gocv.IMWriteJpegQuality, 95})
+	case "webp":
+		quality := 95
+		if webpChunk(imgByte, "VP8L") != nil { // 原图是无损的
+			quality = webpLosslessQuality
+		}
+		buf, err = gocv.IMEncodeWithParams(".webp", rotated, []int{gocv.IMWriteWebpQuality, quality})
+	default:
+		buf, err = gocv.IMEncode(gocv.PNGFileExt, rotated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return copyImageMeta(imgByte, bytes.Clone(buf.GetBytes())), nil
+}
+
+// 读取EXIF的TIFF数据，没有时返回nil
+func imageExif(imgByte []byte, format string) []byte {
+	var exif []byte
+	switch format {
+	case "jpg":
+		jpegEachSegment(imgByte, func(marker byte, segment []byte) {
+			if marker == 0xE1 && exif == nil && bytes.HasPrefix(segment[4:], jpegExifPrefix) {
+				exif = segment[4+len(jpegExifPrefix):]
+			}
+		})
+	case "png":
+		exif = pngChunkData(imgByte, "eXIf")
+	case "webp":
+		exif = bytes.TrimPrefix(webpChunk(imgByte, "EXIF"), jpegExifPrefix) // 有的软件会带上jpg里的标识
+	}
+	return exif
+}
+
+// 去掉隐私信息：jpg只保留JFIF和Adobe的APP段，png去掉eXIf和文本块，webp去掉EXIF和XMP块。keepIcc为false时ICC也去掉
+func stripMetadata(imgByte []byte, format string, keepIcc bool) []byte {
+	if imageFormat(imgByte) != format { // 文件头不完整
+		return imgByte
+	}
+	switch format {
+	case "jpg":
+		result := []byte{0xFF, 0xD8}
+		sos := jpegEachSegment(imgByte, func(marker byte, segment []byte) {
+			switch {
+			case marker == 0xE0 || marker == 0xEE: // JFIF里有DPI，Adobe的APP14决定颜色怎么解码
+			case marker == 0xE2 && keepIcc && bytes.HasPrefix(segment[4:], jpegIccPrefix):
+			case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE: // 其他APP段和注释
+				return
+			}
+			result = append(result, segment...)
+		})
+		if sos < 0 {
+			return imgByte
+		}
+		return append(result, imgByte[sos:]...)
+	case "png":
+		result := bytes.Clone(imgByte[:8])
+		complete := pngEachChunk(imgByte, func(chunkType string, chunk []byte) {
+			switch chunkType {
+			case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+				return
+			case "iCCP":
+				if !keepIcc {
+					return
+				}
+			}
+			result = append(result, chunk...)
+		})
+		if !complete {
+			return imgByte
+		}
+		return result
+	case "webp":
+		remove := []string{"EXIF", "XMP "}
+		if !keepIcc {
+			remove = append(remove, "ICCP")
+		}
+		return webpRemoveChunks(imgByte, remove)
+	}
+	return imgByte
+}
+
+// 读取ICC色彩配置文件，没有时返回nil
+func imageIcc(imgByte []byte, format string) []byte {
+	switch format {
+	case "jpg":
+		// ICC可能分成多个APP2段，按序号拼起来
+		var chunks [][]byte
+		jpegEachSegment(imgByte, func(marker byte, segment []byte) {
+			if marker == 0xE2 && len(segment) > 4+len(jpegIccPrefix)+2 && bytes.HasPrefix(segment[4:], jpegIccPrefix) {
+				chunks = append(chunks, segment[4+len(jpegIccPrefix):])
+			}
+		})
+		if len(chunks) == 0 {
+			return nil
+		}
+		slices.SortStableFunc(chunks, func(a, b []byte) int { return int(a[0]) - int(b[0]) })
+		var icc []byte
+		for _, chunk := range chunks {
+			icc = append(icc, chunk[2:]...)
+		}
+		return icc
+	case "png":
+		// iCCP：名称、0、压缩方式、zlib压缩的数据
+		data := pngChunkData(imgByte, "iCCP")
+		nameEnd := bytes.IndexByte(data, 0)
+		if nameEnd < 0 || nameEnd+2 > len(data) {
+			return nil
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(data[nameEnd+2:]))
+		if err != nil {
+			return nil
+		}
+		defer reader.Close()
+		icc, err := io.ReadAll(reader)
+		if err != nil {
+			return nil
+		}
+		return icc
+	case "webp":
+		return webpChunk(imgByte, "ICCP")
+	}
+	return nil
+}
+
+// 写入ICC，jpg放在JFIF头后面，png放在IHDR后面，webp放在VP8X后面
+func setImageIcc(imgByte []byte, format string, icc []byte) []byte {
+	if imageFormat(imgByte) != format {
+		return imgByte
+	}
+	switch format {
+	case "jpg":
+		count := (len(icc) + jpegIccChunkSize - 1) / jpegIccChunkSize
+		if count > 255 {
+			return imgByte
+		}
+		var app2 []byte
+		for i := 0; i < count; i++ {
+			chunk := icc[i*jpegIccChunkSize : min(len(icc), (i+1)*jpegIccChunkSize)]
+			app2 = append(app2, 0xFF, 0xE2)
+			app2 = binary.BigEndian.AppendUint16(app2, uint16(2+len(jpegIccPrefix)+2+len(chunk)))
+			app2 = append(app2, jpegIccPrefix...)
+			app2 = append(app2, byte(i+1), byte(count))
+			app2 = append(app2, chunk...)
+		}
+		result := []byte{0xFF, 0xD8}
+		inserted := false
+		sos := jpegEachSegment(imgByte, func(marker byte, segment []byte) {
+			if !inserted && marker != 0xE0 {
+				result, inserted = append(result, app2...), true
+			}
+			result = append(result, segment...)
+		})
+		if sos < 0 {
+			return imgByte
+		}
+		if !inserted {
+			result = append(result, app2...)
+		}
+		return append(result, imgByte[sos:]...)
+	case "png":
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(icc)
+		writer.Close()
+		iccp := pngChunk("iCCP", append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...))
+		result := bytes.Clone(imgByte[:8])
+		complete := pngEachChunk(imgByte, func(chunkType string, chunk []byte) {
+			if chunkType == "sRGB" { // 有iCCP时不能再有sRGB
+				return
+			}
+			result = append(result, chunk...)
+			if chunkType == "IHDR" {
+				result = append(result, iccp...)
+			}
+		})
+		if !complete {
+			return imgByte
+		}
+		return result
+	case "webp":
+		return webpSetIcc(imgByte, icc)
+	}
+	return imgByte
+}
+
+// 依次处理jpg在SOS之前的每个段，segment包括标记和长度。返回SOS的位置，格式不对时返回-1
+func jpegEachSegment(imgByte []byte, fn func(marker byte, segment []byte)) int {
+	if len(imgByte) < 4 || imgByte[0] != 0xFF || imgByte[1] != 0xD8 {
+		return -1
+	}
+	for pos := 2; pos+4 <= len(imgByte); {
+		if imgByte[pos] != 0xFF {
+			return -1
+		}
+		marker := imgByte[pos+1]
+		switch {
+		case marker == 0xFF: // 填充
+			pos++
+			continue
+		case marker == 0xDA: // SOS后面是图像数据
+			return pos
+		case marker == 0xD9:
+			return -1
+		}
+		length := int(binary.BigEndian.Uint16(imgByte[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(imgByte) {
+			return -1
+		}
+		fn(marker, imgByte[pos:end])
+		pos = end
+	}
+	return -1
+}
+
+// 依次处理png的每个块，chunk包括长度、类型和crc。到IEND为止，后面多余的数据不管。返回是否完整处理到了IEND，格式不对时停止并返回false
+func pngEachChunk(imgByte []byte, fn func(chunkType string, chunk []byte)) bool {
+	for pos := 8; pos+12 <= len(imgByte); {
+		end := pos + 12 + int(binary.BigEndian.Uint32(imgByte[pos:pos+4]))
+		if end > len(imgByte) {
+			return false
+		}
+		chunkType := string(imgByte[pos+4 : pos+8])
+		fn(chunkType, imgByte[pos:end])
+		if chunkType == "IEND" {
+			return true
+		}
+		pos = end
+	}
+	return false
+}
+
+// png里第一个该类型的块的数据，没有时返回nil
+func pngChunkData(imgByte []byte, chunkType string) []byte {
+	var data []byte
+	pngEachChunk(imgByte, func(thisType string, chunk []byte) {
+		if thisType == chunkType && data == nil {
+			data = chunk[8 : len(chunk)-4]
+		}
+	})
+	return data
+}
+
+// 依次处理webp的每个块，chunk包括类型、长度和补齐的字节。只处理RIFF长度以内的部分，
+// 返回是否完整处理到了RIFF的末尾，格式不对或者文件不完整时停止并返回false
+func webpEachChunk(imgByte []byte, fn func(fourCC string, chunk []byte)) bool {
+	if len(imgByte) < 12 {
+		return false
+	}
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(imgByte[4:8]))
+	data := imgByte[:min(len(imgByte), riffEnd)]
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := min(len(data), pos+8+size+size%2) // 奇数长度的块后面补一个字节，最后一块可能没补
+		if pos+8+size > len(data) {
+			return false
+		}
+		fn(string(data[pos:pos+4]), data[pos:end])
+		pos = end
+	}
+	return pos == riffEnd
+}
+
+// webp里该类型的块的数据，没有时返回nil
+func webpChunk(imgByte []byte, fourCC string) []byte {
+	var data []byte
+	webpEachChunk(imgByte, func(thisFourCC string, chunk []byte) {
+		if thisFourCC == fourCC && data == nil {
+			data = chunk[8 : 8+binary.LittleEndian.Uint32(chunk[4:8])]
+		}
+	})
+	return data
+}
+
+// 去掉webp里的一些块，同时更新VP8X里的标志和RIFF的长度。只有扩展格式(VP8X)的webp才有元数据
+func webpRemoveChunks(imgByte []byte, remove []string) []byte {
+	// VP8X必须是第一个块，数据固定10个字节
+	if len(imgByte) < 30 || string(imgByte[12:16]) != "VP8X" || binary.LittleEndian.Uint32(imgByte[16:20]) != 10 {
+		return imgByte
+	}
+	flags := map[string]byte{"ICCP": 0x20, "EXIF": 0x08, "XMP ": 0x04}
+	result := bytes.Clone(imgByte[:12])
+	var removedFlags byte
+	complete := webpEachChunk(imgByte, func(fourCC string, chunk []byte) {
+		if slices.Contains(remove, fourCC) {
+			removedFlags |= flags[fourCC]
+			return
+		}
+		result = append(result, chunk...)
+		if len(chunk)%2 == 1 {
+			result = append(result, 0)
+		}
+	})
+	if !complete {
+		return imgByte
+	}
+	result[20] &^= removedFlags // 标志在VP8X数据的第一个字节
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result
+}
+
+/**
+ * @description: 给webp写入ICC。ICCP块必须紧跟在VP8X后面，同时要设置VP8X里的ICC标志。
+ * OpenCV编码的webp是简单格式(只有VP8或VP8L块)，这时按图像块里的宽高补一个VP8X
+ * @param {[]byte} imgByte
+ * @param {[]byte} icc
+ * @return {[]byte} 格式不对时原样返回
+ */
+func webpSetIcc(imgByte []byte, icc []byte) []byte {
+	if len(imgByte) < 20 {
+		return imgByte
+	}
+	var vp8x []byte
+	var chunks [][]byte
+	complete := webpEachChunk(imgByte, func(fourCC string, chunk []byte) {
+		switch fourCC {
+		case "VP8X":
+			vp8x = bytes.Clone(chunk)
+		case "ICCP": // 原来的去掉
+		default:
+			chunks = append(chunks, chunk)
+		}
+	})
+	if !complete {
+		return imgByte
+	}
+	if vp8x == nil {
+		if len(chunks) == 0 {
+			return imgByte
+		}
+		vp8x = webpSimpleVP8X(chunks[0])
+	}
+	if len(vp8x) != 18 {
+		return imgByte
+	}
+	vp8x[8] |= 0x20
+	result := bytes.Clone(imgByte[:12])
+	result = append(result, vp8x...)
+	result = append(result, webpMakeChunk("ICCP", icc)...)
+	for _, chunk := range chunks {
+		result = append(result, chunk...)
+		if len(chunk)%2 == 1 {
+			result = append(result, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result
+}
+
+// 按简单格式webp的图像块生成VP8X块，VP8L的宽高在签名0x2F后面的14位里，VP8的在关键帧起始码9D 01 2A后面。不认识时返回nil
+func webpSimpleVP8X(chunk []byte) []byte {
+	var width, height int
+	var flags byte
+	data := chunk[8:]
+	switch string(chunk[:4]) {
+	case "VP8L":
+		if len(data) < 5 || data[0] != 0x2F {
+			return nil
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		width, height = int(bits&0x3FFF)+1, int(bits>>14&0x3FFF)+1
+		if bits>>28&1 == 1 {
+			flags |= 0x10 // 有透明通道
+		}
+	case "VP8 ":
+		if len(data) < 10 || data[3] != 0x9D || data[4] != 0x01 || data[5] != 0x2A {
+			return nil
+		}
+		width, height = int(binary.LittleEndian.Uint16(data[6:8])&0x3FFF), int(binary.LittleEndian.Uint16(data[8:10])&0x3FFF)
+	default:
+		return nil
+	}
+	if width == 0 || height == 0 {
+		return nil
+	}
+	// 标志、3个保留字节、宽减1和高减1各占3个字节
+	payload := make([]byte, 10)
+	payload[0] = flags
+	payload[4], payload[5], payload[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	payload[7], payload[8], payload[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+	return webpMakeChunk("VP8X", payload)
+}
+
+// 生成一个webp块：类型、小端的长度、数据，奇数长度补一个字节
+func webpMakeChunk(fourCC string, data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data)+1)
+	copy(chunk[:4], fourCC)
+	binary.LittleEndian.PutUint32(chunk[4:8], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
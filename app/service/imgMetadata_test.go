@@ -0,0 +1,459 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 16:05:31
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 16:05:31
+ * @Description: 图片元数据的测试：EXIF的方向和DPI、去掉隐私信息、ICC的读写、webp的VP8X，以及截断和损坏的文件。
+ * 除了TestApplyOrientation，其他测试用手工拼出来的字节，不需要真实的图片
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"gocv.io/x/gocv"
+	"golang.org/x/image/webp"
+)
+
+// 1x1的无损webp，只有一个VP8L块，没有透明通道
+const testWebpHex = "524946461a000000574542505650384c0d0000002f00000000071011118888fe0700"
+
+var testIcc = []byte("fake icc profile for test")
+
+// 生成EXIF的TIFF数据，IFD0里有方向、横向分辨率和分辨率单位
+func testTiff(order binary.AppendByteOrder, orientation uint16, xRes [2]uint32, unit uint16) []byte {
+	tiff := []byte("II*\x00")
+	if order == binary.BigEndian {
+		tiff = []byte("MM\x00*")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 3)
+	entry := func(tag uint16, typ uint16, value []byte) {
+		tiff = order.AppendUint16(tiff, tag)
+		tiff = order.AppendUint16(tiff, typ)
+		tiff = order.AppendUint32(tiff, 1)
+		tiff = append(tiff, value...)
+	}
+	short := func(v uint16) []byte { return append(order.AppendUint16(nil, v), 0, 0) }
+	entry(0x0112, 3, short(orientation))
+	entry(0x011A, 5, order.AppendUint32(nil, 8+2+3*12+4)) // 分数放在IFD后面
+	entry(0x0128, 3, short(unit))
+	tiff = order.AppendUint32(tiff, 0) // 没有下一个IFD
+	tiff = order.AppendUint32(tiff, xRes[0])
+	return order.AppendUint32(tiff, xRes[1])
+}
+
+func testJpegSegment(marker byte, data []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+// 拼一个jpg：SOI、传入的段、SOS和几个字节的图像数据、EOI
+func testJpeg(segments ...[]byte) []byte {
+	result := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		result = append(result, segment...)
+	}
+	result = append(result, testJpegSegment(0xDA, []byte{1, 1, 0, 0, 0x3F, 0})...)
+	return append(result, 0x12, 0x34, 0x56, 0xFF, 0xD9)
+}
+
+func testJfif() []byte {
+	return testJpegSegment(0xE0, []byte{'J', 'F', 'I', 'F', 0, 1, 1, 1, 0, 72, 0, 72, 0, 0})
+}
+
+// 拼一个png：签名、IHDR、传入的块、IDAT、IEND。png不解码，块的内容不用是真的
+func testPng(chunks ...[]byte) []byte {
+	result := []byte("\x89PNG\r\n\x1a\n")
+	result = append(result, pngChunk("IHDR", []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 2, 0, 0, 0})...)
+	for _, chunk := range chunks {
+		result = append(result, chunk...)
+	}
+	result = append(result, pngChunk("IDAT", []byte{1, 2, 3})...)
+	return append(result, pngChunk("IEND", nil)...)
+}
+
+// 拼一个webp：RIFF头加传入的块
+func testWebp(chunks ...[]byte) []byte {
+	result := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		result = append(result, chunk...)
+	}
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result
+}
+
+func testVP8X(flags byte) []byte {
+	return webpMakeChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+}
+
+// 1x1的VP8L块，从testWebpHex里取出来
+func testVP8L(t *testing.T) []byte {
+	img, err := hex.DecodeString(testWebpHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img[12:]
+}
+
+// webp里所有块的类型，按顺序
+func webpFourCCs(imgByte []byte) []string {
+	var fourCCs []string
+	webpEachChunk(imgByte, func(fourCC string, chunk []byte) { fourCCs = append(fourCCs, fourCC) })
+	return fourCCs
+}
+
+func TestParseExif(t *testing.T) {
+	tests := []struct {
+		name        string
+		tiff        []byte
+		orientation int
+		dpi         int
+	}{
+		{"小端英寸", testTiff(binary.LittleEndian, 6, [2]uint32{72, 1}, 2), 6, 72},
+		{"大端英寸", testTiff(binary.BigEndian, 8, [2]uint32{300, 1}, 2), 8, 300},
+		{"单位是厘米", testTiff(binary.LittleEndian, 3, [2]uint32{11811, 100}, 3), 3, 300},
+		{"单位未知", testTiff(binary.BigEndian, 2, [2]uint32{72, 1}, 1), 2, 0},
+		{"分母为0", testTiff(binary.LittleEndian, 5, [2]uint32{72, 0}, 2), 5, 0},
+		{"空数据", nil, 0, 0},
+		{"字节序不对", append([]byte("XX"), testTiff(binary.LittleEndian, 6, [2]uint32{72, 1}, 2)[2:]...), 0, 0},
+		{"IFD偏移超出", []byte("II*\x00\xff\xff\xff\x7f"), 0, 0},
+		{"条目数超出，只读完整的条目", testTiff(binary.LittleEndian, 7, [2]uint32{72, 1}, 2)[:8+2+12], 7, 0},
+		{"分数的偏移超出", testTiff(binary.BigEndian, 4, [2]uint32{72, 1}, 2)[:50], 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orientation, dpi := parseExif(tt.tiff)
+			if orientation != tt.orientation || dpi != tt.dpi {
+				t.Fatalf("方向%d、DPI%d，期望%d、%d", orientation, dpi, tt.orientation, tt.dpi)
+			}
+		})
+	}
+}
+
+// 方向2~8分别放在jpg的APP1、png的eXIf和webp的EXIF块里，都能读出来
+func TestImageExifOrientation(t *testing.T) {
+	for orientation := uint16(2); orientation <= 8; orientation++ {
+		tiff := testTiff(binary.BigEndian, orientation, [2]uint32{72, 1}, 2)
+		exif := append(bytes.Clone(jpegExifPrefix), tiff...)
+		tests := []struct {
+			name    string
+			imgByte []byte
+		}{
+			{"jpg", testJpeg(testJfif(), testJpegSegment(0xE1, exif))},
+			{"png", testPng(pngChunk("eXIf", tiff))},
+			{"webp", testWebp(testVP8X(0x08), webpMakeChunk("EXIF", tiff), testVP8L(t))},
+			{"webp带jpg的标识", testWebp(testVP8X(0x08), webpMakeChunk("EXIF", exif), testVP8L(t))},
+		}
+		for _, tt := range tests {
+			got, _ := parseExif(imageExif(tt.imgByte, imageFormat(tt.imgByte)))
+			if got != int(orientation) {
+				t.Errorf("%s：方向%d，期望%d", tt.name, got, orientation)
+			}
+		}
+	}
+}
+
+// 3x2的灰度图按方向2~8转正，和EXIF规范里的变换对比
+func TestApplyOrientation(t *testing.T) {
+	src := gocv.NewMatWithSize(2, 3, gocv.MatTypeCV8UC1)
+	defer src.Close()
+	for i := 0; i < 6; i++ {
+		src.SetUCharAt(i/3, i%3, uint8((i+1)*10))
+	}
+	buf, err := gocv.IMEncode(gocv.PNGFileExt, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pngByte := bytes.Clone(buf.GetBytes())
+	buf.Close()
+	// 原图是 10 20 30 / 40 50 60
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{2, [][]uint8{{30, 20, 10}, {60, 50, 40}}},
+		{3, [][]uint8{{60, 50, 40}, {30, 20, 10}}},
+		{4, [][]uint8{{40, 50, 60}, {10, 20, 30}}},
+		{5, [][]uint8{{10, 40}, {20, 50}, {30, 60}}},
+		{6, [][]uint8{{40, 10}, {50, 20}, {60, 30}}},
+		{7, [][]uint8{{60, 30}, {50, 20}, {40, 10}}},
+		{8, [][]uint8{{30, 60}, {20, 50}, {10, 40}}},
+	}
+	for _, tt := range tests {
+		rotated, err := applyOrientation(pngByte, "png", tt.orientation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := gocv.IMDecode(rotated, gocv.IMReadUnchanged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Rows() != len(tt.want) || img.Cols() != len(tt.want[0]) {
+			t.Fatalf("方向%d：转正后%dx%d，期望%dx%d", tt.orientation, img.Cols(), img.Rows(), len(tt.want[0]), len(tt.want))
+		}
+		for row := range tt.want {
+			for col, want := range tt.want[row] {
+				if got := img.GetUCharAt(row, col); got != want {
+					t.Errorf("方向%d：(%d,%d)是%d，期望%d", tt.orientation, row, col, got, want)
+				}
+			}
+		}
+		img.Close()
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	exif := append(bytes.Clone(jpegExifPrefix), testTiff(binary.LittleEndian, 1, [2]uint32{72, 1}, 2)...)
+	icc := testJpegSegment(0xE2, append(append(bytes.Clone(jpegIccPrefix), 1, 1), testIcc...))
+	adobe := testJpegSegment(0xEE, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+	t.Run("jpg", func(t *testing.T) {
+		imgByte := testJpeg(testJfif(), testJpegSegment(0xE1, exif), icc, testJpegSegment(0xED, []byte("Photoshop 3.0\x00")),
+			adobe, testJpegSegment(0xFE, []byte("comment")), testJpegSegment(0xDB, make([]byte, 65)))
+		want := testJpeg(testJfif(), adobe, testJpegSegment(0xDB, make([]byte, 65)))
+		if got := stripMetadata(imgByte, "jpg", false); !bytes.Equal(got, want) {
+			t.Fatalf("只应该保留JFIF、Adobe和其他非APP段：\n%x\n%x", got, want)
+		}
+		want = testJpeg(testJfif(), icc, adobe, testJpegSegment(0xDB, make([]byte, 65)))
+		if got := stripMetadata(imgByte, "jpg", true); !bytes.Equal(got, want) {
+			t.Fatalf("要求保留ICC时，只应该保留JFIF、ICC、Adobe和其他非APP段：\n%x\n%x", got, want)
+		}
+	})
+	t.Run("png", func(t *testing.T) {
+		iccp := pngChunk("iCCP", []byte("icc\x00\x00x"))
+		phys := pngChunk("pHYs", []byte{0, 0, 11, 19, 0, 0, 11, 19, 1})
+		imgByte := testPng(pngChunk("eXIf", exif[6:]), iccp, pngChunk("tEXt", []byte("GPS\x00x")), pngChunk("zTXt", []byte("a\x00\x00")),
+			pngChunk("iTXt", []byte("a\x00\x00\x00\x00\x00")), pngChunk("tIME", make([]byte, 7)), phys)
+		if got, want := stripMetadata(imgByte, "png", false), testPng(phys); !bytes.Equal(got, want) {
+			t.Fatalf("只应该保留pHYs：\n%x\n%x", got, want)
+		}
+		if got, want := stripMetadata(imgByte, "png", true), testPng(iccp, phys); !bytes.Equal(got, want) {
+			t.Fatalf("要求保留ICC时，只应该保留iCCP和pHYs：\n%x\n%x", got, want)
+		}
+	})
+	t.Run("webp", func(t *testing.T) {
+		// EXIF是奇数长度，后面有补齐的字节
+		imgByte := testWebp(testVP8X(0x2C), webpMakeChunk("ICCP", testIcc), webpMakeChunk("EXIF", exif[:len(exif)-1]),
+			webpMakeChunk("XMP ", []byte("<x:xmpmeta/>")), testVP8L(t))
+		got := stripMetadata(imgByte, "webp", false)
+		if want := testWebp(testVP8X(0), testVP8L(t)); !bytes.Equal(got, want) {
+			t.Fatalf("只应该保留图像块，ICC、EXIF和XMP的标志要去掉：\n%x\n%x", got, want)
+		}
+		if int(binary.LittleEndian.Uint32(got[4:8])) != len(got)-8 {
+			t.Fatal("RIFF的长度没有更新")
+		}
+		got = stripMetadata(imgByte, "webp", true)
+		if want := testWebp(testVP8X(0x20), webpMakeChunk("ICCP", testIcc), testVP8L(t)); !bytes.Equal(got, want) {
+			t.Fatalf("要求保留ICC时，只应该保留ICCP，EXIF和XMP的标志要去掉：\n%x\n%x", got, want)
+		}
+	})
+}
+
+// 多个APP2段的ICC按序号拼起来，段的顺序是乱的，中间还夹着其他段
+func TestImageIccJpegSegments(t *testing.T) {
+	part := func(seq byte, data string) []byte {
+		return testJpegSegment(0xE2, append(append(bytes.Clone(jpegIccPrefix), seq, 3), data...))
+	}
+	imgByte := testJpeg(testJfif(), part(2, "second-"), testJpegSegment(0xE2, []byte("MPF\x00")), part(3, "third"), part(1, "first-"))
+	if got := imageIcc(imgByte, "jpg"); string(got) != "first-second-third" {
+		t.Fatalf("拼出来的ICC是%q", got)
+	}
+	// 超过一个段的ICC写入后分成多段，读出来和原来一样
+	large := bytes.Repeat([]byte("0123456789"), 15000)
+	written := setImageIcc(testJpeg(testJfif()), "jpg", large)
+	count := 0
+	jpegEachSegment(written, func(marker byte, segment []byte) {
+		if marker == 0xE2 {
+			count++
+		}
+	})
+	if count != 3 {
+		t.Fatalf("150000字节的ICC应该分成3段，实际%d段", count)
+	}
+	if !bytes.Equal(imageIcc(written, "jpg"), large) {
+		t.Fatal("分段写入的ICC读出来不一样")
+	}
+	if !bytes.HasPrefix(written[2:], testJfif()) {
+		t.Fatal("JFIF头应该还是第一个段")
+	}
+}
+
+func TestSetImageIcc(t *testing.T) {
+	tests := []struct {
+		name    string
+		imgByte []byte
+	}{
+		{"jpg", testJpeg(testJfif())},
+		{"jpg没有JFIF头", testJpeg(testJpegSegment(0xDB, make([]byte, 65)))},
+		{"png", testPng(pngChunk("sRGB", []byte{0}))},
+		{"简单格式的webp", testWebp(testVP8L(t))},
+		{"扩展格式的webp", testWebp(testVP8X(0x08), webpMakeChunk("EXIF", []byte("II*\x00")), testVP8L(t))},
+		{"替换webp原来的ICC", testWebp(testVP8X(0x20), webpMakeChunk("ICCP", []byte("old")), testVP8L(t))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := imageFormat(tt.imgByte)
+			got := setImageIcc(tt.imgByte, format, testIcc)
+			if !bytes.Equal(imageIcc(got, format), testIcc) {
+				t.Fatalf("写入后读不出ICC：%x", got)
+			}
+			if format == "png" && pngChunkData(got, "sRGB") != nil {
+				t.Fatal("有iCCP时应该去掉sRGB")
+			}
+		})
+	}
+}
+
+// webp写入ICC后ICCP紧跟在VP8X后面，VP8X的标志和RIFF的长度正确，而且还能解码
+func TestWebpSetIcc(t *testing.T) {
+	got := setImageIcc(testWebp(testVP8L(t)), "webp", testIcc)
+	if fourCCs := strings.Join(webpFourCCs(got), ","); fourCCs != "VP8X,ICCP,VP8L" {
+		t.Fatalf("块的顺序是%s", fourCCs)
+	}
+	if int(binary.LittleEndian.Uint32(got[4:8])) != len(got)-8 {
+		t.Fatal("RIFF的长度不对")
+	}
+	if got[20] != 0x20 {
+		t.Fatalf("VP8X的标志是%#x，期望只有ICC", got[20])
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(got))
+	if err != nil || config.Width != 1 || config.Height != 1 {
+		t.Fatalf("VP8X里的画布大小不对：%+v %v", config, err)
+	}
+	if _, err := webp.Decode(bytes.NewReader(got)); err != nil {
+		t.Fatal("写入ICC后不能解码：", err)
+	}
+	// 扩展格式的webp保留原来的标志
+	got = setImageIcc(testWebp(testVP8X(0x08), webpMakeChunk("EXIF", []byte("II*\x00")), testVP8L(t)), "webp", testIcc)
+	if fourCCs := strings.Join(webpFourCCs(got), ","); fourCCs != "VP8X,ICCP,EXIF,VP8L" || got[20] != 0x28 {
+		t.Fatalf("块的顺序是%s，标志是%#x", fourCCs, got[20])
+	}
+}
+
+func TestWebpSimpleVP8X(t *testing.T) {
+	vp8l := testVP8L(t)
+	vp8lAlpha := bytes.Clone(vp8l)
+	vp8lAlpha[12] |= 0x10 // 宽高后面的透明通道位
+	// 关键帧：3个字节的帧标记、起始码、14位的宽和高，高2位是缩放
+	vp8 := webpMakeChunk("VP8 ", []byte{0x50, 0x02, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x42, 0xE0, 0x01})
+	tests := []struct {
+		name   string
+		chunk  []byte
+		flags  byte
+		width  int
+		height int
+	}{
+		{"VP8L", vp8l, 0, 1, 1},
+		{"VP8L有透明通道", vp8lAlpha, 0x10, 1, 1},
+		{"VP8", vp8, 0, 640, 480},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp8x := webpSimpleVP8X(tt.chunk)
+			if len(vp8x) != 18 || string(vp8x[:4]) != "VP8X" || binary.LittleEndian.Uint32(vp8x[4:8]) != 10 {
+				t.Fatalf("VP8X块不对：%x", vp8x)
+			}
+			width := int(vp8x[12]) | int(vp8x[13])<<8 | int(vp8x[14])<<16 + 1
+			height := int(vp8x[15]) | int(vp8x[16])<<8 | int(vp8x[17])<<16 + 1
+			if vp8x[8] != tt.flags || width != tt.width || height != tt.height {
+				t.Fatalf("标志%#x、%dx%d，期望%#x、%dx%d", vp8x[8], width, height, tt.flags, tt.width, tt.height)
+			}
+		})
+	}
+	for _, chunk := range [][]byte{webpMakeChunk("VP8L", []byte{0x2E, 0, 0, 0, 0}), webpMakeChunk("VP8 ", make([]byte, 10)), webpMakeChunk("ALPH", nil)} {
+		if vp8x := webpSimpleVP8X(chunk); vp8x != nil {
+			t.Fatalf("%s不认识，应该返回nil", chunk[:4])
+		}
+	}
+}
+
+// 截断和损坏的文件：读取的函数不能panic，修改的函数原样返回
+func TestMalformedInput(t *testing.T) {
+	exif := append(bytes.Clone(jpegExifPrefix), testTiff(binary.LittleEndian, 6, [2]uint32{72, 1}, 2)...)
+	iccSegment := testJpegSegment(0xE2, append(append(bytes.Clone(jpegIccPrefix), 1, 1), testIcc...))
+	jpg := testJpeg(testJfif(), testJpegSegment(0xE1, exif), iccSegment)
+	png := setImageIcc(testPng(pngChunk("eXIf", exif[6:]), pngChunk("tEXt", []byte("a\x00b"))), "png", testIcc)
+	webpExt := testWebp(testVP8X(0x28), webpMakeChunk("ICCP", testIcc), webpMakeChunk("EXIF", exif), testVP8L(t))
+	webpSimple := testWebp(testVP8L(t))
+
+	var tests []struct {
+		name    string
+		format  string
+		imgByte []byte
+	}
+	add := func(name string, format string, imgByte []byte) {
+		tests = append(tests, struct {
+			name    string
+			format  string
+			imgByte []byte
+		}{name, format, imgByte})
+	}
+	// jpg的SOS后面是图像数据，截断了也看不出来，只截断到SOS之前
+	for cut := 0; cut < bytes.Index(jpg, []byte{0xFF, 0xDA}); cut++ {
+		add("jpg截断", "jpg", jpg[:cut])
+	}
+	// png以IEND结束，webp按RIFF的长度，截断到哪里都能看出来
+	for cut := 0; cut < len(png); cut++ {
+		add("png截断", "png", png[:cut])
+	}
+	for cut := 0; cut < len(webpExt); cut++ {
+		add("webp截断", "webp", webpExt[:cut])
+	}
+	for cut := 0; cut < len(webpSimple); cut++ {
+		add("简单格式的webp截断", "webp", webpSimple[:cut])
+	}
+	badLength := bytes.Clone(jpg)
+	badLength[5] = 1 // JFIF段的长度小于2
+	add("jpg段长度不对", "jpg", badLength)
+	badMarker := bytes.Clone(jpg)
+	badMarker[2] = 0x00
+	add("jpg段不是0xFF开头", "jpg", badMarker)
+	hugeChunk := bytes.Clone(png)
+	binary.BigEndian.PutUint32(hugeChunk[8:12], 0xFFFFFFFF)
+	add("png块长度超出", "png", hugeChunk)
+	badVP8X := bytes.Clone(webpExt)
+	binary.LittleEndian.PutUint32(badVP8X[16:20], 2)
+	add("VP8X长度不对", "webp", badVP8X)
+	hugeWebpChunk := bytes.Clone(webpExt)
+	binary.LittleEndian.PutUint32(hugeWebpChunk[34:38], 0xFFFFFFF0)
+	add("webp块长度超出", "webp", hugeWebpChunk)
+	hugeRiff := bytes.Clone(webpSimple)
+	binary.LittleEndian.PutUint32(hugeRiff[4:8], 0xFFFFFFF0)
+	add("RIFF长度超出", "webp", hugeRiff)
+
+	for _, tt := range tests {
+		name := tt.name + "/" + hex.EncodeToString(tt.imgByte[:min(len(tt.imgByte), 24)])
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					t.Fatalf("%s（%d字节）panic：%v", name, len(tt.imgByte), err)
+				}
+			}()
+			imageFormat(tt.imgByte)
+			parseExif(imageExif(tt.imgByte, tt.format))
+			imageIcc(tt.imgByte, tt.format)
+			GetImageDpi(tt.imgByte, tt.format)
+			modified := map[string][]byte{
+				"stripMetadata":          stripMetadata(tt.imgByte, tt.format, false),
+				"stripMetadata(keepIcc)": stripMetadata(tt.imgByte, tt.format, true),
+				"setImageIcc":            setImageIcc(tt.imgByte, tt.format, []byte("new icc")),
+				"SetImageDpi":            SetImageDpi(tt.imgByte, tt.format, 300),
+				"copyImageMeta":          copyImageMeta(jpg, tt.imgByte),
+			}
+			if tt.format == "webp" {
+				modified["webpRemoveChunks"] = webpRemoveChunks(tt.imgByte, []string{"EXIF"})
+			}
+			for fn, got := range modified {
+				if !bytes.Equal(got, tt.imgByte) {
+					t.Errorf("%s（%d字节）：%s应该原样返回", name, len(tt.imgByte), fn)
+				}
+			}
+		}()
+	}
+}
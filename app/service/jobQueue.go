@@ -0,0 +1,273 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 19:46:30
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 19:46:30
+ * @Description: 异步任务的worker。worker轮询job表领取任务，执行期间定时续租，失败后按退避时间重试，重试次数用完后调用善后函数
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"src/app/model"
+	g "src/global"
+	"sync"
+	"time"
+)
+
+// 异步任务的处理函数
+type JobHandler struct {
+	Run         func(ctx context.Context, job *model.Job) error // 执行任务，返回NoRetry包装的错误时不再重试。租约失效时ctx会被取消
+	OnFail      func(job *model.Job, errMsg string)             // 任务彻底失败后调用一次，用于退款等善后，可以为空
+	MaxAttempts int                                             // 最多执行的次数
+}
+
+type noRetryError struct {
+	error
+}
+
+// 包装不需要重试的错误，比如参数错误、外部接口明确返回的失败
+func NoRetry(err error) error {
+	return noRetryError{err}
+}
+
+var (
+	jobHandlers     = make(map[string]JobHandler)
+	jobHandlersLock sync.RWMutex
+)
+
+/**
+ * @description: 注册任务类型的处理函数，需要在启动worker之前注册
+ * @param {string} jobType 任务类型
+ * @param {JobHandler} handler
+ * @return {*}
+ */
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlersLock.Lock()
+	defer jobHandlersLock.Unlock()
+	jobHandlers[jobType] = handler
+}
+
+// 已注册的任务类型
+func jobTypes() []string {
+	jobHandlersLock.RLock()
+	defer jobHandlersLock.RUnlock()
+	types := make([]string, 0, len(jobHandlers))
+	for jobType := range jobHandlers {
+		types = append(types, jobType)
+	}
+	return types
+}
+
+func getJobHandler(jobType string) (JobHandler, bool) {
+	jobHandlersLock.RLock()
+	defer jobHandlersLock.RUnlock()
+	handler, ok := jobHandlers[jobType]
+	return handler, ok
+}
+
+/**
+ * @description: 提交任务，任务类型必须已经注册
+ * @param {string} jobType 任务类型
+ * @param {*model.ImgTask} task 任务对应的图片任务
+ * @param {string} payload 任务参数
+ * @return {*model.Job}
+ * @return {error}
+ */
+func SubmitJob(jobType string, task *model.ImgTask, payload string) (*model.Job, error) {
+	handler, ok := getJobHandler(jobType)
+	if !ok {
+		return nil, fmt.Errorf("未注册的任务类型:%s", jobType)
+	}
+	return model.EnqueueJob(jobType, task.ToolId, task.Id, payload, handler.MaxAttempts)
+}
+
+/**
+ * @description: 为任务创建图片任务对象，worker里没有gin的上下文，日志和数据库单独初始化
+ * @param {context.Context} ctx
+ * @param {*model.Job} job
+ * @param {string} logName 日志里的名称
+ * @return {*model.ImgTask}
+ */
+func NewJobImgTask(ctx context.Context, job *model.Job, logName string) *model.ImgTask {
+	thisLog := &g.Log{RequestUrl: logName + ":" + job.TaskId}
+	task := &model.ImgTask{Id: job.TaskId, ToolId: job.ToolId}
+	task.Ctx = ctx
+	task.Log = thisLog
+	task.DB = g.Mysql.WithContext(context.WithValue(ctx, g.MysqlLogKeyName, thisLog))
+	return task
+}
+
+// worker的配置
+type jobWorkerConfig struct {
+	lease time.Duration // 租约时长
+}
+
+func getJobWorkerConfig() jobWorkerConfig {
+	conf := jobWorkerConfig{lease: 30 * time.Second}
+	if second := g.VP.GetInt("Job.LeaseSecond"); second > 0 {
+		conf.lease = time.Duration(second) * time.Second
+	}
+	return conf
+}
+
+// 没有任务时的轮询间隔，默认1秒
+func JobPollInterval() time.Duration {
+	if second := g.VP.GetInt("Job.PollSecond"); second > 0 {
+		return time.Duration(second) * time.Second
+	}
+	return time.Second
+}
+
+// 启动时需要的worker数量，默认2个
+func JobWorkerCount() int {
+	if count := g.VP.GetInt("Job.Workers"); count > 0 {
+		return count
+	}
+	return 2
+}
+
+/**
+ * @description: 创建job表并注册内置的任务类型，启动worker之前调用
+ * @return {error}
+ */
+func InitJobQueue() error {
+	if err := g.Mysql.AutoMigrate(&model.Job{}); err != nil {
+		return err
+	}
+	RegisterJobHandler(DocConvertJobType, docConvertJobHandler())
+	return nil
+}
+
+/**
+ * @description: 运行一个worker，直到收到停止信号。正在执行的任务不会等它结束，它的租约过期后由其他worker或重启后的程序接着执行
+ * @param {int} index worker的序号，序号为0的worker负责清理超时的任务
+ * @param {*time.Ticker} ticker 轮询用的定时器，由调用方注册，方便统一关闭
+ * @param {<-chan bool} stopChan 关闭后worker退出
+ * @return {*}
+ */
+func RunJobWorker(index int, ticker *time.Ticker, stopChan <-chan bool) {
+	conf := getJobWorkerConfig()
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), index)
+	thisLog := g.Log{RequestUrl: "jobWorker:" + owner}
+	lastSweep := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			if index == 0 && time.Since(lastSweep) > conf.lease {
+				sweepExhaustedJobs(&thisLog)
+				lastSweep = time.Now()
+			}
+			// 有任务就连续执行，没有任务再等下一次轮询
+			for {
+				job, err := model.ClaimJob(jobTypes(), owner, conf.lease)
+				if err != nil {
+					thisLog.Error("领取任务失败", err)
+					break
+				}
+				if job == nil {
+					break
+				}
+				runJob(job, conf, &thisLog)
+				select {
+				case <-stopChan:
+					return
+				default:
+				}
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// 执行一个任务，执行期间定时续租，续租失败时取消任务
+func runJob(job *model.Job, conf jobWorkerConfig, thisLog *g.Log) {
+	handler, ok := getJobHandler(job.Type)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		renewTicker := time.NewTicker(conf.lease / 3)
+		defer renewTicker.Stop()
+		for {
+			select {
+			case <-renewTicker.C:
+				if err := job.RenewLease(conf.lease); err != nil {
+					thisLog.Warn("任务续租失败，停止执行", err.Error())
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := runJobSafely(ctx, handler, job)
+	if ctx.Err() != nil { // 租约已经失效，任务可能已经被别的worker领取，结果不能再写入
+		return
+	}
+	if err == nil {
+		if err = job.Succeed(); err != nil {
+			thisLog.Error("更新任务状态失败", err)
+		}
+		return
+	}
+	backoff := jobBackoff(job.Attempts)
+	failed, updateErr := job.Fail(err.Error(), retryable(err), backoff)
+	if updateErr != nil {
+		thisLog.Error("更新任务状态失败", updateErr)
+		return
+	}
+	if !failed {
+		thisLog.Warn(fmt.Sprintf("任务%d执行失败，%s后重试", job.Id, backoff), err.Error())
+		return
+	}
+	thisLog.Error(fmt.Sprintf("任务%d执行失败", job.Id), err)
+	if handler.OnFail != nil {
+		handler.OnFail(job, err.Error())
+	}
+}
+
+// 第attempts次执行失败后，重试前等待的时间：5s、20s、45s...
+func jobBackoff(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * 5 * time.Second
+}
+
+// 错误是否允许重试，NoRetry包装的错误即使再被其他错误包装也不重试
+func retryable(err error) bool {
+	var noRetry noRetryError
+	return !errors.As(err, &noRetry)
+}
+
+// 执行任务，处理函数panic时当作执行失败，避免worker退出
+func runJobSafely(ctx context.Context, handler JobHandler, job *model.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("任务执行异常:%v", r)
+		}
+	}()
+	return handler.Run(ctx, job)
+}
+
+// 租约过期且重试次数用完的任务标记为失败并善后，一般是执行期间程序崩溃了
+func sweepExhaustedJobs(thisLog *g.Log) {
+	jobs, err := model.FailExhaustedJobs(jobTypes())
+	if err != nil {
+		thisLog.Error("查询超时的任务失败", err)
+		return
+	}
+	for i := range jobs {
+		if handler, ok := getJobHandler(jobs[i].Type); ok && handler.OnFail != nil {
+			handler.OnFail(&jobs[i], "任务执行超时")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 11:02:27
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 11:02:27
+ * @Description: worker重试退避、不重试的错误和panic处理的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"src/app/model"
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 20 * time.Second},
+		{3, 45 * time.Second},
+		{4, 80 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := jobBackoff(tt.attempts); got != tt.want {
+			t.Fatalf("第%d次失败后等待%s，期望%s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	base := errors.New("外部接口返回失败")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"普通错误", base, true},
+		{"超时", context.DeadlineExceeded, true},
+		{"NoRetry", NoRetry(base), false},
+		{"被包装过的NoRetry", fmt.Errorf("转换失败:%w", NoRetry(base)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Fatalf("retryable = %v，期望%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunJobSafely(t *testing.T) {
+	job := &model.Job{Id: 1}
+	handler := JobHandler{Run: func(ctx context.Context, job *model.Job) error {
+		var m map[string]int
+		m["a"] = 1 // 写nil map会panic
+		return nil
+	}}
+	if err := runJobSafely(context.Background(), handler, job); err == nil {
+		t.Fatal("处理函数panic时应该返回错误")
+	} else if !retryable(err) {
+		t.Fatal("panic应该允许重试")
+	}
+	want := errors.New("失败")
+	handler.Run = func(ctx context.Context, job *model.Job) error { return want }
+	if err := runJobSafely(context.Background(), handler, job); !errors.Is(err, want) {
+		t.Fatalf("应该原样返回处理函数的错误，实际%v", err)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 01:18:05
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 01:18:05
+ * @Description: 本地人像分割，百度接口不可用（token刷新失败、额度用完）时证件照换底色仍然可以使用，只用CPU
+ * 配置了onnx模型时用OpenCV DNN推理（如MODNet），否则用人脸检测确定人像的大致位置，再用GrabCut分割
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"errors"
+	"image"
+	"src/app/model"
+	g "src/global"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// GrabCut mask的取值
+const (
+	gcBgd   = 0 // 确定是背景
+	gcFgd   = 1 // 确定是前景
+	gcPrBgd = 2 // 可能是背景
+	gcPrFgd = 3 // 可能是前景
+)
+
+const grabCutMaxSide = 800 // GrabCut比较慢，长边超过这个值时缩小后再分割
+
+var (
+	segNet     *gocv.Net // 分割模型，Net不能并发使用，用segNetLock保护
+	segNetLock sync.Mutex
+	segNetOnce sync.Once
+
+	faceCascade     *gocv.CascadeClassifier // 人脸检测，同样不能并发使用
+	faceCascadeLock sync.Mutex
+	faceCascadeOnce sync.Once
+)
+
+/**
+ * @description: 本地人像分割，返回带透明通道的BGRA人像图，和百度人像分割的foreground结果一样
+ * @param {*model.ImgTask} task 使用task.ImgByte
+ * @return {gocv.Mat} 调用方负责Close
+ * @return {error}
+ */
+func LocalPortraitSegmentation(task *model.ImgTask) (gocv.Mat, error) {
+	img, err := gocv.IMDecode(task.ImgByte, gocv.IMReadColor)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer img.Close()
+	if img.Empty() {
+		return gocv.NewMat(), errors.New("图片解码失败")
+	}
+	var alpha gocv.Mat
+	if net := loadSegNet(); net != nil {
+		alpha, err = dnnAlpha(img, net)
+	} else {
+		alpha, err = grabCutAlpha(task, img)
+	}
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer alpha.Close()
+	channels := gocv.Split(img)
+	defer func() {
+		for _, channel := range channels {
+			channel.Close()
+		}
+	}()
+	foreground := gocv.NewMat()
+	gocv.Merge(append(channels, alpha), &foreground)
+	return foreground, nil
+}
+
+// 加载Segmentation.Model配置的onnx模型，没有配置或者加载失败时返回nil
+func loadSegNet() *gocv.Net {
+	segNetOnce.Do(func() {
+		modelPath := g.VP.GetString("Segmentation.Model")
+		if modelPath == "" {
+			return
+		}
+		thisLog := g.Log{RequestUrl: "loadSegNet"}
+		net := gocv.ReadNet(modelPath, "")
+		if net.Empty() {
+			thisLog.Error("加载人像分割模型失败：" + modelPath)
+			return
+		}
+		net.SetPreferableBackend(gocv.NetBackendDefault)
+		net.SetPreferableTarget(gocv.NetTargetCPU)
+		segNet = &net
+	})
+	return segNet
+}
+
+// 用模型推理透明通道。输入按MODNet的要求缩放到InputSize并归一化到[-1,1]，输出是[1,1,size,size]的[0,1]透明度
+func dnnAlpha(img gocv.Mat, net *gocv.Net) (gocv.Mat, error) {
+	size := 512
+	if g.VP.GetInt("Segmentation.InputSize") > 0 {
+		size = g.VP.GetInt("Segmentation.InputSize")
+	}
+	blob := gocv.BlobFromImage(img, 1.0/127.5, image.Pt(size, size), gocv.NewScalar(127.5, 127.5, 127.5, 0), true, false)
+	defer blob.Close()
+	segNetLock.Lock()
+	net.SetInput(blob, "")
+	output := net.Forward("")
+	segNetLock.Unlock()
+	defer output.Close()
+	data, err := output.DataPtrFloat32()
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	if len(data) != size*size {
+		return gocv.NewMat(), errors.New("人像分割模型的输出和InputSize不一致")
+	}
+	alphaByte := make([]byte, len(data))
+	for i, v := range data {
+		alphaByte[i] = uint8(min(max(v, 0), 1) * 255)
+	}
+	small, err := matFromBytes(size, size, gocv.MatTypeCV8UC1, alphaByte)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer small.Close()
+	alpha := gocv.NewMat()
+	gocv.Resize(small, &alpha, image.Pt(img.Cols(), img.Rows()), 0, 0, gocv.InterpolationLinear)
+	return alpha, nil
+}
+
+// 用GrabCut分割，人脸和人脸下方的身体作为前景的种子，图片的上边和左右两边作为背景的种子
+func grabCutAlpha(task *model.ImgTask, img gocv.Mat) (gocv.Mat, error) {
+	// 缩小后再分割，分割完再放大到原图大小
+	small := img
+	scale := 1.0
+	if longSide := max(img.Rows(), img.Cols()); longSide > grabCutMaxSide {
+		scale = float64(grabCutMaxSide) / float64(longSide)
+		small = gocv.NewMat()
+		defer small.Close()
+		gocv.Resize(img, &small, image.Pt(int(float64(img.Cols())*scale), int(float64(img.Rows())*scale)), 0, 0, gocv.InterpolationArea)
+	}
+	rows, cols := small.Rows(), small.Cols()
+	face, found := detectFace(small)
+	if !found {
+		// 证件照的人像一般在中间，按常见的构图估计人脸的位置
+		task.Log.Warn("本地人像分割没有检测到人脸，按证件照的构图估计", nil)
+		face = image.Rect(cols*3/10, rows/6, cols*7/10, rows/2)
+	}
+	fw, fh := face.Dx(), face.Dy()
+
+	maskByte := make([]byte, rows*cols)
+	for i := range maskByte {
+		maskByte[i] = gcPrBgd
+	}
+	// 人像的大致范围：人脸上方留一些头发，左右各扩展一个多脸宽给肩膀，一直到图片底部
+	person := image.Rect(face.Min.X-fw*6/5, face.Min.Y-fh*2/5, face.Max.X+fw*6/5, rows).Intersect(image.Rect(0, 0, cols, rows))
+	fillMask(maskByte, cols, person, gcPrFgd)
+	// 人脸中心和脖子、躯干的中间部分肯定是前景
+	fillMask(maskByte, cols, image.Rect(face.Min.X+fw/5, face.Min.Y+fh/5, face.Max.X-fw/5, face.Max.Y), gcFgd)
+	fillMask(maskByte, cols, image.Rect(face.Min.X+fw/3, face.Max.Y, face.Max.X-fw/3, rows), gcFgd)
+	// 图片的最上面和左右两边肯定是背景，底部是身体，不设置
+	border := max(2, min(rows, cols)/50)
+	if person.Min.Y > border {
+		fillMask(maskByte, cols, image.Rect(0, 0, cols, border), gcBgd)
+	}
+	fillMask(maskByte, cols, image.Rect(0, 0, min(border, person.Min.X), rows), gcBgd)
+	fillMask(maskByte, cols, image.Rect(max(cols-border, person.Max.X), 0, cols, rows), gcBgd)
+
+	mask, err := matFromBytes(rows, cols, gocv.MatTypeCV8UC1, maskByte)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer mask.Close()
+	bgdModel, fgdModel := gocv.NewMat(), gocv.NewMat()
+	defer bgdModel.Close()
+	defer fgdModel.Close()
+	gocv.GrabCut(small, &mask, person, &bgdModel, &fgdModel, 5, gocv.GCInitWithMask)
+
+	// 前景和可能的前景作为不透明，其余透明，边缘模糊一下过渡得自然些
+	alphaByte := mask.ToBytes()
+	for i, v := range alphaByte {
+		if v == gcFgd || v == gcPrFgd {
+			alphaByte[i] = 255
+		} else {
+			alphaByte[i] = 0
+		}
+	}
+	smallAlpha, err := matFromBytes(rows, cols, gocv.MatTypeCV8UC1, alphaByte)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer smallAlpha.Close()
+	gocv.GaussianBlur(smallAlpha, &smallAlpha, image.Pt(5, 5), 0, 0, gocv.BorderDefault)
+	alpha := gocv.NewMat()
+	gocv.Resize(smallAlpha, &alpha, image.Pt(img.Cols(), img.Rows()), 0, 0, gocv.InterpolationLinear)
+	return alpha, nil
+}
+
+// 检测最大的人脸，没有配置Segmentation.FaceCascade或者没检测到时返回false
+func detectFace(img gocv.Mat) (image.Rectangle, bool) {
+	faceCascadeOnce.Do(func() {
+		cascadePath := g.VP.GetString("Segmentation.FaceCascade")
+		if cascadePath == "" {
+			return
+		}
+		cascade := gocv.NewCascadeClassifier()
+		if !cascade.Load(cascadePath) {
+			thisLog := g.Log{RequestUrl: "detectFace"}
+			thisLog.Error("加载人脸检测模型失败：" + cascadePath)
+			cascade.Close()
+			return
+		}
+		faceCascade = &cascade
+	})
+	if faceCascade == nil {
+		return image.Rectangle{}, false
+	}
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	gocv.EqualizeHist(gray, &gray)
+	faceCascadeLock.Lock()
+	faces := faceCascade.DetectMultiScale(gray)
+	faceCascadeLock.Unlock()
+	var face image.Rectangle
+	for _, f := range faces {
+		if f.Dx()*f.Dy() > face.Dx()*face.Dy() {
+			face = f
+		}
+	}
+	return face, len(faces) > 0
+}
+
+// 把mask中rect范围内的值设置为value，rect超出范围的部分忽略
+func fillMask(maskByte []byte, cols int, rect image.Rectangle, value byte) {
+	rect = rect.Intersect(image.Rect(0, 0, cols, len(maskByte)/cols))
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := maskByte[y*cols : (y+1)*cols]
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			row[x] = value
+		}
+	}
+}
+
+// 从字节创建Mat，NewMatFromBytes不复制数据，这里复制一份，不依赖go的切片
+func matFromBytes(rows int, cols int, mt gocv.MatType, data []byte) (gocv.Mat, error) {
+	mat, err := gocv.NewMatFromBytes(rows, cols, mt, data)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer mat.Close()
+	return mat.Clone(), nil
+}
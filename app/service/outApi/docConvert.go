@@ -38,7 +38,7 @@ func DocConvert(task *model.ImgTask, ctx context.Context, api string, taskId str
 	}
 
 	dc := &dto.DocConvert{}
-	if err := myHttp.FormPost(task.C, fullUrl, sendBody.Form.Encode(), dc); err != nil {
+	if err := myHttp.FormPost(ctx, fullUrl, sendBody.Form.Encode(), dc); err != nil {
 		task.Log.Error("百度文档格式转换api请求失败", err)
 		task.ErrMsg = err.Error()
 		return nil
@@ -36,7 +36,7 @@ func EffectsEnhancementPost(task *model.ImgTask, api string, errMsg string) *dto
 		return nil
 	}
 	ee := &dto.EffectsEnhancement{}
-	if err := myHttp.FormPost(task.C, fullUrl, sendBody.Form.Encode(), ee); err != nil {
+	if err := myHttp.FormPost(task.Ctx, fullUrl, sendBody.Form.Encode(), ee); err != nil {
 		task.Log.Error(errMsg, err)
 		task.ErrMsg = errMsg
 		return nil
@@ -55,7 +55,7 @@ func AliH5CreateOrder(ctx *gin.Context, order *model.Order) (*string, error) {
 	timeExpire := time.Now().Add(time.Minute * 5) // 设置订单过期时间为5分钟
 	bm := make(gopay.BodyMap)
 	bm.Set("out_trade_no", order.Id)
-	bm.Set("total_amount", model.ToolsMap[order.ToolId].DiscountPrice)
+	bm.Set("total_amount", strconv.FormatFloat(float64(order.Amount)/100, 'f', 2, 64)) // 按订单金额收款，批量任务的金额和工具单价不同
 	bm.Set("subject", model.ToolsMap[order.ToolId].Name)
 	bm.Set("product_code", "QUICK_WAP_WAY") // 销售产品码，商家和支付宝签约的产品码。手机网站支付为：QUICK_WAP_WAY
 	bm.Set("time_expire", timeExpire.Format("2006-01-02 15:04:05"))
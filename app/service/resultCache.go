@@ -0,0 +1,98 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 00:52:30
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 00:52:30
+ * @Description: 百度接口结果的缓存。用户付款出问题后经常重新上传同一张图片，按图片内容的md5、工具和接口参数缓存百度返回的不带水印的图，保留期内相同的请求不再调用百度，节省额度
+ * 缓存保存在存储里，多台服务器共用，过期的由定时任务删除
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"src/app/model"
+	g "src/global"
+	MD5 "src/utils/md5"
+	"src/utils/storage"
+	"time"
+)
+
+const BaiduCacheDir = "./cache/baidu" // 缓存在存储里的目录
+
+/**
+ * @description: 缓存的保留时长，配置ResultCache.RetentionHour，未配置时为24小时，ResultCache.Enable为false时返回0，表示不使用缓存
+ * @return {time.Duration}
+ */
+func BaiduCacheRetention() time.Duration {
+	if g.VP.IsSet("ResultCache.Enable") && !g.VP.GetBool("ResultCache.Enable") {
+		return 0
+	}
+	retentionHour := 24
+	if g.VP.GetInt("ResultCache.RetentionHour") > 0 {
+		retentionHour = g.VP.GetInt("ResultCache.RetentionHour")
+	}
+	return time.Duration(retentionHour) * time.Hour
+}
+
+// 缓存的key：工具id/图片的md5_接口参数的md5，参数可能是接口名或者返回类型
+func baiduCacheKey(task *model.ImgTask, params string) string {
+	return fmt.Sprintf("%s/%d/%s_%s", BaiduCacheDir, task.ToolId, MD5.MD5(string(task.ImgByte)), MD5.MD5(params)[:8])
+}
+
+/**
+ * @description: 查找task.ImgByte在该工具和参数下的百度接口结果，没有缓存或者已经过期时返回nil
+ * @param {*model.ImgTask} task
+ * @param {string} params 调用百度接口的参数
+ * @return {[]byte} 百度返回的图片
+ */
+func getBaiduCache(task *model.ImgTask, params string) []byte {
+	retention := BaiduCacheRetention()
+	if retention <= 0 {
+		return nil
+	}
+	ctx := task.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	key := baiduCacheKey(task, params)
+	info, err := storage.Default().Stat(ctx, key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			task.Log.Error("查询百度接口结果缓存失败", err)
+		}
+		return nil
+	}
+	if time.Since(info.ModTime) > retention { // 还没来得及被定时任务删除
+		return nil
+	}
+	imgByte, err := storage.ReadAll(ctx, key)
+	if err != nil {
+		task.Log.Error("读取百度接口结果缓存失败", err)
+		return nil
+	}
+	task.Log.Info("使用百度接口结果缓存", key)
+	return imgByte
+}
+
+/**
+ * @description: 保存百度接口的结果，保存失败只记录日志，不影响任务
+ * @param {*model.ImgTask} task
+ * @param {string} params 调用百度接口的参数
+ * @param {[]byte} imgByte 百度返回的图片
+ * @return {*}
+ */
+func setBaiduCache(task *model.ImgTask, params string, imgByte []byte) {
+	if BaiduCacheRetention() <= 0 {
+		return
+	}
+	ctx := task.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := storage.PutBytes(ctx, baiduCacheKey(task, params), imgByte); err != nil {
+		task.Log.Error("保存百度接口结果缓存失败", err)
+	}
+}
@@ -0,0 +1,418 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 04:15:32
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 04:15:32
+ * @Description: 按目标大小压缩：二分查找满足大小的最高质量，质量降到最低还不够时缩小分辨率，可以设置和原图相比的SSIM或PSNR下限
+ * jpg、webp和avif调整编码质量，png用pngquant调整量化的质量
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"src/app/model"
+	g "src/global"
+	"sync/atomic"
+	"time"
+
+	"github.com/ultimate-guitar/go-imagequant"
+	"gocv.io/x/gocv"
+)
+
+const (
+	maxScaleTimes   = 6    // 最多缩小分辨率的次数
+	minCompressSide = 16   // 缩小分辨率时短边不小于这个值
+	metricMaxSide   = 1024 // 计算SSIM和PSNR时缩小到的长边，大图逐像素计算太慢
+
+	imWriteAvifQuality = 512   // opencv 4.9以上的IMWRITE_AVIF_QUALITY，gocv还没有这个常量
+	webpMaxSide        = 16383 // webp的最大宽高，超过时opencv会抛异常导致程序崩溃
+
+	avifProbeEnv = "TOOLSJ_AVIF_PROBE" // 设置了该环境变量的进程只探测avif编码，不启动服务
+)
+
+var avifEnabled atomic.Bool // 启动时探测通过后才打开
+
+// 直接提示给用户的错误
+var (
+	errQualityFloor = errors.New("在画质不低于要求的情况下无法压缩到目标大小，请调大目标大小或降低画质要求") // 有画质下限时压不到目标大小
+	errWebpTooLarge = errors.New("图片的宽高超过了webp的限制16383")
+)
+
+// 压缩的目标
+type CompressTarget struct {
+	NeedSize int     `json:"need_size"`          // 目标大小，单位byte
+	MinSsim  float64 `json:"min_ssim,omitempty"` // 和原图相比的SSIM下限，(0,1]，0表示不限制
+	MinPsnr  float64 `json:"min_psnr,omitempty"` // 和原图相比的PSNR下限，单位dB，0表示不限制
+}
+
+// 最终选择的压缩参数，返回给前端
+type CompressPlan struct {
+	Quality int     `json:"quality"` // jpg、webp的编码质量，png的量化质量，都是[0,100]
+	Scale   float64 `json:"scale"`   // 分辨率的缩放比例，1表示没有缩小
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Size    int     `json:"size"`    // 压缩后的大小，单位byte
+	Ssim    float64 `json:"ssim"`    // 和原图相比的SSIM
+	Psnr    float64 `json:"psnr"`    // 和原图相比的PSNR，单位dB，完全一样时为100
+	Reached bool    `json:"reached"` // 是否达到了目标大小，没有画质下限时即使达不到也返回最小的结果
+	Encodes int     `json:"encodes"` // 编码的次数
+}
+
+// 一次压缩的尝试
+type compressCandidate struct {
+	plan     CompressPlan
+	fileByte []byte
+}
+
+/**
+ * @description: 是否支持输出avif，配置了Compress.Avif并且启动时探测通过
+ * @return {bool}
+ */
+func AvifEnabled() bool {
+	return avifEnabled.Load()
+}
+
+/**
+ * @description: 启动时检查opencv是否能编码avif，配置了Compress.Avif才检查。
+ * gocv调用的imencode不会捕获异常，opencv不支持时编码会直接崩溃，所以先看版本是否在4.9以上，再在子进程里编码一张1x1的图片试试
+ * @return {error} 不支持的原因，返回错误时不提供avif格式，不影响其他功能
+ */
+func InitAvif() error {
+	avifEnabled.Store(false)
+	if !g.VP.GetBool("Compress.Avif") {
+		return nil
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(gocv.OpenCVVersion(), "%d.%d", &major, &minor); err != nil || major < 4 || (major == 4 && minor < 9) {
+		return fmt.Errorf("opencv的版本%s低于4.9，不支持avif", gocv.OpenCVVersion())
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), avifProbeEnv+"=1")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("opencv编码avif失败，可能编译时没有带libavif：%v %s", err, bytes.TrimSpace(output))
+	}
+	avifEnabled.Store(true)
+	return nil
+}
+
+/**
+ * @description: 在InitAvif启动的子进程里编码一张1x1的avif，成功时退出码为0。不是子进程时直接返回，需要在main的最开始调用
+ * @return {*}
+ */
+func AvifProbe() {
+	if os.Getenv(avifProbeEnv) == "" {
+		return
+	}
+	mat := gocv.NewMatWithSize(1, 1, gocv.MatTypeCV8UC3)
+	defer mat.Close()
+	buf, err := gocv.IMEncodeWithParams(".avif", mat, []int{imWriteAvifQuality, 50}) // 不支持时这里会直接崩溃
+	if err != nil || buf.Len() == 0 {
+		os.Exit(1)
+	}
+	buf.Close()
+	os.Exit(0)
+}
+
+/**
+ * @description: 按目标大小压缩task.Mat，格式是task.Suffix
+ * @param {*model.ImgTask} task
+ * @param {CompressTarget} target
+ * @return {*CompressPlan} 选择的参数
+ * @return {[]byte} 压缩后的图片，有画质下限且达不到目标时返回错误
+ * @return {error}
+ */
+func optimizeSize(task *model.ImgTask, target CompressTarget) (*CompressPlan, []byte, error) {
+	reference := metricReference(task.Mat)
+	defer reference.Close()
+	minQuality := 0
+	if task.Suffix == "webp" { // webp的质量最低是1
+		minQuality = 1
+	}
+	encodes := 0
+	var smallest *compressCandidate // 没有画质下限时，达不到目标就返回最小的
+	scale := 1.0
+	for times := 0; times <= maxScaleTimes; times++ {
+		mat := scaleMat(task.Mat, scale)
+		// 二分查找不超过目标大小的最高质量
+		var best *compressCandidate
+		for lo, hi := minQuality, 100; lo <= hi; {
+			quality := (lo + hi) / 2
+			fileByte, err := encodeWithQuality(mat, task.Suffix, quality)
+			encodes++
+			if err != nil {
+				mat.Close()
+				return nil, nil, err
+			}
+			candidate := &compressCandidate{plan: CompressPlan{Quality: quality, Scale: scale, Width: mat.Cols(), Height: mat.Rows(), Size: len(fileByte)}, fileByte: fileByte}
+			if smallest == nil || candidate.plan.Size < smallest.plan.Size {
+				smallest = candidate
+			}
+			if len(fileByte) <= target.NeedSize {
+				best, lo = candidate, quality+1
+			} else {
+				hi = quality - 1
+			}
+		}
+		mat.Close()
+
+		if best != nil {
+			best.plan.Ssim, best.plan.Psnr = compareQuality(reference, best.fileByte)
+			if (target.MinSsim <= 0 || best.plan.Ssim >= target.MinSsim) && (target.MinPsnr <= 0 || best.plan.Psnr >= target.MinPsnr) {
+				best.plan.Reached, best.plan.Encodes = true, encodes
+				return &best.plan, best.fileByte, nil
+			}
+			// 画质不够，缩小分辨率后可以用更高的质量，再试一次
+			task.Log.Info("压缩后画质低于下限，缩小分辨率再试", best.plan)
+			scale *= 0.85
+		} else {
+			// 按大小和像素数成正比估计需要缩小的比例，多缩一点，避免多试一次
+			scale *= min(0.9, max(0.5, math.Sqrt(float64(target.NeedSize)/float64(smallest.plan.Size))*0.95))
+		}
+		if float64(min(task.Mat.Rows(), task.Mat.Cols()))*scale < minCompressSide {
+			break
+		}
+	}
+	if target.MinSsim > 0 || target.MinPsnr > 0 {
+		return nil, nil, errQualityFloor
+	}
+	smallest.plan.Ssim, smallest.plan.Psnr = compareQuality(reference, smallest.fileByte)
+	smallest.plan.Encodes = encodes
+	return &smallest.plan, smallest.fileByte, nil
+}
+
+// 按比例缩小，比例为1时复制一份，调用方负责Close
+func scaleMat(mat gocv.Mat, scale float64) gocv.Mat {
+	if scale >= 1 {
+		return mat.Clone()
+	}
+	scaled := gocv.NewMat()
+	size := image.Pt(max(1, int(float64(mat.Cols())*scale)), max(1, int(float64(mat.Rows())*scale)))
+	gocv.Resize(mat, &scaled, size, 0, 0, gocv.InterpolationArea)
+	return scaled
+}
+
+/**
+ * @description: 按格式和质量编码
+ * @param {gocv.Mat} mat
+ * @param {string} suffix jpg webp avif png
+ * @param {int} quality [0,100]
+ * @return {[]byte}
+ * @return {error}
+ */
+func encodeWithQuality(mat gocv.Mat, suffix string, quality int) ([]byte, error) {
+	var buf *gocv.NativeByteBuffer
+	var err error
+	switch suffix {
+	case "jpg", "jpeg":
+		buf, err = gocv.IMEncodeWithParams(gocv.JPEGFileExt, mat, []int{gocv.IMWriteJpegQuality, quality})
+	case "webp":
+		if max(mat.Rows(), mat.Cols()) > webpMaxSide {
+			return nil, errWebpTooLarge
+		}
+		buf, err = gocv.IMEncodeWithParams(".webp", mat, []int{gocv.IMWriteWebpQuality, max(quality, 1)})
+	case "avif":
+		if !AvifEnabled() {
+			return nil, errors.New("没有开启avif格式")
+		}
+		buf, err = gocv.IMEncodeWithParams(".avif", mat, []int{imWriteAvifQuality, quality})
+	case "png":
+		return pngQuantize(mat, quality)
+	default:
+		return nil, errors.New("不支持的压缩格式" + suffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return bytes.Clone(buf.GetBytes()), nil
+}
+
+// 16位的图片转为8位。opencv编码jpg、webp时会自动转换，但不会缩放，结果几乎是一片白
+func to8Bit(mat *gocv.Mat) {
+	if mat.Type()&7 == gocv.MatTypeCV16U {
+		mat.ConvertToWithParams(mat, gocv.MatTypeCV8U, 1.0/257, 0)
+	}
+}
+
+// 用pngquant把png量化为最多256色，quality越低颜色越少，文件越小
+func pngQuantize(mat gocv.Mat, quality int) ([]byte, error) {
+	rgba := gocv.NewMat()
+	defer rgba.Close()
+	switch mat.Channels() {
+	case 1:
+		gocv.CvtColor(mat, &rgba, gocv.ColorGrayToRGBA)
+	case 3:
+		gocv.CvtColor(mat, &rgba, gocv.ColorBGRToRGBA)
+	case 4:
+		gocv.CvtColor(mat, &rgba, gocv.ColorBGRAToRGBA)
+	default:
+		return nil, errors.New("图片通道数不支持")
+	}
+	if rgba.Type() != gocv.MatTypeCV8UC4 { // 16位的png
+		rgba.ConvertToWithParams(&rgba, gocv.MatTypeCV8UC4, 1.0/257, 0)
+	}
+	attr, err := imagequant.NewAttributes()
+	if err != nil {
+		return nil, err
+	}
+	defer attr.Release()
+	if err = attr.SetSpeed(4); err != nil {
+		return nil, err
+	}
+	if err = attr.SetQuality(0, quality); err != nil {
+		return nil, err
+	}
+	liqImage, err := imagequant.NewImage(attr, string(rgba.ToBytes()), rgba.Cols(), rgba.Rows(), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer liqImage.Release()
+	result, err := liqImage.Quantize(attr)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Release()
+	indexes, err := result.WriteRemappedImage()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+	if err = encoder.Encode(&out, imagequant.Rgb8PaletteToGoImage(result.GetImageWidth(), result.GetImageHeight(), indexes, result.GetPalette())); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// 计算画质用的原图：灰度、float32，长边不超过metricMaxSide
+func metricReference(mat gocv.Mat) gocv.Mat {
+	gray := gocv.NewMat()
+	switch mat.Channels() {
+	case 3:
+		gocv.CvtColor(mat, &gray, gocv.ColorBGRToGray)
+	case 4:
+		gocv.CvtColor(mat, &gray, gocv.ColorBGRAToGray)
+	default:
+		mat.CopyTo(&gray)
+	}
+	if longSide := max(gray.Rows(), gray.Cols()); longSide > metricMaxSide {
+		scale := float64(metricMaxSide) / float64(longSide)
+		gocv.Resize(gray, &gray, image.Pt(max(1, int(float64(gray.Cols())*scale)), max(1, int(float64(gray.Rows())*scale))), 0, 0, gocv.InterpolationArea)
+	}
+	if gray.Type() == gocv.MatTypeCV16UC1 {
+		gray.ConvertToWithParams(&gray, gocv.MatTypeCV32F, 1.0/257, 0)
+	} else {
+		gray.ConvertTo(&gray, gocv.MatTypeCV32F)
+	}
+	return gray
+}
+
+/**
+ * @description: 压缩结果和原图比较画质，压缩结果缩放到和reference一样大再比较
+ * @param {gocv.Mat} reference metricReference的结果
+ * @param {[]byte} fileByte 压缩后的图片
+ * @return {float64} SSIM
+ * @return {float64} PSNR，单位dB
+ */
+func compareQuality(reference gocv.Mat, fileByte []byte) (float64, float64) {
+	img, err := gocv.IMDecode(fileByte, gocv.IMReadGrayScale)
+	if err != nil || img.Empty() {
+		img.Close()
+		return 0, 0
+	}
+	defer img.Close()
+	compressed := gocv.NewMat()
+	defer compressed.Close()
+	interpolation := gocv.InterpolationArea
+	if img.Cols() < reference.Cols() {
+		interpolation = gocv.InterpolationLinear
+	}
+	gocv.Resize(img, &compressed, image.Pt(reference.Cols(), reference.Rows()), 0, 0, interpolation)
+	compressed.ConvertTo(&compressed, gocv.MatTypeCV32F)
+	return math.Round(ssim(reference, compressed)*10000) / 10000, math.Round(psnr(reference, compressed)*100) / 100
+}
+
+// 峰值信噪比，两张图完全一样时返回100
+func psnr(a gocv.Mat, b gocv.Mat) float64 {
+	diff := gocv.NewMat()
+	defer diff.Close()
+	gocv.AbsDiff(a, b, &diff)
+	gocv.Multiply(diff, diff, &diff)
+	mse := diff.Mean().Val1
+	if mse <= 1e-10 {
+		return 100
+	}
+	return min(100, 10*math.Log10(255*255/mse))
+}
+
+// 结构相似性，按OpenCV文档的实现，11*11的高斯窗口
+func ssim(a gocv.Mat, b gocv.Mat) float64 {
+	const c1, c2 = 6.5025, 58.5225 // (0.01*255)^2 (0.03*255)^2
+	var mats []gocv.Mat
+	defer func() {
+		for _, mat := range mats {
+			mat.Close()
+		}
+	}()
+	newMat := func() gocv.Mat {
+		mat := gocv.NewMat()
+		mats = append(mats, mat)
+		return mat
+	}
+	blur := func(src gocv.Mat) gocv.Mat {
+		dst := newMat()
+		gocv.GaussianBlur(src, &dst, image.Pt(11, 11), 1.5, 0, gocv.BorderDefault)
+		return dst
+	}
+	multiply := func(x gocv.Mat, y gocv.Mat) gocv.Mat {
+		dst := newMat()
+		gocv.Multiply(x, y, &dst)
+		return dst
+	}
+
+	mu1, mu2 := blur(a), blur(b)
+	mu1Sq, mu2Sq, mu1Mu2 := multiply(mu1, mu1), multiply(mu2, mu2), multiply(mu1, mu2)
+	sigma1Sq, sigma2Sq, sigma12 := blur(multiply(a, a)), blur(multiply(b, b)), blur(multiply(a, b))
+	gocv.Subtract(sigma1Sq, mu1Sq, &sigma1Sq)
+	gocv.Subtract(sigma2Sq, mu2Sq, &sigma2Sq)
+	gocv.Subtract(sigma12, mu1Mu2, &sigma12)
+
+	// (2*mu1*mu2+c1)*(2*sigma12+c2) / ((mu1^2+mu2^2+c1)*(sigma1^2+sigma2^2+c2))
+	mu1Mu2.MultiplyFloat(2)
+	mu1Mu2.AddFloat(c1)
+	sigma12.MultiplyFloat(2)
+	sigma12.AddFloat(c2)
+	numerator := multiply(mu1Mu2, sigma12)
+	gocv.Add(mu1Sq, mu2Sq, &mu1Sq)
+	mu1Sq.AddFloat(c1)
+	gocv.Add(sigma1Sq, sigma2Sq, &sigma1Sq)
+	sigma1Sq.AddFloat(c2)
+	denominator := multiply(mu1Sq, sigma1Sq)
+	ssimMap := newMat()
+	gocv.Divide(numerator, denominator, &ssimMap)
+	return ssimMap.Mean().Val1
+}
+
+// 把压缩失败的原因转为给用户的提示，画质下限的错误直接提示，其他的是未知错误
+func compressErrMsg(task *model.ImgTask, err error) string {
+	if errors.Is(err, errQualityFloor) || errors.Is(err, errWebpTooLarge) {
+		return err.Error()
+	}
+	task.Log.Error("按目标大小压缩失败", err)
+	return g.UnknownErrorMsg
+}
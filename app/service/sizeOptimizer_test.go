@@ -0,0 +1,192 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 14:36:18
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 14:36:18
+ * @Description: 按目标大小压缩的测试：二分查找的质量、缩小分辨率的回退和画质下限。需要opencv
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"errors"
+	"os"
+	"src/app/model"
+	g "src/global"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gocv.io/x/gocv"
+)
+
+func TestMain(m *testing.M) {
+	g.VP = viper.New()
+	g.ZapLog = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// 生成有渐变和细节的测试图片，纯色图片压缩后太小，测不出二分查找
+func testCompressMat(t *testing.T, rows int, cols int) gocv.Mat {
+	mat := gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV8UC3)
+	data, err := mat.DataPtrUint8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := uint32(1)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			seed = seed*1664525 + 1013904223 // 固定种子的伪随机噪点，每次运行结果一样
+			noise := int(seed>>24) % 40
+			p := (y*cols + x) * 3
+			data[p] = byte((x*255/cols + noise) % 256)
+			data[p+1] = byte((y*255/rows + noise) % 256)
+			data[p+2] = byte(((x+y)*4 + noise) % 256)
+		}
+	}
+	return mat
+}
+
+func newCompressTask(t *testing.T, suffix string) *model.ImgTask {
+	task := &model.ImgTask{Suffix: suffix}
+	task.Log = &g.Log{RequestUrl: "test"}
+	task.Mat = testCompressMat(t, 300, 400)
+	t.Cleanup(func() { task.Mat.Close() })
+	return task
+}
+
+func TestOptimizeSizeQuality(t *testing.T) {
+	for _, suffix := range []string{"jpg", "webp", "png"} {
+		t.Run(suffix, func(t *testing.T) {
+			task := newCompressTask(t, suffix)
+			// 先看最高质量的大小，目标设为它的一半，不需要缩小分辨率就能达到
+			full, err := encodeWithQuality(task.Mat, suffix, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := CompressTarget{NeedSize: len(full) / 2}
+			plan, fileByte, err := optimizeSize(task, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !plan.Reached || plan.Size > target.NeedSize || plan.Size != len(fileByte) {
+				t.Fatalf("应该达到目标大小%d：%+v", target.NeedSize, plan)
+			}
+			if plan.Scale != 1 || plan.Width != 400 || plan.Height != 300 {
+				t.Fatalf("不需要缩小分辨率：%+v", plan)
+			}
+			// 二分查找的是满足大小的最高质量，再高一级就超过目标了。pngquant的大小和质量不是严格单调的，不检查
+			if plan.Quality < 100 && suffix != "png" {
+				higher, err := encodeWithQuality(task.Mat, suffix, plan.Quality+1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(higher) <= target.NeedSize {
+					t.Fatalf("质量%d也满足目标大小，没有选到最高的质量%d", plan.Quality+1, plan.Quality)
+				}
+			}
+			if plan.Encodes > 8 { // [0,100]二分最多7、8次
+				t.Fatalf("编码次数太多：%d", plan.Encodes)
+			}
+			if plan.Ssim <= 0 || plan.Ssim > 1 || plan.Psnr <= 0 {
+				t.Fatalf("画质指标不正确：%+v", plan)
+			}
+		})
+	}
+}
+
+func TestOptimizeSizeScale(t *testing.T) {
+	task := newCompressTask(t, "jpg")
+	smallest, err := encodeWithQuality(task.Mat, "jpg", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 质量最低也达不到，需要缩小分辨率
+	target := CompressTarget{NeedSize: len(smallest) / 3}
+	plan, fileByte, err := optimizeSize(task, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Reached || len(fileByte) > target.NeedSize {
+		t.Fatalf("缩小分辨率后应该达到目标大小%d：%+v", target.NeedSize, plan)
+	}
+	if plan.Scale >= 1 || plan.Width >= 400 || plan.Height >= 300 {
+		t.Fatalf("应该缩小了分辨率：%+v", plan)
+	}
+	img, err := gocv.IMDecode(fileByte, gocv.IMReadUnchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Cols() != plan.Width || img.Rows() != plan.Height {
+		t.Fatalf("结果的大小%dx%d和返回的%dx%d不一致", img.Cols(), img.Rows(), plan.Width, plan.Height)
+	}
+}
+
+func TestOptimizeSizeUnreachable(t *testing.T) {
+	task := newCompressTask(t, "jpg")
+	// 缩到最小也达不到，没有画质下限时返回最小的结果
+	plan, fileByte, err := optimizeSize(task, CompressTarget{NeedSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Reached || len(fileByte) == 0 || plan.Size != len(fileByte) {
+		t.Fatalf("应该返回没有达到目标的最小结果：%+v", plan)
+	}
+
+	// 有画质下限时返回错误
+	_, _, err = optimizeSize(task, CompressTarget{NeedSize: 10, MinSsim: 0.9})
+	if !errors.Is(err, errQualityFloor) {
+		t.Fatalf("应该返回errQualityFloor，实际%v", err)
+	}
+}
+
+func TestOptimizeSizeQualityFloor(t *testing.T) {
+	task := newCompressTask(t, "jpg")
+	full, err := encodeWithQuality(task.Mat, "jpg", 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := CompressTarget{NeedSize: len(full) / 4}
+	noFloor, _, err := optimizeSize(task, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 要求的画质比不限制时高，只能缩小分辨率换更高的质量，或者达不到
+	target.MinPsnr = noFloor.Psnr + 1
+	plan, _, err := optimizeSize(task, target)
+	if errors.Is(err, errQualityFloor) {
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Psnr < target.MinPsnr || plan.Size > target.NeedSize || plan.Scale >= 1 {
+		t.Fatalf("结果应该满足画质下限并且缩小了分辨率：%+v", plan)
+	}
+}
+
+func TestCompareQuality(t *testing.T) {
+	mat := testCompressMat(t, 300, 400)
+	defer mat.Close()
+	reference := metricReference(mat)
+	defer reference.Close()
+	lossless, err := gocv.IMEncode(gocv.PNGFileExt, mat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lossless.Close()
+	if ssim, psnr := compareQuality(reference, lossless.GetBytes()); ssim < 0.9999 || psnr != 100 {
+		t.Fatalf("无损的结果ssim=%v psnr=%v，期望1和100", ssim, psnr)
+	}
+	high, _ := encodeWithQuality(mat, "jpg", 95)
+	low, _ := encodeWithQuality(mat, "jpg", 5)
+	highSsim, highPsnr := compareQuality(reference, high)
+	lowSsim, lowPsnr := compareQuality(reference, low)
+	if highSsim <= lowSsim || highPsnr <= lowPsnr {
+		t.Fatalf("质量高的画质指标应该更高：%v/%v %v/%v", highSsim, highPsnr, lowSsim, lowPsnr)
+	}
+	if ssim, psnr := compareQuality(reference, []byte("not an image")); ssim != 0 || psnr != 0 {
+		t.Fatal("解码失败时应该返回0")
+	}
+}
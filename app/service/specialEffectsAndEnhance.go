@@ -9,10 +9,13 @@
 package service
 
 import (
+	"encoding/base64"
 	"src/app/model"
 	"src/app/service/outApi"
 	g "src/global"
 	"src/utils/base"
+
+	"gocv.io/x/gocv"
 )
 
 /**
@@ -23,13 +26,23 @@ import (
  */
 func Generic(task *model.ImgTask, api string, errMsg string) {
 	// 之前已有相同的文件被处理过，所以只需要拿之前的结果重新处理即可
-	ee := outApi.EffectsEnhancementPost(task, api, errMsg)
-	if task.ErrMsg != "" {
-		return
+	imgByte := getBaiduCache(task, api)
+	if imgByte == nil {
+		ee := outApi.EffectsEnhancementPost(task, api, errMsg)
+		if task.ErrMsg != "" {
+			return
+		}
+		go base.OutApiCall(task.ToolId) // 记录api访问成功次数
+		var err error
+		if imgByte, err = base64.StdEncoding.DecodeString(ee.GetImage()); err != nil {
+			task.Log.Error(errMsg, err)
+			task.ErrMsg = g.UnknownErrorMsg
+			return
+		}
+		setBaiduCache(task, api, imgByte)
 	}
-	go base.OutApiCall(task.ToolId) // 记录api访问成功次数
 	var err error
-	task.Mat, err = ImgStr2RGB(ee.GetImage())
+	task.Mat, err = gocv.IMDecode(imgByte, gocv.IMReadUnchanged)
 	if err != nil {
 		task.Log.Error(errMsg, err)
 		task.ErrMsg = g.UnknownErrorMsg
@@ -39,7 +52,7 @@ func Generic(task *model.ImgTask, api string, errMsg string) {
 		return
 	}
 	// 加水印后保存水印照
-	ImgWatermark(task.Mat)
+	ImgWatermark(task.ToolId, task.Mat)
 	if task.ResultPath = GocvSaveImg(task, "water_", -1); task.ErrMsg != "" {
 		return
 	}
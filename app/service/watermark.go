@@ -0,0 +1,400 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 02:41:15
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 02:41:15
+ * @Description: 结果预览图的水印。支持图片水印和文字水印，可以设置不透明度、旋转角度、平铺的间距或者放在角落，按工具选择水印
+ * 水印在启动时按配置生成好，保存为只读的字节，多个请求同时使用不需要加锁，修改配置后可以重新加载，不需要重启
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package service
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	g "src/global"
+	"src/utils/fontRender"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gocv.io/x/gocv"
+)
+
+// 水印的位置
+const (
+	WatermarkTile        = "tile" // 平铺整张图片
+	WatermarkCenter      = "center"
+	WatermarkTopLeft     = "top_left"
+	WatermarkTopRight    = "top_right"
+	WatermarkBottomLeft  = "bottom_left"
+	WatermarkBottomRight = "bottom_right"
+)
+
+// 水印的样式，对应配置文件Watermark.Styles下的一项
+type WatermarkStyle struct {
+	Type      string  // image 图片水印，text 文字水印
+	Image     string  // 图片水印的路径，图片中亮度大于30的部分作为水印，其余透明
+	Text      string  // 文字水印的内容
+	FontFile  string  // TTF/OTF字体文件的路径，配置后用该字体渲染，可以写中文；为空时使用OpenCV自带的Hershey字体，只支持英文、数字和符号
+	FontSize  float64 // FontFile的字号，像素，未配置时为32
+	Font      string  // Hershey字体：simplex plain duplex complex triplex complex_small script_simplex script_complex
+	Italic    bool    // Hershey字体是否斜体
+	FontScale float64 // Hershey字体的缩放
+	Thickness int     // Hershey字体笔画的粗细
+	Color     []int   // 文字的颜色，RGB
+	Opacity   float64 // 不透明度，(0,1]，未配置时为1
+	Angle     float64 // 逆时针旋转的角度
+	Spacing   int     // 平铺时水印之间的间距，像素
+	Position  string  // 位置，见上面的常量，未配置时平铺
+	Margin    int     // 不平铺时离图片边缘的距离，像素
+}
+
+// 生成好的水印，创建后只读
+type watermark struct {
+	width, height int
+	bgr           []byte // 水印的颜色，3通道
+	alpha         []byte // 每个像素的不透明度，已经乘上了Opacity，0表示不覆盖
+	spacing       int
+	position      string
+	margin        int
+}
+
+// 当前使用的水印配置，重新加载时整体替换
+type watermarkConfig struct {
+	styles       map[string]*watermark // 按样式名，viper读取的key都是小写的
+	tools        map[uint8]string      // 工具单独配置的样式名
+	defaultStyle string
+}
+
+var (
+	watermarkLock    sync.RWMutex
+	currentWatermark *watermarkConfig
+)
+
+var hersheyFonts = map[string]gocv.HersheyFont{
+	"simplex":        gocv.FontHersheySimplex,
+	"plain":          gocv.FontHersheyPlain,
+	"duplex":         gocv.FontHersheyDuplex,
+	"complex":        gocv.FontHersheyComplex,
+	"triplex":        gocv.FontHersheyTriplex,
+	"complex_small":  gocv.FontHersheyComplexSmall,
+	"script_simplex": gocv.FontHersheyScriptSimplex,
+	"script_complex": gocv.FontHersheyScriptComplex,
+}
+
+/**
+ * @description: 从配置文件加载水印，可重复调用。没有配置Watermark.Styles时使用WaterImg的图片平铺，和以前的水印一样
+ * @return {error} 配置有误时返回错误，原来的水印继续使用
+ */
+func LoadWatermark() error {
+	styles := make(map[string]WatermarkStyle)
+	if err := g.VP.UnmarshalKey("Watermark.Styles", &styles); err != nil {
+		return err
+	}
+	defaultStyle := strings.ToLower(g.VP.GetString("Watermark.Default"))
+	if len(styles) == 0 {
+		styles["image"] = WatermarkStyle{Type: "image", Image: g.VP.GetString("WaterImg"), Spacing: 200}
+		defaultStyle = "image"
+	}
+	config := &watermarkConfig{styles: make(map[string]*watermark), tools: make(map[uint8]string), defaultStyle: defaultStyle}
+	for name, style := range styles {
+		mark, err := newWatermark(style)
+		if err != nil {
+			return fmt.Errorf("水印%s：%w", name, err)
+		}
+		config.styles[name] = mark
+	}
+	if _, ok := config.styles[defaultStyle]; !ok {
+		return fmt.Errorf("默认水印%s不存在", defaultStyle)
+	}
+	for toolIdStr, name := range g.VP.GetStringMapString("Watermark.Tools") {
+		toolId, err := strconv.Atoi(toolIdStr)
+		if err != nil || toolId <= 0 || toolId > math.MaxUint8 {
+			return fmt.Errorf("水印配置的工具id%s不正确", toolIdStr)
+		}
+		name = strings.ToLower(name)
+		if _, ok := config.styles[name]; !ok {
+			return fmt.Errorf("工具%d的水印%s不存在", toolId, name)
+		}
+		config.tools[uint8(toolId)] = name
+	}
+	watermarkLock.Lock()
+	currentWatermark = config
+	watermarkLock.Unlock()
+	return nil
+}
+
+// 取得工具使用的水印，没有加载时返回nil
+func getWatermark(toolId uint8) *watermark {
+	watermarkLock.RLock()
+	defer watermarkLock.RUnlock()
+	if currentWatermark == nil {
+		return nil
+	}
+	if name, ok := currentWatermark.tools[toolId]; ok {
+		return currentWatermark.styles[name]
+	}
+	return currentWatermark.styles[currentWatermark.defaultStyle]
+}
+
+/**
+ * @description: 给图片添加工具对应的水印，直接修改img，支持1、3、4通道的8位图片
+ * @param {uint8} toolId 工具id，按工具选择水印
+ * @param {gocv.Mat} img
+ * @return {*}
+ */
+func ImgWatermark(toolId uint8, img gocv.Mat) {
+	thisLog := g.Log{RequestUrl: "ImgWatermark"}
+	mark := getWatermark(toolId)
+	if mark == nil {
+		thisLog.Error("水印没有加载")
+		return
+	}
+	channels := img.Channels()
+	if channels != 1 && channels != 3 && channels != 4 {
+		thisLog.Warn("图片通道数不支持", channels)
+		return
+	}
+	if !img.IsContinuous() {
+		thisLog.Warn("图片的数据不连续，不能添加水印", nil)
+		return
+	}
+	data, err := img.DataPtrUint8()
+	if err != nil {
+		thisLog.Error("读取图片数据失败", err)
+		return
+	}
+	rows, cols := img.Rows(), img.Cols()
+	for _, pos := range mark.positions(rows, cols) {
+		mark.blend(data, rows, cols, channels, pos)
+	}
+}
+
+// 水印左上角在图片上的位置，可能超出图片，绘制时会裁掉
+func (w *watermark) positions(rows int, cols int) []image.Point {
+	right, bottom := cols-w.width-w.margin, rows-w.height-w.margin
+	switch w.position {
+	case WatermarkCenter:
+		return []image.Point{{X: (cols - w.width) / 2, Y: (rows - w.height) / 2}}
+	case WatermarkTopLeft:
+		return []image.Point{{X: w.margin, Y: w.margin}}
+	case WatermarkTopRight:
+		return []image.Point{{X: right, Y: w.margin}}
+	case WatermarkBottomLeft:
+		return []image.Point{{X: w.margin, Y: bottom}}
+	case WatermarkBottomRight:
+		return []image.Point{{X: right, Y: bottom}}
+	}
+	var points []image.Point
+	for y := 0; y < rows; y += w.height + w.spacing {
+		for x := 0; x < cols; x += w.width + w.spacing {
+			points = append(points, image.Pt(x, y))
+		}
+	}
+	return points
+}
+
+// 把水印按不透明度叠加到图片的pos位置。透明图片的透明度也叠加，水印在透明的地方同样可见
+func (w *watermark) blend(data []byte, rows int, cols int, channels int, pos image.Point) {
+	area := image.Rect(pos.X, pos.Y, pos.X+w.width, pos.Y+w.height).Intersect(image.Rect(0, 0, cols, rows))
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			i := (y-pos.Y)*w.width + (x - pos.X)
+			a := int(w.alpha[i])
+			if a == 0 {
+				continue
+			}
+			p := (y*cols + x) * channels
+			b, gr, r := int(w.bgr[i*3]), int(w.bgr[i*3+1]), int(w.bgr[i*3+2])
+			switch channels {
+			case 1:
+				gray := (b*114 + gr*587 + r*299) / 1000
+				data[p] = byte((gray*a + int(data[p])*(255-a)) / 255)
+			case 3:
+				data[p] = byte((b*a + int(data[p])*(255-a)) / 255)
+				data[p+1] = byte((gr*a + int(data[p+1])*(255-a)) / 255)
+				data[p+2] = byte((r*a + int(data[p+2])*(255-a)) / 255)
+			case 4:
+				// 按透明度叠加：outA = a + imgA*(1-a)，颜色按各自的权重加权
+				imgA := int(data[p+3]) * (255 - a) / 255
+				outA := a + imgA
+				data[p] = byte((b*a + int(data[p])*imgA) / outA)
+				data[p+1] = byte((gr*a + int(data[p+1])*imgA) / outA)
+				data[p+2] = byte((r*a + int(data[p+2])*imgA) / outA)
+				data[p+3] = byte(outA)
+			}
+		}
+	}
+}
+
+// 按样式生成水印
+func newWatermark(style WatermarkStyle) (*watermark, error) {
+	opacity := style.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	if opacity < 0 || opacity > 1 {
+		return nil, errors.New("Opacity必须在(0,1]之间")
+	}
+	position := style.Position
+	if position == "" {
+		position = WatermarkTile
+	}
+	switch position {
+	case WatermarkTile, WatermarkCenter, WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight:
+	default:
+		return nil, errors.New("不支持的位置" + position)
+	}
+
+	var stamp, mask gocv.Mat
+	var err error
+	switch style.Type {
+	case "image":
+		stamp, mask, err = imageStamp(style)
+	case "text":
+		stamp, mask, err = textStamp(style)
+	default:
+		return nil, errors.New("Type只能是image或text")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer stamp.Close()
+	defer mask.Close()
+	if style.Angle != 0 {
+		rotateStamp(&stamp, style.Angle)
+		rotateStamp(&mask, style.Angle)
+	}
+
+	alpha := mask.ToBytes()
+	for i, v := range alpha {
+		alpha[i] = byte(math.Round(float64(v) * opacity))
+	}
+	return &watermark{
+		width:    stamp.Cols(),
+		height:   stamp.Rows(),
+		bgr:      stamp.ToBytes(),
+		alpha:    alpha,
+		spacing:  max(style.Spacing, 0),
+		position: position,
+		margin:   max(style.Margin, 0),
+	}, nil
+}
+
+// 图片水印，亮度大于30的部分作为水印
+func imageStamp(style WatermarkStyle) (gocv.Mat, gocv.Mat, error) {
+	stamp := gocv.IMRead(style.Image, gocv.IMReadColor)
+	if stamp.Empty() {
+		stamp.Close()
+		return gocv.NewMat(), gocv.NewMat(), errors.New("读取水印图片失败：" + style.Image)
+	}
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(stamp, &gray, gocv.ColorBGRToGray)
+	mask := gocv.NewMat()
+	gocv.Threshold(gray, &mask, 30, 255, gocv.ThresholdBinary)
+	return stamp, mask, nil
+}
+
+// 文字水印，整块都是文字的颜色，文字的形状在mask里
+func textStamp(style WatermarkStyle) (gocv.Mat, gocv.Mat, error) {
+	if style.Text == "" {
+		return gocv.NewMat(), gocv.NewMat(), errors.New("文字水印的Text不能为空")
+	}
+	textColor := color.RGBA{R: 255, G: 255, B: 255}
+	if len(style.Color) == 3 {
+		textColor = color.RGBA{R: uint8(style.Color[0]), G: uint8(style.Color[1]), B: uint8(style.Color[2])}
+	}
+	var mask gocv.Mat
+	var err error
+	if style.FontFile != "" {
+		mask, err = fontTextMask(style)
+	} else {
+		mask, err = hersheyTextMask(style)
+	}
+	if err != nil {
+		return gocv.NewMat(), gocv.NewMat(), err
+	}
+	stamp := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(float64(textColor.B), float64(textColor.G), float64(textColor.R), 0), mask.Rows(), mask.Cols(), gocv.MatTypeCV8UC3)
+	return stamp, mask, nil
+}
+
+// 用配置的字体文件渲染文字的形状
+func fontTextMask(style WatermarkStyle) (gocv.Mat, error) {
+	font, err := fontRender.LoadFont(style.FontFile)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	fontSize := style.FontSize
+	if fontSize <= 0 {
+		fontSize = 32
+	}
+	alpha, err := fontRender.Render(font, style.Text, fontSize, 2) // 留一点边，旋转时抗锯齿的边缘不被裁掉
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	mask, err := gocv.NewMatFromBytes(alpha.Rect.Dy(), alpha.Rect.Dx(), gocv.MatTypeCV8UC1, alpha.Pix)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer mask.Close()
+	return mask.Clone(), nil // NewMatFromBytes直接引用go的内存，复制一份再使用
+}
+
+// 用OpenCV自带的Hershey字体绘制文字的形状，只支持ASCII字符
+func hersheyTextMask(style WatermarkStyle) (gocv.Mat, error) {
+	for _, r := range style.Text {
+		if r >= utf8.RuneSelf {
+			return gocv.NewMat(), fmt.Errorf("Hershey字体不支持字符%q，请配置FontFile使用TTF/OTF字体", r)
+		}
+	}
+	fontName := style.Font
+	if fontName == "" {
+		fontName = "simplex"
+	}
+	font, ok := hersheyFonts[fontName]
+	if !ok {
+		return gocv.NewMat(), errors.New("不支持的字体" + fontName)
+	}
+	if style.Italic {
+		font |= gocv.FontItalic
+	}
+	fontScale, thickness := style.FontScale, style.Thickness
+	if fontScale <= 0 {
+		fontScale = 1
+	}
+	if thickness <= 0 {
+		thickness = 2
+	}
+
+	size, baseline := gocv.GetTextSizeWithBaseline(style.Text, font, fontScale, thickness)
+	padding := thickness + 2 // 留一点边，抗锯齿的边缘不被裁掉
+	width, height := size.X+2*padding, size.Y+baseline+2*padding
+	mask := gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC1)
+	mask.SetTo(gocv.NewScalar(0, 0, 0, 0))
+	gocv.PutTextWithParams(&mask, style.Text, image.Pt(padding, padding+size.Y), font, fontScale, color.RGBA{R: 255, G: 255, B: 255}, thickness, gocv.LineAA, false)
+	return mask, nil
+}
+
+// 绕中心逆时针旋转，画布扩大到能放下整个旋转后的水印，空出来的部分为0
+func rotateStamp(mat *gocv.Mat, angle float64) {
+	width, height := float64(mat.Cols()), float64(mat.Rows())
+	radian := angle * math.Pi / 180
+	sin, cos := math.Abs(math.Sin(radian)), math.Abs(math.Cos(radian))
+	newWidth, newHeight := int(math.Ceil(width*cos+height*sin)), int(math.Ceil(width*sin+height*cos))
+
+	transform := gocv.GetRotationMatrix2D(image.Pt(mat.Cols()/2, mat.Rows()/2), angle, 1)
+	defer transform.Close()
+	// 平移到新画布的中心
+	transform.SetDoubleAt(0, 2, transform.GetDoubleAt(0, 2)+float64(newWidth-mat.Cols())/2)
+	transform.SetDoubleAt(1, 2, transform.GetDoubleAt(1, 2)+float64(newHeight-mat.Rows())/2)
+	rotated := gocv.NewMat()
+	gocv.WarpAffineWithParams(*mat, &rotated, transform, image.Pt(newWidth, newHeight), gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	mat.Close()
+	*mat = rotated
+}
@@ -0,0 +1,279 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 11:05:27
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 11:05:27
+ * @Description: 封禁台账，记录封禁的原因、来源、时间，并支持任意时长的封禁
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	BanSourceAuto   = "auto"   // 访问超限自动封禁
+	BanSourceManual = "manual" // 通过本地接口手动封禁
+
+	banHistoryMax = 1000 // 最多保留的历史封禁记录条数
+)
+
+// 一条封禁记录
+type banRecord struct {
+	Ip           string `json:"ip"`           // ipv4 为完整地址，ipv6 为 前缀/64
+	Reason       string `json:"reason"`       // 封禁原因
+	Source       string `json:"source"`       // 封禁来源，auto 或 manual
+	StartAt      int64  `json:"startAt"`      // 封禁开始时间，毫秒时间戳
+	ExpireAt     int64  `json:"expireAt"`     // 封禁结束时间，毫秒时间戳，0表示永封
+	LastVisitAt  int64  `json:"lastVisitAt"`  // 封禁期间最后一次访问的时间
+	BlockedTimes int    `json:"blockedTimes"` // 封禁期间被拦截的次数
+	EndAt        int64  `json:"endAt"`        // 实际解封的时间，仅历史记录有值
+	EndReason    string `json:"endReason"`    // 解封原因，仅历史记录有值
+}
+
+// 台账的持久化结构
+type banLedgerFile struct {
+	Active  []*banRecord `json:"active"`
+	History []*banRecord `json:"history"`
+}
+
+/**
+ * @description: 封禁一个ip，和AddBanTime不同，这里的封禁时长不受127分钟的限制，并会记录到台账里
+ * 超过127分钟的封禁，在IpList里标记为-128，由台账记录真正的过期时间，到期后由CheckIPList解封，不会保存到永封文件
+ * @param {string} ipStr 封禁的ip
+ * @param {int} minute 封禁时长，单位分钟，小于等于0表示永封
+ * @param {string} reason 封禁原因
+ * @param {string} source 封禁来源
+ * @return {int8} 同AddBanTime
+ */
+func (i *ipVisitS) Ban(ipStr string, minute int, reason string, source string) int8 {
+	banTime := int8(-128)
+	if minute > 0 && minute < 128 {
+		banTime = int8(-minute)
+	}
+	res := i.AddBanTime(ipStr, banTime)
+	if res == 0 {
+		return 0
+	}
+	var expireAt int64
+	if res != -128 { // 短时封禁会在原来的基础上累加，以累加后的为准
+		expireAt = time.Now().Add(time.Duration(-res) * time.Minute).UnixMilli()
+	} else if minute > 0 {
+		expireAt = time.Now().Add(time.Duration(minute) * time.Minute).UnixMilli()
+	}
+	i.recordBan(IpKey(ipStr), reason, source, expireAt)
+	return res
+}
+
+/**
+ * @description: 写入或更新一条封禁记录，已有永封记录的不会被降级
+ * @param {string} key ipKey 的返回值
+ * @param {int64} expireAt 过期时间，0表示永封
+ * @return {*}
+ */
+func (i *ipVisitS) recordBan(key string, reason string, source string, expireAt int64) {
+	if key == "" {
+		return
+	}
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	record, ok := i.banLedger[key]
+	if !ok {
+		i.banLedger[key] = &banRecord{Ip: key, Reason: reason, Source: source, StartAt: time.Now().UnixMilli(), ExpireAt: expireAt}
+		return
+	}
+	record.Reason = reason
+	record.Source = source
+	if record.ExpireAt != 0 && (expireAt == 0 || expireAt > record.ExpireAt) {
+		record.ExpireAt = expireAt
+	}
+}
+
+/**
+ * @description: Add 中被封禁的ip访问时调用，只在ip处于封禁状态时才会进来，不影响正常访问的性能
+ * @param {string} ipStr
+ * @param {int8} old 访问前的值
+ * @param {int8} res 访问后的值
+ * @return {*}
+ */
+func (i *ipVisitS) onBanVisit(ipStr string, old int8, res int8) {
+	key := IpKey(ipStr)
+	if old >= 0 { // 刚达到访问上限
+		i.recordBan(key, "访问过于频繁", BanSourceAuto, time.Now().Add(time.Duration(-res)*time.Minute).UnixMilli())
+		return
+	}
+	if old != -128 && res == -128 { // 封禁期间仍持续访问，累加到了永封
+		i.recordBan(key, "封禁期间仍持续访问", BanSourceAuto, 0)
+		return
+	}
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	record, ok := i.banLedger[key]
+	if !ok {
+		return
+	}
+	record.LastVisitAt = time.Now().UnixMilli()
+	record.BlockedTimes++
+	if res != -128 && record.ExpireAt != 0 { // 每次访问都会增加封禁时长，同步更新过期时间
+		record.ExpireAt = time.Now().Add(time.Duration(-res) * time.Minute).UnixMilli()
+	}
+}
+
+// 去掉台账里有过期时间的长时封禁。它们在IpList里也是-128，但到期要由台账解封，不能保存到永封文件里，否则重启后就变成永封了
+func (i *ipVisitS) dropLongBans(list []byte, size int, key func([]byte) string) []byte {
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	result := make([]byte, 0, len(list))
+	for j := 0; j+size <= len(list); j += size {
+		if record, ok := i.banLedger[key(list[j:j+size])]; ok && record.ExpireAt != 0 {
+			continue
+		}
+		result = append(result, list[j:j+size]...)
+	}
+	return result
+}
+
+// 结束一条封禁记录，移入历史记录
+func (i *ipVisitS) endBan(key string, endReason string) {
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	i.endBanLocked(key, endReason)
+}
+
+// 同endBan，调用前需持有ledgerLock
+func (i *ipVisitS) endBanLocked(key string, endReason string) {
+	record, ok := i.banLedger[key]
+	if !ok {
+		return
+	}
+	delete(i.banLedger, key)
+	record.EndAt = time.Now().UnixMilli()
+	record.EndReason = endReason
+	i.banHistory = append(i.banHistory, record)
+	if len(i.banHistory) > banHistoryMax {
+		i.banHistory = i.banHistory[len(i.banHistory)-banHistoryMax:]
+	}
+}
+
+// 获取一个ip当前的封禁记录，没有则返回nil
+func (i *ipVisitS) GetBanRecord(ipStr string) *banRecord {
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	record, ok := i.banLedger[IpKey(ipStr)]
+	if !ok {
+		return nil
+	}
+	copyRecord := *record
+	return &copyRecord
+}
+
+// 获取所有正在生效的封禁记录
+func (i *ipVisitS) GetBanList() []banRecord {
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	list := make([]banRecord, 0, len(i.banLedger))
+	for _, v := range i.banLedger {
+		list = append(list, *v)
+	}
+	return list
+}
+
+// 获取历史封禁记录，ipStr不为空时只返回该ip的
+func (i *ipVisitS) GetBanHistory(ipStr string) []banRecord {
+	key := ""
+	if ipStr != "" {
+		key = IpKey(ipStr)
+	}
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	list := make([]banRecord, 0)
+	for _, v := range i.banHistory {
+		if key == "" || v.Ip == key {
+			list = append(list, *v)
+		}
+	}
+	return list
+}
+
+/**
+ * @description: 检查台账，由CheckIPList定时调用。
+ * 到期的长时封禁需要在这里解除IpList中的-128；短时封禁由IpList自己计时，到期后只需要移入历史
+ * @return {*}
+ */
+func (i *ipVisitS) checkBanLedger() {
+	now := time.Now().UnixMilli()
+	expired := make([]string, 0)
+	i.ledgerLock.Lock()
+	for key, v := range i.banLedger {
+		if v.ExpireAt != 0 && v.ExpireAt <= now {
+			expired = append(expired, key)
+		}
+	}
+	i.ledgerLock.Unlock()
+	for _, key := range expired {
+		if res, _ := i.IsBan(key); res == -128 {
+			i.resetIp(key)
+		}
+		i.endBan(key, "到期解封")
+	}
+}
+
+// 保存台账到文件
+func (i *ipVisitS) saveBanLedger(thisLog Log) {
+	i.ledgerLock.Lock()
+	ledgerFile := banLedgerFile{History: i.banHistory}
+	for _, v := range i.banLedger {
+		ledgerFile.Active = append(ledgerFile.Active, v)
+	}
+	data, err := json.Marshal(ledgerFile)
+	i.ledgerLock.Unlock()
+	if err != nil {
+		thisLog.Error("封禁台账序列化失败", err)
+		return
+	}
+	saveGzip(VP.GetString("OtherFile.BanLedger"), data, thisLog)
+}
+
+// 从文件加载台账，并将仍在封禁期的ip恢复到IpList中
+func (i *ipVisitS) loadBanLedger(thisLog Log) {
+	data := loadGzip(VP.GetString("OtherFile.BanLedger"), thisLog)
+	if len(data) == 0 {
+		return
+	}
+	var ledgerFile banLedgerFile
+	if err := json.Unmarshal(data, &ledgerFile); err != nil {
+		thisLog.Error("封禁台账反序列化失败", err)
+		return
+	}
+	now := time.Now().UnixMilli()
+	i.ledgerLock.Lock()
+	defer i.ledgerLock.Unlock()
+	i.banHistory = ledgerFile.History
+	for _, v := range ledgerFile.Active {
+		i.banLedger[v.Ip] = v
+		if v.ExpireAt != 0 && v.ExpireAt <= now { // 停机期间已经到期的。旧版本会把长时封禁当作永封保存，需要清除
+			i.resetIp(v.Ip)
+			i.endBanLocked(v.Ip, "到期解封")
+			continue
+		}
+		banTime := int8(-128)
+		if remain := (v.ExpireAt - now) / 60000; v.ExpireAt != 0 && remain < 127 {
+			banTime = int8(-remain - 1)
+		}
+		i.AddBanTime(v.Ip, banTime)
+	}
+}
+
+// 台账和限流使用的key，ipv4为完整地址，ipv6为 前缀/64，格式错误返回空字符串
+func IpKey(ipStr string) string {
+	ipByte, prefix, ipType := parseIp(ipStr)
+	switch ipType {
+	case 4:
+		return ipv4String(ipByte)
+	case 6:
+		return prefix2String(prefix)
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 17:24:52
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 17:24:52
+ * @Description: 验证码通过凭证的签发和校验。凭证和ip绑定，带过期时间和随机数，用HMAC签名，不需要在服务端保存
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"encoding/hex"
+	"fmt"
+	"src/utils/sign"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CaptchaTokenKey = "captcha-token" // 请求头中验证码通过凭证的key
+
+var (
+	captchaSecret     []byte
+	captchaSecretOnce sync.Once
+)
+
+// 读取签名密钥，调试模式下未配置时随机生成，重启后之前签发的凭证失效；正式环境必须配置，见CheckSecrets
+func getCaptchaSecret() []byte {
+	captchaSecretOnce.Do(func() {
+		captchaSecret = configSecret("Captcha.Secret", "未配置Captcha.Secret，使用随机密钥")
+	})
+	return captchaSecret
+}
+
+// 正式环境必须配置的签名密钥，随机密钥在重启后会让已经发出去的任务id、下载链接和验证码凭证全部失效，多实例之间也互相不认
+var requiredSecrets = []string{"Task.Secret", "Download.Secret", "Captcha.Secret"}
+
+/**
+ * @description: 检查正式环境（AppDebug为false）是否配置了必须的签名密钥，调试模式下允许为空，使用随机密钥
+ * @return {error} 缺少密钥时返回错误，应当拒绝启动
+ */
+func CheckSecrets() error {
+	if VP.GetBool("AppDebug") {
+		return nil
+	}
+	for _, key := range requiredSecrets {
+		if VP.GetString(key) == "" {
+			return fmt.Errorf("正式环境必须配置%s", key)
+		}
+	}
+	return nil
+}
+
+// 从配置文件读取签名密钥，未配置时随机生成一个并记录警告
+func configSecret(key string, warnMsg string) []byte {
+	secret := []byte(VP.GetString(key))
+	if len(secret) == 0 {
+		secret = sign.RandomBytes(32)
+		thisLog := Log{RequestUrl: "configSecret"}
+		thisLog.Warn(warnMsg, nil)
+	}
+	return secret
+}
+
+/**
+ * @description: 签发验证码通过凭证
+ * @param {string} ipStr 客户端ip，凭证只对该ip（ipv6为/64前缀）有效
+ * @return {string} 凭证
+ * @return {int64} 过期时间，毫秒
+ */
+func IssueCaptchaPass(ipStr string) (string, int64) {
+	passMinute := VP.GetInt("Captcha.PassMinute")
+	if passMinute <= 0 {
+		passMinute = 10
+	}
+	expireAt := time.Now().Add(time.Duration(passMinute) * time.Minute).UnixMilli()
+	payload := fmt.Sprintf("%s|%d|%s", IpKey(ipStr), expireAt, hex.EncodeToString(sign.RandomBytes(8)))
+	return sign.Token(getCaptchaSecret(), payload), expireAt
+}
+
+/**
+ * @description: 校验验证码通过凭证
+ * @param {string} token 凭证
+ * @param {string} ipStr 客户端ip
+ * @return {string} 凭证的随机数，用于限制一个凭证只能使用一次的场景
+ * @return {int64} 过期时间，毫秒
+ * @return {bool} 是否有效
+ */
+func CheckCaptchaPass(token string, ipStr string) (string, int64, bool) {
+	if token == "" {
+		return "", 0, false
+	}
+	payload, ok := sign.Parse(getCaptchaSecret(), token)
+	if !ok {
+		return "", 0, false
+	}
+	fields := strings.Split(payload, "|")
+	if len(fields) != 3 || fields[0] != IpKey(ipStr) {
+		return "", 0, false
+	}
+	expireAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || expireAt < time.Now().UnixMilli() {
+		return "", 0, false
+	}
+	return fields[2], expireAt, true
+}
@@ -0,0 +1,51 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 14:21:40
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 14:21:40
+ * @Description: 真实客户端ip的解析配置，部署在nginx或CDN后面时使用
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	ClientIpHeaderXFF           = "X-Forwarded-For"
+	ClientIpHeaderRealIp        = "X-Real-IP"
+	ClientIpHeaderProxyProtocol = "ProxyProtocol" // 不是请求头，表示从四层的PROXY protocol中获取
+)
+
+/**
+ * @description: 读取配置的可信任代理地址段，未配置时返回空，表示不信任任何代理，直接使用连接的地址
+ * @return {[]string} 原始的配置，可直接传给gin
+ * @return {[]*net.IPNet} 解析后的地址段
+ * @return {error}
+ */
+func GetTrustedProxies() ([]string, []*net.IPNet, error) {
+	cidrList := VP.GetStringSlice("Proxy.TrustedProxies")
+	ipNetList := make([]*net.IPNet, 0, len(cidrList))
+	for _, cidr := range cidrList {
+		ipNet, err := parseCidr(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("可信任代理%s格式错误", cidr)
+		}
+		ipNetList = append(ipNetList, ipNet)
+	}
+	return cidrList, ipNetList, nil
+}
+
+/**
+ * @description: 读取获取客户端ip的方式，默认X-Forwarded-For，也可以是CDN自定义的请求头
+ * @return {string}
+ */
+func GetClientIpHeader() string {
+	header := VP.GetString("Proxy.ClientIpHeader")
+	if header == "" {
+		return ClientIpHeaderXFF
+	}
+	return header
+}
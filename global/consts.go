@@ -37,6 +37,10 @@ const (
 	AccessForbiddenCode int    = -403
 	AccessForbiddenMsg  string = "禁止访问"
 
+	// 需要先通过验证码
+	CaptchaRequiredCode int    = -428
+	CaptchaRequiredMsg  string = "请先完成验证码验证"
+
 	// 访问成功
 	AccessSuccessCode int = 200
 
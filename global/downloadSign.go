@@ -0,0 +1,91 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 18:52:40
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 18:52:40
+ * @Description: 下载链接的签名，链接和工具、任务绑定，可选绑定ip，过期后失效
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	"src/utils/sign"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	downloadSecret     []byte
+	downloadSecretOnce sync.Once
+)
+
+// 读取下载链接的签名密钥
+func getDownloadSecret() []byte {
+	downloadSecretOnce.Do(func() {
+		downloadSecret = configSecret("Download.Secret", "未配置Download.Secret，使用随机密钥，重启后之前签发的下载链接都会失效")
+	})
+	return downloadSecret
+}
+
+// 签名的内容，绑定ip时带上ip，否则为空
+func downloadPayload(toolId uint8, taskId string, expires int64, ipKey string) string {
+	return fmt.Sprintf("%d|%s|%d|%s", toolId, taskId, expires, ipKey)
+}
+
+/**
+ * @description: 生成带签名的下载链接
+ * @param {uint8} toolId 工具id
+ * @param {string} taskId 任务id
+ * @param {string} ipStr 请求的客户端ip，Download.BindIp为true时链接只能由该ip使用
+ * @return {string} 下载链接，不含域名
+ * @return {int64} 过期时间，秒
+ */
+func SignDownloadUrl(toolId uint8, taskId string, ipStr string) (string, int64) {
+	expireSecond := VP.GetInt64("Download.ExpireSecond")
+	if expireSecond <= 0 {
+		expireSecond = 300
+	}
+	expires := time.Now().Unix() + expireSecond
+	ipKey, bind := "", "0"
+	if VP.GetBool("Download.BindIp") {
+		ipKey, bind = IpKey(ipStr), "1"
+	}
+	signature := base64.RawURLEncoding.EncodeToString(sign.Hmac(getDownloadSecret(), downloadPayload(toolId, taskId, expires, ipKey))[:16])
+	return fmt.Sprintf("/tools/imgDown/%d/%s?expires=%d&bind=%s&sign=%s", toolId, taskId, expires, bind, signature), expires
+}
+
+/**
+ * @description: 校验下载链接的签名
+ * @param {uint8} toolId 工具id
+ * @param {string} taskId 任务id
+ * @param {string} expiresStr 链接中的过期时间
+ * @param {string} bind 链接中是否绑定了ip
+ * @param {string} signStr 链接中的签名
+ * @param {string} ipStr 请求的客户端ip
+ * @return {string} 校验失败的原因，为空表示通过
+ */
+func CheckDownloadSign(toolId uint8, taskId string, expiresStr string, bind string, signStr string, ipStr string) string {
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || signStr == "" {
+		return "下载链接无效"
+	}
+	if expires < time.Now().Unix() {
+		return "下载链接已过期，请重新下载"
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(signStr)
+	if err != nil {
+		return "下载链接无效"
+	}
+	ipKey := ""
+	if bind == "1" { // 是否绑定ip也在签名里，用户改了这个参数签名就对不上
+		ipKey = IpKey(ipStr)
+	}
+	if !hmac.Equal(signature, sign.Hmac(getDownloadSecret(), downloadPayload(toolId, taskId, expires, ipKey))[:16]) {
+		return "下载链接无效"
+	}
+	return ""
+}
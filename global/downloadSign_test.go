@@ -0,0 +1,112 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 10:31:52
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 10:31:52
+ * @Description: 下载链接签名和过期的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"encoding/base64"
+	"net/url"
+	"src/utils/sign"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 解析签发的下载链接，返回过期时间、是否绑定ip和签名
+func parseDownloadUrl(t *testing.T, link string) (string, string, string) {
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("下载链接 %s 格式错误: %v", link, err)
+	}
+	q := u.Query()
+	return q.Get("expires"), q.Get("bind"), q.Get("sign")
+}
+
+// 用指定的过期时间签名，用于构造已经过期的链接
+func signWithExpires(toolId uint8, taskId string, expires int64, ipKey string) string {
+	return base64.RawURLEncoding.EncodeToString(sign.Hmac(getDownloadSecret(), downloadPayload(toolId, taskId, expires, ipKey))[:16])
+}
+
+func TestDownloadSign(t *testing.T) {
+	VP.Set("Download.BindIp", true)
+	VP.Set("Download.ExpireSecond", 300)
+	defer VP.Set("Download.BindIp", nil)
+	defer VP.Set("Download.ExpireSecond", nil)
+	taskId := NewTaskId()
+	link, expires := SignDownloadUrl(2, taskId, "1.2.3.4")
+	if remain := expires - time.Now().Unix(); remain < 299 || remain > 300 {
+		t.Fatalf("链接的有效期为%d秒，期望300秒", remain)
+	}
+	expiresStr, bind, signStr := parseDownloadUrl(t, link)
+	tests := []struct {
+		name    string
+		toolId  uint8
+		taskId  string
+		expires string
+		bind    string
+		sign    string
+		ip      string
+		wantErr bool
+	}{
+		{"正常下载", 2, taskId, expiresStr, bind, signStr, "1.2.3.4", false},
+		{"换了ip", 2, taskId, expiresStr, bind, signStr, "1.2.3.5", true},
+		{"改成不绑定ip", 2, taskId, expiresStr, "0", signStr, "1.2.3.5", true},
+		{"改了工具id", 3, taskId, expiresStr, bind, signStr, "1.2.3.4", true},
+		{"改了任务id", 2, NewTaskId(), expiresStr, bind, signStr, "1.2.3.4", true},
+		{"延长了过期时间", 2, taskId, strconv.FormatInt(expires+3600, 10), bind, signStr, "1.2.3.4", true},
+		{"过期时间格式错误", 2, taskId, "abc", bind, signStr, "1.2.3.4", true},
+		{"没有签名", 2, taskId, expiresStr, bind, "", "1.2.3.4", true},
+		{"签名不是base64", 2, taskId, expiresStr, bind, "!!!", "1.2.3.4", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := CheckDownloadSign(tt.toolId, tt.taskId, tt.expires, tt.bind, tt.sign, tt.ip)
+			if (msg != "") != tt.wantErr {
+				t.Fatalf("CheckDownloadSign 返回 %q，期望失败: %v", msg, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadSignExpired(t *testing.T) {
+	taskId := NewTaskId()
+	tests := []struct {
+		name    string
+		expires int64
+		wantErr bool
+	}{
+		{"还有1分钟过期", time.Now().Unix() + 60, false},
+		{"1秒前过期", time.Now().Unix() - 1, true},
+		{"1天前过期", time.Now().AddDate(0, 0, -1).Unix(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 签名是正确的，只有过期时间决定结果
+			signStr := signWithExpires(2, taskId, tt.expires, "")
+			msg := CheckDownloadSign(2, taskId, strconv.FormatInt(tt.expires, 10), "0", signStr, "1.2.3.4")
+			if (msg != "") != tt.wantErr {
+				t.Fatalf("CheckDownloadSign 返回 %q，期望失败: %v", msg, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadSignIpv6(t *testing.T) {
+	VP.Set("Download.BindIp", true)
+	defer VP.Set("Download.BindIp", nil)
+	taskId := NewTaskId()
+	link, _ := SignDownloadUrl(2, taskId, "2001:db8:1:2::1")
+	expiresStr, bind, signStr := parseDownloadUrl(t, link)
+	// ipv6按/64前缀绑定，同一个前缀下换地址仍然可以下载
+	if msg := CheckDownloadSign(2, taskId, expiresStr, bind, signStr, "2001:db8:1:2::ff"); msg != "" {
+		t.Fatalf("同一个/64前缀应该可以下载: %s", msg)
+	}
+	if msg := CheckDownloadSign(2, taskId, expiresStr, bind, signStr, "2001:db8:1:3::1"); msg == "" {
+		t.Fatal("不同的/64前缀不应该可以下载")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 16:05:18
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 16:05:18
+ * @Description: 国内ip段的加载和查询。加载时排序并合并相邻的ip段，查询用二分查找，支持文件更新后热加载
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ipv4的一个ip段，首尾都包含
+type ipv4Range struct {
+	start uint32
+	end   uint32
+}
+
+// ipv6的一个ip段，地址按大端拆成高低两个uint64
+type ipv6Range struct {
+	startHi, startLo uint64
+	endHi, endLo     uint64
+}
+
+type geoZone struct {
+	v4      []ipv4Range
+	v6      []ipv6Range
+	modTime time.Time // 文件的修改时间，用于判断是否需要重新加载
+}
+
+var cnZone atomic.Pointer[geoZone] // 查询时直接读，重新加载时整体替换，不需要加锁
+
+/**
+ * @description: 加载国内ip段文件，文件每行一个CIDR，支持ipv4和ipv6，#开头的为注释。文件不存在时不报错，所有ip都视为国内
+ * @return {error}
+ */
+func LoadGeoZone() error {
+	fileName := VP.GetString("OtherFile.CnIp")
+	info, err := os.Stat(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		cnZone.Store(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	zoneFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer zoneFile.Close()
+
+	zone := &geoZone{modTime: info.ModTime()}
+	scanner := bufio.NewScanner(zoneFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return errors.New("国内ip段格式错误:" + line)
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			start := binary.BigEndian.Uint32(ip4)
+			zone.v4 = append(zone.v4, ipv4Range{start: start, end: start | ^binary.BigEndian.Uint32(ipNet.Mask)})
+		} else {
+			r := ipv6Range{startHi: binary.BigEndian.Uint64(ipNet.IP[:8]), startLo: binary.BigEndian.Uint64(ipNet.IP[8:])}
+			r.endHi = r.startHi | ^binary.BigEndian.Uint64(ipNet.Mask[:8])
+			r.endLo = r.startLo | ^binary.BigEndian.Uint64(ipNet.Mask[8:])
+			zone.v6 = append(zone.v6, r)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	zone.v4 = mergeIpv4Range(zone.v4)
+	zone.v6 = mergeIpv6Range(zone.v6)
+	cnZone.Store(zone)
+	return nil
+}
+
+/**
+ * @description: 文件修改时间变化后重新加载，由定时器调用
+ * @return {bool} 是否重新加载了
+ * @return {error}
+ */
+func ReloadGeoZoneIfChanged() (bool, error) {
+	info, err := os.Stat(VP.GetString("OtherFile.CnIp"))
+	if errors.Is(err, os.ErrNotExist) { // 没有配置文件时不限制，和LoadGeoZone一致
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if zone := cnZone.Load(); zone != nil && info.ModTime().Equal(zone.modTime) {
+		return false, nil
+	}
+	return true, LoadGeoZone()
+}
+
+/**
+ * @description: 判断一个ip是否是国内ip。内网和本机地址视为国内；文件里没有ipv6的段时，ipv6都视为国内，避免误伤
+ * @param {string} ipStr
+ * @return {bool} 是否国内ip，ip格式错误时返回false
+ */
+func IsCnIp(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	zone := cnZone.Load()
+	if zone == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		// 找到第一个end>=v的段，再判断start
+		j := sort.Search(len(zone.v4), func(k int) bool { return zone.v4[k].end >= v })
+		return j < len(zone.v4) && zone.v4[j].start <= v
+	}
+	if len(zone.v6) == 0 {
+		return true
+	}
+	hi, lo := binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])
+	j := sort.Search(len(zone.v6), func(k int) bool { return !less128(zone.v6[k].endHi, zone.v6[k].endLo, hi, lo) })
+	return j < len(zone.v6) && !less128(hi, lo, zone.v6[j].startHi, zone.v6[j].startLo)
+}
+
+// 获取加载的ip段数量，合并后的
+func GetGeoZoneLen() (v4Len int, v6Len int) {
+	if zone := cnZone.Load(); zone != nil {
+		return len(zone.v4), len(zone.v6)
+	}
+	return 0, 0
+}
+
+// 排序并合并重叠或相邻的段，合并后段与段之间不相交，才能用二分查找
+func mergeIpv4Range(list []ipv4Range) []ipv4Range {
+	sort.Slice(list, func(a, b int) bool { return list[a].start < list[b].start })
+	merged := make([]ipv4Range, 0, len(list))
+	for _, r := range list {
+		last := len(merged) - 1
+		if last >= 0 && (r.start <= merged[last].end || r.start == merged[last].end+1) {
+			merged[last].end = max(merged[last].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// 同mergeIpv4Range，ipv6的段一般不会首尾相接，只合并重叠的
+func mergeIpv6Range(list []ipv6Range) []ipv6Range {
+	sort.Slice(list, func(a, b int) bool {
+		return less128(list[a].startHi, list[a].startLo, list[b].startHi, list[b].startLo)
+	})
+	merged := make([]ipv6Range, 0, len(list))
+	for _, r := range list {
+		last := len(merged) - 1
+		if last >= 0 && !less128(merged[last].endHi, merged[last].endLo, r.startHi, r.startLo) {
+			if less128(merged[last].endHi, merged[last].endLo, r.endHi, r.endLo) {
+				merged[last].endHi, merged[last].endLo = r.endHi, r.endLo
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// 比较两个128位的数，a<b返回true
+func less128(aHi, aLo, bHi, bLo uint64) bool {
+	return aHi < bHi || (aHi == bHi && aLo < bLo)
+}
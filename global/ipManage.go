@@ -9,22 +9,20 @@
 package global
 
 import (
-	"bufio"
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
 
-var (
-	cnIpMaskList = make([]*net.IPNet, 0)
-)
-
 // 访问ip管理
 type ipVisitS struct {
 	// 黑名单列表，正好对应ip地址的四层，以下标计数，-1表示永久封禁
@@ -33,12 +31,21 @@ type ipVisitS struct {
 	// 有定时任务每cycleSecond循环检查一次，当取值范围为[-127,0)时，加1，表示封禁时长减一分钟。当取值范围为(0,127]时，归零，表示封禁时长减一分钟
 	// 应对场景，防止恶意高频访问。不需要应对非常精确的场景，优点，简单，节省内存，速度非常快，比基于redis的更快，因为没有通信消耗。
 	// 方案弊端：1. 按分钟计算，每分钟都得做一次循环，占用性能
-	// 2. 封禁时长不可超过127分钟，超过127分钟，将无法计算，只能升级为永封
+	// 2. 封禁时长不可超过127分钟，超过127分钟，将无法计算，只能升级为永封（通过Ban封禁的由封禁台账记录真正的过期时间，到期解封）
 	// 3. 访问次数每分钟上限限制在127次，再往上无法计算了const
-	// 4. 无法记录每次访问的时间，每次巡查只能直接清零
-	// 5. 无法记录封禁原因
+	// 4. 无法记录每次访问的时间，每次巡查只能直接清零（被封禁的ip由封禁台账记录最后访问时间）
+	// 5. 无法记录封禁原因（由封禁台账记录）
 	// 6. 无法精准的执行封禁时间，因为每次循环本身就需要执行时间，这个执行时间是不计算进封禁时间的
-	IpList            [256]*[256]*[256]*[256]int8
+	IpList [256]*[256]*[256]*[256]int8
+	// ipv6 的地址空间无法用数组表示，所以用map记录，值的含义与IpList一致
+	// 以/64前缀为key，因为运营商一般给一个用户分配一整个/64段，只按完整地址计数的话，用户换个地址就能绕过限制
+	IpListV6          map[uint64]int8
+	v6Lock            sync.Mutex            // map不支持并发写，需要加锁
+	rangeList         []*ipRange            // ip段的封禁和白名单，数量不多，直接遍历
+	rangeLock         sync.RWMutex          // ip段读多写少，用读写锁
+	banLedger         map[string]*banRecord // 封禁台账，只记录封禁中的ip，不影响正常访问的性能
+	banHistory        []*banRecord          // 已结束的封禁记录
+	ledgerLock        sync.Mutex
 	limit             int8  // 设置的每cycleSecond的访问上限
 	cycleSecond       int32 // 每次循环检查的间隔时长，单位秒
 	visitLimitBanTime int8  // 访问超限的封禁时长，单位分钟
@@ -62,6 +69,8 @@ func InitIpVisit(limit int8, cycleSecond int32, visitLimitBanTime int8) (*ipVisi
 	}
 
 	ipVisit := &ipVisitS{
+		IpListV6:          make(map[uint64]int8),
+		banLedger:         make(map[string]*banRecord),
 		limit:             limit,
 		cycleSecond:       cycleSecond,
 		visitLimitBanTime: visitLimitBanTime,
@@ -69,7 +78,7 @@ func InitIpVisit(limit int8, cycleSecond int32, visitLimitBanTime int8) (*ipVisi
 
 	ipVisit.loadBanIP() // 加载IP黑名单列表
 
-	if err := loadIpMask(); err != nil { // 加载ip白名单
+	if err := LoadGeoZone(); err != nil { // 加载国内ip段
 		return nil, err
 	}
 	return ipVisit, nil
@@ -86,28 +95,48 @@ func InitIpVisit(limit int8, cycleSecond int32, visitLimitBanTime int8) (*ipVisi
     -128:    永封
 */
 func (i *ipVisitS) Add(ipStr string) int8 {
-	ipByte, errCode := ip2byte(ipStr)
-	if errCode != 0 {
+	ipByte, prefix, ipType := parseIp(ipStr)
+	if ipType == 0 {
 		return 0
 	}
 	// 20240804 暂时解除国外ip限制
-	// 只允许国内ip
-	// if !ipIn(ipByte) {
-	// 	return 0
-	// }
-	thisIP := i.nil2Create(ipByte)
-	// 前面都是初始化的校验，下面才是记录ip
-	if thisIP[ipByte[3]] == -128 {
-		return -128
-	} else if thisIP[ipByte[3]] < 0 { // 小于零说明已经被封禁
-		thisIP[ipByte[3]]-- // 封禁时长+1
-		return thisIP[ipByte[3]]
-	} else if thisIP[ipByte[3]] >= 0 && thisIP[ipByte[3]] < i.limit {
-		thisIP[ipByte[3]]++ // 访问次数加1
-	} else if thisIP[ipByte[3]] == i.limit { // 访问达到上限，封禁一定时间
-		thisIP[ipByte[3]] = -(i.visitLimitBanTime)
+	// 国外ip的限制改由 middleware.GeoHandler 按路由和工具配置
+	var old, res int8
+	if ipType == 6 {
+		i.v6Lock.Lock()
+		old = i.IpListV6[prefix]
+		res = i.nextVisit(old)
+		i.IpListV6[prefix] = res
+		i.v6Lock.Unlock()
+	} else {
+		thisIP := i.nil2Create(ipByte)
+		// 前面都是初始化的校验，下面才是记录ip
+		old = thisIP[ipByte[3]]
+		res = i.nextVisit(old)
+		thisIP[ipByte[3]] = res
 	}
-	return thisIP[ipByte[3]]
+	if res < 0 { // 只有封禁中的ip才需要记录台账
+		i.onBanVisit(ipStr, old, res)
+	}
+	return res
+}
+
+/**
+ * @description: 根据当前的记录值，计算访问一次后的值
+ * @param {int8} v 当前的记录值
+ * @return {int8} 访问一次后的值
+ */
+func (i *ipVisitS) nextVisit(v int8) int8 {
+	if v == -128 {
+		return -128
+	} else if v < 0 { // 小于零说明已经被封禁
+		v-- // 封禁时长+1
+	} else if v >= 0 && v < i.limit {
+		v++ // 访问次数加1
+	} else if v == i.limit { // 访问达到上限，封禁一定时间
+		v = -(i.visitLimitBanTime)
+	}
+	return v
 }
 
 /*
@@ -120,15 +149,29 @@ func (i *ipVisitS) Add(ipStr string) int8 {
     -128:    永封
 */
 func (i *ipVisitS) Reduce(ipStr string) int8 {
-	ipByte, errCode := ip2byte(ipStr)
-	if errCode != 0 {
+	ipByte, prefix, ipType := parseIp(ipStr)
+	if ipType == 0 {
 		return 0
 	}
+	if ipType == 6 {
+		i.v6Lock.Lock()
+		defer i.v6Lock.Unlock()
+		i.IpListV6[prefix] = reduceVisit(i.IpListV6[prefix])
+		return i.IpListV6[prefix]
+	}
 	thisIP := i.nil2Create(ipByte)
-	thisIP[ipByte[3]]--
+	thisIP[ipByte[3]] = reduceVisit(thisIP[ipByte[3]])
 	return thisIP[ipByte[3]]
 }
 
+// 记录值减1，已经是-128时保持不变，int8直接减会溢出成127，永封变成了访问次数
+func reduceVisit(v int8) int8 {
+	if v == -128 {
+		return v
+	}
+	return v - 1
+}
+
 /*
 *
   - @description: 增加封禁时长，如果还未被封禁，则等于封禁时长，如果已被封禁，则增加banTime
@@ -140,18 +183,20 @@ func (i *ipVisitS) Reduce(ipStr string) int8 {
     -128:    永封
 */
 func (i *ipVisitS) AddBanTime(ipStr string, banTime int8) int8 {
-	ip2byte(ipStr)
-	ipByteList, errCode := ip2byte(ipStr)
-	if errCode != 0 {
+	ipByteList, prefix, ipType := parseIp(ipStr)
+	if ipType == 0 {
 		return 0
 	}
+	if ipType == 6 {
+		return i.addBanTimeV6(prefix, banTime)
+	}
 	return i.addBanTime(ipByteList, banTime)
 }
 
 /*
 *
   - @description:同AddBanTime一样，入参形式不同, 增加封禁时长，如果还未被封禁，则等于封禁时长，如果已被封禁，则增加banTime
-  - @param {string} ipStr 封禁的IP地址
+  - @param {[]byte} ip 封禁的IP地址，长度为4表示ipv4，长度为8表示ipv6的/64前缀，长度为16表示完整的ipv6
   - @param {int8} banTime 用负数表示，数值表示增加的时长，单位分钟，-128表示永封
   - @return {int8}     0: 输入的ip格式错误
     (0,128): cycleSecond时间内访问次数
@@ -159,10 +204,13 @@ func (i *ipVisitS) AddBanTime(ipStr string, banTime int8) int8 {
     -128:    永封
 */
 func (i *ipVisitS) AddBanTimeByByte(ip []byte, banTime int8) int8 {
-	if len(ip) != 4 {
-		return 0
+	switch len(ip) {
+	case 4:
+		return i.addBanTime(ip, banTime)
+	case 8, 16:
+		return i.addBanTimeV6(binary.BigEndian.Uint64(ip[:8]), banTime)
 	}
-	return i.addBanTime(ip, banTime)
+	return 0
 }
 
 /*
@@ -182,20 +230,40 @@ func (i *ipVisitS) addBanTime(ip []byte, banTime int8) int8 {
 	}
 	thisIP := i.nil2Create(ip)
 	// 前面都是初始化的校验，下面才是记录ip
+	thisIP[ip[3]] = nextBanTime(thisIP[ip[3]], banTime)
+	return thisIP[ip[3]]
+}
+
+// 同addBanTime，作用于ipv6的/64前缀
+func (i *ipVisitS) addBanTimeV6(prefix uint64, banTime int8) int8 {
+	// 不得输入大于等于0的数
+	if banTime >= 0 {
+		return 0
+	}
+	i.v6Lock.Lock()
+	defer i.v6Lock.Unlock()
+	i.IpListV6[prefix] = nextBanTime(i.IpListV6[prefix], banTime)
+	return i.IpListV6[prefix]
+}
+
+/**
+ * @description: 根据当前的记录值，计算增加封禁时长后的值
+ * @param {int8} v 当前的记录值
+ * @param {int8} banTime 用负数表示，数值表示增加的时长，单位分钟，-128表示永封
+ * @return {int8} 增加封禁时长后的值
+ */
+func nextBanTime(v int8, banTime int8) int8 {
 	if banTime == -128 { // 表示永封
-		thisIP[ip[3]] = banTime
-	} else {
-		if thisIP[ip[3]] >= 0 { // 大于等于零说明还未被封禁
-			thisIP[ip[3]] = banTime
-		} else if thisIP[ip[3]] < 0 { // 小于零需要判断它再加上banTime会不会达到-128
-			if thisIP[ip[3]]+banTime > -128 {
-				thisIP[ip[3]] += banTime
-			} else {
-				thisIP[ip[3]] = -128 // 如果会，使其等于-128
-			}
-		}
+		return banTime
 	}
-	return thisIP[ip[3]]
+	if v >= 0 { // 大于等于零说明还未被封禁
+		return banTime
+	}
+	// 小于零需要判断它再加上banTime会不会达到-128
+	if v+banTime > -128 && v+banTime < 0 {
+		return v + banTime
+	}
+	return -128 // 如果会，使其等于-128
 }
 
 /*
@@ -206,11 +274,15 @@ func (i *ipVisitS) addBanTime(ip []byte, banTime int8) int8 {
     {bool} 第二个返回值的含义：false:输入的ip有误,true:输入的ip正确
 */
 func (i *ipVisitS) IsBan(ipStr string) (int8, bool) {
-
-	ipByteList, errCode := ip2byte(ipStr)
-	if errCode != 0 {
+	ipByteList, prefix, ipType := parseIp(ipStr)
+	if ipType == 0 {
 		return 0, false
 	}
+	if ipType == 6 {
+		i.v6Lock.Lock()
+		defer i.v6Lock.Unlock()
+		return i.IpListV6[prefix], true
+	}
 	if i.IpList[ipByteList[0]] == nil || i.IpList[ipByteList[0]][ipByteList[1]] == nil || i.IpList[ipByteList[0]][ipByteList[1]][ipByteList[2]] == nil {
 		return 0, true
 	}
@@ -247,25 +319,44 @@ func (i *ipVisitS) nil2Create(ipIntList []byte) *[256]int8 {
 	return i.IpList[ipIntList[0]][ipIntList[1]][ipIntList[2]]
 }
 
-// 获取黑名单列表长度
+// 获取黑名单列表长度，ipv6按/64前缀计数
 func (i *ipVisitS) GetLen() (listLen int) {
 	listLen, _ = i.get(1)
+	i.v6Lock.Lock()
+	listLen += len(i.IpListV6)
+	i.v6Lock.Unlock()
 	return
 }
 
 // 获取被永久封禁的ip
 func (i *ipVisitS) GetPermanentBan() (ipList []byte) {
 	_, ipList = i.get(2)
-	return
+	return i.dropLongBans(ipList, 4, ipv4String)
+}
+
+// 获取被永久封禁的ipv6的/64前缀，每8个byte表示一个前缀
+func (i *ipVisitS) GetPermanentBanV6() (prefixList []byte) {
+	i.v6Lock.Lock()
+	for prefix, v := range i.IpListV6 {
+		if v == -128 {
+			prefixList = binary.BigEndian.AppendUint64(prefixList, prefix)
+		}
+	}
+	i.v6Lock.Unlock()
+	return i.dropLongBans(prefixList, 8, func(prefix []byte) string { return prefix2String(binary.BigEndian.Uint64(prefix)) })
 }
 
-// 获取被永久封禁的ip的string形式
+// 获取被永久封禁的ip的string形式，ipv6以 前缀/64 的形式表示
 func (i *ipVisitS) GetPermanentBanString() []string {
-	_, ipListByte := i.get(2)
+	ipListByte := i.GetPermanentBan() // 和保存到永封文件的一样，去掉有过期时间的长时封禁
 	ipList := make([]string, len(ipListByte)/4)
 	// 解压后，添加到ip列表
 	for i := 0; i < len(ipList); i++ {
-		ipList[i] = fmt.Sprintf("%d.%d.%d.%d", ipListByte[i*4], ipListByte[i*4+1], ipListByte[i*4+2], ipListByte[i*4+3])
+		ipList[i] = ipv4String(ipListByte[i*4 : i*4+4])
+	}
+	prefixByte := i.GetPermanentBanV6()
+	for j := 0; j < len(prefixByte); j += 8 {
+		ipList = append(ipList, prefix2String(binary.BigEndian.Uint64(prefixByte[j:j+8])))
 	}
 	return ipList
 }
@@ -281,10 +372,28 @@ func (i *ipVisitS) GetAll() (ipList []byte) {
 
 // 删除一个ip的访问数据 ,-2表示输入的ip有误，-1表示无该ip记录，0 表示删除成功
 func (i *ipVisitS) DeleteIp(ipStr string) int {
-	ipByte, errCode := ip2byte(ipStr)
-	if errCode != 0 {
+	res := i.resetIp(ipStr)
+	if res == 0 {
+		i.endBan(IpKey(ipStr), "手动解封")
+	}
+	return res
+}
+
+// 将ip的访问数据置零，不处理台账，返回值同DeleteIp
+func (i *ipVisitS) resetIp(ipStr string) int {
+	ipByte, prefix, ipType := parseIp(ipStr)
+	if ipType == 0 {
 		return -2
 	}
+	if ipType == 6 {
+		i.v6Lock.Lock()
+		defer i.v6Lock.Unlock()
+		if i.IpListV6[prefix] == 0 {
+			return -1
+		}
+		delete(i.IpListV6, prefix)
+		return 0
+	}
 	if i.IpList[ipByte[0]] == nil || i.IpList[ipByte[0]][ipByte[1]] == nil || i.IpList[ipByte[0]][ipByte[1]][ipByte[2]] == nil {
 		return -1
 	} else if i.IpList[ipByte[0]][ipByte[1]][ipByte[2]][ipByte[3]] == 0 {
@@ -378,58 +487,7 @@ func (ip *ipVisitS) CheckIPList(stopChan chan bool) *time.Ticker {
 		for {
 			select {
 			case <-ticker.C:
-				// 以下变量记录每一层是否有记录ip,如果都没有记录ip,，则将引用置空，防止一直占用内存
-				second := 0
-				third := 0
-				fourth := 0
-				for i := 0; i < 256; i++ {
-					if ip.IpList[i] == nil {
-						continue
-					}
-					second = 0 // 进入该段的循环前，清空前面记录的次数
-					for j := 0; j < 256; j++ {
-						if ip.IpList[i][j] == nil {
-							continue
-						}
-						third = 0 // 进入该段的循环前，清空前面记录的次数
-						for k := 0; k < 256; k++ {
-							if ip.IpList[i][j][k] == nil {
-								continue
-							}
-							fourth = 0 // 进入该段的循环前，清空前面记录的次数
-							for l := 0; l < 256; l++ {
-								if ip.IpList[i][j][k][l] == 0 {
-									continue
-								}
-								// 表明该段内记录了ip
-								fourth++
-								third++
-								second++
-								// 永封的不处理
-								if ip.IpList[i][j][k][l] == -128 {
-									continue
-								} else if ip.IpList[i][j][k][l] > 0 {
-									// 每次减20次,但是要防止出现小于0的情况
-									ip.IpList[i][j][k][l] = int8(math.Max(float64(ip.IpList[i][j][k][l])-IPPerAllow, 0))
-								} else if ip.IpList[i][j][k][l] < 0 {
-									ip.IpList[i][j][k][l]++
-								}
-							}
-							// 如果第四层循环结束还是为0，表明该段没有记录ip，可以置空回收，当然，访问次数或封禁时间刚恢复到0的不包含在内
-							if fourth == 0 {
-								ip.IpList[i][j][k] = nil
-							}
-						}
-						// 如果第三层循环结束还是为0，表明该段没有记录ip
-						if third == 0 {
-							ip.IpList[i][j] = nil
-						}
-					}
-					// 如果第二层循环结束还是为0，表明该段没有记录ip
-					if second == 0 {
-						ip.IpList[i] = nil
-					}
-				}
+				ip.checkIPList()
 			case <-stopChan:
 				return // 退出协程
 			}
@@ -438,103 +496,205 @@ func (ip *ipVisitS) CheckIPList(stopChan chan bool) *time.Ticker {
 	return ticker
 }
 
+// CheckIPList 每次循环执行的检查
+func (ip *ipVisitS) checkIPList() {
+	// 以下变量记录每一层是否有记录ip,如果都没有记录ip,，则将引用置空，防止一直占用内存
+	second := 0
+	third := 0
+	fourth := 0
+	for i := 0; i < 256; i++ {
+		if ip.IpList[i] == nil {
+			continue
+		}
+		second = 0 // 进入该段的循环前，清空前面记录的次数
+		for j := 0; j < 256; j++ {
+			if ip.IpList[i][j] == nil {
+				continue
+			}
+			third = 0 // 进入该段的循环前，清空前面记录的次数
+			for k := 0; k < 256; k++ {
+				if ip.IpList[i][j][k] == nil {
+					continue
+				}
+				fourth = 0 // 进入该段的循环前，清空前面记录的次数
+				for l := 0; l < 256; l++ {
+					if ip.IpList[i][j][k][l] == 0 {
+						continue
+					}
+					// 表明该段内记录了ip
+					fourth++
+					third++
+					second++
+					// 永封的不处理
+					if ip.IpList[i][j][k][l] == -128 {
+						continue
+					} else if ip.IpList[i][j][k][l] > 0 {
+						// 每次减20次,但是要防止出现小于0的情况
+						ip.IpList[i][j][k][l] = int8(math.Max(float64(ip.IpList[i][j][k][l])-IPPerAllow, 0))
+					} else if ip.IpList[i][j][k][l] < 0 {
+						ip.IpList[i][j][k][l]++
+					}
+				}
+				// 如果第四层循环结束还是为0，表明该段没有记录ip，可以置空回收，当然，访问次数或封禁时间刚恢复到0的不包含在内
+				if fourth == 0 {
+					ip.IpList[i][j][k] = nil
+				}
+			}
+			// 如果第三层循环结束还是为0，表明该段没有记录ip
+			if third == 0 {
+				ip.IpList[i][j] = nil
+			}
+		}
+		// 如果第二层循环结束还是为0，表明该段没有记录ip
+		if second == 0 {
+			ip.IpList[i] = nil
+		}
+	}
+	ip.checkIPListV6()
+	ip.checkRangeList()
+	ip.checkBanLedger()
+}
+
+// CheckIPList 中对ipv6的处理，规则和ipv4一致，值归零的直接从map中删除
+func (ip *ipVisitS) checkIPListV6() {
+	ip.v6Lock.Lock()
+	defer ip.v6Lock.Unlock()
+	for prefix, v := range ip.IpListV6 {
+		if v == -128 {
+			continue
+		} else if v > 0 {
+			v = int8(math.Max(float64(v)-IPPerAllow, 0))
+		} else if v < 0 {
+			v++
+		}
+		if v == 0 {
+			delete(ip.IpListV6, prefix)
+		} else {
+			ip.IpListV6[prefix] = v
+		}
+	}
+}
+
 func SaveBanIP() {
-	banIp := IP.GetPermanentBan()
+	IP.Save()
+}
+
+// 保存永封ip、ip段和封禁台账到文件
+func (ip *ipVisitS) Save() {
 	thisLog := Log{RequestUrl: "SaveBanIP"}
-	// 压缩
-	gzipBuff, err := os.Create(VP.GetString("OtherFile.BanIP"))
+	saveGzip(VP.GetString("OtherFile.BanIP"), ip.GetPermanentBan(), thisLog)
+	// ipv6 单独保存在另一个文件中，每8个byte是一个/64前缀
+	saveGzip(VP.GetString("OtherFile.BanIpV6"), ip.GetPermanentBanV6(), thisLog)
+	ip.saveRange(thisLog) // ip段和永封ip一起保存
+	ip.saveBanLedger(thisLog)
+}
+
+/**
+ * @description: 将数据压缩后保存到文件
+ * @param {string} fileName 文件路径
+ * @param {[]byte} data 需要保存的数据
+ * @param {Log} thisLog
+ * @return {*}
+ */
+func saveGzip(fileName string, data []byte, thisLog Log) {
+	if fileName == "" {
+		return
+	}
+	gzipBuff, err := os.Create(fileName)
 	if err != nil {
 		thisLog.Error("创建文件失败", err)
 		return
 	}
-	// 写入
+	defer gzipBuff.Close()
 	gzipW := gzip.NewWriter(gzipBuff)
-	_, err = gzipW.Write(banIp)
-	if err != nil {
+	defer gzipW.Close()
+	if _, err = gzipW.Write(data); err != nil {
 		thisLog.Error("写入数据失败", err)
-		return
 	}
-	gzipW.Close()
-	gzipBuff.Close()
 }
 
-func (ip *ipVisitS) loadBanIP() {
-	thisLog := Log{RequestUrl: "loadBanIP"}
-	// 读取
-	gzipBuff, err := os.Open(VP.GetString("OtherFile.BanIP"))
+/**
+ * @description: 读取压缩文件并解压，文件不存在时返回nil
+ * @param {string} fileName 文件路径
+ * @param {Log} thisLog
+ * @return {*}
+ */
+func loadGzip(fileName string, thisLog Log) []byte {
+	if fileName == "" {
+		return nil
+	}
+	gzipBuff, err := os.Open(fileName)
 	// 如果文件不存在,直接退出
 	if errors.Is(err, os.ErrNotExist) {
-		return
+		return nil
 	}
 	if err != nil {
 		thisLog.Error("打开文件失败", err)
-		return
+		return nil
 	}
 	defer gzipBuff.Close()
 	gzipR, err := gzip.NewReader(gzipBuff)
 	if err != nil {
 		thisLog.Error("初始化解压失败", err)
-		return
+		return nil
 	}
 	defer gzipR.Close()
-	// 解压
-	banIpByte, err := io.ReadAll(gzipR)
+	data, err := io.ReadAll(gzipR)
 	if err != nil {
 		thisLog.Error("读取解压后数据失败", err)
-		return
+		return nil
 	}
+	return data
+}
 
-	// 解压后，添加到ip列表
-	banIp := make([]int32, len(banIpByte)/4)
-	for i := 0; i < len(banIp); i++ {
-		ip.AddBanTimeByByte(banIpByte[i*4:(i+1)*4], -128)
+func (ip *ipVisitS) loadBanIP() {
+	thisLog := Log{RequestUrl: "loadBanIP"}
+	// 读取并解压，添加到ip列表
+	banIpByte := loadGzip(VP.GetString("OtherFile.BanIP"), thisLog)
+	for i := 0; i+4 <= len(banIpByte); i += 4 {
+		ip.AddBanTimeByByte(banIpByte[i:i+4], -128)
 	}
+	banPrefixByte := loadGzip(VP.GetString("OtherFile.BanIpV6"), thisLog)
+	for i := 0; i+8 <= len(banPrefixByte); i += 8 {
+		ip.AddBanTimeByByte(banPrefixByte[i:i+8], -128)
+	}
+	ip.loadRange(thisLog)
+	ip.loadBanLedger(thisLog)
 }
 
 /**
- * @description: 加载ip列表
- * @return {*}
+ * @description: 解析ip字符串，兼容ipv4和ipv6。ipv4映射的ipv6地址（::ffff:1.2.3.4）按ipv4处理，ipv6可以是 前缀/64 的形式
+ * @param {string} ipStr ip字符串
+ * @return {*} ipv4时返回长度为4的byte数组；ipv6时返回/64前缀；ip类型：4表示ipv4,6表示ipv6,0表示格式错误
  */
-func loadIpMask() error {
-	thisLog := Log{RequestUrl: "loadIpMask"}
-	ipMask, err := os.Open(VP.GetString("OtherFile.CnIp"))
-	// 如果文件不存在,直接退出
-	if errors.Is(err, os.ErrNotExist) {
-		return nil
-	}
-	if err != nil {
-		thisLog.Error("打开文件失败", err)
-		return err
-	}
-	// 创建ip列表
-	ipMaskScanner := bufio.NewScanner(ipMask)
-	for ipMaskScanner.Scan() {
-		_, ipnet, err := net.ParseCIDR(ipMaskScanner.Text())
-		if err != nil {
-			return err
+func parseIp(ipStr string) (ipByte []byte, prefix uint64, ipType int) {
+	if !strings.Contains(ipStr, ":") {
+		ipByte, errCode := ip2byte(ipStr)
+		if errCode != 0 {
+			return nil, 0, 0
 		}
-		cnIpMaskList = append(cnIpMaskList, ipnet)
+		return ipByte, 0, 4
 	}
-	return nil
+	ip := net.ParseIP(strings.TrimSuffix(ipStr, "/64")) // 兼容 前缀/64 的写法
+	if ip == nil {
+		return nil, 0, 0
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return []byte(ip4), 0, 4
+	}
+	return nil, binary.BigEndian.Uint64(ip[:8]), 6
 }
 
-// 通过二分查找
-func ipIn(ip []byte) bool {
-	low, high := 0, len(cnIpMaskList)-1
-	mid := 0
-	for low <= high {
-		mid = low + (high-low)/2
-		if cnIpMaskList[mid].Contains(ip) {
-			return true
-		} else if byteCompare(cnIpMaskList[mid].IP, ip) {
-			high = mid - 1
-			continue
-		} else {
-			low = mid + 1
-			continue
-		}
-	}
-	return false
+// 将ipv4的byte数组转为字符串
+func ipv4String(ipByte []byte) string {
+	return fmt.Sprintf("%d.%d.%d.%d", ipByte[0], ipByte[1], ipByte[2], ipByte[3])
+}
+
+// 将/64前缀转为 2001:db8::/64 形式的字符串
+func prefix2String(prefix uint64) string {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip, prefix)
+	return ip.String() + "/64"
 }
 
 /**
@@ -557,15 +717,3 @@ func ip2byte(ip string) ([]byte, int) {
 	}
 	return ipByte, 0
 }
-
-// byte 数组比较大小,确保a!=b, 返回true表示a>b，返回false表示a<b
-func byteCompare(a []byte, b []byte) bool {
-	for i := 0; i < len(a); i++ {
-		if a[i] > b[i] {
-			return true
-		} else if a[i] < b[i] {
-			return false
-		}
-	}
-	return true
-}
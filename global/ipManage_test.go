@@ -0,0 +1,40 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 17:12:08
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 17:12:08
+ * @Description: ip管理的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"slices"
+	"testing"
+)
+
+// 只在内存里的ip管理，不加载永封文件和国内ip段
+func newTestIpVisit() *ipVisitS {
+	return &ipVisitS{
+		IpListV6:          make(map[uint64]int8),
+		banLedger:         make(map[string]*banRecord),
+		limit:             127,
+		cycleSecond:       60,
+		visitLimitBanTime: 5,
+	}
+}
+
+// 超过127分钟的封禁在IpList里也是-128，但有过期时间，不能出现在永封列表里
+func TestGetPermanentBanString(t *testing.T) {
+	ip := newTestIpVisit()
+	ip.Ban("1.1.1.1", 0, "测试永封", BanSourceManual)
+	ip.Ban("2.2.2.2", 300, "测试长时封禁", BanSourceManual)
+	ip.Ban("3.3.3.3", 10, "测试短时封禁", BanSourceManual)
+	ip.Ban("2001:db8::1", 0, "测试永封", BanSourceManual)
+	ip.Ban("2001:db8:0:1::1", 300, "测试长时封禁", BanSourceManual)
+	got := ip.GetPermanentBanString()
+	want := []string{"1.1.1.1", "2001:db8::/64"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("永封列表是%v，期望%v", got, want)
+	}
+}
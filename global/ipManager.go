@@ -0,0 +1,80 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 15:02:31
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 15:02:31
+ * @Description: ip管理模块的接口，单实例使用内存实现，多实例部署时使用共享实现，让计数和封禁在各实例间同步
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	IpBackendMemory = "memory" // 只保存在本进程内存中
+	IpBackendMysql  = "mysql"  // 通过mysql在多个实例间共享
+)
+
+// ip管理的接口，方法含义见内存实现ipVisitS
+type IpManager interface {
+	Add(ipStr string) int8
+	Reduce(ipStr string) int8
+	AddBanTime(ipStr string, banTime int8) int8
+	IsBan(ipStr string) (int8, bool)
+	DeleteIp(ipStr string) int
+
+	// 封禁台账
+	Ban(ipStr string, minute int, reason string, source string) int8
+	GetBanRecord(ipStr string) *banRecord
+	GetBanList() []banRecord
+	GetBanHistory(ipStr string) []banRecord
+
+	// ip段
+	AddRange(cidr string, rangeType int, reason string, expireMinute int) error
+	DeleteRange(cidr string) int
+	GetRangeList() []ipRange
+	CheckRange(ipStr string) int
+
+	// 限流策略的计数，key由调用方决定，windowStart和window单位都是毫秒
+	ReportVisit(key string, windowStart int64, window int64, delta int) // 记录本实例的访问次数
+	ClusterVisit(key string, windowStart int64) int                     // 查询其他实例在该窗口的访问次数
+	InstanceCount() int                                                 // 当前存活的实例数，令牌桶按它平分速率
+
+	GetLen() int
+	GetPermanentBanString() []string
+	GetAll() []byte
+	GetSizeOf() uintptr
+	CheckIPList(stopChan chan bool) *time.Ticker
+	Save()
+}
+
+/**
+ * @description: 根据配置初始化ip管理模块，IpManage.Backend 为空或memory时使用内存实现
+ * @param {int8} limit 设置的每cycleSecond的访问上限
+ * @param {int32} cycleSecond 每次循环检查的间隔时长，单位秒
+ * @param {int8} visitLimitBanTime 访问超限的封禁时长，单位分钟
+ * @return {*}
+ */
+func InitIpManager(limit int8, cycleSecond int32, visitLimitBanTime int8) (IpManager, error) {
+	ipVisit, err := InitIpVisit(limit, cycleSecond, visitLimitBanTime)
+	if err != nil {
+		return nil, err
+	}
+	switch VP.GetString("IpManage.Backend") {
+	case "", IpBackendMemory:
+		return ipVisit, nil
+	case IpBackendMysql:
+		return initSharedIpVisit(ipVisit)
+	}
+	return nil, errors.New("IpManage.Backend只能是memory或mysql")
+}
+
+// 内存实现只有一个实例，不存在其他实例的计数
+func (i *ipVisitS) ReportVisit(key string, windowStart int64, window int64, delta int) {}
+
+func (i *ipVisitS) ClusterVisit(key string, windowStart int64) int { return 0 }
+
+func (i *ipVisitS) InstanceCount() int { return 1 }
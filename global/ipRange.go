@@ -0,0 +1,201 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 10:12:41
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 10:12:41
+ * @Description: ip段（CIDR）的封禁和白名单
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	RangeTypeBan   = 1 // ip段封禁
+	RangeTypeAllow = 2 // ip段白名单，命中后不再计数
+)
+
+// ip段的记录
+type ipRange struct {
+	Cidr      string     `json:"cidr"`
+	Type      int        `json:"type"`      // 1:封禁 2:白名单
+	Reason    string     `json:"reason"`    // 封禁或加白的原因
+	CreatedAt int64      `json:"createdAt"` // 创建时间，毫秒时间戳
+	ExpireAt  int64      `json:"expireAt"`  // 过期时间，毫秒时间戳，0表示永不过期
+	ipNet     *net.IPNet // 解析后的ip段，用于匹配
+}
+
+/**
+ * @description: 添加一个ip段，相同的ip段会被覆盖
+ * @param {string} cidr 形如 1.2.3.0/24 或 2001:db8::/48，不带掩码时视为单个ip
+ * @param {int} rangeType 1:封禁 2:白名单
+ * @param {string} reason 原因
+ * @param {int} expireMinute 有效时长，单位分钟，0表示永久
+ * @return {error}
+ */
+func (i *ipVisitS) AddRange(cidr string, rangeType int, reason string, expireMinute int) error {
+	if rangeType != RangeTypeBan && rangeType != RangeTypeAllow {
+		return errors.New("ip段类型错误")
+	}
+	if expireMinute < 0 {
+		return errors.New("有效时长不得小于0")
+	}
+	ipNet, err := parseCidr(cidr)
+	if err != nil {
+		return err
+	}
+	r := &ipRange{
+		Cidr:      ipNet.String(),
+		Type:      rangeType,
+		Reason:    reason,
+		CreatedAt: time.Now().UnixMilli(),
+		ipNet:     ipNet,
+	}
+	if expireMinute > 0 {
+		r.ExpireAt = time.Now().Add(time.Duration(expireMinute) * time.Minute).UnixMilli()
+	}
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	for j, v := range i.rangeList {
+		if v.Cidr == r.Cidr {
+			i.rangeList[j] = r
+			return nil
+		}
+	}
+	i.rangeList = append(i.rangeList, r)
+	return nil
+}
+
+// 删除一个ip段，-2表示输入的ip段有误，-1表示无该ip段记录，0 表示删除成功
+func (i *ipVisitS) DeleteRange(cidr string) int {
+	ipNet, err := parseCidr(cidr)
+	if err != nil {
+		return -2
+	}
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	for j, v := range i.rangeList {
+		if v.Cidr == ipNet.String() {
+			i.rangeList = append(i.rangeList[:j], i.rangeList[j+1:]...)
+			return 0
+		}
+	}
+	return -1
+}
+
+// 获取所有的ip段记录
+func (i *ipVisitS) GetRangeList() []ipRange {
+	i.rangeLock.RLock()
+	defer i.rangeLock.RUnlock()
+	list := make([]ipRange, len(i.rangeList))
+	for j, v := range i.rangeList {
+		list[j] = *v
+	}
+	return list
+}
+
+/**
+ * @description: 检查ip是否命中ip段，白名单优先于封禁
+ * @param {string} ipStr
+ * @return {int} 0:未命中或ip格式错误；1:命中封禁；2:命中白名单
+ */
+func (i *ipVisitS) CheckRange(ipStr string) int {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return 0
+	}
+	now := time.Now().UnixMilli()
+	result := 0
+	i.rangeLock.RLock()
+	defer i.rangeLock.RUnlock()
+	for _, v := range i.rangeList {
+		if v.ExpireAt != 0 && v.ExpireAt <= now {
+			continue
+		}
+		if !v.ipNet.Contains(ip) {
+			continue
+		}
+		if v.Type == RangeTypeAllow {
+			return RangeTypeAllow
+		}
+		result = RangeTypeBan
+	}
+	return result
+}
+
+// 删除已过期的ip段，由CheckIPList定时调用
+func (i *ipVisitS) checkRangeList() {
+	now := time.Now().UnixMilli()
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	newList := i.rangeList[:0]
+	for _, v := range i.rangeList {
+		if v.ExpireAt == 0 || v.ExpireAt > now {
+			newList = append(newList, v)
+		}
+	}
+	i.rangeList = newList
+}
+
+// 保存ip段到文件，和永封ip一样使用gzip压缩，内容是json
+func (i *ipVisitS) saveRange(thisLog Log) {
+	data, err := json.Marshal(i.GetRangeList())
+	if err != nil {
+		thisLog.Error("ip段序列化失败", err)
+		return
+	}
+	saveGzip(VP.GetString("OtherFile.BanRange"), data, thisLog)
+}
+
+// 从文件加载ip段，已过期的不再加载
+func (i *ipVisitS) loadRange(thisLog Log) {
+	data := loadGzip(VP.GetString("OtherFile.BanRange"), thisLog)
+	if len(data) == 0 {
+		return
+	}
+	var list []*ipRange
+	if err := json.Unmarshal(data, &list); err != nil {
+		thisLog.Error("ip段反序列化失败", err)
+		return
+	}
+	now := time.Now().UnixMilli()
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	for _, v := range list {
+		if v.ExpireAt != 0 && v.ExpireAt <= now {
+			continue
+		}
+		ipNet, err := parseCidr(v.Cidr)
+		if err != nil {
+			thisLog.Error("加载ip段失败:"+v.Cidr, err)
+			continue
+		}
+		v.ipNet = ipNet
+		i.rangeList = append(i.rangeList, v)
+	}
+}
+
+// 解析ip段，不带掩码时视为单个ip
+func parseCidr(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, errors.New("ip段格式错误")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.New("ip段格式错误")
+	}
+	return ipNet, nil
+}
@@ -0,0 +1,436 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 15:20:44
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 15:20:44
+ * @Description: ip管理的多实例共享实现。热路径仍然是本地内存，封禁事件和限流计数通过mysql定时同步，各实例在几秒内达成一致
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 封禁事件的类型
+const (
+	ipEventBan         uint8 = 1 // 封禁ip
+	ipEventUnban       uint8 = 2 // 解封ip
+	ipEventRangeAdd    uint8 = 3 // 添加ip段
+	ipEventRangeDelete uint8 = 4 // 删除ip段
+)
+
+const (
+	ipEventKeepDay    = 7  // 已结束的事件保留的天数，新实例启动时会重放未结束的事件
+	instanceAliveSec  = 10 // 超过多少秒没有心跳的实例视为已下线（会和同步间隔取较大值）
+	ipEventOverlapSec = 60 // 每次同步重新读取最近多少秒内的事件（会和同步间隔的2倍取较大值）
+)
+
+// 封禁事件表，每个实例轮询新事件并应用到本地
+type ipBanEvent struct {
+	Id        int64  `gorm:"primaryKey;autoIncrement"`
+	Instance  string `gorm:"size:64"`              // 产生事件的实例
+	Action    uint8  `gorm:"index:idx_ip"`         // 事件类型
+	Ip        string `gorm:"size:64;index:idx_ip"` // IpKey 的返回值或ip段
+	RangeType int    // ip段的类型
+	Reason    string `gorm:"size:255"`
+	Source    string `gorm:"size:16"`
+	ExpireAt  int64  // 过期时间，毫秒，0表示永久
+	CreatedAt int64  `gorm:"autoCreateTime:milli;index"`
+}
+
+// 限流计数表，每个实例每个窗口一行
+type ipVisitCount struct {
+	CountKey    string `gorm:"primaryKey;size:128"` // 调用方定义的key，一般是 策略名:IpKey
+	WindowStart int64  `gorm:"primaryKey"`          // 窗口开始时间，毫秒
+	Instance    string `gorm:"primaryKey;size:64"`
+	Count       int
+	ExpireAt    int64 `gorm:"index"` // 超过该时间的计数已无意义，可以删除
+}
+
+// 实例心跳表，用于统计存活的实例数
+type ipInstance struct {
+	Instance    string `gorm:"primaryKey;size:64"`
+	HeartbeatAt int64
+}
+
+type visitKey struct {
+	key         string
+	windowStart int64
+}
+
+type visitDelta struct {
+	count    int
+	expireAt int64
+}
+
+// 已应用的事件，用于去重和判断晚提交的旧事件
+type appliedEvent struct {
+	id        int64
+	action    uint8
+	createdAt int64
+}
+
+type sharedIpVisit struct {
+	*ipVisitS
+	instance      string // 本实例的标识
+	syncSecond    int    // 同步间隔，单位秒
+	eventLock     sync.Mutex
+	lastEventId   int64                   // 已应用的最大的事件id
+	seenEvents    map[int64]int64         // 重叠窗口内已应用的事件id，值为事件的创建时间
+	latestEvents  map[string]appliedEvent // 重叠窗口内每个ip或ip段最后的事件，包括本实例发布的
+	lastClean     int64                   // 上次清理过期数据的时间
+	instanceCount int32                   // 存活的实例数，原子操作
+	visitLock     sync.Mutex
+	localVisit    map[visitKey]*visitDelta // 还未写入mysql的本地计数
+	remoteVisit   map[visitKey]int         // 其他实例的计数，每次同步整体替换
+}
+
+/**
+ * @description: 初始化共享实现，建表并重放还在生效的事件
+ * @param {*ipVisitS} ipVisit 本地的内存实现，已加载本地文件
+ * @return {*}
+ */
+func initSharedIpVisit(ipVisit *ipVisitS) (*sharedIpVisit, error) {
+	if err := Mysql.AutoMigrate(&ipBanEvent{}, &ipVisitCount{}, &ipInstance{}); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	s := &sharedIpVisit{
+		ipVisitS:      ipVisit,
+		instance:      fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixMilli()),
+		syncSecond:    VP.GetInt("IpManage.SyncSecond"),
+		instanceCount: 1,
+		localVisit:    make(map[visitKey]*visitDelta),
+		remoteVisit:   make(map[visitKey]int),
+		seenEvents:    make(map[int64]int64),
+		latestEvents:  make(map[string]appliedEvent),
+	}
+	if s.syncSecond <= 0 {
+		s.syncSecond = 2
+	}
+	// 启动时重放所有事件，包括其他实例之前产生的，保证新实例的封禁状态和其他实例一致
+	var eventList []ipBanEvent
+	if err := Mysql.Order("id").Find(&eventList).Error; err != nil {
+		return nil, err
+	}
+	s.applyEvents(eventList, time.Now().UnixMilli())
+	return s, nil
+}
+
+// 访问超限自动封禁时，需要通知其他实例
+func (s *sharedIpVisit) Add(ipStr string) int8 {
+	old, _ := s.ipVisitS.IsBan(ipStr)
+	res := s.ipVisitS.Add(ipStr)
+	if old >= 0 && res < 0 {
+		s.publish(ipBanEvent{Action: ipEventBan, Ip: IpKey(ipStr), Reason: "访问过于频繁", Source: BanSourceAuto, ExpireAt: time.Now().Add(time.Duration(-res) * time.Minute).UnixMilli()})
+	}
+	return res
+}
+
+func (s *sharedIpVisit) AddBanTime(ipStr string, banTime int8) int8 {
+	res := s.ipVisitS.AddBanTime(ipStr, banTime)
+	if res < 0 {
+		s.publishBan(ipStr, res, "", BanSourceManual)
+	}
+	return res
+}
+
+func (s *sharedIpVisit) Ban(ipStr string, minute int, reason string, source string) int8 {
+	res := s.ipVisitS.Ban(ipStr, minute, reason, source)
+	if res < 0 {
+		s.publishBan(ipStr, res, reason, source)
+	}
+	return res
+}
+
+func (s *sharedIpVisit) DeleteIp(ipStr string) int {
+	res := s.ipVisitS.DeleteIp(ipStr)
+	if res == 0 {
+		s.publish(ipBanEvent{Action: ipEventUnban, Ip: IpKey(ipStr)})
+	}
+	return res
+}
+
+func (s *sharedIpVisit) AddRange(cidr string, rangeType int, reason string, expireMinute int) error {
+	if err := s.ipVisitS.AddRange(cidr, rangeType, reason, expireMinute); err != nil {
+		return err
+	}
+	event := ipBanEvent{Action: ipEventRangeAdd, RangeType: rangeType, Reason: reason}
+	ipNet, _ := parseCidr(cidr) // 前面已校验过格式
+	event.Ip = ipNet.String()
+	if expireMinute > 0 {
+		event.ExpireAt = time.Now().Add(time.Duration(expireMinute) * time.Minute).UnixMilli()
+	}
+	s.publish(event)
+	return nil
+}
+
+func (s *sharedIpVisit) DeleteRange(cidr string) int {
+	res := s.ipVisitS.DeleteRange(cidr)
+	if res == 0 {
+		ipNet, _ := parseCidr(cidr)
+		s.publish(ipBanEvent{Action: ipEventRangeDelete, Ip: ipNet.String()})
+	}
+	return res
+}
+
+// 记录本实例的访问次数，在下次同步时写入mysql
+func (s *sharedIpVisit) ReportVisit(key string, windowStart int64, window int64, delta int) {
+	s.visitLock.Lock()
+	defer s.visitLock.Unlock()
+	k := visitKey{key: key, windowStart: windowStart}
+	v, ok := s.localVisit[k]
+	if !ok {
+		v = &visitDelta{expireAt: windowStart + 2*window} // 滑动窗口最多用到上一个窗口
+		s.localVisit[k] = v
+	}
+	v.count += delta
+}
+
+// 其他实例在该窗口的访问次数，是上次同步时的值
+func (s *sharedIpVisit) ClusterVisit(key string, windowStart int64) int {
+	s.visitLock.Lock()
+	defer s.visitLock.Unlock()
+	return s.remoteVisit[visitKey{key: key, windowStart: windowStart}]
+}
+
+func (s *sharedIpVisit) InstanceCount() int {
+	return int(atomic.LoadInt32(&s.instanceCount))
+}
+
+// 除了本地的定时检查，还需要定时和mysql同步
+func (s *sharedIpVisit) CheckIPList(stopChan chan bool) *time.Ticker {
+	ticker := time.NewTicker(time.Second * time.Duration(s.cycleSecond))
+	syncTicker := time.NewTicker(time.Second * time.Duration(s.syncSecond))
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.checkIPList()
+			case <-syncTicker.C:
+				s.sync()
+			case <-stopChan:
+				syncTicker.Stop()
+				return // 退出协程
+			}
+		}
+	}()
+	return ticker
+}
+
+// 计算封禁的过期时间并发布事件
+func (s *sharedIpVisit) publishBan(ipStr string, res int8, reason string, source string) {
+	event := ipBanEvent{Action: ipEventBan, Ip: IpKey(ipStr), Reason: reason, Source: source}
+	if record := s.ipVisitS.GetBanRecord(ipStr); record != nil { // 台账里有真正的过期时间
+		event.ExpireAt = record.ExpireAt
+		if event.Reason == "" {
+			event.Reason = record.Reason
+		}
+	} else if res != -128 {
+		event.ExpireAt = time.Now().Add(time.Duration(-res) * time.Minute).UnixMilli()
+	}
+	s.publish(event)
+}
+
+// 写入事件，解封和删除ip段时，之前的封禁事件已经没有意义，一并删除，避免新实例重放
+func (s *sharedIpVisit) publish(event ipBanEvent) {
+	thisLog := Log{RequestUrl: "sharedIpVisit.publish"}
+	event.Instance = s.instance
+	if err := Mysql.Create(&event).Error; err != nil {
+		thisLog.Error("写入封禁事件失败", err)
+		return
+	}
+	s.eventLock.Lock()
+	s.noteEvent(event)
+	s.eventLock.Unlock()
+	var oldAction uint8
+	switch event.Action {
+	case ipEventUnban:
+		oldAction = ipEventBan
+	case ipEventRangeDelete:
+		oldAction = ipEventRangeAdd
+	default:
+		return
+	}
+	if err := Mysql.Where("ip = ? AND action = ? AND id < ?", event.Ip, oldAction, event.Id).Delete(&ipBanEvent{}).Error; err != nil {
+		thisLog.Error("删除旧的封禁事件失败", err)
+	}
+}
+
+/**
+ * @description: 把其他实例的事件应用到本地，只调用内存实现的方法，不会再次发布。
+ * 按过期时间计算剩余时长，重复应用同一个事件结果不变
+ * @param {ipBanEvent} event
+ * @return {*}
+ */
+func (s *sharedIpVisit) applyEvent(event ipBanEvent) {
+	now := time.Now().UnixMilli()
+	if event.ExpireAt != 0 && event.ExpireAt <= now { // 已经过期的不再应用
+		return
+	}
+	minute := 0 // 0 表示永久
+	if event.ExpireAt != 0 {
+		minute = int((event.ExpireAt - now + 59999) / 60000)
+	}
+	switch event.Action {
+	case ipEventBan:
+		v, ok := s.ipVisitS.IsBan(event.Ip)
+		if !ok || v == -128 {
+			return
+		}
+		// Ban 对短时封禁是累加的，这里要的是设置成剩余时长，所以减去本地已有的封禁时长
+		if v < 0 && minute > 0 && minute < 128 {
+			if minute <= int(-v) {
+				return
+			}
+			minute -= int(-v)
+		}
+		s.ipVisitS.Ban(event.Ip, minute, event.Reason, event.Source)
+	case ipEventUnban:
+		s.ipVisitS.DeleteIp(event.Ip)
+	case ipEventRangeAdd:
+		s.ipVisitS.AddRange(event.Ip, event.RangeType, event.Reason, minute)
+	case ipEventRangeDelete:
+		s.ipVisitS.DeleteRange(event.Ip)
+	}
+}
+
+/**
+ * @description: 按id顺序应用事件，跳过已应用过的。晚提交的旧事件如果和同一个ip或ip段更新的事件相反（封禁和解封、添加和删除ip段），
+ * 说明状态已经被更新的事件改变了，不再应用
+ * @param {[]ipBanEvent} eventList 按id升序
+ * @param {int64} now 当前时间，毫秒，用于清理重叠窗口之外的记录
+ * @return {*}
+ */
+func (s *sharedIpVisit) applyEvents(eventList []ipBanEvent, now int64) {
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+	for _, event := range eventList {
+		if _, ok := s.seenEvents[event.Id]; ok {
+			continue
+		}
+		s.seenEvents[event.Id] = event.CreatedAt
+		if latest, ok := s.latestEvents[eventTarget(event)]; !ok || latest.id < event.Id || latest.action == event.Action {
+			s.applyEvent(event)
+		}
+		s.noteEvent(event)
+		s.lastEventId = max(s.lastEventId, event.Id)
+	}
+	expire := now - int64(max(ipEventOverlapSec, 2*s.syncSecond))*1000
+	for id, createdAt := range s.seenEvents {
+		if createdAt < expire {
+			delete(s.seenEvents, id)
+		}
+	}
+	for target, latest := range s.latestEvents {
+		if latest.createdAt < expire {
+			delete(s.latestEvents, target)
+		}
+	}
+}
+
+// 记录ip或ip段最后的事件，调用前需持有eventLock
+func (s *sharedIpVisit) noteEvent(event ipBanEvent) {
+	target := eventTarget(event)
+	if latest, ok := s.latestEvents[target]; !ok || latest.id < event.Id {
+		s.latestEvents[target] = appliedEvent{id: event.Id, action: event.Action, createdAt: event.CreatedAt}
+	}
+}
+
+// 事件作用的对象，ip和ip段分开
+func eventTarget(event ipBanEvent) string {
+	if event.Action == ipEventRangeAdd || event.Action == ipEventRangeDelete {
+		return "range:" + event.Ip
+	}
+	return event.Ip
+}
+
+// 和mysql同步：心跳、写入本地计数、读取其他实例的计数、应用新的封禁事件、清理过期数据
+func (s *sharedIpVisit) sync() {
+	thisLog := Log{RequestUrl: "sharedIpVisit.sync"}
+	now := time.Now().UnixMilli()
+
+	// 心跳并统计存活的实例数
+	if err := Mysql.Save(&ipInstance{Instance: s.instance, HeartbeatAt: now}).Error; err != nil {
+		thisLog.Error("写入实例心跳失败", err)
+	}
+	aliveMs := int64(max(instanceAliveSec, 3*s.syncSecond)) * 1000
+	var count int64
+	if err := Mysql.Model(&ipInstance{}).Where("heartbeat_at > ?", now-aliveMs).Count(&count).Error; err == nil && count > 0 {
+		atomic.StoreInt32(&s.instanceCount, int32(count))
+	}
+
+	// 写入本地计数，用 count = count + ? 累加
+	s.visitLock.Lock()
+	localVisit := s.localVisit
+	s.localVisit = make(map[visitKey]*visitDelta)
+	s.visitLock.Unlock()
+	rows := make([]ipVisitCount, 0, len(localVisit))
+	for k, v := range localVisit {
+		if v.count != 0 {
+			rows = append(rows, ipVisitCount{CountKey: k.key, WindowStart: k.windowStart, Instance: s.instance, Count: v.count, ExpireAt: v.expireAt})
+		}
+	}
+	if len(rows) > 0 {
+		err := Mysql.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + VALUES(count)")}),
+		}).CreateInBatches(rows, 500).Error
+		if err != nil {
+			thisLog.Error("写入限流计数失败", err)
+		}
+	}
+
+	// 读取其他实例还有意义的计数
+	var remoteRows []ipVisitCount
+	err := Mysql.Model(&ipVisitCount{}).Select("count_key, window_start, SUM(count) AS count").
+		Where("expire_at > ? AND instance <> ?", now, s.instance).Group("count_key, window_start").Find(&remoteRows).Error
+	if err != nil {
+		thisLog.Error("读取限流计数失败", err)
+	} else {
+		remoteVisit := make(map[visitKey]int, len(remoteRows))
+		for _, v := range remoteRows {
+			remoteVisit[visitKey{key: v.CountKey, windowStart: v.WindowStart}] = v.Count
+		}
+		s.visitLock.Lock()
+		s.remoteVisit = remoteVisit
+		s.visitLock.Unlock()
+	}
+
+	// 应用其他实例的新事件。自增id在插入时分配而不是提交时，id小的事件可能在id大的之后才提交，
+	// 只按id > lastEventId读取会永远漏掉它，所以最近一段时间内的事件每次都重新读取，已应用的跳过
+	overlapMs := int64(max(ipEventOverlapSec, 2*s.syncSecond)) * 1000
+	s.eventLock.Lock()
+	lastEventId := s.lastEventId
+	s.eventLock.Unlock()
+	var eventList []ipBanEvent
+	if err := Mysql.Where("(id > ? OR created_at > ?) AND instance <> ?", lastEventId, now-overlapMs, s.instance).Order("id").Find(&eventList).Error; err != nil {
+		thisLog.Error("读取封禁事件失败", err)
+	}
+	s.applyEvents(eventList, now)
+
+	// 每分钟清理一次过期的计数、事件和下线的实例
+	if now-s.lastClean < 60000 {
+		return
+	}
+	s.lastClean = now
+	if err := Mysql.Where("expire_at < ?", now).Delete(&ipVisitCount{}).Error; err != nil {
+		thisLog.Error("清理限流计数失败", err)
+	}
+	// 保留一段时间方便排查，之后删除已过期的封禁，以及解封、删除ip段这类只需要应用一次的事件
+	err = Mysql.Where("created_at < ? AND ((expire_at <> 0 AND expire_at < ?) OR action IN ?)", now-ipEventKeepDay*86400000, now, []uint8{ipEventUnban, ipEventRangeDelete}).
+		Delete(&ipBanEvent{}).Error
+	if err != nil {
+		thisLog.Error("清理封禁事件失败", err)
+	}
+	if err := Mysql.Where("heartbeat_at < ?", now-ipEventKeepDay*86400000).Delete(&ipInstance{}).Error; err != nil {
+		thisLog.Error("清理下线实例失败", err)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 18:20:41
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 18:20:41
+ * @Description: 多实例共享封禁和限流计数的测试，除了applyEvents外都需要mysql，设置环境变量TEST_MYSQL_DSN后才会执行，如 user:pass@tcp(127.0.0.1:3306)/test
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// 不连mysql的共享实现，只用来测试事件的应用
+func newTestShared() *sharedIpVisit {
+	return &sharedIpVisit{
+		ipVisitS:     newTestIpVisit(),
+		instance:     "local",
+		syncSecond:   2,
+		seenEvents:   make(map[int64]int64),
+		latestEvents: make(map[string]appliedEvent),
+	}
+}
+
+// 连接测试库并清空共享表，没有配置TEST_MYSQL_DSN时跳过
+func setupSharedTable(t *testing.T) {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("未设置TEST_MYSQL_DSN，跳过")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("连接mysql失败: %v", err)
+	}
+	if err = db.Migrator().DropTable(&ipBanEvent{}, &ipVisitCount{}, &ipInstance{}); err != nil {
+		t.Fatal(err)
+	}
+	oldMysql, oldLog := Mysql, ZapLog
+	Mysql = db
+	if ZapLog == nil {
+		ZapLog = zap.NewNop()
+	}
+	t.Cleanup(func() { Mysql, ZapLog = oldMysql, oldLog })
+}
+
+// 启动一个实例，同一毫秒内启动的实例标识会重复，所以手动指定
+func startInstance(t *testing.T, name string) *sharedIpVisit {
+	s, err := initSharedIpVisit(newTestIpVisit())
+	if err != nil {
+		t.Fatalf("初始化共享实现失败: %v", err)
+	}
+	s.instance = name
+	return s
+}
+
+func checkBan(t *testing.T, s *sharedIpVisit, ip string, want int8) {
+	t.Helper()
+	if got, _ := s.IsBan(ip); got != want {
+		t.Fatalf("实例%s上%s的值是%d，期望%d", s.instance, ip, got, want)
+	}
+}
+
+// 同一个事件重复应用结果不变；晚到的旧事件和更新的事件相反时不应用，相同时照常应用
+func TestApplyEvents(t *testing.T) {
+	s := newTestShared()
+	now := time.Now().UnixMilli()
+	expireAt := now + 10*60000
+	ban := ipBanEvent{Id: 10, Action: ipEventBan, Ip: "1.1.1.1", ExpireAt: expireAt, CreatedAt: now}
+	s.applyEvents([]ipBanEvent{ban}, now)
+	s.applyEvents([]ipBanEvent{ban}, now) // 重叠窗口会再次读到
+	checkBan(t, s, "1.1.1.1", -10)
+	if s.lastEventId != 10 {
+		t.Fatalf("lastEventId是%d，期望10", s.lastEventId)
+	}
+
+	// id小于lastEventId的事件晚提交，仍然要应用
+	s.applyEvents([]ipBanEvent{{Id: 5, Action: ipEventBan, Ip: "2.2.2.2", CreatedAt: now}}, now)
+	checkBan(t, s, "2.2.2.2", -128)
+	if s.lastEventId != 10 {
+		t.Fatalf("lastEventId是%d，不应被旧事件改小", s.lastEventId)
+	}
+
+	// 已经应用了解封，晚到的旧封禁不能把ip再封上
+	s.applyEvents([]ipBanEvent{{Id: 20, Action: ipEventUnban, Ip: "1.1.1.1", CreatedAt: now}}, now)
+	checkBan(t, s, "1.1.1.1", 0)
+	s.applyEvents([]ipBanEvent{{Id: 15, Action: ipEventBan, Ip: "1.1.1.1", ExpireAt: expireAt, CreatedAt: now}}, now)
+	checkBan(t, s, "1.1.1.1", 0)
+
+	// ip段和ip分开判断，同一个ip段先删除后晚到的添加也不应用
+	s.applyEvents([]ipBanEvent{{Id: 30, Action: ipEventRangeDelete, Ip: "10.0.0.0/8", CreatedAt: now}}, now)
+	s.applyEvents([]ipBanEvent{{Id: 25, Action: ipEventRangeAdd, Ip: "10.0.0.0/8", RangeType: RangeTypeBan, CreatedAt: now}}, now)
+	if got := s.CheckRange("10.1.2.3"); got != 0 {
+		t.Fatalf("ip段的类型是%d，期望0", got)
+	}
+
+	// 重叠窗口之外的记录会被清理
+	later := now + int64(ipEventOverlapSec+1)*1000
+	s.applyEvents(nil, later)
+	if len(s.seenEvents) != 0 || len(s.latestEvents) != 0 {
+		t.Fatalf("过期的记录没有清理: %v %v", s.seenEvents, s.latestEvents)
+	}
+}
+
+// 一个实例的封禁、解封和ip段能同步到另一个实例，新启动的实例能重放
+func TestSharedBanPropagation(t *testing.T) {
+	setupSharedTable(t)
+	a := startInstance(t, "a")
+	b := startInstance(t, "b")
+
+	a.Ban("1.1.1.1", 10, "测试", BanSourceManual)
+	a.Ban("2.2.2.2", 0, "测试", BanSourceManual)
+	if err := a.AddRange("10.0.0.0/8", RangeTypeBan, "测试", 0); err != nil {
+		t.Fatal(err)
+	}
+	b.sync()
+	checkBan(t, b, "1.1.1.1", -10)
+	checkBan(t, b, "2.2.2.2", -128)
+	if got := b.CheckRange("10.1.2.3"); got != RangeTypeBan {
+		t.Fatalf("ip段的类型是%d，期望%d", got, RangeTypeBan)
+	}
+	b.sync() // 重叠窗口内再次读到同一批事件，短时封禁不能累加
+	checkBan(t, b, "1.1.1.1", -10)
+
+	c := startInstance(t, "c")
+	checkBan(t, c, "1.1.1.1", -10)
+	checkBan(t, c, "2.2.2.2", -128)
+
+	b.DeleteIp("2.2.2.2")
+	b.DeleteRange("10.0.0.0/8")
+	a.sync()
+	checkBan(t, a, "2.2.2.2", 0)
+	if got := a.CheckRange("10.1.2.3"); got != 0 {
+		t.Fatalf("ip段的类型是%d，期望0", got)
+	}
+	d := startInstance(t, "d")
+	checkBan(t, d, "2.2.2.2", 0)
+	checkBan(t, d, "1.1.1.1", -10)
+}
+
+// 每个实例读到的是其他实例计数的和，不包括自己的
+func TestSharedVisitCount(t *testing.T) {
+	setupSharedTable(t)
+	a := startInstance(t, "a")
+	b := startInstance(t, "b")
+	c := startInstance(t, "c")
+	now := time.Now().UnixMilli()
+	windowStart := now - now%60000
+
+	a.ReportVisit("test:1.1.1.1", windowStart, 60000, 3)
+	b.ReportVisit("test:1.1.1.1", windowStart, 60000, 2)
+	c.ReportVisit("test:1.1.1.1", windowStart, 60000, 4)
+	a.sync()
+	b.sync()
+	c.sync()
+	a.sync() // a第一次同步时还没有其他实例的计数
+	if got := a.ClusterVisit("test:1.1.1.1", windowStart); got != 6 {
+		t.Fatalf("实例a读到的计数是%d，期望6", got)
+	}
+	if got := c.ClusterVisit("test:1.1.1.1", windowStart); got != 5 {
+		t.Fatalf("实例c读到的计数是%d，期望5", got)
+	}
+	if got := a.InstanceCount(); got != 3 {
+		t.Fatalf("存活实例数是%d，期望3", got)
+	}
+
+	// 同一个窗口的后续计数累加到原来的行上
+	a.ReportVisit("test:1.1.1.1", windowStart, 60000, 1)
+	a.sync()
+	b.sync()
+	if got := b.ClusterVisit("test:1.1.1.1", windowStart); got != 8 {
+		t.Fatalf("实例b读到的计数是%d，期望8", got)
+	}
+	if got := b.ClusterVisit("test:2.2.2.2", windowStart); got != 0 {
+		t.Fatalf("没有访问过的key计数是%d，期望0", got)
+	}
+}
+
+// 自增id小的事件在id大的之后才提交，下次同步时仍然要应用
+func TestSharedLateEvent(t *testing.T) {
+	setupSharedTable(t)
+	a := startInstance(t, "a")
+	b := startInstance(t, "b")
+	now := time.Now().UnixMilli()
+	insert := func(event ipBanEvent) {
+		event.Instance = "a"
+		event.CreatedAt = now
+		if err := Mysql.Create(&event).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(ipBanEvent{Id: 100, Action: ipEventBan, Ip: "3.3.3.3"})
+	b.sync()
+	checkBan(t, b, "3.3.3.3", -128)
+	insert(ipBanEvent{Id: 50, Action: ipEventBan, Ip: "4.4.4.4"})
+	b.sync()
+	checkBan(t, b, "4.4.4.4", -128)
+
+	// 晚提交的封禁比已应用的解封旧，不能再封上
+	insert(ipBanEvent{Id: 200, Action: ipEventUnban, Ip: "3.3.3.3"})
+	b.sync()
+	checkBan(t, b, "3.3.3.3", 0)
+	insert(ipBanEvent{Id: 150, Action: ipEventBan, Ip: "3.3.3.3"})
+	b.sync()
+	checkBan(t, b, "3.3.3.3", 0)
+
+	// 自己发布的事件不会再应用一次
+	a.Ban("5.5.5.5", 10, "测试", BanSourceManual)
+	a.sync()
+	checkBan(t, a, "5.5.5.5", -10)
+}
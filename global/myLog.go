@@ -16,6 +16,7 @@ import (
 type Log struct {
 	Logid      *int
 	RequestUrl string
+	ClientIp   string // 解析代理后的真实客户端ip，非请求产生的日志为空
 }
 
 func InitLog(logId int) *Log {
@@ -24,11 +25,19 @@ func InitLog(logId int) *Log {
 
 // 以下方法将logid封装进去，使用时可以做到无感知
 func (l *Log) Info(msg string, info interface{}) {
-	ZapLog.Info(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), zap.Any("info", info))
+	ZapLog.Info(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), l.clientIpField(), zap.Any("info", info))
 }
 func (l *Log) Warn(msg string, warn interface{}) {
-	ZapLog.Warn(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), zap.Any("warn", warn))
+	ZapLog.Warn(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), l.clientIpField(), zap.Any("warn", warn))
 }
 func (l *Log) Error(msg string, err ...error) {
-	ZapLog.Error(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), zap.Errors("error", err))
+	ZapLog.Error(msg, zap.Intp(LogIdKey, l.Logid), zap.String("RequestUrl", l.RequestUrl), l.clientIpField(), zap.Errors("error", err))
+}
+
+// 没有客户端ip时不输出该字段
+func (l *Log) clientIpField() zap.Field {
+	if l.ClientIp == "" {
+		return zap.Skip()
+	}
+	return zap.String("ClientIp", l.ClientIp)
 }
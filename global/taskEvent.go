@@ -0,0 +1,100 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 21:40:16
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 21:40:16
+ * @Description: 任务事件的订阅和发布，按任务id分发进度、状态、支付结果等变化，用于向前端推送，代替轮询。
+ * 只在本进程内存中分发。多实例部署时worker和支付回调可能在其他实例执行，收不到事件，推送接口每次心跳都会重新查询任务兜底
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import "sync"
+
+// 任务事件的名称
+const (
+	TaskEventProgress = "progress" // 进度变化
+	TaskEventStatus   = "status"   // 状态变化
+	TaskEventPay      = "pay"      // 订单状态变化
+	TaskEventDownload = "download" // 下载次数变化
+)
+
+const (
+	taskEventBuffer       = 16 // 每个订阅者缓存的事件数，推送跟不上时丢弃新事件
+	taskEventMaxSubscribe = 3  // 每个任务最多同时订阅的连接数，防止一个任务占用过多连接
+)
+
+type TaskEvent struct {
+	Name string
+	Data map[string]any
+}
+
+var (
+	taskEventLock   sync.Mutex
+	taskEventSubs   = make(map[string]map[chan TaskEvent]struct{}) // 任务id -> 订阅者
+	taskEventClosed bool                                           // 服务退出后不再接受订阅
+)
+
+/**
+ * @description: 订阅任务的事件
+ * @param {string} taskId
+ * @return {<-chan TaskEvent} 接收事件的通道
+ * @return {func()} 取消订阅，连接断开时必须调用
+ * @return {bool} 订阅数超限时返回false
+ */
+func SubscribeTaskEvent(taskId string) (<-chan TaskEvent, func(), bool) {
+	taskEventLock.Lock()
+	defer taskEventLock.Unlock()
+	subs := taskEventSubs[taskId]
+	if taskEventClosed || len(subs) >= taskEventMaxSubscribe {
+		return nil, nil, false
+	}
+	if subs == nil {
+		subs = make(map[chan TaskEvent]struct{})
+		taskEventSubs[taskId] = subs
+	}
+	ch := make(chan TaskEvent, taskEventBuffer)
+	subs[ch] = struct{}{}
+	return ch, func() {
+		taskEventLock.Lock()
+		defer taskEventLock.Unlock()
+		delete(subs, ch)
+		if len(subs) == 0 {
+			delete(taskEventSubs, taskId)
+		}
+	}, true
+}
+
+/**
+ * @description: 发布任务事件，没有订阅者时直接忽略，不会阻塞调用方
+ * @param {string} taskId
+ * @param {string} name 事件名称
+ * @param {map[string]any} data 事件内容
+ * @return {*}
+ */
+func PublishTaskEvent(taskId string, name string, data map[string]any) {
+	taskEventLock.Lock()
+	defer taskEventLock.Unlock()
+	for ch := range taskEventSubs[taskId] {
+		select {
+		case ch <- TaskEvent{Name: name, Data: data}:
+		default: // 订阅者处理不过来，丢弃，推送时会重新查询最新状态
+		}
+	}
+}
+
+/**
+ * @description: 关闭所有订阅的通道，让推送的长连接结束，否则http服务退出时要一直等待这些连接
+ * @return {*}
+ */
+func CloseTaskEvents() {
+	taskEventLock.Lock()
+	defer taskEventLock.Unlock()
+	taskEventClosed = true
+	for taskId, subs := range taskEventSubs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(taskEventSubs, taskId)
+	}
+}
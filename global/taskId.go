@@ -0,0 +1,101 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 18:20:37
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 18:20:37
+ * @Description: 任务id的生成和校验。任务id等同于文件的所有权，所以用加密随机数加HMAC签名，知道算法也没法枚举出别人的id
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"crypto/hmac"
+	"encoding/base32"
+	"src/utils/sign"
+	"sync"
+	"time"
+)
+
+const (
+	taskIdRandLen = 15 // 随机部分的字节数，120位
+	taskIdSignLen = 5  // 签名部分的字节数，40位，伪造一个能通过校验的id要尝试上万亿次
+	TaskIdLen     = 32 // (15+5)字节base32编码后的长度
+	legacyIdLen   = 8  // 旧版任务id的长度
+)
+
+var (
+	taskIdSecret     []byte
+	taskIdSecretOnce sync.Once
+)
+
+// 读取任务id的签名密钥
+func getTaskIdSecret() []byte {
+	taskIdSecretOnce.Do(func() {
+		taskIdSecret = configSecret("Task.Secret", "未配置Task.Secret，使用随机密钥，重启后之前生成的任务id都会失效")
+	})
+	return taskIdSecret
+}
+
+/**
+ * @description: 生成新的任务id，仅包含大写字母和数字2~7，可以直接用于文件名和url
+ * @return {string} 长度为TaskIdLen的字符串
+ */
+func NewTaskId() string {
+	raw := sign.RandomBytes(taskIdRandLen)
+	raw = append(raw, sign.Hmac(getTaskIdSecret(), string(raw))[:taskIdSignLen]...)
+	return base32.StdEncoding.EncodeToString(raw)
+}
+
+/**
+ * @description: 校验任务id，新版校验签名；旧版在Task.LegacyUntil之前仍然接受，用于迁移期间已经发出去的id
+ * @param {string} taskId
+ * @return {bool} 是否合法
+ */
+func CheckTaskId(taskId string) bool {
+	switch len(taskId) {
+	case TaskIdLen:
+		raw, err := base32.StdEncoding.DecodeString(taskId)
+		if err != nil || len(raw) != taskIdRandLen+taskIdSignLen {
+			return false
+		}
+		return hmac.Equal(raw[taskIdRandLen:], sign.Hmac(getTaskIdSecret(), string(raw[:taskIdRandLen]))[:taskIdSignLen])
+	case legacyIdLen:
+		return acceptLegacyTaskId() && checkLegacyTaskId(taskId)
+	}
+	return false
+}
+
+// 是否还在旧版任务id的迁移期内，Task.LegacyUntil为空或格式错误时不再接受旧版id
+func acceptLegacyTaskId() bool {
+	until, err := time.ParseInLocation(time.DateOnly, VP.GetString("Task.LegacyUntil"), time.Local)
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(until.AddDate(0, 0, 1)) // 包含当天
+}
+
+/**
+ * @description: 校验旧版的8位任务id，前6位是数字和大写字母，后2位是前6位的校验码。
+ * 校验码的算法很简单，只能防止用户手误，不能防伪造，所以只在迁移期内使用
+ * @param {string} taskId
+ * @return {bool}
+ */
+func checkLegacyTaskId(taskId string) bool {
+	for _, v := range taskId {
+		// 不是数字且不是大写字母
+		if !(v >= 48 && v <= 57) && !(v >= 65 && v <= 90) {
+			return false
+		}
+	}
+	code1 := int(taskId[0]) + int(taskId[2]) + int(taskId[4]) + int(taskId[5])
+	code2 := int(taskId[0]) + int(taskId[1]) + int(taskId[3]) + int(taskId[4])
+	return taskId[6] == legacyHashChar(code1) && taskId[7] == legacyHashChar(code2)
+}
+
+// 把校验和映射成数字或大写字母，余数小于10时是数字，否则是字母
+func legacyHashChar(code int) byte {
+	if code%36 < 10 {
+		return byte(code%36 + 48)
+	}
+	return byte(code%36 + 55)
+}
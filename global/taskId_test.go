@@ -0,0 +1,139 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 10:05:16
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 10:05:16
+ * @Description: 任务id签名和旧版id兼容截止日期的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package global
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 测试用的配置，签名密钥是用sync.Once读取的，必须在所有测试之前设置好
+func TestMain(m *testing.M) {
+	VP = viper.New()
+	VP.Set("Task.Secret", "task-secret-for-test")
+	VP.Set("Download.Secret", "download-secret-for-test")
+	VP.Set("Captcha.Secret", "captcha-secret-for-test")
+	os.Exit(m.Run())
+}
+
+// 按旧版的算法生成带校验码的8位id
+func legacyTaskId(prefix string) string {
+	code1 := int(prefix[0]) + int(prefix[2]) + int(prefix[4]) + int(prefix[5])
+	code2 := int(prefix[0]) + int(prefix[1]) + int(prefix[3]) + int(prefix[4])
+	return prefix + string(legacyHashChar(code1)) + string(legacyHashChar(code2))
+}
+
+func TestNewTaskId(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := NewTaskId()
+		if len(id) != TaskIdLen {
+			t.Fatalf("任务id长度为%d，期望%d", len(id), TaskIdLen)
+		}
+		if !CheckTaskId(id) {
+			t.Fatalf("新生成的任务id %s 校验失败", id)
+		}
+		if seen[id] {
+			t.Fatalf("任务id %s 重复", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCheckTaskIdTampered(t *testing.T) {
+	id := NewTaskId()
+	// 替换任意一个字符都应该校验失败
+	for i := 0; i < len(id); i++ {
+		c := byte('A')
+		if id[i] == 'A' {
+			c = 'B'
+		}
+		tampered := id[:i] + string(c) + id[i+1:]
+		if CheckTaskId(tampered) {
+			t.Fatalf("修改第%d个字符后的id %s 不应该通过校验", i, tampered)
+		}
+	}
+	tests := []string{
+		"",
+		id[:TaskIdLen-1],
+		id + "A",
+		"11111111111111111111111111111111", // 不是合法的base32
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", // 格式正确但签名不对
+	}
+	for _, tt := range tests {
+		if CheckTaskId(tt) {
+			t.Fatalf("%q 不应该通过校验", tt)
+		}
+	}
+}
+
+func TestCheckTaskIdSecret(t *testing.T) {
+	id := NewTaskId()
+	old := taskIdSecret
+	taskIdSecret = []byte("another-secret")
+	defer func() { taskIdSecret = old }()
+	if CheckTaskId(id) {
+		t.Fatal("换了密钥后之前的任务id不应该通过校验")
+	}
+}
+
+func TestCheckLegacyTaskId(t *testing.T) {
+	valid := legacyTaskId("AB12CD")
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+	today := time.Now().Format(time.DateOnly)
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+	tests := []struct {
+		name        string
+		legacyUntil string
+		taskId      string
+		want        bool
+	}{
+		{"截止日期之前", tomorrow, valid, true},
+		{"截止日期当天", today, valid, true},
+		{"截止日期之后", yesterday, valid, false},
+		{"未配置截止日期", "", valid, false},
+		{"截止日期格式错误", "2027/01/31", valid, false},
+		{"校验码错误", tomorrow, valid[:7] + string(valid[6]+1), false},
+		{"包含小写字母", tomorrow, "ab12cd" + valid[6:], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			VP.Set("Task.LegacyUntil", tt.legacyUntil)
+			defer VP.Set("Task.LegacyUntil", "")
+			if got := CheckTaskId(tt.taskId); got != tt.want {
+				t.Fatalf("CheckTaskId(%s) = %v，期望%v", tt.taskId, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	defer VP.Set("AppDebug", nil)
+	defer VP.Set("Task.Secret", VP.GetString("Task.Secret"))
+	VP.Set("AppDebug", false)
+	if err := CheckSecrets(); err != nil {
+		t.Fatalf("配置了密钥不应该报错: %v", err)
+	}
+	for _, key := range requiredSecrets {
+		value := VP.GetString(key)
+		VP.Set(key, "")
+		if err := CheckSecrets(); err == nil {
+			t.Fatalf("正式环境未配置%s应该拒绝启动", key)
+		}
+		VP.Set(key, value)
+	}
+	VP.Set("Task.Secret", "")
+	VP.Set("AppDebug", true)
+	if err := CheckSecrets(); err != nil {
+		t.Fatalf("调试模式允许不配置密钥: %v", err)
+	}
+}
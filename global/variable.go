@@ -16,7 +16,6 @@ import (
 	"github.com/spf13/viper"
 	"github.com/wechatpay-apiv3/wechatpay-go/core"
 	"go.uber.org/zap"
-	"gocv.io/x/gocv"
 	"gorm.io/gorm"
 )
 
@@ -30,19 +29,12 @@ var (
 
 	Mysql *gorm.DB // 全局gorm的客户端连接
 
-	IP *ipVisitS // ip管理的对象
+	IP IpManager // ip管理的对象，单实例时是内存实现，多实例时是共享实现
 
 	BaiduToken = make(map[int]string) // 储存百度token的map
 
 	WechatPay *core.Client // 微信支付客户端
 
-	Watermark1   *gocv.Mat // 保存水印图的索引，避免每次读取文件,1通道的
-	WatermarkBW1 *gocv.Mat // 保存水印图的二值图，避免每次读取文件 1通道的
-	Watermark3   *gocv.Mat // 保存水印图的索引，避免每次读取文件,3通道的
-	WatermarkBW3 *gocv.Mat // 保存水印图的二值图，避免每次读取文件 3通道的
-	Watermark4   *gocv.Mat // 保存水印图的索引，避免每次读取文件,4通道的
-	WatermarkBW4 *gocv.Mat // 保存水印图的二值图，避免每次读取文件 4通道的
-
 	ZeroStamp int // 今日0点的时间戳
 
 	ExitSignal = make(chan os.Signal, 1)
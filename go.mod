@@ -18,6 +18,7 @@ require (
 	go.uber.org/ratelimit v0.3.1
 	go.uber.org/zap v1.27.0
 	gocv.io/x/gocv v0.36.1
+	golang.org/x/image v0.23.0
 	golang.org/x/time v0.8.0
 	gorm.io/driver/mysql v1.5.7
 	gorm.io/gorm v1.25.7
@@ -13,19 +13,25 @@ import (
 	"crypto/tls"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"src/app/api"
 	"src/app/model"
+	"src/app/service"
 	"src/app/service/payService"
 	"src/global"
 	g "src/global"
+	"src/middleware"
 	"src/router"
 	"src/timer"
 	myFileUtil "src/utils/file"
 	"src/utils/gormV2"
 	"src/utils/mylog"
+	"src/utils/proxyProtocol"
 	snow "src/utils/snowId"
+	"src/utils/storage"
 	"src/utils/ymlConfig"
 	"src/utils/zapFactory"
 	"syscall"
@@ -34,27 +40,83 @@ import (
 
 // 这里可以存放后端路由（例如后台管理系统）
 func main() {
+	service.AvifProbe() // 探测avif编码的子进程，执行完直接退出
 	programInit()
 	thisLog := g.Log{RequestUrl: "main"}
 
-	// 初始化IP管理模块
+	// 正式环境不允许使用随机的签名密钥
+	if err := g.CheckSecrets(); err != nil {
+		thisLog.Error(err.Error())
+		os.Exit(-1)
+	}
+	// 初始化IP管理模块，参数未配置时使用默认值
 	var err error
-	g.IP, err = g.InitIpVisit(127, 60, 5)
+	limit, cycleSecond, banMinute := 127, 60, 5
+	if g.VP.IsSet("IpManage.Limit") {
+		limit = g.VP.GetInt("IpManage.Limit")
+	}
+	if g.VP.IsSet("IpManage.CycleSecond") {
+		cycleSecond = g.VP.GetInt("IpManage.CycleSecond")
+	}
+	if g.VP.IsSet("IpManage.BanMinute") {
+		banMinute = g.VP.GetInt("IpManage.BanMinute")
+	}
+	g.IP, err = g.InitIpManager(int8(limit), int32(cycleSecond), int8(banMinute))
 	if err != nil {
 		thisLog.Error(err.Error())
 		os.Exit(-1)
 	}
+	// 加载各路由组的限流策略
+	if err = middleware.LoadRateLimitPolicy(); err != nil {
+		thisLog.Error("加载限流策略失败", err)
+		os.Exit(-1)
+	}
+	// 加载境外ip策略
+	if err = middleware.LoadGeoPolicy(); err != nil {
+		thisLog.Error("加载境外ip策略失败", err)
+		os.Exit(-1)
+	}
+	// 加载水印，处理图片前必须加载好
+	if err = service.LoadWatermark(); err != nil {
+		thisLog.Error("加载水印失败", err)
+		os.Exit(-1)
+	}
+	// 检查opencv是否支持avif，不支持时压缩工具不提供avif格式
+	if err = service.InitAvif(); err != nil {
+		thisLog.Warn("不支持输出avif", err.Error())
+	}
+	// 创建文件存储，任务队列的worker启动后就会读写文件，需要先创建
+	if err = storage.Init(); err != nil {
+		thisLog.Error("初始化文件存储失败", err)
+		os.Exit(-1)
+	}
+	// 创建异步任务队列，重启前没有执行完的任务会由worker接着执行
+	if err = service.InitJobQueue(); err != nil {
+		thisLog.Error("初始化异步任务队列失败", err)
+		os.Exit(-1)
+	}
+	api.InitAsyncTools()
 	// 加载网站静态资源
 	if err = g.LoadWebStatic(); err != nil {
 		thisLog.Error("加载网站静态资源失败", err)
 		os.Exit(-1)
 	}
-	router := router.InitRouter() // 初始化路由
+	router, err := router.InitRouter() // 初始化路由
+	if err != nil {
+		thisLog.Error("初始化路由失败", err)
+		os.Exit(-1)
+	}
+	listener, err := newListener()
+	if err != nil {
+		thisLog.Error("监听端口失败", err)
+		os.Exit(-1)
+	}
 
 	server := http.Server{
 		Addr:    g.VP.GetString("HttpServer.Port"),
 		Handler: router,
 	}
+	server.RegisterOnShutdown(g.CloseTaskEvents) // 退出时断开推送的长连接
 	// 加载支付客户端
 	if !LoadPayClient() {
 		os.Exit(-1)
@@ -79,10 +141,10 @@ func main() {
 			}
 			server80 = startHttp80Server()                                   // 启动http80服务,用于重定向到https
 			server.ErrorLog = log.New(&mylog.ServerLog{}, "", log.LstdFlags) // 自定义log，否则他一直打印一些无关紧要的错误
-			server.ListenAndServeTLS(g.VP.GetString("CA.Crt"), g.VP.GetString("CA.Key"))
+			server.ServeTLS(listener, g.VP.GetString("CA.Crt"), g.VP.GetString("CA.Key"))
 		} else {
 			// 开发环境
-			server.ListenAndServe()
+			server.Serve(listener)
 		}
 	}()
 	timer.StartTimer()                    // 启动业务定时器
@@ -198,6 +260,31 @@ func startHttp80Server() *http.Server {
 	return &server80
 }
 
+/**
+ * @description: 创建服务的监听器，配置了PROXY protocol时，从协议头中获取客户端地址
+ * @return {*}
+ */
+func newListener() (net.Listener, error) {
+	ln, err := net.Listen("tcp", g.VP.GetString("HttpServer.Port"))
+	if err != nil {
+		return nil, err
+	}
+	if g.GetClientIpHeader() != g.ClientIpHeaderProxyProtocol {
+		return ln, nil
+	}
+	_, trusted, err := g.GetTrustedProxies()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	ppLn, err := proxyProtocol.NewListener(ln, trusted)
+	if err != nil { // 没有配置Proxy.TrustedProxies时拒绝启动，否则任何客户端都能伪造ip
+		ln.Close()
+		return nil, err
+	}
+	return ppLn, nil
+}
+
 func LoadPayClient() bool {
 	return payService.NewAliPayClient() && payService.NewWechatClient()
 }
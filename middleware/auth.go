@@ -13,7 +13,6 @@ import (
 
 	"src/utils/response"
 
-	"github.com/dchest/captcha"
 	"github.com/gin-gonic/gin"
 )
 
@@ -21,21 +20,19 @@ type HeaderParams struct {
 	Authorization string `header:"Authorization" binding:"required,min=10"`
 }
 
-// CheckCaptchaAuth 验证码中间件
+// CheckCaptchaAuth 验证码中间件，请求头中必须带有通过验证码后签发的凭证。境外ip策略为captcha的路由由GeoHandler调用
 func CheckCaptchaAuth() gin.HandlerFunc {
-	captchaIdKey := g.VP.GetString("Captcha.captchaId")
-	captchaValueKey := g.VP.GetString("Captcha.captchaValue")
 	return func(c *gin.Context) {
-		captchaId := c.Param(captchaIdKey)
-		value := c.Param(captchaValueKey)
-		if captchaId == "" || value == "" {
-			response.Fail(c, 400351, "校验验证码：提交的参数无效，请检查 【验证码ID、验证码值】 提交时的键名是否与配置项一致")
+		if !captchaPassed(c) {
+			response.Fail(c, g.CaptchaRequiredCode, g.CaptchaRequiredMsg)
 			return
 		}
-		if captcha.VerifyString(captchaId, value) {
-			c.Next()
-		} else {
-			response.Fail(c, 400355, "验证码校验失败")
-		}
+		c.Next()
 	}
 }
+
+// 校验请求是否带有有效的验证码通过凭证，凭证在有效期内可重复使用
+func captchaPassed(c *gin.Context) bool {
+	_, _, ok := g.CheckCaptchaPass(c.GetHeader(g.CaptchaTokenKey), c.ClientIP())
+	return ok
+}
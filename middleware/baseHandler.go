@@ -10,6 +10,7 @@ package middleware
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	g "src/global"
 	"strconv"
@@ -36,7 +37,7 @@ var secureMiddle = secure.New(secure.Options{
  * @return {*}
  */
 func Cors() gin.HandlerFunc {
-	allowHeaders := fmt.Sprintf("Access-Control-Allow-Headers,%s,%s", g.TaskIdKey, g.ToolIdKey)
+	allowHeaders := fmt.Sprintf("Access-Control-Allow-Headers,%s,%s,%s", g.TaskIdKey, g.ToolIdKey, g.CaptchaTokenKey)
 	return func(c *gin.Context) {
 		method := c.Request.Method
 		c.Header("Access-Control-Allow-Origin", c.GetHeader("origin"))
@@ -79,17 +80,19 @@ func LogHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		requestId := int(idgen.NextId())
 		c.Writer.Header().Add("Access-Control-Expose-Headers", g.LogIdKey)
-		c.Set("log", &g.Log{Logid: &requestId,RequestUrl: c.Request.URL.String()})                   // 将日志方法封装到请求头中
+		c.Set("log", &g.Log{Logid: &requestId,RequestUrl: c.Request.URL.String(), ClientIp: c.ClientIP()}) // 将日志方法封装到请求头中
 		c.Request.Header.Set(g.LogIdKey, strconv.Itoa(requestId)) // 设置request的header
 		c.Header(g.LogIdKey, strconv.Itoa(requestId))             // 设置response的header
 		c.Next()
 	}
 }
 
-// 只允许 127.0.0.1通过的中间件
+// 只允许本机（127.0.0.1或::1）通过的中间件。经过代理转发的请求，即使代理在本机也不允许，防止本地接口通过nginx暴露出去
 func LocalhostHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.ClientIP() != "127.0.0.1" {
+		remoteIp, clientIp := net.ParseIP(c.RemoteIP()), net.ParseIP(c.ClientIP())
+		if remoteIp == nil || !remoteIp.IsLoopback() || clientIp == nil || !clientIp.IsLoopback() ||
+			c.GetHeader(g.ClientIpHeaderXFF) != "" || c.GetHeader(g.ClientIpHeaderRealIp) != "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
 			return
 		}
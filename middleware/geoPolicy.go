@@ -0,0 +1,145 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 16:32:09
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 16:32:09
+ * @Description: 境外ip的访问策略，按工具和路由配置放行、拒绝或要求验证码，策略在config.yml的GeoPolicy中配置
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	g "src/global"
+	"src/utils/response"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GeoActionAllow   = "allow"   // 放行
+	GeoActionDeny    = "deny"    // 拒绝
+	GeoActionCaptcha = "captcha" // 通过验证码后放行
+)
+
+type geoRoute struct {
+	prefix string // 路由前缀，小写
+	action string
+}
+
+type geoPolicyS struct {
+	defaultAction string
+	routes        []geoRoute        // 按前缀长度降序，最长的优先匹配
+	tools         map[string]string // 工具id对应的策略，和路由的策略取更严格的
+}
+
+// 策略的严格程度，工具和路由的策略取更严格的
+var geoActionLevel = map[string]int{GeoActionAllow: 0, GeoActionCaptcha: 1, GeoActionDeny: 2}
+
+var geoPolicy atomic.Pointer[geoPolicyS]
+
+var checkCaptchaAuth = CheckCaptchaAuth() // 策略为captcha时的校验，没有通过凭证时返回-428
+
+/**
+ * @description: 从配置文件加载境外ip策略，可重复调用
+ * @return {error}
+ */
+func LoadGeoPolicy() error {
+	policy := &geoPolicyS{defaultAction: g.VP.GetString("GeoPolicy.Default"), tools: make(map[string]string)}
+	if policy.defaultAction == "" {
+		policy.defaultAction = GeoActionAllow
+	}
+	if !isGeoAction(policy.defaultAction) {
+		return fmt.Errorf("GeoPolicy.Default只能是%s、%s或%s", GeoActionAllow, GeoActionDeny, GeoActionCaptcha)
+	}
+	for prefix, action := range g.VP.GetStringMapString("GeoPolicy.Routes") {
+		if !isGeoAction(action) {
+			return fmt.Errorf("路由%s的境外ip策略%s错误", prefix, action)
+		}
+		policy.routes = append(policy.routes, geoRoute{prefix: strings.ToLower(prefix), action: action})
+	}
+	sort.Slice(policy.routes, func(a, b int) bool { return len(policy.routes[a].prefix) > len(policy.routes[b].prefix) })
+	for toolId, action := range g.VP.GetStringMapString("GeoPolicy.Tools") {
+		if !isGeoAction(action) {
+			return fmt.Errorf("工具%s的境外ip策略%s错误", toolId, action)
+		}
+		policy.tools[toolId] = action
+	}
+	geoPolicy.Store(policy)
+	return nil
+}
+
+func isGeoAction(action string) bool {
+	return action == GeoActionAllow || action == GeoActionDeny || action == GeoActionCaptcha
+}
+
+// 获取本次请求适用的策略：最长匹配的路由，没有匹配时为默认策略；配置了工具的策略时取两者中更严格的。
+// 工具id可以来自客户端的请求头，随便填一个放行的工具id不能绕过路由的拒绝或验证码
+func (p *geoPolicyS) action(c *gin.Context) string {
+	action := p.defaultAction
+	path := strings.ToLower(c.Request.URL.Path)
+	for _, r := range p.routes {
+		if strings.HasPrefix(path, r.prefix) {
+			action = r.action
+			break
+		}
+	}
+	toolId := c.Param("toolId") // 下载接口的工具id在路径里
+	if toolId == "" {
+		toolId = c.Request.Header.Get(g.ToolIdKey)
+	}
+	if toolAction, ok := p.tools[toolId]; ok && geoActionLevel[toolAction] > geoActionLevel[action] {
+		action = toolAction
+	}
+	return action
+}
+
+/**
+ * @description: 境外ip访问控制的中间件，国内ip直接放行
+ * @return {*}
+ */
+func GeoHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := geoPolicy.Load()
+		// OPTIONS预检请求不带自定义请求头，由后面的Cors处理；验证码接口本身不能被拦截
+		if policy == nil || c.Request.Method == http.MethodOptions || strings.HasPrefix(c.Request.URL.Path, "/captcha/") || g.IsCnIp(c.ClientIP()) {
+			c.Next()
+			return
+		}
+		switch policy.action(c) {
+		case GeoActionDeny:
+			response.Fail(c, g.AccessForbiddenCode, "该功能暂不对境外ip开放")
+			return
+		case GeoActionCaptcha:
+			checkCaptchaAuth(c) // 通过时由它调用c.Next()
+			return
+		}
+		c.Next()
+	}
+}
+
+/**
+ * @description: 重新读取配置文件，更新境外ip策略和国内ip段，供本地路由调用
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func UpdateGeoPolicy(c *gin.Context) {
+	if err := g.VP.ReadInConfig(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "读取配置文件失败:"+err.Error())
+		return
+	}
+	if err := LoadGeoPolicy(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "更新境外ip策略失败:"+err.Error())
+		return
+	}
+	if err := g.LoadGeoZone(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "更新国内ip段失败:"+err.Error())
+		return
+	}
+	v4Len, v6Len := g.GetGeoZoneLen()
+	response.Success(c, fmt.Sprintf("更新境外ip策略成功，国内ip段ipv4:%d个，ipv6:%d个", v4Len, v6Len))
+}
@@ -0,0 +1,59 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 17:40:26
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 17:40:26
+ * @Description: 境外ip策略的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	g "src/global"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGeoPolicyAction(t *testing.T) {
+	policy := &geoPolicyS{
+		defaultAction: GeoActionAllow,
+		routes: []geoRoute{
+			{prefix: "/tools/img2doc", action: GeoActionDeny},
+			{prefix: "/tools/", action: GeoActionCaptcha},
+		},
+		tools: map[string]string{"1": GeoActionAllow, "27": GeoActionDeny},
+	}
+	tests := []struct {
+		name       string
+		path       string
+		headerTool string
+		paramTool  string
+		want       string
+	}{
+		{"没有工具id，按路由", "/tools/img2doc", "", "", GeoActionDeny},
+		{"没有匹配的路由，按默认", "/home", "", "", GeoActionAllow},
+		{"请求头填放行的工具绕不过路由的拒绝", "/tools/img2doc", "1", "", GeoActionDeny},
+		{"请求头填放行的工具绕不过路由的验证码", "/tools/cardChangeBGColor", "1", "", GeoActionCaptcha},
+		{"工具的策略更严格时按工具", "/tools/task/submit", "27", "", GeoActionDeny},
+		{"默认放行的路径也按工具收紧", "/home", "27", "", GeoActionDeny},
+		{"路径里的工具id优先于请求头", "/tools/imgDown/27/x", "1", "27", GeoActionDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.headerTool != "" {
+				c.Request.Header.Set(g.ToolIdKey, tt.headerTool)
+			}
+			if tt.paramTool != "" {
+				c.Params = gin.Params{{Key: "toolId", Value: tt.paramTool}}
+			}
+			if got := policy.action(c); got != tt.want {
+				t.Fatalf("策略是%s，期望%s", got, tt.want)
+			}
+		})
+	}
+}
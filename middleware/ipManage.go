@@ -18,18 +18,36 @@ import (
 )
 
 /**
- * @description: 该中间件控制Ip访问
+ * @description: 该中间件控制Ip访问，只拦截被封禁的ip，访问次数的限制由各路由组的限流策略RateLimitHandler负责，
+ * 超限后先要求验证码，不理会验证码继续访问的才会被封禁
  * @return {*}
  */
 func IPHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		res := g.IP.Add(c.ClientIP())
-		if res == 0 {
+		// 先检查ip段，白名单直接放行，不计数
+		switch g.IP.CheckRange(c.ClientIP()) {
+		case g.RangeTypeAllow:
+			c.Next()
+			return
+		case g.RangeTypeBan:
+			response.Fail(c, g.AccessForbiddenCode, "你所在的ip段已被封禁！")
+			return
+		}
+		res, ok := g.IP.IsBan(c.ClientIP())
+		if ok && res < 0 {
+			res = g.IP.Add(c.ClientIP()) // 封禁期间的访问需要记录，会累加封禁时长
+		}
+		if !ok {
 			response.Fail(c, g.AccessForbiddenCode, "ip格式错误")
 			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), " ", c.ClientIP(), c.Request.URL.Path, " ")
 			c.Abort()
 		} else if res == -128 {
-			response.Fail(c, g.AccessForbiddenCode, "你已被禁用永久封禁！")
+			// 超过127分钟的封禁也是-128，需要从台账里查询真正的过期时间
+			if record := g.IP.GetBanRecord(c.ClientIP()); record != nil && record.ExpireAt != 0 {
+				response.Fail(c, g.AccessForbiddenCode, fmt.Sprintf("您已被封禁至%s！", time.UnixMilli(record.ExpireAt).Format(g.DateFormat)))
+			} else {
+				response.Fail(c, g.AccessForbiddenCode, "你已被禁用永久封禁！")
+			}
 			c.Abort()
 		} else if res < 0 {
 			response.Fail(c, g.AccessForbiddenCode, fmt.Sprintf("由于访问过于频繁，您已被禁用%d分钟！", -res))
@@ -39,10 +57,6 @@ func IPHandler() gin.HandlerFunc {
 			c.Abort()
 		} else {
 			c.Next()
-			// 如果是300走缓存，则减少访问次数
-			if c.Writer.Status() >= 300 && c.Writer.Status() < 400 {
-				g.IP.Reduce(c.ClientIP())
-			}
 		}
 	}
 }
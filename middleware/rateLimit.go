@@ -0,0 +1,330 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 13:20:06
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 13:20:06
+ * @Description: 按路由组配置的限流策略，支持滑动窗口和令牌桶两种算法，策略在config.yml的RateLimit.Policies中配置
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package middleware
+
+import (
+	"fmt"
+	g "src/global"
+	"src/utils/response"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AlgorithmSliding = "sliding" // 滑动窗口
+	AlgorithmToken   = "token"   // 令牌桶
+)
+
+// 限流策略的配置
+type RateLimitPolicy struct {
+	Algorithm    string  // sliding 或 token
+	Limit        int     // 滑动窗口：窗口内允许的访问次数
+	WindowSecond int     // 滑动窗口：窗口大小，单位秒
+	Rate         float64 // 令牌桶：每秒生成的令牌数
+	Burst        int     // 令牌桶：桶的容量，即瞬时最大访问量
+	BanMinute    int     // 超限后封禁的时长，单位分钟，0表示只拒绝本次请求不封禁
+	Captcha      bool    // 超限后先要求验证码，通过后可以继续访问，不理会验证码继续访问的才封禁
+}
+
+// 超限后要求验证码期间，最多拒绝多少次，超过后按BanMinute封禁
+const captchaRejectMax = 30
+
+// 要求验证码的结果
+const (
+	challengeAsk  = iota // 需要验证码
+	challengePass        // 验证码已通过，放行
+	challengeBan         // 一直不理会验证码，封禁
+)
+
+// 一个ip在策略下的验证码状态
+type captchaState struct {
+	bonus    int   // 通过验证码获得的额外访问次数
+	rejected int   // 要求验证码后仍继续访问的次数
+	lastSeen int64 // 最后一次访问的时间，毫秒
+}
+
+// 滑动窗口的计数，用上一个窗口和当前窗口的计数按时间加权估算，不需要记录每次访问的时间
+type slidingCounter struct {
+	windowStart int64 // 当前窗口的开始时间，毫秒
+	prevCount   int   // 上一个窗口的访问次数
+	currCount   int   // 当前窗口的访问次数
+}
+
+// 令牌桶的计数，每个ip一个桶。没有用rate.Limiter，因为它的Reservation在预定的时间过后就没法取消了，300走缓存时还不回令牌
+type tokenBucket struct {
+	tokens   float64 // 桶内剩余的令牌数
+	lastSeen int64   // 最后一次访问的时间，毫秒，用于补充令牌和清理长时间未访问的ip
+}
+
+// 一个策略下所有ip的计数
+type policyLimiter struct {
+	name      string
+	policy    RateLimitPolicy
+	lock      sync.Mutex
+	sliding   map[string]*slidingCounter
+	token     map[string]*tokenBucket
+	captcha   map[string]*captchaState // 超限后要求验证码的ip
+	usedPass  map[string]int64         // 已使用过的验证码凭证，一个凭证只能换一次额外次数，值为过期时间
+	lastClean int64                    // 上次清理的时间，毫秒
+}
+
+var (
+	policyMap  = make(map[string]*policyLimiter) // 所有的限流策略，key为策略名
+	policyLock sync.RWMutex
+)
+
+/**
+ * @description: 从配置文件加载限流策略，可重复调用，重新加载后计数会清零
+ * @return {error}
+ */
+func LoadRateLimitPolicy() error {
+	policies := make(map[string]RateLimitPolicy)
+	if err := g.VP.UnmarshalKey("RateLimit.Policies", &policies); err != nil {
+		return err
+	}
+	newMap := make(map[string]*policyLimiter)
+	for name, policy := range policies {
+		switch policy.Algorithm {
+		case AlgorithmSliding:
+			if policy.Limit <= 0 || policy.WindowSecond <= 0 {
+				return fmt.Errorf("限流策略%s的Limit和WindowSecond必须大于0", name)
+			}
+		case AlgorithmToken:
+			if policy.Rate <= 0 || policy.Burst <= 0 {
+				return fmt.Errorf("限流策略%s的Rate和Burst必须大于0", name)
+			}
+		default:
+			return fmt.Errorf("限流策略%s的Algorithm只能是%s或%s", name, AlgorithmSliding, AlgorithmToken)
+		}
+		newMap[name] = &policyLimiter{
+			name:     name,
+			policy:   policy,
+			sliding:  make(map[string]*slidingCounter),
+			token:    make(map[string]*tokenBucket),
+			captcha:  make(map[string]*captchaState),
+			usedPass: make(map[string]int64),
+		}
+	}
+	policyLock.Lock()
+	policyMap = newMap
+	policyLock.Unlock()
+	return nil
+}
+
+func getPolicyLimiter(name string) *policyLimiter {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return policyMap[strings.ToLower(name)] // viper读取的key都是小写的
+}
+
+/**
+ * @description: 按策略限流的中间件，策略未配置时直接放行
+ * @param {string} policyName 策略名，对应配置文件RateLimit.Policies下的key
+ * @return {*}
+ */
+func RateLimitHandler(policyName string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pl := getPolicyLimiter(policyName) // 每次都重新获取，以便支持重新加载配置
+		if pl == nil {
+			c.Next()
+			return
+		}
+		key := g.IpKey(c.ClientIP())
+		if key == "" {
+			response.Fail(c, g.AccessForbiddenCode, "ip格式错误")
+			return
+		}
+		allow, undo := pl.allow(key)
+		if !allow && pl.policy.Captcha {
+			switch pl.challenge(key, c) {
+			case challengeAsk:
+				response.Fail(c, g.CaptchaRequiredCode, "访问过于频繁，"+g.CaptchaRequiredMsg)
+				return
+			case challengePass:
+				allow, undo = true, func() {}
+			}
+		}
+		if !allow {
+			if pl.policy.BanMinute > 0 {
+				g.IP.Ban(c.ClientIP(), pl.policy.BanMinute, "触发限流策略:"+pl.name, g.BanSourceAuto)
+			}
+			response.Fail(c, g.AccessForbiddenCode, "访问过于频繁，请稍后再试！")
+			return
+		}
+		c.Next()
+		// 如果是300走缓存，则返还本次访问的次数
+		if c.Writer.Status() >= 300 && c.Writer.Status() < 400 {
+			undo()
+		}
+	}
+}
+
+/**
+ * @description: 判断本次访问是否允许
+ * @param {string} key ip对应的key
+ * @return {bool} 是否允许
+ * @return {func()} 撤销本次计数的方法
+ */
+func (pl *policyLimiter) allow(key string) (bool, func()) {
+	now := time.Now().UnixMilli()
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.clean(now)
+	if pl.policy.Algorithm == AlgorithmToken {
+		// 多实例部署时，令牌桶无法共享，按存活的实例数平分速率和容量
+		rate, burst := pl.policy.Rate, float64(pl.policy.Burst)
+		if n := g.IP.InstanceCount(); n > 1 {
+			rate, burst = rate/float64(n), float64(max(pl.policy.Burst/n, 1))
+		}
+		bucket, ok := pl.token[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, lastSeen: now}
+			pl.token[key] = bucket
+		}
+		bucket.tokens = min(bucket.tokens+float64(now-bucket.lastSeen)*rate/1000, burst) // 补充距离上次访问生成的令牌
+		bucket.lastSeen = now
+		if bucket.tokens < 1 {
+			return false, nil
+		}
+		bucket.tokens--
+		return true, func() {
+			pl.lock.Lock()
+			defer pl.lock.Unlock()
+			bucket.tokens = min(bucket.tokens+1, burst)
+		}
+	}
+
+	window := int64(pl.policy.WindowSecond) * 1000
+	counter, ok := pl.sliding[key]
+	if !ok {
+		counter = &slidingCounter{windowStart: now - now%window}
+		pl.sliding[key] = counter
+	}
+	// 窗口滚动
+	if elapsed := now - counter.windowStart; elapsed >= 2*window {
+		counter.prevCount, counter.currCount = 0, 0
+		counter.windowStart = now - now%window
+	} else if elapsed >= window {
+		counter.prevCount, counter.currCount = counter.currCount, 0
+		counter.windowStart += window
+	}
+	// 上一个窗口按剩余的时间比例计入，多实例部署时加上其他实例的计数
+	windowStart := counter.windowStart
+	countKey := pl.name + ":" + key
+	prevCount := counter.prevCount + g.IP.ClusterVisit(countKey, windowStart-window)
+	currCount := counter.currCount + g.IP.ClusterVisit(countKey, windowStart)
+	weight := float64(window-(now-windowStart)) / float64(window)
+	if float64(prevCount)*weight+float64(currCount) >= float64(pl.policy.Limit) {
+		return false, nil
+	}
+	counter.currCount++
+	g.IP.ReportVisit(countKey, windowStart, window, 1)
+	return true, func() {
+		pl.lock.Lock()
+		defer pl.lock.Unlock()
+		if counter.windowStart == windowStart && counter.currCount > 0 {
+			counter.currCount--
+			g.IP.ReportVisit(countKey, windowStart, window, -1)
+		}
+	}
+}
+
+/**
+ * @description: 超限后要求验证码。带有未使用过的通过凭证时，获得一个周期的额外访问次数
+ * @param {string} key ip对应的key
+ * @param {*gin.Context} c
+ * @return {int} challengeAsk、challengePass 或 challengeBan
+ */
+func (pl *policyLimiter) challenge(key string, c *gin.Context) int {
+	now := time.Now().UnixMilli()
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	state, ok := pl.captcha[key]
+	if !ok {
+		state = &captchaState{}
+		pl.captcha[key] = state
+	}
+	state.lastSeen = now
+	if state.bonus == 0 {
+		nonce, expireAt, ok := g.CheckCaptchaPass(c.GetHeader(g.CaptchaTokenKey), c.ClientIP())
+		if _, used := pl.usedPass[nonce]; ok && !used {
+			pl.usedPass[nonce] = expireAt
+			state.bonus, state.rejected = pl.policy.Limit, 0
+			if pl.policy.Algorithm == AlgorithmToken {
+				state.bonus = pl.policy.Burst
+			}
+		}
+	}
+	if state.bonus > 0 {
+		state.bonus--
+		return challengePass
+	}
+	state.rejected++
+	if state.rejected > captchaRejectMax {
+		state.rejected = 0 // 封禁结束后重新计算
+		return challengeBan
+	}
+	return challengeAsk
+}
+
+// 清理长时间未访问的ip，防止一直占用内存。调用前需持有锁
+func (pl *policyLimiter) clean(now int64) {
+	// 滑动窗口两个窗口以上未访问的计数已经没有意义，令牌桶则是桶被填满后就没有意义了
+	expire := int64(pl.policy.WindowSecond) * 2000
+	if pl.policy.Algorithm == AlgorithmToken {
+		expire = int64(float64(pl.policy.Burst)/pl.policy.Rate*1000) + 1000
+	}
+	if expire < 60000 {
+		expire = 60000 // 最多每分钟清理一次
+	}
+	if now-pl.lastClean < expire {
+		return
+	}
+	pl.lastClean = now
+	for key, v := range pl.sliding {
+		if now-v.windowStart >= expire {
+			delete(pl.sliding, key)
+		}
+	}
+	for key, v := range pl.token {
+		if now-v.lastSeen >= expire {
+			delete(pl.token, key)
+		}
+	}
+	for key, v := range pl.captcha {
+		if now-v.lastSeen >= expire {
+			delete(pl.captcha, key)
+		}
+	}
+	for nonce, expireAt := range pl.usedPass {
+		if expireAt < now {
+			delete(pl.usedPass, nonce)
+		}
+	}
+}
+
+/**
+ * @description: 重新读取配置文件并更新限流策略，供本地路由调用，原有的计数会被清空
+ * @param {*gin.Context} c
+ * @return {*}
+ */
+func UpdateRateLimitPolicy(c *gin.Context) {
+	if err := g.VP.ReadInConfig(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "读取配置文件失败:"+err.Error())
+		return
+	}
+	if err := LoadRateLimitPolicy(); err != nil {
+		response.Fail(c, g.ExecuteErrorCode, "更新限流策略失败:"+err.Error())
+		return
+	}
+	response.Success(c, "更新限流策略成功")
+}
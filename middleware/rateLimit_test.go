@@ -0,0 +1,261 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 09:12:40
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 09:12:40
+ * @Description: 限流策略滑动窗口和令牌桶的测试
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	g "src/global"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 验证码凭证的签名密钥是用sync.Once读取的，必须在所有测试之前设置好
+func TestMain(m *testing.M) {
+	g.VP = viper.New()
+	g.VP.Set("Captcha.Secret", "captcha-secret-for-test")
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// 测试用的ip管理，只实现限流用到的方法，instances模拟存活的实例数，cluster模拟其他实例的计数
+type stubIpManager struct {
+	g.IpManager
+	instances int
+	cluster   map[int64]int
+	banned    map[string]int // 被封禁的ip和分钟数
+}
+
+func (s *stubIpManager) Ban(ipStr string, minute int, reason string, source string) int8 {
+	if s.banned == nil {
+		s.banned = make(map[string]int)
+	}
+	s.banned[ipStr] = minute
+	return int8(-min(minute, 128))
+}
+
+func (s *stubIpManager) ReportVisit(key string, windowStart int64, window int64, delta int) {}
+
+func (s *stubIpManager) ClusterVisit(key string, windowStart int64) int {
+	return s.cluster[windowStart]
+}
+
+func (s *stubIpManager) InstanceCount() int { return s.instances }
+
+func setStubIp(t *testing.T, stub *stubIpManager) {
+	old := g.IP
+	g.IP = stub
+	t.Cleanup(func() { g.IP = old })
+}
+
+func newTestLimiter(policy RateLimitPolicy) *policyLimiter {
+	return &policyLimiter{
+		name:     "test",
+		policy:   policy,
+		sliding:  make(map[string]*slidingCounter),
+		token:    make(map[string]*tokenBucket),
+		captcha:  make(map[string]*captchaState),
+		usedPass: make(map[string]int64),
+	}
+}
+
+func TestSlidingWindowLimit(t *testing.T) {
+	setStubIp(t, &stubIpManager{instances: 1})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmSliding, Limit: 5, WindowSecond: 60})
+	for i := 0; i < 5; i++ {
+		if ok, _ := pl.allow("1.1.1.1"); !ok {
+			t.Fatalf("第%d次访问应该放行", i+1)
+		}
+	}
+	if ok, _ := pl.allow("1.1.1.1"); ok {
+		t.Fatal("超过Limit后应该拒绝")
+	}
+	// 不同ip分开计数
+	if ok, _ := pl.allow("2.2.2.2"); !ok {
+		t.Fatal("其他ip不应该受影响")
+	}
+}
+
+func TestSlidingWindowUndo(t *testing.T) {
+	setStubIp(t, &stubIpManager{instances: 1})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmSliding, Limit: 2, WindowSecond: 60})
+	pl.allow("1.1.1.1")
+	_, undo := pl.allow("1.1.1.1")
+	undo() // 300走缓存的请求会撤销计数
+	if ok, _ := pl.allow("1.1.1.1"); !ok {
+		t.Fatal("撤销后应该还能访问一次")
+	}
+	if ok, _ := pl.allow("1.1.1.1"); ok {
+		t.Fatal("撤销的次数只能用一次")
+	}
+}
+
+func TestSlidingWindowWeight(t *testing.T) {
+	setStubIp(t, &stubIpManager{instances: 1})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmSliding, Limit: 10, WindowSecond: 60})
+	window := int64(60000)
+	tests := []struct {
+		name     string
+		elapsed  int64 // 当前时间距离当前窗口开始的时间，毫秒
+		prev     int   // 滚动前当前窗口的计数
+		allowCnt int   // 滚动后还能访问的次数
+	}{
+		{"刚进入下一个窗口，上一个窗口几乎全部计入", window + 10, 10, 0},
+		{"进入下一个窗口一半，上一个窗口计入一半", window + window/2, 10, 5},
+		{"上一个窗口只用了一半", window + window/2, 4, 8},
+		{"超过两个窗口，全部清零", 2*window + 10, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now().UnixMilli()
+			pl.sliding["1.1.1.1"] = &slidingCounter{windowStart: now - tt.elapsed, currCount: tt.prev}
+			got := 0
+			for i := 0; i < 20; i++ {
+				if ok, _ := pl.allow("1.1.1.1"); ok {
+					got++
+				}
+			}
+			// 测试运行期间时间还在走，允许差1
+			if got < tt.allowCnt || got > tt.allowCnt+1 {
+				t.Fatalf("滚动后允许访问%d次，期望%d次", got, tt.allowCnt)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowCluster(t *testing.T) {
+	now := time.Now().UnixMilli()
+	window := int64(60000)
+	windowStart := now - now%window
+	// 其他实例在当前窗口已经访问了3次
+	setStubIp(t, &stubIpManager{instances: 2, cluster: map[int64]int{windowStart: 3}})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmSliding, Limit: 5, WindowSecond: 60})
+	got := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := pl.allow("1.1.1.1"); ok {
+			got++
+		}
+	}
+	if got != 2 {
+		t.Fatalf("加上其他实例的计数后应该只允许2次，实际%d次", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	setStubIp(t, &stubIpManager{instances: 1})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmToken, Rate: 20, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if ok, _ := pl.allow("1.1.1.1"); !ok {
+			t.Fatalf("桶内有令牌，第%d次应该放行", i+1)
+		}
+	}
+	if ok, _ := pl.allow("1.1.1.1"); ok {
+		t.Fatal("令牌用完后应该拒绝")
+	}
+	time.Sleep(120 * time.Millisecond) // 每秒20个，等待后至少生成2个
+	if ok, _ := pl.allow("1.1.1.1"); !ok {
+		t.Fatal("令牌生成后应该放行")
+	}
+}
+
+func TestTokenBucketUndo(t *testing.T) {
+	setStubIp(t, &stubIpManager{instances: 1})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmToken, Rate: 0.01, Burst: 1})
+	_, undo := pl.allow("1.1.1.1")
+	undo()
+	if ok, _ := pl.allow("1.1.1.1"); !ok {
+		t.Fatal("撤销后令牌应该还回桶里")
+	}
+	if ok, _ := pl.allow("1.1.1.1"); ok {
+		t.Fatal("令牌用完后应该拒绝")
+	}
+}
+
+func TestTokenBucketInstances(t *testing.T) {
+	// 3个实例平分容量，每个实例只有2个令牌
+	setStubIp(t, &stubIpManager{instances: 3})
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmToken, Rate: 0.01, Burst: 6})
+	got := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := pl.allow("1.1.1.1"); ok {
+			got++
+		}
+	}
+	if got != 2 {
+		t.Fatalf("按实例数平分后应该只允许2次，实际%d次", got)
+	}
+}
+
+// 通过RateLimitHandler访问一次，返回响应里的code
+func limitedRequest(t *testing.T, engine *gin.Engine, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "1.1.1.1:1234"
+	if token != "" {
+		req.Header.Set(g.CaptchaTokenKey, token)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	var body struct{ Code int }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Code
+}
+
+// 超限后先要求验证码，通过后获得一轮访问次数；不理会验证码一直访问的才封禁
+func TestCaptchaChallenge(t *testing.T) {
+	stub := &stubIpManager{instances: 1}
+	setStubIp(t, stub)
+	pl := newTestLimiter(RateLimitPolicy{Algorithm: AlgorithmSliding, Limit: 2, WindowSecond: 60, BanMinute: 10, Captcha: true})
+	policyLock.Lock()
+	oldMap := policyMap
+	policyMap = map[string]*policyLimiter{"test": pl}
+	policyLock.Unlock()
+	t.Cleanup(func() {
+		policyLock.Lock()
+		policyMap = oldMap
+		policyLock.Unlock()
+	})
+	engine := gin.New()
+	engine.GET("/", RateLimitHandler("test"), func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"code": g.StatusOkCode}) })
+
+	for i := 0; i < 2; i++ {
+		if code := limitedRequest(t, engine, ""); code != g.StatusOkCode {
+			t.Fatalf("第%d次访问应该放行，返回%d", i+1, code)
+		}
+	}
+	if code := limitedRequest(t, engine, ""); code != g.CaptchaRequiredCode {
+		t.Fatalf("第一次超限应该要求验证码，返回%d", code)
+	}
+	// 通过验证码后可以再访问Limit次，同一个凭证不能再换一轮
+	token, _ := g.IssueCaptchaPass("1.1.1.1")
+	for i := 0; i < 2; i++ {
+		if code := limitedRequest(t, engine, token); code != g.StatusOkCode {
+			t.Fatalf("通过验证码后第%d次访问应该放行，返回%d", i+1, code)
+		}
+	}
+	if code := limitedRequest(t, engine, token); code != g.CaptchaRequiredCode {
+		t.Fatalf("用过的凭证不能再换访问次数，返回%d", code)
+	}
+	// 再要求验证码captchaRejectMax次后仍继续访问，才封禁
+	for i := 1; i < captchaRejectMax; i++ {
+		limitedRequest(t, engine, "")
+	}
+	if len(stub.banned) != 0 {
+		t.Fatal("要求验证码期间不应该封禁")
+	}
+	if code := limitedRequest(t, engine, ""); code != g.AccessForbiddenCode || stub.banned["1.1.1.1"] != 10 {
+		t.Fatalf("一直不理会验证码应该封禁10分钟，返回%d，封禁%v", code, stub.banned)
+	}
+}
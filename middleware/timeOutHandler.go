@@ -10,6 +10,7 @@ package middleware
 
 import (
 	"net/http"
+	g "src/global"
 	"time"
 
 	"github.com/gin-contrib/timeout"
@@ -63,8 +64,15 @@ func LeakyBucketHandler() gin.HandlerFunc {
  * @return {*}
  */
 func LimitHandler() gin.HandlerFunc {
-	var lmt = rate.Limit(50)            // 每秒最大访问量
-	var lmter = rate.NewLimiter(lmt, 20) // 瞬时最大访问量
+	limit, burst := 50.0, 20 // 未配置时的默认值
+	if g.VP.IsSet("RateLimit.Global.Rate") {
+		limit = g.VP.GetFloat64("RateLimit.Global.Rate")
+	}
+	if g.VP.IsSet("RateLimit.Global.Burst") {
+		burst = g.VP.GetInt("RateLimit.Global.Burst")
+	}
+	var lmt = rate.Limit(limit)             // 每秒最大访问量
+	var lmter = rate.NewLimiter(lmt, burst) // 瞬时最大访问量
 	return func(c *gin.Context) {
 		if !lmter.Allow() {
 			c.AbortWithStatus(http.StatusTooManyRequests)
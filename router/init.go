@@ -16,7 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func InitRouter() *gin.Engine {
+func InitRouter() (*gin.Engine, error) {
 	var router *gin.Engine
 	// 非调试模式（生产模式） 日志写到日志文件
 	if !g.VP.GetBool("AppDebug") {
@@ -36,18 +36,43 @@ func InitRouter() *gin.Engine {
 	}
 
 	// 设置可信任的代理服务器列表,gin (2021-11-24发布的v1.7.7版本之后出的新功能)
-	_ = router.SetTrustedProxies(nil)
+	if err := setClientIp(router); err != nil {
+		return nil, err
+	}
 
 	addLocalR(router.Group("")) // 本地开发路由
 
-	router.Use(middleware.IPHandler()) //在此加入的中间件，无论是否有对应路由都会进入
+	router.Use(middleware.IPHandler(), middleware.GeoHandler()) //在此加入的中间件，无论是否有对应路由都会进入
 	if !g.VP.GetBool("AppDebug") {
 		router.Use(middleware.HttpsHandler()) // 生产模式启用https
 	}
 	addStaticRoutes(router.Group("")) // 静态资源路由
+	router.NoRoute(middleware.RateLimitHandler("scanner")) // 没有路由的路径不经过各路由组的限流，用scanner策略兜底，之后由gin返回404
 
 	// 因为options请求不会进入以下路由内部，所以内部use Cors()是无效的，必须得在最外层应用，直接作用于router的中间件是全局的，无论是否有对应的路由，他都会进入
 	router.Use(middleware.Cors())
+	addStreamRoutes(router.Group(""))
 	addTimeoutRoutes(router.Group(""))
-	return router
+	return router, nil
+}
+
+/**
+ * @description: 设置获取真实客户端ip的方式。只有来自可信任代理的请求才会读取请求头，否则直接使用连接的地址，防止伪造
+ * @param {*gin.Engine} router
+ * @return {error}
+ */
+func setClientIp(router *gin.Engine) error {
+	cidrList, _, err := g.GetTrustedProxies()
+	if err != nil {
+		return err
+	}
+	header := g.GetClientIpHeader()
+	// PROXY protocol在监听器里已经把连接地址替换成了客户端地址，不需要再读请求头
+	if len(cidrList) == 0 || header == g.ClientIpHeaderProxyProtocol {
+		router.ForwardedByClientIP = false
+		return router.SetTrustedProxies(nil)
+	}
+	router.ForwardedByClientIP = true
+	router.RemoteIPHeaders = []string{header}
+	return router.SetTrustedProxies(cidrList)
 }
@@ -27,6 +27,15 @@ func addLocalR(localR *gin.RouterGroup) {
 	localR.GET("/ip/get_size", proxy.GetSizeOf)
 	localR.GET("/ip/add_ban", proxy.AddBanTime)
 	localR.GET("/ip/delete", proxy.DeleteIP) // 删除ip
+	localR.GET("/ip/get_range", proxy.GetRange)       // 查询ip段
+	localR.GET("/ip/add_range", proxy.AddRange)       // 封禁或加白ip段
+	localR.GET("/ip/delete_range", proxy.DeleteRange) // 删除ip段
+	localR.GET("/ip/get_ban_record", proxy.GetBanRecord)   // 查询封禁记录
+	localR.GET("/ip/get_ban_history", proxy.GetBanHistory) // 查询历史封禁记录
 	localR.GET("/static/update", g.UpdateStaticFile) // 更新静态资源
 	localR.GET("/tools/update",api.UpdateToolsMsg) // 更新工具信息
+	localR.GET("/rate_limit/update", middleware.UpdateRateLimitPolicy) // 更新限流策略
+	localR.GET("/geo/update", middleware.UpdateGeoPolicy) // 更新境外ip策略和国内ip段
+	localR.GET("/watermark/update", api.UpdateWatermark) // 更新水印
+	localR.POST("/forensic/extract", api.ForensicExtract) // 从可疑的图片中读取取证水印
 }
@@ -12,7 +12,7 @@ func addStaticRoutes(r *gin.RouterGroup) {
 	// 代理js，css等文件，因为数量众多，所以不计入限制的中间件中
 	r.GET("/dist/*name", proxy.ProxyStatic)
 
-	r.Use(middleware.LimitHandler())
+	r.Use(middleware.LimitHandler(), middleware.RateLimitHandler("static"))
 	// 下面这些资源加入访问次数控制，上面的dist不加，因为访问频率太高
 	r.GET("/", proxy.ProxyStatic)
 	r.GET("/images/*name", proxy.ProxyStatic)
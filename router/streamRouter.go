@@ -0,0 +1,27 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 22:03:11
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 22:03:11
+ * @Description: 推送类的长连接路由
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package router
+
+import (
+	"src/app/api"
+	"src/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 长连接不能经过超时中间件，超时中间件会把响应缓存到接口返回才发出去，并且60秒就断开
+func addStreamRoutes(router *gin.RouterGroup) {
+	router.Use(middleware.LimitHandler(), middleware.LogHandler())
+
+	validatorRouter = router.Group("tools", middleware.TaskIdFromQuery(), middleware.CheckTaskId())
+	{
+		Method = "GET"
+		Request("/task/events", api.TaskEvents, middleware.RateLimitHandler("orderStatus")) // 推送任务的进度、状态和支付结果
+	}
+}
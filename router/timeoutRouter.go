@@ -29,9 +29,22 @@ func addTimeoutRoutes(router *gin.RouterGroup) {
 		Request("/order/wechatRefundNotify", api.WechatpayRefundNotify) // 微信支付退款回调接口
 		Request("order/aliPayNotify", api.AlipayNotify)                 // 支付宝支付回调接口
 		Method = "GET"
-		Request("/tool", api.GetToolMsg)                 // 查询工具信息
-		Request("/order/status/:orderId", api.PayStatus) // 查询订单支付状态
-		Request("/imgDown/:toolId/:taskId", api.ImageDown) // 普通下载接口
+		Request("/tool", api.GetToolMsg, middleware.RateLimitHandler("default"))                    // 查询工具信息
+		Request("/idPhotoSpecs", api.IdPhotoSpecs, middleware.RateLimitHandler("default"))          // 查询支持的证件照规格
+		Request("/idPhotoLayoutPapers", api.IdPhotoLayoutPapers, middleware.RateLimitHandler("default")) // 查询冲印排版支持的相纸
+		Request("/order/status/:orderId", api.PayStatus, middleware.RateLimitHandler("orderStatus")) // 查询订单支付状态，前端轮询，单独限流
+		Request("/imgDown/:toolId/:taskId", api.ImageDown, middleware.RateLimitHandler("default"))   // 普通下载接口，需要带上downUrl签发的签名参数
+	}
+
+	// 验证码接口，访问过于频繁或境外ip需要人机验证时使用
+	validatorRouter = router.Group("captcha")
+	{
+		Method = "GET"
+		Request("/new", api.NewCaptcha, middleware.RateLimitHandler("default"))                  // 生成验证码
+		Request("/image/:captchaId", api.CaptchaImage, middleware.RateLimitHandler("default"))   // 验证码图片
+		Request("/audio/:captchaId", api.CaptchaAudio, middleware.RateLimitHandler("default"))   // 验证码语音
+		Method = "POST"
+		Request("/verify", api.VerifyCaptcha, middleware.RateLimitHandler("default")) // 校验验证码，成功返回通过凭证
 	}
 
 	// 以下路由是必须输入taskID的
@@ -40,27 +53,33 @@ func addTimeoutRoutes(router *gin.RouterGroup) {
 		// get方法写在这下面，以此类推
 		Method = "GET"
 		// Request("/img2docDownType", api.Get27ToolDownType)  // 图片转文档可供下载的类型
-		Request("/img2docDown/:type", api.Get27ToolDownUrl) // 图片转文档可供下载的类型
-		Request("/img2docResult", api.DocConvertResult)     // 查询图片转文档结果接口
-		Request("/order/wechatOrder", api.WechatPay)        // 创建订单接口
-		Request("/order/AliH5Order", api.AliH5Pay)              // 创建订单接口
-		Request("/downTimes", api.GetDownTimes)             // 查询下载次数接口
-		Method = "POST"                                     // post方法写在这下面
-		Request("/img2doc", api.DocImgConvert)              // 图片转文档接口
+		Request("/img2docDown/:type", api.Get27ToolDownUrl, middleware.RateLimitHandler("default"))    // 图片转文档可供下载的类型
+		Request("/img2docResult", api.DocConvertResult, middleware.RateLimitHandler("orderStatus"))    // 查询图片转文档结果接口，前端轮询
+		Request("/order/wechatOrder", api.WechatPay, middleware.RateLimitHandler("payCreate"))         // 创建订单接口
+		Request("/order/AliH5Order", api.AliH5Pay, middleware.RateLimitHandler("payCreate"))           // 创建订单接口
+		Request("/downTimes", api.GetDownTimes, middleware.RateLimitHandler("default"))                // 查询下载次数接口
+		Request("/downUrl", api.GetDownUrl, middleware.RateLimitHandler("default"))                    // 获取带签名的下载链接
+		Request("/task/status", api.TaskStatus, middleware.RateLimitHandler("orderStatus"))            // 查询异步任务的状态，前端轮询
+		Request("/task/result", api.TaskResult, middleware.RateLimitHandler("default"))                // 获取异步任务的结果预览图
+		Method = "POST"                                                                                 // post方法写在这下面
+		Request("/img2doc", api.DocImgConvert, middleware.RateLimitHandler("upload"))                  // 图片转文档接口
 	}
 	//以下任务是可以不输入taskID的
 	validatorRouter = router.Group("tools", middleware.CreateTask())
 	{
 		Method = "POST" // post方法写在这下面
-		Request("/cardChangeBGColor", api.CardChangeBGColor)
-		Request("/imgLossyCompress", api.LossyCompression)
-		Request("/pngLosslessCompress", api.PngLosslessCompress)
-		Request("/imgEffectEnhance", api.EffectsEnhancement) // 图像特效处理接口
-		Request("/imgConvers", api.ImgConvers)               // 图像转换接口
+		Request("/cardChangeBGColor", api.CardChangeBGColor, middleware.RateLimitHandler("upload"))
+		Request("/imgLossyCompress", api.LossyCompression, middleware.RateLimitHandler("upload"))
+		Request("/pngLosslessCompress", api.PngLosslessCompress, middleware.RateLimitHandler("upload"))
+		Request("/imgEffectEnhance", api.EffectsEnhancement, middleware.RateLimitHandler("upload")) // 图像特效处理接口
+		Request("/imgConvers", api.ImgConvers, middleware.RateLimitHandler("upload"))               // 图像转换接口
+		Request("/task/submit", api.SubmitTask, middleware.RateLimitHandler("upload"))              // 所有工具通用的异步任务提交接口
+		Request("/batch/submit", api.SubmitBatch, middleware.RateLimitHandler("upload"))            // 批量任务提交接口，多张图片或zip压缩包
+		Request("/pipeline/submit", api.SubmitPipeline, middleware.RateLimitHandler("upload"))      // 组合任务提交接口，一次上传依次执行多个工具
 		// get方法写在这下面，以此类推
 		Method = "GET"
-		Request("/order/wechatOrderFirst", api.WechatPayFirst) // 创建订单接口，应用与先付款再使用的场景
-		Request("/order/AliOrderFirst", api.AliPayFirst)       // 创建订单接口，应用与先付款再使用的场景
+		Request("/order/wechatOrderFirst", api.WechatPayFirst, middleware.RateLimitHandler("payCreate")) // 创建订单接口，应用与先付款再使用的场景
+		Request("/order/AliOrderFirst", api.AliPayFirst, middleware.RateLimitHandler("payCreate"))       // 创建订单接口，应用与先付款再使用的场景
 	}
 
 }
@@ -19,6 +19,7 @@ func MigrateDataTicker() {
 			case <-fiveTimer.C:
 				migrateImgTaskData() // 迁移图片任务数据
 				migrateOrderData()   // 迁移订单数据
+				cleanJobData()       // 清理已结束的异步任务
 				nextFiveStamp += 86400
 				fiveTimer.Reset(time.Until(time.Unix(int64(nextFiveStamp), 0)))
 			case <-StopChan:
@@ -77,3 +78,11 @@ func migrateOrderData() {
 		return
 	}
 }
+
+// 删除结束超过24小时的异步任务，结果已经保存在img_task表里
+func cleanJobData() {
+	thisLog := g.Log{RequestUrl: "cleanJobData"}
+	if err := model.DeleteFinishedJobs(time.Now().Add(-24 * time.Hour).UnixMilli()); err != nil {
+		thisLog.Error("删除job表中的数据失败", err)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 16:50:27
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 16:50:27
+ * @Description: 定时检查国内ip段文件是否更新，更新了就重新加载，不需要重启服务
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package timer
+
+import (
+	g "src/global"
+	"time"
+)
+
+// 国内ip段文件的热加载定时器
+func GeoZoneReloadTicker() {
+	reloadSecond := g.VP.GetInt("GeoPolicy.ReloadSecond")
+	if reloadSecond <= 0 {
+		reloadSecond = 60
+	}
+	ticker := time.NewTicker(time.Duration(reloadSecond) * time.Second)
+	TickerList = append(TickerList, ticker) // 添加到队列，方便结束程序时退出定时器
+	go func() {
+		thisLog := g.Log{RequestUrl: "GeoZoneReloadTicker"}
+		for {
+			select {
+			case <-ticker.C:
+				reload, err := g.ReloadGeoZoneIfChanged()
+				if err != nil {
+					thisLog.Error("重新加载国内ip段失败", err)
+				} else if reload {
+					v4Len, v6Len := g.GetGeoZoneLen()
+					thisLog.Info("重新加载国内ip段成功", map[string]int{"v4": v4Len, "v6": v6Len})
+				}
+			case <-StopChan:
+				return // 退出协程
+			}
+		}
+	}()
+}
@@ -0,0 +1,29 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 20:12:44
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 20:12:44
+ * @Description: 启动异步任务队列的worker
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package timer
+
+import (
+	"src/app/service"
+	"time"
+)
+
+// 每个worker一个定时器，按配置的间隔轮询job表
+func JobWorkerTicker() {
+	for i := 0; i < service.JobWorkerCount(); i++ {
+		ticker := time.NewTicker(service.JobPollInterval())
+		TickerList = append(TickerList, ticker) // 添加到队列，方便结束程序时退出定时器
+		go func(index int) {
+			// worker可能正在执行任务，不能及时接收StopChan，所以由这里接收后关闭done通知worker，避免退出时阻塞
+			done := make(chan bool)
+			go service.RunJobWorker(index, ticker, done)
+			<-StopChan
+			close(done)
+		}(i)
+	}
+}
@@ -10,10 +10,11 @@
 package timer
 
 import (
-	"os"
-	"path/filepath"
+	"context"
+	"src/app/service"
 	g "src/global"
 	"src/utils/base"
+	"src/utils/storage"
 	"time"
 )
 
@@ -40,28 +41,35 @@ func DelSaveFilesTicker() {
 
 
 
-// 删除./save目录及其只目录下最后更新时间超过24小时的文件
+// 删除./save目录及其子目录下最后更新时间超过24小时的文件，使用对象存储时，本机处理过程中留下的临时文件也一起删除
+// 百度接口结果的缓存按ResultCache.RetentionHour删除
 func delSaveFiles() {
-	thisLog:=g.Log{RequestUrl: "delSaveFiles"}
-	// 获取当前时间
-	currentTime := time.Now()
+	thisLog := g.Log{RequestUrl: "delSaveFiles"}
 	// 获取24小时前的时间
-	twentyFourHoursAgo := currentTime.Add(-24 * time.Hour)
+	twentyFourHoursAgo := time.Now().Add(-24 * time.Hour)
 
-	// 遍历./save目录及其子目录下的文件
-	err := filepath.Walk("./save", func(path string, info os.FileInfo, err error) error {
-		// 检查文件是否为普通文件且最后更新时间超过24小时
-		if !info.IsDir() && info.ModTime().Before(twentyFourHoursAgo) {
-		    // 删除文件
-		    err := os.Remove(path)
-		    if err != nil {
-		        return err
-		    }
+	stores := []storage.Storage{storage.Default()}
+	if !storage.IsLocal() {
+		stores = append(stores, &storage.Local{})
+	}
+	for _, store := range stores {
+		// 遍历./save目录及其子目录下的文件
+		if err := delExpiredFiles(store, "./save", twentyFourHoursAgo); err != nil {
+			thisLog.Error("删除文件失败", err)
+		}
+	}
+	// 关闭缓存后，之前的缓存也全部删除
+	if err := delExpiredFiles(storage.Default(), service.BaiduCacheDir, time.Now().Add(-service.BaiduCacheRetention())); err != nil {
+		thisLog.Error("删除百度接口结果缓存失败", err)
+	}
+}
+
+// 删除dir目录及其子目录下最后更新时间早于before的文件
+func delExpiredFiles(store storage.Storage, dir string, before time.Time) error {
+	return store.Walk(context.Background(), dir, func(info storage.FileInfo) error {
+		if info.ModTime.Before(before) {
+			return store.Delete(context.Background(), info.Key)
 		}
 		return nil
 	})
-
-	if err != nil {
-		thisLog.Error("删除文件失败",err)
-	}
 }
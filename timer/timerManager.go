@@ -50,6 +50,12 @@ func StartTimer() {
 	// 删除保存的文件
 	DelSaveFilesTicker()
 	
+	// 国内ip段文件的热加载
+	GeoZoneReloadTicker()
+
+	// 异步任务队列的worker
+	JobWorkerTicker()
+
 	// 定时检查ip
 	ipTicker := global.IP.CheckIPList(StopChan)
 	TickerList = append(TickerList, ipTicker)
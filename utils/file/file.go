@@ -16,6 +16,7 @@ import (
 	"path"
 	"src/app/model"
 	g "src/global"
+	"src/utils/storage"
 )
 
 // SaveImg 用于保存图片文件
@@ -133,3 +134,55 @@ func ReadToolRegionFile2Byte(ctx context.Context, log *g.Log, toolId int, taskId
 	err = nil
 	return
 }
+
+/**
+ * @description: 把图片保存到存储里，返回保存的key。上传的原图可能由其他服务器上的worker处理，所以不能只保存在本机
+ * @param {*model.ImgTask} task
+ * @param {[]byte} fileByte
+ * @param {string} fileNamePrefix
+ * @return {string} key，和本机保存时的路径一样
+ */
+func StoreImg(task *model.ImgTask, fileByte []byte, fileNamePrefix string) (key string) {
+	key = GetImgSaveFullPath(task, fileNamePrefix)
+	if task.ErrMsg != "" {
+		return
+	}
+	if err := storage.PutBytes(taskCtx(task), key, fileByte); err != nil {
+		task.Log.Error("保存文件失败：", err)
+		task.ErrMsg = "保存文件失败"
+	}
+	return
+}
+
+/**
+ * @description: 把处理过程中保存在本机的结果图和水印图保存到存储里，使用对象存储时删除本机的文件。任务完成入库前调用
+ * @param {*model.ImgTask} task
+ * @return {*}
+ */
+func StoreResult(task *model.ImgTask) {
+	for _, prefix := range []string{"result_", "water_"} {
+		filePath := GetImgSaveFullPath(task, prefix)
+		if task.ErrMsg != "" {
+			return
+		}
+		if exist, _ := FileOrPathExists(filePath); !exist { // 有的工具没有水印图
+			continue
+		}
+		if err := storage.PutFile(taskCtx(task), filePath, filePath); err != nil {
+			task.Log.Error("保存结果文件失败：", err)
+			task.ErrMsg = "保存结果文件失败"
+			return
+		}
+		if !storage.IsLocal() {
+			os.Remove(filePath)
+		}
+	}
+}
+
+// 任务的上下文，定时任务等没有上下文的情况使用Background
+func taskCtx(task *model.ImgTask) context.Context {
+	if task.Ctx != nil {
+		return task.Ctx
+	}
+	return context.Background()
+}
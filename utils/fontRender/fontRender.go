@@ -0,0 +1,96 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 13:42:05
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 13:42:05
+ * @Description: 用TTF/OTF字体把文字渲染成灰度图，用于文字水印。OpenCV自带的Hershey字体只有ASCII字符，写不了中文
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package fontRender
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+/**
+ * @description: 读取字体文件，支持ttf、otf，以及ttc、otc字体集合（使用集合中的第一个字体）
+ * @param {string} path 字体文件的路径
+ * @return {*opentype.Font}
+ * @return {error}
+ */
+func LoadFont(path string) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取字体文件失败：%w", err)
+	}
+	return ParseFont(data)
+}
+
+/**
+ * @description: 解析字体文件的内容
+ * @param {[]byte} data 字体文件的内容，解析后仍会被使用，不能修改
+ * @return {*opentype.Font}
+ * @return {error}
+ */
+func ParseFont(data []byte) (*opentype.Font, error) {
+	collection, err := opentype.ParseCollection(data) // 单个字体会当作只有一个字体的集合
+	if err != nil {
+		return nil, fmt.Errorf("解析字体文件失败：%w", err)
+	}
+	return collection.Font(0)
+}
+
+/**
+ * @description: 把一行文字渲染成灰度图，文字部分为255，其余为0，边缘抗锯齿。字体中缺少的字符会返回错误，而不是画成方框
+ * @param {*opentype.Font} f 字体
+ * @param {string} text 文字
+ * @param {float64} size 字号，单位像素
+ * @param {int} padding 四周留白的像素
+ * @return {*image.Alpha}
+ * @return {error}
+ */
+func Render(f *opentype.Font, text string, size float64, padding int) (*image.Alpha, error) {
+	if text == "" {
+		return nil, errors.New("文字不能为空")
+	}
+	if size <= 0 {
+		return nil, errors.New("字号必须大于0")
+	}
+	var buf sfnt.Buffer
+	for _, r := range text {
+		if index, err := f.GlyphIndex(&buf, r); err != nil || index == 0 {
+			return nil, fmt.Errorf("字体中没有字符%q", r)
+		}
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	// 按字形实际占用的范围确定图片大小，基线位置由范围的上边界决定
+	bounds, _ := font.BoundString(face, text)
+	minX, minY := bounds.Min.X.Floor(), bounds.Min.Y.Floor()
+	width := bounds.Max.X.Ceil() - minX + 2*padding
+	height := bounds.Max.Y.Ceil() - minY + 2*padding
+	if width <= 2*padding || height <= 2*padding { // 全是空格
+		return nil, errors.New("文字没有可见的字符")
+	}
+	dst := image.NewAlpha(image.Rect(0, 0, width, height))
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(padding-minX, padding-minY),
+	}
+	drawer.DrawString(text)
+	return dst, nil
+}
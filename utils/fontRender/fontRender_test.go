@@ -0,0 +1,83 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 13:58:31
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 13:58:31
+ * @Description: 文字渲染的测试，使用Go自带的字体
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package fontRender
+
+import (
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestRender(t *testing.T) {
+	f, err := ParseFont(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := Render(f, "toolsj.cn", 32, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() < 100 || bounds.Dy() < 24 || bounds.Dy() > 60 {
+		t.Fatalf("渲染的大小不对：%v", bounds)
+	}
+	// 留白的部分没有像素，中间有文字的像素
+	inked := 0
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			v := img.AlphaAt(x, y).A
+			if v == 0 {
+				continue
+			}
+			inked++
+			if x < 4 || y < 4 || x >= bounds.Dx()-4 || y >= bounds.Dy()-4 {
+				t.Fatalf("留白的位置(%d,%d)有像素", x, y)
+			}
+		}
+	}
+	if inked < 200 {
+		t.Fatalf("文字的像素太少：%d", inked)
+	}
+
+	// 字号越大图片越大
+	bigger, _ := Render(f, "toolsj.cn", 64, 4)
+	if bigger.Bounds().Dx() <= bounds.Dx() {
+		t.Fatal("字号变大后图片应该变大")
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	f, err := ParseFont(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		text string
+		size float64
+	}{
+		{"空文字", "", 32},
+		{"只有空格", "   ", 32},
+		{"字号为0", "abc", 0},
+		{"字体中没有中文", "图片工具", 32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Render(f, tt.text, tt.size, 2); err == nil {
+				t.Fatal("应该返回错误")
+			}
+		})
+	}
+	if _, err = ParseFont([]byte("not a font")); err == nil {
+		t.Fatal("不是字体文件时应该返回错误")
+	}
+	if _, err = LoadFont("./not_exist.ttf"); err == nil {
+		t.Fatal("文件不存在时应该返回错误")
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 14:05:12
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 14:05:12
+ * @Description: PROXY protocol（v1文本格式和v2二进制格式）的监听器，部署在四层负载均衡后面时，用它获取真实的客户端地址
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package proxyProtocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	v1Prefix  = []byte("PROXY ")
+	v2Sign    = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	headerMax = 536 // v1最长107字节，v2这里限制为536字节，足够放下地址和常见的TLV
+)
+
+// 读取头部的超时时间，防止连接建立后一直不发数据占用协程
+const headerTimeout = 5 * time.Second
+
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet // 只有来自这些地址的连接才会解析PROXY头
+}
+
+/**
+ * @description: 包装一个监听器，使其支持PROXY protocol
+ * @param {net.Listener} ln 原始监听器
+ * @param {[]*net.IPNet} trusted 可信任的代理地址段，不能为空，否则任何客户端都能通过PROXY头伪造地址
+ * @return {*}
+ */
+func NewListener(ln net.Listener, trusted []*net.IPNet) (*Listener, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("启用PROXY protocol时必须配置可信任的代理地址")
+	}
+	return &Listener{Listener: ln, trusted: trusted}, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) { // 不可信任的来源，不解析头部，防止伪造地址
+		return conn, nil
+	}
+	// 头部在第一次读取或获取地址时才解析，避免阻塞Accept
+	return &Conn{Conn: conn, reader: bufio.NewReaderSize(conn, headerMax)}, nil
+}
+
+// 判断连接是否来自可信任的代理，没有配置可信任的代理时谁都不信任
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr // 头部中的客户端地址，没有头部时为nil
+	err        error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// 解析PROXY头，没有头部的连接按普通连接处理
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	// v1和v2的前缀不同，先看第一个字节
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		if err != io.EOF {
+			c.err = err
+		}
+		return
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		c.remoteAddr, c.err = c.readV1()
+	case v2Sign[0]:
+		c.remoteAddr, c.err = c.readV2()
+	}
+}
+
+// v1格式：PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n
+func (c *Conn) readV1() (net.Addr, error) {
+	if prefix, err := c.reader.Peek(len(v1Prefix)); err != nil || !bytes.Equal(prefix, v1Prefix) {
+		return nil, nil
+	}
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, errors.New("PROXY v1头部格式错误")
+	}
+	fields := strings.Fields(strings.TrimSpace(string(line)))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" { // 代理自身发起的连接，使用原始地址
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("PROXY v1头部格式错误")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("PROXY v1头部地址错误")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// v2格式：12字节签名 + 版本和命令 + 协议族 + 2字节长度 + 地址
+func (c *Conn) readV2() (net.Addr, error) {
+	header, err := c.reader.Peek(16)
+	if err != nil || !bytes.Equal(header[:12], v2Sign) {
+		return nil, nil
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("PROXY v2版本错误")
+	}
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if 16+length > headerMax {
+		return nil, errors.New("PROXY v2头部过长")
+	}
+	buf := make([]byte, 16+length)
+	if _, err = io.ReadFull(c.reader, buf); err != nil {
+		return nil, errors.New("PROXY v2头部不完整")
+	}
+	if header[12]&0x0F == 0 { // LOCAL命令，代理自身的健康检查等，使用原始地址
+		return nil, nil
+	}
+	addr := buf[16:]
+	switch header[13] >> 4 {
+	case 1: // ipv4：源地址4 + 目标地址4 + 源端口2 + 目标端口2
+		if len(addr) < 12 {
+			return nil, errors.New("PROXY v2地址长度错误")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(binary.BigEndian.Uint16(addr[8:10]))}, nil
+	case 2: // ipv6：源地址16 + 目标地址16 + 源端口2 + 目标端口2
+		if len(addr) < 36 {
+			return nil, errors.New("PROXY v2地址长度错误")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(binary.BigEndian.Uint16(addr[32:34]))}, nil
+	}
+	return nil, nil // unix socket等其他协议族，使用原始地址
+}
@@ -0,0 +1,69 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 17:10:36
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 17:10:36
+ * @Description: 基于HMAC-SHA256的签名工具，用于生成和校验各种带签名的凭证
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+/**
+ * @description: 计算HMAC-SHA256
+ * @param {[]byte} secret 密钥
+ * @param {string} data 需要签名的数据
+ * @return {[]byte}
+ */
+func Hmac(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/**
+ * @description: 生成凭证，格式为 base64url(payload).base64url(签名)，签名截取前16字节，足够防伪造且凭证不会太长
+ * @param {[]byte} secret 密钥
+ * @param {string} payload 凭证的内容，不加密，不要放敏感信息
+ * @return {string}
+ */
+func Token(secret []byte, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(Hmac(secret, payload)[:16])
+}
+
+/**
+ * @description: 校验凭证并取出内容
+ * @param {[]byte} secret 密钥
+ * @param {string} token Token生成的凭证
+ * @return {string} 凭证的内容
+ * @return {bool} 签名是否正确
+ */
+func Parse(secret []byte, token string) (string, bool) {
+	payloadStr, signStr, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(signStr)
+	if err != nil || !hmac.Equal(signature, Hmac(secret, string(payload))[:16]) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+// 生成指定长度的随机字节，用于密钥和随机数
+func RandomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
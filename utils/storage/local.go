@@ -0,0 +1,101 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 23:58:12
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 23:58:12
+ * @Description: 本机磁盘存储，key就是相对程序运行目录的文件路径，和原来直接保存文件的方式一样
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Local struct{}
+
+// key对应的文件路径
+func (l *Local) Path(key string) string {
+	return filepath.Clean(filepath.FromSlash(key))
+}
+
+func (l *Local) Put(ctx context.Context, key string, reader io.Reader, size int64) error {
+	filePath := l.Path(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return err
+	}
+	return file.Close()
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(l.Path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, ErrNotExist
+		}
+		return nil, 0, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, fileInfo.Size(), nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (FileInfo, error) {
+	fileInfo, err := os.Stat(l.Path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return FileInfo{}, ErrNotExist
+		}
+		return FileInfo{}, err
+	}
+	return FileInfo{Key: key, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(l.Path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// 遍历prefix目录及其子目录下的文件，目录不存在时什么都不做
+func (l *Local) Walk(ctx context.Context, prefix string, fn func(info FileInfo) error) error {
+	err := filepath.Walk(l.Path(prefix), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(FileInfo{Key: filepath.ToSlash(path), Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// 本机存储只能由本服务下载
+func (l *Local) PresignGet(key string, fileName string, expire time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
@@ -0,0 +1,335 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-19 00:21:47
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-19 00:21:47
+ * @Description: S3兼容的对象存储，如MinIO和各家云的对象存储。只用到几个简单的接口，直接用AWS Signature V4签名请求，不引入SDK
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	g "src/global"
+	"src/utils/sign"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD" // 上传时不计算内容的哈希，可以直接流式上传
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type S3 struct {
+	endpoint       *url.URL
+	publicEndpoint *url.URL // 生成预签名链接用的地址，用户通过它直接访问存储
+	region         string
+	bucket         string
+	accessKey      string
+	secretKey      string
+	pathStyle      bool   // true时bucket放在路径里，MinIO需要；false时放在域名里
+	prefix         string // key的前缀，多个环境共用一个bucket时区分开
+	client         *http.Client
+}
+
+/**
+ * @description: 按Storage.S3的配置创建S3存储
+ * @return {*S3}
+ * @return {error}
+ */
+func NewS3() (*S3, error) {
+	endpoint, err := url.Parse(g.VP.GetString("Storage.S3.Endpoint"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Storage.S3.Endpoint配置错误：%s", g.VP.GetString("Storage.S3.Endpoint"))
+	}
+	publicEndpoint := endpoint
+	if g.VP.GetString("Storage.S3.PublicEndpoint") != "" {
+		if publicEndpoint, err = url.Parse(g.VP.GetString("Storage.S3.PublicEndpoint")); err != nil || publicEndpoint.Host == "" {
+			return nil, fmt.Errorf("Storage.S3.PublicEndpoint配置错误：%s", g.VP.GetString("Storage.S3.PublicEndpoint"))
+		}
+	}
+	s3 := &S3{
+		endpoint:       endpoint,
+		publicEndpoint: publicEndpoint,
+		region:         g.VP.GetString("Storage.S3.Region"),
+		bucket:         g.VP.GetString("Storage.S3.Bucket"),
+		accessKey:      g.VP.GetString("Storage.S3.AccessKey"),
+		secretKey:      g.VP.GetString("Storage.S3.SecretKey"),
+		pathStyle:      g.VP.GetBool("Storage.S3.PathStyle"),
+		prefix:         strings.Trim(g.VP.GetString("Storage.S3.Prefix"), "/"),
+		client:         &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s3.region == "" {
+		s3.region = "us-east-1"
+	}
+	if s3.bucket == "" || s3.accessKey == "" || s3.secretKey == "" {
+		return nil, errors.New("Storage.S3的Bucket、AccessKey、SecretKey不能为空")
+	}
+	return s3, nil
+}
+
+// key对应的对象名，去掉开头的./和/，加上前缀
+func (s *S3) objectKey(key string) string {
+	key = strings.TrimLeft(strings.TrimPrefix(key, "./"), "/")
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// 对象名对应的key，去掉前缀
+func (s *S3) fileKey(objectKey string) string {
+	if s.prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, s.prefix+"/")
+}
+
+// 对象的访问地址，objectKey为空时是bucket的地址
+func (s *S3) objectUrl(endpoint *url.URL, objectKey string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host}
+	basePath := strings.TrimRight(endpoint.Path, "/")
+	if s.pathStyle {
+		u.Path = basePath + "/" + s.bucket + "/" + objectKey
+	} else {
+		u.Host = s.bucket + "." + endpoint.Host
+		u.Path = basePath + "/" + objectKey
+	}
+	u.RawPath = s3EscapePath(u.Path) // 发送的路径和签名时编码的路径保持一致
+	u.RawQuery = s3CanonicalQuery(query)
+	return u
+}
+
+func (s *S3) Put(ctx context.Context, key string, reader io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectUrl(s.endpoint, s.objectKey(key), nil).String(), reader)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s.do(req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectUrl(s.endpoint, s.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (FileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectUrl(s.endpoint, s.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectUrl(s.endpoint, s.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjectsV2的返回
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// 遍历prefix下的所有对象，每次最多列出1000个
+func (s *S3) Walk(ctx context.Context, prefix string, fn func(info FileInfo) error) error {
+	objectPrefix := strings.TrimRight(s.objectKey(prefix), "/")
+	if objectPrefix != "" {
+		objectPrefix += "/"
+	}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {objectPrefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectUrl(s.endpoint, "", query).String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req, s3EmptyPayload)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("解析对象列表失败：%s", err.Error())
+		}
+		for _, content := range result.Contents {
+			if err = fn(FileInfo{Key: s.fileKey(content.Key), Size: content.Size, ModTime: content.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// 生成预签名的下载链接，使用PublicEndpoint，下载时的文件名通过response-content-disposition指定
+func (s *S3) PresignGet(key string, fileName string, expire time.Duration) (string, error) {
+	return s.presignGet(time.Now().UTC(), key, fileName, expire), nil
+}
+
+// 按指定的时间生成预签名链接，时间作为参数方便用固定的时间校验签名
+func (s *S3) presignGet(now time.Time, key string, fileName string, expire time.Duration) string {
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expire.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if fileName != "" {
+		query.Set("response-content-disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	}
+	u := s.objectUrl(s.publicEndpoint, s.objectKey(key), query)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, s3EscapePath(u.Path), u.RawQuery, "host:" + u.Host + "\n", "host", s3UnsignedPayload,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return u.String()
+}
+
+// 签名并发送请求，返回2xx以外的状态码时返回错误，404返回ErrNotExist
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.signRequest(req, payloadHash, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("对象存储返回%d：%s", resp.StatusCode, string(body))
+}
+
+// 给请求加上签名的请求头，签名host、x-amz-content-sha256和x-amz-date三个请求头
+func (s *S3) signRequest(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + req.Header.Get("X-Amz-Date") + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, s.scope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+// 签名的范围
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// 计算Signature V4的签名
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" + hex.EncodeToString(hash[:])
+	signingKey := sign.Hmac([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	signingKey = sign.Hmac(signingKey, s.region)
+	signingKey = sign.Hmac(signingKey, "s3")
+	signingKey = sign.Hmac(signingKey, "aws4_request")
+	return hex.EncodeToString(sign.Hmac(signingKey, stringToSign))
+}
+
+// 按S3的要求编码，除了字母数字和-_.~都要编码，空格编码为%20
+func s3Escape(str string) string {
+	var builder strings.Builder
+	for _, b := range []byte(str) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+// 路径按段编码，保留/
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// 按key排序的查询参数，同时作为请求的查询字符串和签名的内容，保证两者一致
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
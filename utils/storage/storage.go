@@ -0,0 +1,126 @@
+/*
+ * @Author: lsjweiyi
+ * @Date: 2026-10-18 23:58:12
+ * @LastEditors: lsjweiyi
+ * @LastEditTime: 2026-10-18 23:58:12
+ * @Description: 文件存储的抽象，上传的原图和处理结果都通过它读写，可以保存在本机磁盘，也可以保存在S3兼容的对象存储里，多台服务器共用
+ * key就是原来保存在本机时的相对路径，如 save/idCard/result_xxx.jpg，本机存储直接作为文件路径
+ * Copyright (c) 2026 by lsjweiyi, All Rights Reserved.
+ */
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	g "src/global"
+	"time"
+)
+
+var (
+	ErrNotExist            = errors.New("文件不存在")
+	ErrPresignNotSupported = errors.New("该存储不支持预签名链接")
+)
+
+// 文件的信息
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// 存储的接口，key统一使用/分隔
+type Storage interface {
+	Put(ctx context.Context, key string, reader io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error) // 流式读取，调用方负责Close
+	Stat(ctx context.Context, key string) (FileInfo, error)            // 文件不存在时返回ErrNotExist
+	Delete(ctx context.Context, key string) error                      // 文件不存在不算错误
+	Walk(ctx context.Context, prefix string, fn func(info FileInfo) error) error
+	PresignGet(key string, fileName string, expire time.Duration) (string, error) // 生成直接从存储下载的链接，fileName为下载保存的文件名
+}
+
+var defaultStorage Storage = &Local{}
+
+/**
+ * @description: 按配置Storage.Driver创建存储，local为本机磁盘，s3为S3兼容的对象存储，未配置时为local
+ * @return {error}
+ */
+func Init() error {
+	switch driver := g.VP.GetString("Storage.Driver"); driver {
+	case "", "local":
+		defaultStorage = &Local{}
+	case "s3":
+		s3, err := NewS3()
+		if err != nil {
+			return err
+		}
+		defaultStorage = s3
+	default:
+		return fmt.Errorf("不支持的存储类型：%s", driver)
+	}
+	return nil
+}
+
+// 当前使用的存储
+func Default() Storage {
+	return defaultStorage
+}
+
+// 当前使用的是不是本机存储，本机存储时处理过程中生成的文件就在存储里，不需要再上传
+func IsLocal() bool {
+	_, ok := defaultStorage.(*Local)
+	return ok
+}
+
+/**
+ * @description: 保存二进制数据
+ * @param {context.Context} ctx
+ * @param {string} key
+ * @param {[]byte} fileByte
+ * @return {error}
+ */
+func PutBytes(ctx context.Context, key string, fileByte []byte) error {
+	return defaultStorage.Put(ctx, key, bytes.NewReader(fileByte), int64(len(fileByte)))
+}
+
+/**
+ * @description: 把本机的文件保存到存储里，本机存储且路径相同时什么都不做
+ * @param {context.Context} ctx
+ * @param {string} key
+ * @param {string} filePath 本机文件路径
+ * @return {error}
+ */
+func PutFile(ctx context.Context, key string, filePath string) error {
+	if local, ok := defaultStorage.(*Local); ok && local.Path(key) == local.Path(filePath) {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return defaultStorage.Put(ctx, key, file, fileInfo.Size())
+}
+
+/**
+ * @description: 读取整个文件
+ * @param {context.Context} ctx
+ * @param {string} key
+ * @return {[]byte}
+ * @return {error}
+ */
+func ReadAll(ctx context.Context, key string) ([]byte, error) {
+	reader, _, err := defaultStorage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}